@@ -1,9 +1,204 @@
+// Package acl grants permissions to subjects through roles. Roles are
+// defined by the application, bindings of subjects to roles are stored.
 package acl
 
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+)
+
+var (
+	ErrDenied         = errors.New("acl: permission denied")
+	ErrUnknownRole    = errors.New("acl: unknown role")
+	ErrBindingMissing = errors.New("acl: binding not found")
+	errNoBindings     = errors.New("acl: a bindings model is required, see WithBindings")
+)
+
+type SubjectKind string
+
+const (
+	User           SubjectKind = "user"
+	ServiceAccount SubjectKind = "service_account"
+	// GroupKind subjects are groups, roles bound to them are granted to
+	// their members.
+	GroupKind SubjectKind = "group"
+)
+
+// Subject is who permissions are checked for. Scopes, when not nil,
+// restrict the subject to the permissions they match, as for requests
+// authenticated with a scoped token. Impersonator is set when another
+// subject acts as this one, see WithImpersonationDenied.
+type Subject struct {
+	Kind         SubjectKind
+	ID           string
+	Scopes       []string
+	Impersonator string
+}
+
+func (s Subject) String() string {
+	return string(s.Kind) + ":" + s.ID
+}
+
+// Binding grants a role to a subject.
+type Binding struct {
+	ID        uuid.UUID `json:"id" db:"id,index,required,unique"`
+	Subject   string    `json:"subject" db:"subject,index,required"`
+	Role      string    `json:"role" db:"role,index,required"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
 type Option func(*ACL)
 
-type ACL struct {}
+type ACL struct {
+	roles    map[string][]string
+	bindings database.Model[Binding]
+	groups   database.Model[Group]
+	members  database.Model[Member]
+	cache    membershipCache
+
+	impersonation_denied []string
+}
+
+// WithRole defines a role granting permissions. Permissions are
+// colon separated, e.g. tokens:write, and a * segment matches anything
+// from there on.
+func WithRole(name string, permissions ...string) Option {
+	return func(a *ACL) {
+		a.roles[name] = append(a.roles[name], permissions...)
+	}
+}
+
+// WithImpersonationDenied denies permissions to impersonated subjects,
+// whatever their roles grant, e.g. billing:* or users:delete.
+func WithImpersonationDenied(permissions ...string) Option {
+	return func(a *ACL) {
+		a.impersonation_denied = append(a.impersonation_denied, permissions...)
+	}
+}
+
+// WithBindings sets where bindings are stored.
+func WithBindings(model database.Model[Binding]) Option {
+	return func(a *ACL) {
+		a.bindings = model
+	}
+}
+
+func New(opts ...Option) (*ACL, error) {
+	a := &ACL{roles: map[string][]string{}, cache: membershipCache{ttl: 30 * time.Second}}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.bindings == nil {
+		return nil, errNoBindings
+	}
+	return a, nil
+}
+
+// Bind grants role to s.
+func (a *ACL) Bind(ctx context.Context, s Subject, role string) error {
+	if _, ok := a.roles[role]; !ok {
+		return ErrUnknownRole
+	}
+	if _, err := a.bindings.WithContext(ctx).Query(
+		database.WithFilter("subject", s.String()),
+		database.WithFilter("role", role),
+	).First(); err == nil {
+		return nil
+	}
+	return a.bindings.WithContext(ctx).Save(Binding{
+		ID:        uuid.New(),
+		Subject:   s.String(),
+		Role:      role,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// Unbind takes role away from s.
+func (a *ACL) Unbind(ctx context.Context, s Subject, role string) error {
+	q := a.bindings.WithContext(ctx).Query(
+		database.WithFilter("subject", s.String()),
+		database.WithFilter("role", role),
+	)
+	if _, err := q.First(); err != nil {
+		return ErrBindingMissing
+	}
+	return q.Delete()
+}
+
+// Roles returns the roles bound to s.
+func (a *ACL) Roles(ctx context.Context, s Subject) ([]string, error) {
+	bindings, err := a.bindings.WithContext(ctx).Query(database.WithFilter("subject", s.String())).All()
+	if err != nil {
+		return nil, err
+	}
+	roles := make([]string, 0, len(bindings))
+	for _, b := range bindings {
+		roles = append(roles, b.Role)
+	}
+	return roles, nil
+}
+
+// Forget removes the bindings and group memberships of s, when it is
+// deleted.
+func (a *ACL) Forget(ctx context.Context, s Subject) error {
+	if err := a.bindings.WithContext(ctx).Query(database.WithFilter("subject", s.String())).DeleteMany(); err != nil {
+		return err
+	}
+	if a.members == nil {
+		return nil
+	}
+	defer a.cache.clear()
+	return a.members.WithContext(ctx).Query(database.WithFilter("subject", s.String())).DeleteMany()
+}
+
+// Authorize returns ErrDenied unless a role of s, or of a group it is
+// in, grants permission and, for scoped subjects, one of its scopes
+// matches permission. Impersonated subjects are also denied the
+// permissions of WithImpersonationDenied.
+func (a *ACL) Authorize(ctx context.Context, s Subject, permission string) error {
+	if s.Scopes != nil && !matchAny(s.Scopes, permission) {
+		return ErrDenied
+	}
+	if s.Impersonator != "" && matchAny(a.impersonation_denied, permission) {
+		return ErrDenied
+	}
+	roles, err := a.EffectiveRoles(ctx, s)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if matchAny(a.roles[role], permission) {
+			return nil
+		}
+	}
+	return ErrDenied
+}
+
+func matchAny(patterns []string, permission string) bool {
+	for _, p := range patterns {
+		if Match(p, permission) {
+			return true
+		}
+	}
+	return false
+}
 
-func New(opts ...Option)(*ACL, error){
-    return &ACL{}, nil
+// Match reports whether pattern grants permission, segment by segment:
+// tokens:* and * grant tokens:write.
+func Match(pattern, permission string) bool {
+	ps, qs := strings.Split(pattern, ":"), strings.Split(permission, ":")
+	for i, p := range ps {
+		if p == "*" {
+			return true
+		}
+		if i >= len(qs) || p != qs[i] {
+			return false
+		}
+	}
+	return len(ps) == len(qs)
 }
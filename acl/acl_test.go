@@ -0,0 +1,182 @@
+package acl
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	assert.True(t, Match("tokens:write", "tokens:write"))
+	assert.True(t, Match("tokens:*", "tokens:write"))
+	assert.True(t, Match("*", "tokens:write"))
+	assert.False(t, Match("tokens", "tokens:write"))
+	assert.False(t, Match("tokens:write", "tokens"))
+	assert.False(t, Match("tokens:read", "tokens:write"))
+}
+
+func TestACL(t *testing.T) {
+	_, err := New()
+	assert.Error(t, err)
+
+	a, err := New(
+		WithBindings(testdb.New[Binding]()),
+		WithRole("reader", "repo:read"),
+		WithRole("admin", "repo:*", "users:*"),
+	)
+	require.NoError(t, err)
+	ctx := context.Background()
+	jon := Subject{Kind: User, ID: "jon"}
+
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:read"), ErrDenied)
+	assert.ErrorIs(t, a.Bind(ctx, jon, "owner"), ErrUnknownRole)
+	require.NoError(t, a.Bind(ctx, jon, "reader"))
+	require.NoError(t, a.Bind(ctx, jon, "reader"))
+	roles, err := a.Roles(ctx, jon)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reader"}, roles)
+	assert.NoError(t, a.Authorize(ctx, jon, "repo:read"))
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:write"), ErrDenied)
+
+	require.NoError(t, a.Bind(ctx, jon, "admin"))
+	assert.NoError(t, a.Authorize(ctx, jon, "users:delete"))
+	// scopes narrow what the roles grant
+	scoped := Subject{Kind: User, ID: "jon", Scopes: []string{"repo:*"}}
+	assert.NoError(t, a.Authorize(ctx, scoped, "repo:write"))
+	assert.ErrorIs(t, a.Authorize(ctx, scoped, "users:delete"), ErrDenied)
+	assert.ErrorIs(t, a.Authorize(ctx, Subject{Kind: User, ID: "jon", Scopes: []string{}}, "repo:read"), ErrDenied)
+
+	require.NoError(t, a.Unbind(ctx, jon, "admin"))
+	assert.ErrorIs(t, a.Unbind(ctx, jon, "admin"), ErrBindingMissing)
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "users:delete"), ErrDenied)
+}
+
+func TestGroups(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(WithBindings(testdb.New[Binding]()), WithRole("reader", "repo:read"))
+	require.NoError(t, err)
+	_, err = a.CreateGroup(ctx, "engineering", "")
+	assert.Error(t, err)
+
+	a, err = New(
+		WithBindings(testdb.New[Binding]()),
+		WithGroups(testdb.New[Group](), testdb.New[Member]()),
+		WithRole("reader", "repo:read"),
+	)
+	require.NoError(t, err)
+	g, err := a.CreateGroup(ctx, "engineering", "okta-1")
+	require.NoError(t, err)
+	_, err = a.CreateGroup(ctx, "engineering", "")
+	assert.ErrorIs(t, err, ErrGroupExists)
+
+	jon := Subject{Kind: User, ID: "jon"}
+	require.NoError(t, a.AddMember(ctx, g.ID, jon))
+	require.NoError(t, a.AddMember(ctx, g.ID, jon))
+	members, err := a.Members(ctx, g.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Subject{jon}, members)
+	groups, err := a.GroupsOf(ctx, jon)
+	require.NoError(t, err)
+	require.Len(t, groups, 1)
+	assert.Equal(t, "engineering", groups[0].Name)
+
+	g.Name = "platform"
+	require.NoError(t, a.UpdateGroup(ctx, g))
+	g, err = a.Group(ctx, g.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "platform", g.Name)
+
+	require.NoError(t, a.Bind(ctx, jon, "reader"))
+	require.NoError(t, a.Forget(ctx, jon))
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:read"), ErrDenied)
+	groups, err = a.GroupsOf(ctx, jon)
+	require.NoError(t, err)
+	assert.Empty(t, groups)
+
+	require.NoError(t, a.AddMember(ctx, g.ID, jon))
+	require.NoError(t, a.RemoveMember(ctx, g.ID, jon))
+	members, err = a.Members(ctx, g.ID)
+	require.NoError(t, err)
+	assert.Empty(t, members)
+
+	require.NoError(t, a.DeleteGroup(ctx, g.ID))
+	_, err = a.Group(ctx, g.ID)
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+	assert.ErrorIs(t, a.AddMember(ctx, g.ID, jon), ErrGroupNotFound)
+}
+
+func TestNestedGroups(t *testing.T) {
+	ctx := context.Background()
+	a, err := New(
+		WithBindings(testdb.New[Binding]()),
+		WithGroups(testdb.New[Group](), testdb.New[Member]()),
+		WithRole("reader", "repo:read"),
+		WithRole("writer", "repo:write"),
+	)
+	require.NoError(t, err)
+	engineering, err := a.CreateGroup(ctx, "engineering", "")
+	require.NoError(t, err)
+	platform, err := a.CreateGroup(ctx, "platform", "")
+	require.NoError(t, err)
+	sre, err := a.CreateGroup(ctx, "sre", "")
+	require.NoError(t, err)
+
+	// sre is in platform, which is in engineering
+	jon := Subject{Kind: User, ID: "jon"}
+	require.NoError(t, a.AddMember(ctx, engineering.ID, GroupSubject(platform.ID)))
+	require.NoError(t, a.AddMember(ctx, platform.ID, GroupSubject(sre.ID)))
+	require.NoError(t, a.AddMember(ctx, sre.ID, jon))
+	require.NoError(t, a.Bind(ctx, GroupSubject(engineering.ID), "reader"))
+	groups, err := a.MemberOf(ctx, jon)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{sre.ID, platform.ID, engineering.ID}, groups)
+	assert.NoError(t, a.Authorize(ctx, jon, "repo:read"))
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:write"), ErrDenied)
+	// scopes still narrow inherited roles
+	assert.ErrorIs(t, a.Authorize(ctx, Subject{Kind: User, ID: "jon", Scopes: []string{}}, "repo:read"), ErrDenied)
+
+	members, err := a.ExpandMembers(ctx, engineering.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Subject{jon}, members)
+
+	assert.ErrorIs(t, a.AddMember(ctx, sre.ID, GroupSubject(engineering.ID)), ErrGroupCycle)
+	assert.ErrorIs(t, a.AddMember(ctx, sre.ID, GroupSubject(sre.ID)), ErrGroupCycle)
+	assert.ErrorIs(t, a.AddMember(ctx, sre.ID, GroupSubject(uuid.New())), ErrGroupNotFound)
+
+	// cycles written around AddMember don't hang the resolver
+	require.NoError(t, a.members.Save(Member{ID: uuid.New(), GroupID: sre.ID, Subject: GroupSubject(engineering.ID).String()}))
+	a.cache.clear()
+	groups, err = a.MemberOf(ctx, jon)
+	require.NoError(t, err)
+	assert.Len(t, groups, 3)
+	members, err = a.ExpandMembers(ctx, platform.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []Subject{jon}, members)
+	require.NoError(t, a.RemoveMember(ctx, sre.ID, GroupSubject(engineering.ID)))
+
+	// writes clear the cache
+	require.NoError(t, a.RemoveMember(ctx, engineering.ID, GroupSubject(platform.ID)))
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:read"), ErrDenied)
+	require.NoError(t, a.Bind(ctx, GroupSubject(platform.ID), "writer"))
+	assert.NoError(t, a.Authorize(ctx, jon, "repo:write"))
+
+	g, err := a.RenameGroup(ctx, platform.ID, "infrastructure")
+	require.NoError(t, err)
+	assert.Equal(t, "infrastructure", g.Name)
+	_, err = a.RenameGroup(ctx, platform.ID, "sre")
+	assert.ErrorIs(t, err, ErrGroupExists)
+
+	// deleting a group takes its bindings and nesting with it
+	require.NoError(t, a.DeleteGroup(ctx, platform.ID))
+	assert.ErrorIs(t, a.Authorize(ctx, jon, "repo:write"), ErrDenied)
+	groups, err = a.MemberOf(ctx, jon)
+	require.NoError(t, err)
+	assert.Equal(t, []uuid.UUID{sre.ID}, groups)
+	roles, err := a.Roles(ctx, GroupSubject(platform.ID))
+	require.NoError(t, err)
+	assert.Empty(t, roles)
+}
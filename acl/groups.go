@@ -0,0 +1,240 @@
+package acl
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+)
+
+var (
+	ErrGroupNotFound = errors.New("acl: group not found")
+	ErrGroupExists   = errors.New("acl: a group with this name already exists")
+	ErrGroupCycle    = errors.New("acl: a group can't be nested in itself")
+	errNoGroups      = errors.New("acl: groups require WithGroups")
+)
+
+// Group is a named set of subjects.
+type Group struct {
+	ID   uuid.UUID `json:"id" db:"id,index,required,unique"`
+	Name string    `json:"name" db:"name,index,required"`
+	// ExternalID is the id of the group in the identity provider that
+	// provisions it.
+	ExternalID string    `json:"external_id,omitempty" db:"external_id,index"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// GroupSubject returns the subject of the group id, to bind roles to it
+// or nest it in another group.
+func GroupSubject(id uuid.UUID) Subject {
+	return Subject{Kind: GroupKind, ID: id.String()}
+}
+
+// Member is the membership of a subject in a group.
+type Member struct {
+	ID        uuid.UUID `json:"id" db:"id,index,required,unique"`
+	GroupID   uuid.UUID `json:"group_id" db:"group_id,index,required"`
+	Subject   string    `json:"subject" db:"subject,index,required"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// WithGroups sets where groups and their members are stored.
+func WithGroups(groups database.Model[Group], members database.Model[Member]) Option {
+	return func(a *ACL) {
+		a.groups = groups
+		a.members = members
+	}
+}
+
+// ParseSubject parses the kind:id form of a subject.
+func ParseSubject(s string) (Subject, bool) {
+	kind, id, ok := strings.Cut(s, ":")
+	if !ok || kind == "" || id == "" {
+		return Subject{}, false
+	}
+	return Subject{Kind: SubjectKind(kind), ID: id}, true
+}
+
+// CreateGroup adds a group, names are unique.
+func (a *ACL) CreateGroup(ctx context.Context, name, externalID string) (*Group, error) {
+	if a.groups == nil {
+		return nil, errNoGroups
+	}
+	if _, err := a.groups.WithContext(ctx).Query(database.WithFilter("name", name)).First(); err == nil {
+		return nil, ErrGroupExists
+	}
+	now := time.Now().UTC()
+	g := Group{ID: uuid.New(), Name: name, ExternalID: externalID, CreatedAt: now, UpdatedAt: now}
+	if err := a.groups.WithContext(ctx).Save(g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// Group returns a group.
+func (a *ACL) Group(ctx context.Context, id uuid.UUID) (*Group, error) {
+	if a.groups == nil {
+		return nil, errNoGroups
+	}
+	g, err := a.groups.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return nil, ErrGroupNotFound
+	}
+	return g, nil
+}
+
+// Groups returns every group.
+func (a *ACL) Groups(ctx context.Context) ([]*Group, error) {
+	if a.groups == nil {
+		return nil, errNoGroups
+	}
+	return a.groups.WithContext(ctx).Query().All()
+}
+
+// UpdateGroup saves the name and external id of g.
+func (a *ACL) UpdateGroup(ctx context.Context, g *Group) error {
+	if a.groups == nil {
+		return errNoGroups
+	}
+	if other, err := a.groups.WithContext(ctx).Query(database.WithFilter("name", g.Name)).First(); err == nil && other.ID != g.ID {
+		return ErrGroupExists
+	}
+	g.UpdatedAt = time.Now().UTC()
+	if err := a.groups.WithContext(ctx).Query(database.WithFilter("id", g.ID)).Update(*g); err != nil {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+// RenameGroup changes the name of a group.
+func (a *ACL) RenameGroup(ctx context.Context, id uuid.UUID, name string) (*Group, error) {
+	g, err := a.Group(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	g.Name = name
+	if err := a.UpdateGroup(ctx, g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// DeleteGroup removes a group, its members and bindings, and its
+// memberships in other groups.
+func (a *ACL) DeleteGroup(ctx context.Context, id uuid.UUID) error {
+	if _, err := a.Group(ctx, id); err != nil {
+		return err
+	}
+	defer a.cache.clear()
+	if err := a.members.WithContext(ctx).Query(database.WithFilter("group_id", id)).DeleteMany(); err != nil {
+		return err
+	}
+	if err := a.Forget(ctx, GroupSubject(id)); err != nil {
+		return err
+	}
+	return a.groups.WithContext(ctx).Query(database.WithFilter("id", id)).Delete()
+}
+
+// AddMember adds s to a group. s may be another group, which is nested
+// as long as it doesn't contain the group already.
+func (a *ACL) AddMember(ctx context.Context, groupID uuid.UUID, s Subject) error {
+	if _, err := a.Group(ctx, groupID); err != nil {
+		return err
+	}
+	if s.Kind == GroupKind {
+		if err := a.checkNesting(ctx, groupID, s); err != nil {
+			return err
+		}
+	}
+	if _, err := a.members.WithContext(ctx).Query(
+		database.WithFilter("group_id", groupID),
+		database.WithFilter("subject", s.String()),
+	).First(); err == nil {
+		return nil
+	}
+	defer a.cache.clear()
+	return a.members.WithContext(ctx).Save(Member{
+		ID:        uuid.New(),
+		GroupID:   groupID,
+		Subject:   s.String(),
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+// checkNesting returns ErrGroupCycle when nesting the group s in groupID
+// would make a group a member of itself.
+func (a *ACL) checkNesting(ctx context.Context, groupID uuid.UUID, s Subject) error {
+	child, err := uuid.Parse(s.ID)
+	if err != nil {
+		return ErrGroupNotFound
+	}
+	if _, err := a.Group(ctx, child); err != nil {
+		return err
+	}
+	if child == groupID {
+		return ErrGroupCycle
+	}
+	// the cache may be stale, ancestors are resolved from the store
+	ancestors, err := a.resolve(ctx, GroupSubject(groupID))
+	if err != nil {
+		return err
+	}
+	if slices.Contains(ancestors, child) {
+		return ErrGroupCycle
+	}
+	return nil
+}
+
+// RemoveMember removes s from a group, it is not an error if s isn't a
+// member.
+func (a *ACL) RemoveMember(ctx context.Context, groupID uuid.UUID, s Subject) error {
+	if _, err := a.Group(ctx, groupID); err != nil {
+		return err
+	}
+	defer a.cache.clear()
+	return a.members.WithContext(ctx).Query(
+		database.WithFilter("group_id", groupID),
+		database.WithFilter("subject", s.String()),
+	).DeleteMany()
+}
+
+// Members returns the direct members of a group.
+func (a *ACL) Members(ctx context.Context, groupID uuid.UUID) ([]Subject, error) {
+	if a.members == nil {
+		return nil, errNoGroups
+	}
+	members, err := a.members.WithContext(ctx).Query(database.WithFilter("group_id", groupID)).All()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Subject, 0, len(members))
+	for _, m := range members {
+		if s, ok := ParseSubject(m.Subject); ok {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// GroupsOf returns the groups s is a direct member of.
+func (a *ACL) GroupsOf(ctx context.Context, s Subject) ([]*Group, error) {
+	if a.members == nil {
+		return nil, errNoGroups
+	}
+	members, err := a.members.WithContext(ctx).Query(database.WithFilter("subject", s.String())).All()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Group, 0, len(members))
+	for _, m := range members {
+		if g, err := a.Group(ctx, m.GroupID); err == nil {
+			res = append(res, g)
+		}
+	}
+	return res, nil
+}
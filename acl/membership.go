@@ -0,0 +1,173 @@
+package acl
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+)
+
+// WithMembershipCache sets how long the groups a subject is in are
+// cached, 30 seconds by default. Changes made through the ACL clear the
+// cache, ttl bounds how long changes made by other instances take to
+// apply. A ttl of 0 disables the cache.
+func WithMembershipCache(ttl time.Duration) Option {
+	return func(a *ACL) {
+		a.cache.ttl = ttl
+	}
+}
+
+// membershipCache caches the groups subjects are in, directly or
+// through nested groups.
+type membershipCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+	// generation changes on every write, resolutions started before it
+	// are not cached.
+	generation uint64
+	entries    map[string]cachedGroups
+}
+
+type cachedGroups struct {
+	groups  []uuid.UUID
+	expires time.Time
+}
+
+func (c *membershipCache) get(key string) ([]uuid.UUID, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, c.generation, false
+	}
+	return e.groups, c.generation, true
+}
+
+func (c *membershipCache) put(key string, generation uint64, groups []uuid.UUID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || generation != c.generation {
+		return
+	}
+	if c.entries == nil {
+		c.entries = map[string]cachedGroups{}
+	}
+	c.entries[key] = cachedGroups{groups: groups, expires: time.Now().Add(c.ttl)}
+}
+
+func (c *membershipCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = nil
+}
+
+// MemberOf returns the ids of the groups s is in, directly or through
+// nested groups. Cycles stored by other means than AddMember are
+// tolerated, each group is visited once.
+func (a *ACL) MemberOf(ctx context.Context, s Subject) ([]uuid.UUID, error) {
+	if a.members == nil {
+		return nil, errNoGroups
+	}
+	key := s.String()
+	groups, generation, ok := a.cache.get(key)
+	if ok {
+		return groups, nil
+	}
+	groups, err := a.resolve(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	a.cache.put(key, generation, groups)
+	return groups, nil
+}
+
+// resolve walks the groups of s breadth first.
+func (a *ACL) resolve(ctx context.Context, s Subject) ([]uuid.UUID, error) {
+	seen := map[uuid.UUID]bool{}
+	var res []uuid.UUID
+	queue := []string{s.String()}
+	for len(queue) > 0 {
+		members, err := a.members.WithContext(ctx).Query(database.WithFilter("subject", queue[0])).All()
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, m := range members {
+			if seen[m.GroupID] {
+				continue
+			}
+			seen[m.GroupID] = true
+			res = append(res, m.GroupID)
+			queue = append(queue, GroupSubject(m.GroupID).String())
+		}
+	}
+	return res, nil
+}
+
+// ExpandMembers returns the members of a group that aren't groups,
+// including the members of its nested groups.
+func (a *ACL) ExpandMembers(ctx context.Context, groupID uuid.UUID) ([]Subject, error) {
+	if _, err := a.Group(ctx, groupID); err != nil {
+		return nil, err
+	}
+	seen := map[uuid.UUID]bool{groupID: true}
+	added := map[string]bool{}
+	var res []Subject
+	queue := []uuid.UUID{groupID}
+	for len(queue) > 0 {
+		members, err := a.Members(ctx, queue[0])
+		if err != nil {
+			return nil, err
+		}
+		queue = queue[1:]
+		for _, m := range members {
+			if m.Kind != GroupKind {
+				if !added[m.String()] {
+					added[m.String()] = true
+					res = append(res, m)
+				}
+				continue
+			}
+			id, err := uuid.Parse(m.ID)
+			if err != nil || seen[id] {
+				continue
+			}
+			seen[id] = true
+			queue = append(queue, id)
+		}
+	}
+	return res, nil
+}
+
+// EffectiveRoles returns the roles bound to s and to the groups it is
+// in. It is Roles when the ACL has no groups.
+func (a *ACL) EffectiveRoles(ctx context.Context, s Subject) ([]string, error) {
+	roles, err := a.Roles(ctx, s)
+	if err != nil || a.members == nil {
+		return roles, err
+	}
+	groups, err := a.MemberOf(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, r := range roles {
+		seen[r] = true
+	}
+	for _, id := range groups {
+		inherited, err := a.Roles(ctx, GroupSubject(id))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range inherited {
+			if !seen[r] {
+				seen[r] = true
+				roles = append(roles, r)
+			}
+		}
+	}
+	return roles, nil
+}
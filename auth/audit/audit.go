@@ -0,0 +1,245 @@
+// Package audit keeps a persistent, append-only log of the
+// authentication events published on an events.Bus: logins and failed
+// logins, registrations, password resets, email verifications,
+// impersonations and so on. Entries are never updated, only removed
+// once they are older than the retention period.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+)
+
+// Permission is the permission needed to read the audit log through
+// Handler.
+const Permission = "audit:read"
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var ErrRange = errors.New("audit: since is after until")
+
+// failures are the event types recording a rejected attempt.
+var failures = map[events.Type]bool{
+	events.LoginFailed: true,
+}
+
+// Entry is a recorded event. Data is the JSON encoded data of the
+// event since the database layer stores flat documents.
+type Entry struct {
+	ID      uuid.UUID `json:"id" db:"id,index,required,unique"`
+	EventID string    `json:"event_id" db:"event_id,index"`
+	Type    string    `json:"type" db:"type,index,required"`
+	Outcome string    `json:"outcome" db:"outcome,index"`
+	// ActorID is the user who caused the event, the target user unless
+	// e.g an administrator acted on their behalf.
+	ActorID   string    `json:"actor_id,omitempty" db:"actor_id,index"`
+	UserID    string    `json:"user_id,omitempty" db:"user_id,index"`
+	Email     string    `json:"email,omitempty" db:"email,index"`
+	Provider  string    `json:"provider,omitempty" db:"provider"`
+	IP        string    `json:"ip,omitempty" db:"ip"`
+	UserAgent string    `json:"user_agent,omitempty" db:"user_agent"`
+	Reason    string    `json:"reason,omitempty" db:"reason"`
+	Data      string    `json:"data,omitempty" db:"data"`
+	CreatedAt time.Time `json:"created_at" db:"created_at,index"`
+}
+
+type Options func(*Log)
+
+type Log struct {
+	model       database.Model[Entry]
+	retention   time.Duration
+	prune_every time.Duration
+	batch       int64
+
+	mu         sync.Mutex
+	last_prune time.Time
+}
+
+// WithRetention sets how long entries are kept, 90 days by default.
+// Entries are kept forever when it is 0.
+func WithRetention(d time.Duration) Options {
+	return func(l *Log) {
+		l.retention = d
+	}
+}
+
+// WithPruneInterval sets how often Record removes expired entries, an
+// hour by default.
+func WithPruneInterval(d time.Duration) Options {
+	return func(l *Log) {
+		l.prune_every = d
+	}
+}
+
+// New returns a log storing entries in model, registered by the caller
+// e.g mongodb.RegisterModel(db, "auth_audit_log", audit.Entry{}).
+func New(model database.Model[Entry], opts ...Options) *Log {
+	l := &Log{
+		model:       model,
+		retention:   90 * 24 * time.Hour,
+		prune_every: time.Hour,
+		batch:       500,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Subscribe records every event published on bus.
+func (l *Log) Subscribe(bus *events.Bus) {
+	bus.After(events.All, l.Record)
+}
+
+// Record appends the event to the log. It has the signature of an
+// events.Hook.
+func (l *Log) Record(ctx context.Context, e events.Event) error {
+	entry := Entry{
+		ID:        uuid.New(),
+		EventID:   e.ID,
+		Type:      string(e.Type),
+		Outcome:   OutcomeSuccess,
+		ActorID:   e.ActorID,
+		UserID:    e.UserID,
+		Email:     e.Email,
+		Provider:  e.Provider,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Reason:    e.Reason,
+		CreatedAt: e.CreatedAt,
+	}
+	if failures[e.Type] {
+		entry.Outcome = OutcomeFailure
+	}
+	if entry.ActorID == "" {
+		entry.ActorID = e.UserID
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	if len(e.Data) > 0 {
+		data, err := json.Marshal(e.Data)
+		if err != nil {
+			return err
+		}
+		entry.Data = string(data)
+	}
+	if err := l.model.WithContext(ctx).Save(entry); err != nil {
+		return err
+	}
+	if l.pruneDue() {
+		_, err := l.Prune(ctx)
+		return err
+	}
+	return nil
+}
+
+func (l *Log) pruneDue() bool {
+	if l.retention <= 0 {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.last_prune) < l.prune_every {
+		return false
+	}
+	l.last_prune = time.Now()
+	return true
+}
+
+// Prune removes the entries older than the retention period and returns
+// how many were removed.
+func (l *Log) Prune(ctx context.Context) (int, error) {
+	if l.retention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-l.retention)
+	removed := 0
+	for {
+		oldest, err := l.model.WithContext(ctx).Query(
+			database.WithOrder("created_at", database.ASC),
+			database.WithLimit(l.batch),
+		).All()
+		if err != nil {
+			return removed, err
+		}
+		for _, e := range oldest {
+			if !e.CreatedAt.Before(cutoff) {
+				return removed, nil
+			}
+			if err := l.model.WithContext(ctx).Query(database.WithFilter("id", e.ID)).DeleteMany(); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+		if int64(len(oldest)) < l.batch {
+			return removed, nil
+		}
+	}
+}
+
+// Filter selects entries, zero fields match every entry.
+type Filter struct {
+	UserID string
+	Email  string
+	Type   events.Type
+	Since  time.Time
+	Until  time.Time
+	// Limit is the maximum number of entries returned, all of them
+	// when it is 0.
+	Limit int
+}
+
+// Query returns the entries matching f, newest first.
+func (l *Log) Query(ctx context.Context, f Filter) ([]*Entry, error) {
+	if !f.Since.IsZero() && !f.Until.IsZero() && f.Since.After(f.Until) {
+		return nil, ErrRange
+	}
+	params := []database.Params{database.WithOrder("created_at", database.DESC)}
+	if f.UserID != "" {
+		params = append(params, database.WithFilter("user_id", f.UserID))
+	}
+	if f.Email != "" {
+		params = append(params, database.WithFilter("email", f.Email))
+	}
+	if f.Type != "" {
+		params = append(params, database.WithFilter("type", string(f.Type)))
+	}
+	res := []*Entry{}
+	// the database only filters by equality, time ranges are applied
+	// while paging through the entries from the newest
+	for offset := int64(0); ; offset += l.batch {
+		page, err := l.model.WithContext(ctx).Query(append(params,
+			database.WithLimit(l.batch),
+			database.WithOffset(offset),
+		)...).All()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range page {
+			if !f.Until.IsZero() && e.CreatedAt.After(f.Until) {
+				continue
+			}
+			if !f.Since.IsZero() && e.CreatedAt.Before(f.Since) {
+				return res, nil
+			}
+			res = append(res, e)
+			if f.Limit > 0 && len(res) == f.Limit {
+				return res, nil
+			}
+		}
+		if int64(len(page)) < l.batch {
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	model := testdb.New[Entry]()
+	l := New(model, WithRetention(30*24*time.Hour))
+	l.batch = 2
+	bus := events.New()
+	l.Subscribe(bus)
+
+	now := time.Now().UTC()
+	at := func(d time.Duration) time.Time { return now.Add(-d) }
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.Header.Set("User-Agent", "test")
+	login := events.FromRequest(r, events.LoginSucceeded, "password")
+	login.UserID, login.Email, login.CreatedAt = "u1", "jon@doe.com", at(3*time.Hour)
+	failed := events.FromRequest(r, events.LoginFailed, "password")
+	failed.UserID, failed.Email, failed.Reason, failed.CreatedAt = "u1", "jon@doe.com", "invalid password", at(2*time.Hour)
+	reset := events.FromRequest(r, events.PasswordReset, "password")
+	reset.UserID, reset.Email, reset.CreatedAt = "u1", "jon@doe.com", at(time.Hour)
+	impersonated := events.FromRequest(r, events.ImpersonationStarted, "impersonation")
+	impersonated.UserID, impersonated.ActorID, impersonated.CreatedAt = "u1", "admin", at(time.Minute)
+	impersonated.Data = map[string]any{"session_id": "s1"}
+	other := events.FromRequest(r, events.LoginSucceeded, "ldap")
+	other.UserID, other.CreatedAt = "u2", at(30*time.Minute)
+	for _, e := range []events.Event{login, failed, reset, impersonated, other} {
+		bus.Publish(ctx, e)
+	}
+	bus.Wait()
+
+	t.Run("Record", func(t *testing.T) {
+		all, err := l.Query(ctx, Filter{})
+		require.NoError(t, err)
+		require.Len(t, all, 5)
+		// newest first
+		assert.Equal(t, string(events.ImpersonationStarted), all[0].Type)
+		assert.Equal(t, string(events.LoginSucceeded), all[4].Type)
+
+		e := all[0]
+		assert.Equal(t, impersonated.ID, e.EventID)
+		assert.Equal(t, "admin", e.ActorID)
+		assert.Equal(t, "u1", e.UserID)
+		assert.Equal(t, OutcomeSuccess, e.Outcome)
+		assert.Equal(t, "192.0.2.1", e.IP)
+		assert.Equal(t, "test", e.UserAgent)
+		assert.JSONEq(t, `{"session_id":"s1"}`, e.Data)
+
+		e = all[3]
+		assert.Equal(t, OutcomeFailure, e.Outcome)
+		assert.Equal(t, "invalid password", e.Reason)
+		assert.Equal(t, "u1", e.ActorID)
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		types := func(f Filter) []string {
+			res, err := l.Query(ctx, f)
+			require.NoError(t, err)
+			var types []string
+			for _, e := range res {
+				types = append(types, e.Type)
+			}
+			return types
+		}
+		assert.Len(t, types(Filter{UserID: "u1"}), 4)
+		assert.Len(t, types(Filter{Type: events.LoginSucceeded}), 2)
+		assert.Equal(t, []string{string(events.LoginSucceeded)}, types(Filter{UserID: "u2", Type: events.LoginSucceeded}))
+		assert.Equal(t, []string{string(events.PasswordReset), string(events.LoginFailed)},
+			types(Filter{UserID: "u1", Since: at(150 * time.Minute), Until: at(10 * time.Minute)}))
+		assert.Equal(t, []string{string(events.ImpersonationStarted), string(events.LoginSucceeded)},
+			types(Filter{Since: at(time.Hour), Limit: 2}))
+		assert.Empty(t, types(Filter{UserID: "u3"}))
+
+		_, err := l.Query(ctx, Filter{Since: now, Until: at(time.Hour)})
+		assert.ErrorIs(t, err, ErrRange)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		old := events.FromRequest(r, events.LoginSucceeded, "password")
+		old.UserID, old.CreatedAt = "u1", at(31*24*time.Hour)
+		require.NoError(t, l.Record(ctx, old))
+		all, err := l.Query(ctx, Filter{})
+		require.NoError(t, err)
+		// pruning waits for the interval
+		assert.Len(t, all, 6)
+
+		n, err := l.Prune(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		all, err = l.Query(ctx, Filter{})
+		require.NoError(t, err)
+		assert.Len(t, all, 5)
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		h := l.Handler()
+		get := func(query string) (int, []Entry) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+query, nil))
+			var body struct {
+				Data []Entry `json:"data"`
+			}
+			if w.Code == http.StatusOK {
+				require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+			}
+			return w.Code, body.Data
+		}
+		code, entries := get("user_id=u1&type=" + string(events.LoginFailed))
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, entries, 1)
+		assert.Equal(t, failed.ID, entries[0].EventID)
+
+		code, entries = get("since=" + at(90*time.Minute).Format(time.RFC3339) + "&limit=2")
+		require.Equal(t, http.StatusOK, code)
+		assert.Len(t, entries, 2)
+
+		code, _ = get("since=yesterday")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = get("limit=0")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = get("since=" + now.Format(time.RFC3339) + "&until=" + at(time.Hour).Format(time.RFC3339))
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
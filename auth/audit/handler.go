@@ -0,0 +1,74 @@
+package audit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/utilities"
+)
+
+const maxLimit = 1000
+
+var errLimit = errors.New("audit: limit must be between 1 and 1000")
+
+// Handler serves the log, it must be mounted behind a middleware
+// checking Permission:
+//
+//	GET /   lists entries, newest first, filtered by the user_id, email,
+//	        type, since and until query parameters, times in RFC 3339,
+//	        at most limit entries, 100 by default
+func (l *Log) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := Filter{
+			UserID: q.Get("user_id"),
+			Email:  q.Get("email"),
+			Type:   events.Type(q.Get("type")),
+			Limit:  100,
+		}
+		var err error
+		if v := q.Get("since"); v != "" {
+			if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				fail(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("until"); v != "" {
+			if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+				fail(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("limit"); v != "" {
+			if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 1 || f.Limit > maxLimit {
+				fail(w, errLimit, http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := l.Query(r.Context(), f)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrRange) {
+				status = http.StatusBadRequest
+			}
+			fail(w, err, status)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(entries).Send()
+	})
+	return r
+}
+
+func fail(w http.ResponseWriter, err error, status int) {
+	res := utilities.ResponseFail
+	if status >= http.StatusInternalServerError {
+		res = utilities.ResponseError
+	}
+	utilities.JSON(w).SetStatus(res).SetStatusCode(status).SetMessage(err.Error()).Send()
+}
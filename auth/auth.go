@@ -3,10 +3,24 @@ package auth
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
 	"github.com/neghi-go/database/mongodb"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/audit"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/profile"
 	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/ratelimit"
+	"github.com/neghi-go/iam/auth/risk"
+	"github.com/neghi-go/iam/auth/scim"
+	"github.com/neghi-go/iam/auth/serviceaccounts"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/tokens"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/session"
 )
@@ -14,14 +28,44 @@ import (
 type Options func(*Auth)
 
 type Auth struct {
-	database, url string
-	providers     []*providers.Provider
-	session       session.Session
+	database, url  string
+	providers      []*providers.Provider
+	session        session.Session
+	events         *events.Bus
+	store          storage.Storage
+	ratelimit      []ratelimit.Options
+	no_ratelimit   bool
+	sessions_opts  []sessions.Options
+	tokens_opts    []tokens.Options
+	sa_opts        []serviceaccounts.Options
+	profile_opts   []profile.Options
+	acl            *acl.ACL
+	scim           bool
+	scim_opts      []scim.Options
+	impersonation  time.Duration
+	audit          bool
+	audit_opts     []audit.Options
+	risk           bool
+	risk_opts      []risk.Options
+	deletion_grace time.Duration
+
+	user     database.Model[models.User]
+	sessions *sessions.Manager
+	tokens   *tokens.Manager
+	profiles *profile.Manager
+
+	service_accounts *serviceaccounts.Manager
+	audit_log        *audit.Log
+	risk_evaluator   *risk.Evaluator
 }
 
 func New(opts ...Options) *Auth {
 	cfg := &Auth{
-		session: session.NewJWTSession(),
+		session: sessions.NewJWT(),
+		events:  events.New(),
+		store:   storage.NewMemoryStorage(),
+
+		deletion_grace: 30 * 24 * time.Hour,
 	}
 	for _, opt := range opts {
 		opt(cfg)
@@ -35,11 +79,114 @@ func RegisterStrategy(provider ...*providers.Provider) Options {
 	}
 }
 
+// RegisterSession sets the session backend, sessions.NewJWT by default.
 func RegisterSession(session session.Session) Options {
 	return func(a *Auth) {
 		a.session = session
 	}
 }
+
+// RegisterEvents sets the event bus that providers publish lifecycle
+// events to.
+func RegisterEvents(bus *events.Bus) Options {
+	return func(a *Auth) {
+		a.events = bus
+	}
+}
+
+// RegisterStorage sets the key-value storage providers use for short
+// lived state. An in-memory storage is used by default.
+func RegisterStorage(store storage.Storage) Options {
+	return func(a *Auth) {
+		a.store = store
+	}
+}
+
+// RateLimit configures the rate limiter applied to every provider
+// route. Provider routes are rate limited with the defaults of
+// ratelimit.New unless DisableRateLimit is used.
+func RateLimit(opts ...ratelimit.Options) Options {
+	return func(a *Auth) {
+		a.ratelimit = append(a.ratelimit, opts...)
+	}
+}
+
+func DisableRateLimit() Options {
+	return func(a *Auth) {
+		a.no_ratelimit = true
+	}
+}
+
+// SessionOptions configures the records kept of issued sessions.
+func SessionOptions(opts ...sessions.Options) Options {
+	return func(a *Auth) {
+		a.sessions_opts = append(a.sessions_opts, opts...)
+	}
+}
+
+// TokenOptions configures the personal access tokens users can create.
+func TokenOptions(opts ...tokens.Options) Options {
+	return func(a *Auth) {
+		a.tokens_opts = append(a.tokens_opts, opts...)
+	}
+}
+
+// ServiceAccountOptions configures service accounts and the access
+// tokens they get.
+func ServiceAccountOptions(opts ...serviceaccounts.Options) Options {
+	return func(a *Auth) {
+		a.sa_opts = append(a.sa_opts, opts...)
+	}
+}
+
+// ProfileOptions configures the profiles of users, e.g. with validators
+// of the application fields kept in their metadata.
+func ProfileOptions(opts ...profile.Options) Options {
+	return func(a *Auth) {
+		a.profile_opts = append(a.profile_opts, opts...)
+	}
+}
+
+// RegisterACL sets the ACL the RequirePermission middleware option
+// checks permissions with.
+func RegisterACL(acl *acl.ACL) Options {
+	return func(a *Auth) {
+		a.acl = acl
+	}
+}
+
+// EnableSCIM serves a SCIM 2.0 server at /scim/v2 for identity providers
+// to provision users and, when the ACL has groups, groups. Clients need
+// the scim.Permission permission, granted to the user of their personal
+// access token or their service account in the ACL.
+func EnableSCIM(opts ...scim.Options) Options {
+	return func(a *Auth) {
+		a.scim = true
+		a.scim_opts = append(a.scim_opts, opts...)
+	}
+}
+
+// EnableAuditLog records every event published on the event bus in the
+// auth_audit_log collection and serves it at /audit to users granted
+// audit.Permission in the ACL, see audit.Log.Handler.
+func EnableAuditLog(opts ...audit.Options) Options {
+	return func(a *Auth) {
+		a.audit = true
+		a.audit_opts = append(a.audit_opts, opts...)
+	}
+}
+
+// EnableRiskEvaluation assesses every sign in with a risk.Evaluator
+// remembering devices in the auth_devices collection. Risky sign ins
+// publish events.SuspiciousLogin and get sessions that have to be
+// stepped up with a second factor before they can be used.
+func EnableRiskEvaluation(opts ...risk.Options) Options {
+	return func(a *Auth) {
+		a.risk = true
+		a.risk_opts = append(a.risk_opts, opts...)
+	}
+}
+
 func SetDatabase(url, database string) Options {
 	return func(a *Auth) {
 		a.database = database
@@ -59,10 +206,89 @@ func (a *Auth) Build() (chi.Router, error) {
 	if err != nil {
 		return nil, err
 	}
+	a.user = userModel
+	sessionModel, err := mongodb.RegisterModel(mgd, "auth_sessions", sessions.Record{})
+	if err != nil {
+		return nil, err
+	}
+	refreshModel, err := mongodb.RegisterModel(mgd, "auth_refresh_tokens", sessions.RefreshToken{})
+	if err != nil {
+		return nil, err
+	}
+	a.sessions = sessions.New(sessionModel, a.session, append([]sessions.Options{
+		sessions.WithRefreshTokens(refreshModel, 0),
+		sessions.WithUsers(userModel),
+		sessions.WithStorage(a.store),
+	}, a.sessions_opts...)...)
+	tokenModel, err := mongodb.RegisterModel(mgd, "auth_tokens", tokens.Token{})
+	if err != nil {
+		return nil, err
+	}
+	a.tokens = tokens.New(tokenModel, a.tokens_opts...)
+	a.profiles = profile.New(userModel, append([]profile.Options{
+		profile.WithEvents(a.events),
+	}, a.profile_opts...)...)
+	saModel, err := mongodb.RegisterModel(mgd, "auth_service_accounts", serviceaccounts.ServiceAccount{})
+	if err != nil {
+		return nil, err
+	}
+	credentialModel, err := mongodb.RegisterModel(mgd, "auth_service_account_credentials", serviceaccounts.Credential{})
+	if err != nil {
+		return nil, err
+	}
+	a.service_accounts = serviceaccounts.New(saModel, credentialModel, append([]serviceaccounts.Options{
+		serviceaccounts.WithStorage(a.store),
+	}, a.sa_opts...)...)
+
+	// routes shared by every provider
+	r.Post("/logout", a.sessions.Logout)
+	r.Post("/refresh", a.sessions.Refresh)
+	r.Get("/me", a.sessions.WhoAmI)
+	r.Mount("/sessions", a.sessions.Handler())
+	r.Mount("/tokens", a.tokens.Handler(a.sessions))
+	r.Mount("/profile", a.profiles.Handler(a.sessions))
+	r.Mount("/oauth", a.service_accounts.Handler())
+	r.Mount("/users", a.usersHandler())
+	if a.scim {
+		server := scim.New(userModel, a.acl, append([]scim.Options{
+			scim.WithEvents(a.events),
+			scim.WithDeleteUser(a.DeleteUser),
+			scim.WithDeactivateUser(a.endSessions),
+		}, a.scim_opts...)...)
+		r.With(a.Middleware(RequirePermission(scim.Permission))).Mount("/scim/v2", server.Handler())
+	}
+	if a.impersonation > 0 {
+		r.Mount("/impersonation", a.impersonationHandler())
+	}
+	if a.audit {
+		auditModel, err := mongodb.RegisterModel(mgd, "auth_audit_log", audit.Entry{})
+		if err != nil {
+			return nil, err
+		}
+		a.audit_log = audit.New(auditModel, a.audit_opts...)
+		if a.events != nil {
+			a.audit_log.Subscribe(a.events)
+		}
+		r.With(a.Middleware(RequirePermission(audit.Permission))).Mount("/audit", a.audit_log.Handler())
+	}
+	if a.risk {
+		deviceModel, err := mongodb.RegisterModel(mgd, "auth_devices", risk.Device{})
+		if err != nil {
+			return nil, err
+		}
+		a.risk_evaluator = risk.New(deviceModel, append([]risk.Options{
+			risk.WithStorage(a.store),
+			risk.WithEvents(a.events),
+		}, a.risk_opts...)...)
+	}
+	limiter := ratelimit.New(a.store, a.ratelimit...)
 
 	for _, p := range a.providers {
 		//Creates a new router for provider
 		router := chi.NewRouter()
+		if !a.no_ratelimit {
+			router.Use(limiter.Handler)
+		}
 		// create a context value
 		router.Use(func(h http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -73,11 +299,99 @@ func (a *Auth) Build() (chi.Router, error) {
 		})
 		//initialize route with context
 		p.Init(router, &providers.ProviderConfig{
-			Session: a.session,
-			User:    userModel,
+			Session:  a.session,
+			Sessions: a.sessions,
+			Tokens:   a.tokens,
+			User:     userModel,
+			Events:   a.events,
+			Store:    a.store,
+			Risk:     a.risk_evaluator,
 		})
 		//register handler to global router
 		r.Mount("/"+p.Name, router)
 	}
 	return r, nil
 }
+
+// Events returns the event bus used by the registered providers.
+func (a *Auth) Events() *events.Bus {
+	return a.events
+}
+
+// Sessions returns the session records, for administrative listing and
+// revocation. It can only be called after Build.
+func (a *Auth) Sessions() *sessions.Manager {
+	return a.sessions
+}
+
+// Tokens returns the personal access tokens, for administrative listing
+// and revocation. It can only be called after Build.
+func (a *Auth) Tokens() *tokens.Manager {
+	return a.tokens
+}
+
+// ServiceAccounts returns the service accounts, to manage them and their
+// credentials. Roles are bound to them in the ACL as acl.ServiceAccount
+// subjects. It can only be called after Build.
+func (a *Auth) ServiceAccounts() *serviceaccounts.Manager {
+	return a.service_accounts
+}
+
+// AuditLog returns the audit log, nil unless EnableAuditLog is used. It
+// can only be called after Build.
+func (a *Auth) AuditLog() *audit.Log {
+	return a.audit_log
+}
+
+// Profiles returns the manager of user profiles. It can only be called
+// after Build.
+func (a *Auth) Profiles() *profile.Manager {
+	return a.profiles
+}
+
+// Risk returns the risk evaluator, nil unless EnableRiskEvaluation is
+// used. It can only be called after Build.
+func (a *Auth) Risk() *risk.Evaluator {
+	return a.risk_evaluator
+}
+
+// DeleteUser removes a user, giving pre-hooks the chance to veto the
+// deletion. It can only be called after Build.
+func (a *Auth) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	user, err := a.user.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return err
+	}
+	e := events.Event{
+		ID:        uuid.NewString(),
+		Type:      events.UserDeleted,
+		UserID:    user.ID.String(),
+		Email:     user.Email,
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := a.events.Check(ctx, e); err != nil {
+		return err
+	}
+	if err := a.user.WithContext(ctx).Query(database.WithFilter("id", id)).Delete(); err != nil {
+		return err
+	}
+	if err := a.endSessions(ctx, id); err != nil {
+		return err
+	}
+	if a.acl != nil {
+		if err := a.acl.Forget(ctx, acl.Subject{Kind: acl.User, ID: id.String()}); err != nil {
+			return err
+		}
+	}
+	a.events.Publish(ctx, e)
+	return nil
+}
+
+// endSessions revokes the sessions and personal access tokens of a user.
+func (a *Auth) endSessions(ctx context.Context, id uuid.UUID) error {
+	if _, err := a.sessions.RevokeAll(ctx, id); err != nil {
+		return err
+	}
+	_, err := a.tokens.RevokeAll(ctx, id)
+	return err
+}
@@ -0,0 +1,209 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	// All matches every event type when used to register a hook.
+	All Type = "*"
+
+	UserRegistered         Type = "user.registered"
+	UserDeleted            Type = "user.deleted"
+	EmailVerified          Type = "user.email_verified"
+	VerificationSent       Type = "user.verification_sent"
+	LoginSucceeded         Type = "user.login_succeeded"
+	LoginFailed            Type = "user.login_failed"
+	PasswordResetRequested Type = "user.password_reset_requested"
+	PasswordReset          Type = "user.password_reset"
+	PasswordChanged        Type = "user.password_changed"
+	AccountLocked          Type = "user.account_locked"
+	AccountUnlocked        Type = "user.account_unlocked"
+	// StatusChanged carries the previous and new account status in Data
+	// as from and to.
+	StatusChanged Type = "user.status_changed"
+	// ProfileUpdated carries the names of the changed profile fields in
+	// Data as fields.
+	ProfileUpdated Type = "user.profile_updated"
+	// SuspiciousLogin carries the score and signals of a risky sign in
+	// in Data, see the risk package.
+	SuspiciousLogin Type = "user.suspicious_login"
+	// ImpersonationStarted and ImpersonationEnded carry the impersonated
+	// user, the impersonator is in Data. ImpersonationEnded is only
+	// published for sessions ended by the impersonator, the others end
+	// at the expires_at of ImpersonationStarted's Data, or earlier when
+	// their credential expires.
+	ImpersonationStarted Type = "user.impersonation_started"
+	ImpersonationEnded   Type = "user.impersonation_ended"
+)
+
+var ErrVetoed = errors.New("events: action was rejected by a hook")
+
+// VetoError is returned by Check when a pre-hook rejects an event.
+type VetoError struct {
+	Type Type
+	Err  error
+}
+
+func (v *VetoError) Error() string {
+	return fmt.Sprintf("events: %s rejected: %v", v.Type, v.Err)
+}
+
+func (v *VetoError) Unwrap() []error {
+	return []error{ErrVetoed, v.Err}
+}
+
+type Event struct {
+	ID       string `json:"id"`
+	Type     Type   `json:"type"`
+	Provider string `json:"provider,omitempty"`
+	UserID   string `json:"user_id,omitempty"`
+	Email    string `json:"email,omitempty"`
+	// ActorID is who caused the event when it isn't the user, e.g. the
+	// administrator impersonating them.
+	ActorID   string         `json:"actor_id,omitempty"`
+	IP        string         `json:"ip,omitempty"`
+	UserAgent string         `json:"user_agent,omitempty"`
+	Reason    string         `json:"reason,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// FromRequest creates an event of the given type populated with the
+// client details of the request.
+func FromRequest(r *http.Request, t Type, provider string) Event {
+	return Event{
+		ID:        uuid.NewString(),
+		Type:      t,
+		Provider:  provider,
+		IP:        ClientIP(r),
+		UserAgent: r.UserAgent(),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// LoginRejected returns the LoginFailed event recording that the
+// LoginSucceeded event e was vetoed with err.
+func LoginRejected(e Event, err error) Event {
+	e.ID = uuid.NewString()
+	e.Type = LoginFailed
+	e.Reason = err.Error()
+	e.CreatedAt = time.Now().UTC()
+	return e
+}
+
+// ClientIP returns the host portion of the request's remote address.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type Hook func(ctx context.Context, e Event) error
+
+type Option func(*Bus)
+
+// OnError sets the handler called when an async post-hook fails.
+func OnError(f func(e Event, err error)) Option {
+	return func(b *Bus) {
+		b.on_error = f
+	}
+}
+
+// Bus dispatches lifecycle events to registered hooks. Pre-hooks run
+// synchronously and can veto an action, post-hooks run asynchronously
+// once the action has completed. A nil *Bus is valid and does nothing.
+type Bus struct {
+	mu       sync.RWMutex
+	pre      map[Type][]Hook
+	post     map[Type][]Hook
+	wg       sync.WaitGroup
+	on_error func(e Event, err error)
+}
+
+func New(opts ...Option) *Bus {
+	cfg := &Bus{
+		pre:      make(map[Type][]Hook),
+		post:     make(map[Type][]Hook),
+		on_error: func(e Event, err error) {},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Before registers a pre-hook for the event type. Returning an error
+// from the hook vetoes the action.
+func (b *Bus) Before(t Type, hook Hook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pre[t] = append(b.pre[t], hook)
+}
+
+// After registers a post-hook for the event type.
+func (b *Bus) After(t Type, hook Hook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.post[t] = append(b.post[t], hook)
+}
+
+// Check runs the pre-hooks of the event in registration order and
+// stops at the first one that vetoes it.
+func (b *Bus) Check(ctx context.Context, e Event) error {
+	if b == nil {
+		return nil
+	}
+	for _, hook := range b.hooks(b.pre, e.Type) {
+		if err := hook(ctx, e); err != nil {
+			return &VetoError{Type: e.Type, Err: err}
+		}
+	}
+	return nil
+}
+
+// Publish runs the post-hooks of the event in the background. The
+// hooks receive a context that is not cancelled with the request.
+func (b *Bus) Publish(ctx context.Context, e Event) {
+	if b == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for _, hook := range b.hooks(b.post, e.Type) {
+		b.wg.Add(1)
+		go func(hook Hook) {
+			defer b.wg.Done()
+			if err := hook(ctx, e); err != nil {
+				b.on_error(e, err)
+			}
+		}(hook)
+	}
+}
+
+// Wait blocks until all running post-hooks have returned.
+func (b *Bus) Wait() {
+	if b == nil {
+		return
+	}
+	b.wg.Wait()
+}
+
+func (b *Bus) hooks(m map[Type][]Hook, t Type) []Hook {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	res := make([]Hook, 0, len(m[t])+len(m[All]))
+	res = append(res, m[t]...)
+	return append(res, m[All]...)
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	t.Run("Pre-Hook Vetoes Event", func(t *testing.T) {
+		bus := New()
+		errBlocked := errors.New("domain is blocked")
+		bus.Before(UserRegistered, func(ctx context.Context, e Event) error {
+			if e.Email == "jon@blocked.com" {
+				return errBlocked
+			}
+			return nil
+		})
+
+		err := bus.Check(context.Background(), Event{Type: UserRegistered, Email: "jon@blocked.com"})
+		assert.ErrorIs(t, err, ErrVetoed)
+		assert.ErrorIs(t, err, errBlocked)
+
+		err = bus.Check(context.Background(), Event{Type: UserRegistered, Email: "jon@doe.com"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Post-Hooks Run For Type And All", func(t *testing.T) {
+		var calls atomic.Int32
+		bus := New()
+		hook := func(ctx context.Context, e Event) error {
+			calls.Add(1)
+			return nil
+		}
+		bus.After(LoginSucceeded, hook)
+		bus.After(All, hook)
+		bus.After(LoginFailed, hook)
+
+		bus.Publish(context.Background(), Event{Type: LoginSucceeded})
+		bus.Wait()
+		assert.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("Nil Bus", func(t *testing.T) {
+		var bus *Bus
+		assert.NoError(t, bus.Check(context.Background(), Event{Type: LoginSucceeded}))
+		bus.Publish(context.Background(), Event{Type: LoginSucceeded})
+		bus.Wait()
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	secret := "webhook-secret"
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		err = VerifySignature([]byte(secret), r.Header.Get(SignatureHeader), body, time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, string(UserRegistered), r.Header.Get(EventHeader))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	hook := NewWebhook(server.URL, secret, WithRetries(2, time.Millisecond))
+	err := hook.Deliver(context.Background(), Event{ID: "evt_1", Type: UserRegistered})
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// other failures are reported without retrying
+	attempts.Store(0)
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer rejecting.Close()
+	err = NewWebhook(rejecting.URL, secret, WithRetries(2, time.Millisecond)).
+		Deliver(context.Background(), Event{ID: "evt_2", Type: UserRegistered})
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), attempts.Load())
+
+	err = VerifySignature([]byte("wrong-secret"), Sign([]byte(secret), time.Now(), []byte("{}")), []byte("{}"), time.Minute)
+	assert.Error(t, err)
+}
@@ -0,0 +1,168 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-IAM-Signature"
+	EventHeader     = "X-IAM-Event"
+	DeliveryHeader  = "X-IAM-Delivery"
+)
+
+var errInvalidSignature = errors.New("events: invalid webhook signature")
+
+type WebhookOptions func(*Webhook)
+
+func WithRetries(retries int, backoff time.Duration) WebhookOptions {
+	return func(w *Webhook) {
+		w.retries = retries
+		w.backoff = backoff
+	}
+}
+
+func WithHTTPClient(client *http.Client) WebhookOptions {
+	return func(w *Webhook) {
+		w.client = client
+	}
+}
+
+// Webhook delivers events to an HTTP endpoint. Every request body is
+// signed with HMAC-SHA256 so receivers can verify its origin.
+type Webhook struct {
+	url     string
+	secret  []byte
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+func NewWebhook(url, secret string, opts ...WebhookOptions) *Webhook {
+	cfg := &Webhook{
+		url:     url,
+		secret:  []byte(secret),
+		retries: 3,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Deliver posts the event to the webhook url, retrying with an
+// exponential backoff on network errors, 429 and 5xx responses. Other
+// responses outside 2xx fail without retrying. It satisfies Hook so it
+// can be registered with Bus.After.
+func (w *Webhook) Deliver(ctx context.Context, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.send(ctx, e, body)
+		var status *statusError
+		if err == nil || attempt >= w.retries || errors.As(err, &status) && !status.retry() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *Webhook) send(ctx context.Context, e Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(e.Type))
+	req.Header.Set(DeliveryHeader, e.ID)
+	req.Header.Set(SignatureHeader, Sign(w.secret, time.Now().UTC(), body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &statusError{code: res.StatusCode}
+	}
+	return nil
+}
+
+// statusError is a response of the webhook outside 2xx.
+type statusError struct {
+	code int
+}
+
+func (s *statusError) Error() string {
+	return fmt.Sprintf("events: webhook responded with %d", s.code)
+}
+
+// retry reports whether the delivery may succeed later.
+func (s *statusError) retry() bool {
+	return s.code == http.StatusTooManyRequests || s.code >= 500
+}
+
+// Sign returns the signature header value for body in the form
+// "t=<unix timestamp>,v1=<hex hmac>".
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// VerifySignature checks a signature header produced by Sign and
+// rejects it when it is older than tolerance.
+func VerifySignature(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if tolerance > 0 && time.Since(time.Unix(unix, 0)) > tolerance {
+		return errInvalidSignature
+	}
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return errInvalidSignature
+	}
+	if !hmac.Equal(expected, mac(secret, ts, body)) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret []byte, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/audit"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/profile"
+	"github.com/neghi-go/iam/auth/scim"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/utilities"
+)
+
+// PermissionImpersonate is the permission to impersonate users, see
+// EnableImpersonation.
+const PermissionImpersonate = "users:impersonate"
+
+// impersonationDenied are the administrative permissions impersonation
+// sessions never get, whatever the roles of the impersonated user: an
+// impersonator can't borrow the powers of an administrator.
+var impersonationDenied = []string{
+	PermissionImpersonate,
+	PermissionManageStatus,
+	profile.Permission,
+	audit.Permission,
+	scim.Permission,
+}
+
+var (
+	errNoReason         = errors.New("auth: a reason is required to impersonate a user")
+	errNeedsSession     = errors.New("auth: impersonating requires a session")
+	errImpersonateSelf  = errors.New("auth: you can't impersonate yourself")
+	errImpersonateAdmin = errors.New("auth: users allowed to impersonate can't be impersonated")
+	errUserNotFound     = errors.New("auth: user not found")
+	errNotImpersonating = errors.New("auth: the session is not an impersonation")
+)
+
+// EnableImpersonation serves /impersonation for administrators granted
+// PermissionImpersonate in the ACL to open sessions as other users, for
+// support. Sessions last at most maxDuration, an hour when it is 0:
+//
+//	POST   /   opens a session as {"user_id", "reason", "duration"}, in seconds
+//	DELETE /   ends the impersonation session of the request
+//
+// The session carries both users, see Principal.ImpersonatorID. It is
+// never granted the administrative permissions of this package, such as
+// PermissionImpersonate or audit.Permission, and acl.WithImpersonationDenied
+// keeps it from other dangerous actions. Starting
+// it publishes events.ImpersonationStarted, with the time the session
+// expires at, and ending it with DELETE events.ImpersonationEnded.
+// Sessions left to expire publish no ImpersonationEnded: audits take
+// the expires_at of the started event as their end.
+func EnableImpersonation(maxDuration time.Duration) Options {
+	return func(a *Auth) {
+		if maxDuration <= 0 {
+			maxDuration = time.Hour
+		}
+		a.impersonation = maxDuration
+	}
+}
+
+func (a *Auth) impersonationHandler() http.Handler {
+	r := chi.NewRouter()
+	r.With(a.Middleware(RequirePermission(PermissionImpersonate))).Post("/", a.startImpersonation)
+	r.With(a.Middleware()).Delete("/", a.endImpersonation)
+	return r
+}
+
+func (a *Auth) startImpersonation(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFrom(r.Context())
+	if p.SessionID == uuid.Nil {
+		deny(w, errNeedsSession, http.StatusForbidden, nil)
+		return
+	}
+	if p.Impersonated() {
+		deny(w, sessions.ErrImpersonating, http.StatusForbidden, nil)
+		return
+	}
+	var body struct {
+		UserID   uuid.UUID `json:"user_id"`
+		Reason   string    `json:"reason"`
+		Duration int       `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		deny(w, err, http.StatusBadRequest, nil)
+		return
+	}
+	if body.Reason == "" {
+		deny(w, errNoReason, http.StatusBadRequest, nil)
+		return
+	}
+	if body.UserID == p.UserID {
+		deny(w, errImpersonateSelf, http.StatusBadRequest, nil)
+		return
+	}
+	user, err := a.user.WithContext(r.Context()).Query(database.WithFilter("id", body.UserID)).First()
+	if err != nil {
+		deny(w, errUserNotFound, http.StatusNotFound, nil)
+		return
+	}
+	if user.CheckStatus(time.Now()) != nil {
+		deny(w, ErrAccountInactive, http.StatusForbidden, nil)
+		return
+	}
+	// administrators would gain each other's permissions
+	err = a.acl.Authorize(r.Context(), acl.Subject{Kind: acl.User, ID: user.ID.String()}, PermissionImpersonate)
+	if err == nil {
+		deny(w, errImpersonateAdmin, http.StatusForbidden, nil)
+		return
+	}
+	if !errors.Is(err, acl.ErrDenied) {
+		deny(w, err, http.StatusInternalServerError, nil)
+		return
+	}
+	ttl := a.impersonation
+	if d := time.Duration(body.Duration) * time.Second; d > 0 && d < ttl {
+		ttl = d
+	}
+
+	e := events.FromRequest(r, events.ImpersonationStarted, sessions.ProviderImpersonation)
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	e.ActorID = p.UserID.String()
+	e.Reason = body.Reason
+	e.Data = map[string]any{"impersonator_id": p.UserID.String(), "impersonator_email": p.Email}
+	if err := a.events.Check(r.Context(), e); err != nil {
+		deny(w, err, http.StatusForbidden, nil)
+		return
+	}
+	current, err := a.sessions.Authenticate(r)
+	if err != nil {
+		deny(w, ErrUnauthenticated, http.StatusUnauthorized, nil)
+		return
+	}
+	rec, err := a.sessions.Impersonate(w, r, current, user.ID, user.Email, body.Reason, ttl)
+	if err != nil {
+		deny(w, err, http.StatusInternalServerError, nil)
+		return
+	}
+	e.Data["session_id"] = rec.ID.String()
+	e.Data["expires_at"] = rec.ExpiresAt
+	a.events.Publish(r.Context(), e)
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusCreated).
+		SetData(rec).Send()
+}
+
+func (a *Auth) endImpersonation(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFrom(r.Context())
+	if !p.Impersonated() {
+		deny(w, errNotImpersonating, http.StatusBadRequest, nil)
+		return
+	}
+	if err := a.sessions.Revoke(r.Context(), p.UserID, p.SessionID); err != nil {
+		deny(w, err, http.StatusInternalServerError, nil)
+		return
+	}
+	e := events.FromRequest(r, events.ImpersonationEnded, sessions.ProviderImpersonation)
+	e.UserID = p.UserID.String()
+	e.Email = p.Email
+	e.ActorID = p.ImpersonatorID.String()
+	e.Data = map[string]any{
+		"impersonator_id":    p.ImpersonatorID.String(),
+		"impersonator_email": p.ImpersonatorEmail,
+		"session_id":         p.SessionID.String(),
+	}
+	a.events.Publish(r.Context(), e)
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).Send()
+}
@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/audit"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/tokens"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImpersonation(t *testing.T) {
+	ctx := context.Background()
+	bindings, err := acl.New(
+		acl.WithBindings(testdb.New[acl.Binding]()),
+		acl.WithRole("support", PermissionImpersonate),
+		acl.WithRole("customer", "billing:*", "orders:*"),
+		acl.WithRole("admin", PermissionManageStatus, audit.Permission),
+		acl.WithImpersonationDenied("billing:*"),
+	)
+	require.NoError(t, err)
+	a := New(RegisterACL(bindings), EnableImpersonation(time.Hour))
+	a.user = testdb.New[models.User]()
+	a.sessions = sessions.New(testdb.New[sessions.Record](), a.session)
+	a.tokens = tokens.New(testdb.New[tokens.Token]())
+
+	var mu sync.Mutex
+	var published []events.Event
+	a.events.After(events.All, func(ctx context.Context, e events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, e)
+		return nil
+	})
+
+	agent := models.User{ID: uuid.New(), Email: "agent@example.com", EmailVerified: true}
+	lead := models.User{ID: uuid.New(), Email: "lead@example.com", EmailVerified: true}
+	customer := models.User{ID: uuid.New(), Email: "jon@doe.com", EmailVerified: true}
+	admin := models.User{ID: uuid.New(), Email: "admin@example.com", EmailVerified: true}
+	require.NoError(t, a.user.Save(agent, lead, customer, admin))
+	for _, u := range []models.User{agent, lead} {
+		require.NoError(t, bindings.Bind(ctx, acl.Subject{Kind: acl.User, ID: u.ID.String()}, "support"))
+	}
+	require.NoError(t, bindings.Bind(ctx, acl.Subject{Kind: acl.User, ID: customer.ID.String()}, "customer"))
+	require.NoError(t, bindings.Bind(ctx, acl.Subject{Kind: acl.User, ID: admin.ID.String()}, "admin"))
+	login := func(u models.User) string {
+		w := httptest.NewRecorder()
+		_, err := a.sessions.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), u.ID, u.Email, "password", sessions.AMRPassword)
+		require.NoError(t, err)
+		return w.Header().Get("Auth-Token")
+	}
+	agentTok, customerTok := login(agent), login(customer)
+
+	h := a.impersonationHandler()
+	do := func(method, tok string, body any) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&buf).Encode(body))
+		}
+		r := httptest.NewRequest(method, "/", &buf)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	start := func(tok string, id uuid.UUID, reason string) *httptest.ResponseRecorder {
+		return do(http.MethodPost, tok, map[string]any{"user_id": id, "reason": reason, "duration": 600})
+	}
+
+	var tok string
+	t.Run("Start", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, start(customerTok, agent.ID, "curious").Code)
+		assert.Equal(t, http.StatusBadRequest, start(agentTok, customer.ID, "").Code)
+		assert.Equal(t, http.StatusBadRequest, start(agentTok, agent.ID, "testing").Code)
+		assert.Equal(t, http.StatusNotFound, start(agentTok, uuid.New(), "ticket 42").Code)
+		// support staff can't borrow each other's permissions
+		assert.Equal(t, http.StatusForbidden, start(agentTok, lead.ID, "ticket 42").Code)
+
+		w := start(agentTok, customer.ID, "ticket 42")
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		tok = w.Header().Get("Auth-Token")
+		require.NotEmpty(t, tok)
+		assert.NotEqual(t, customerTok, tok)
+		var body struct {
+			Data sessions.Record `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		assert.Equal(t, agent.ID, body.Data.ImpersonatorID)
+		assert.WithinDuration(t, time.Now().Add(10*time.Minute), body.Data.ExpiresAt, 5*time.Second)
+	})
+
+	t.Run("Principal", func(t *testing.T) {
+		var got *Principal
+		call := func(tok string, opts ...MiddlewareOptions) int {
+			got = nil
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Authorization", "Bearer "+tok)
+			w := httptest.NewRecorder()
+			a.Middleware(opts...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ = PrincipalFrom(r.Context())
+			})).ServeHTTP(w, r)
+			return w.Code
+		}
+		require.Equal(t, http.StatusOK, call(tok))
+		assert.Equal(t, customer.ID, got.UserID)
+		assert.True(t, got.Impersonated())
+		assert.Equal(t, agent.ID, got.ImpersonatorID)
+		assert.Equal(t, agent.Email, got.ImpersonatorEmail)
+		assert.Equal(t, sessions.ProviderImpersonation, got.Provider)
+
+		// the ACL keeps impersonators from dangerous actions
+		assert.Equal(t, http.StatusOK, call(tok, RequirePermission("orders:read")))
+		assert.Equal(t, http.StatusForbidden, call(tok, RequirePermission("billing:write")))
+		assert.Equal(t, http.StatusOK, call(customerTok, RequirePermission("billing:write")))
+		// the session has no authentication methods of the user
+		assert.Equal(t, http.StatusUnauthorized, call(tok, RequireMFA()))
+		// nor can it impersonate further
+		assert.Equal(t, http.StatusForbidden, start(tok, agent.ID, "ticket 42").Code)
+
+		// nor manage the user's tokens and sessions
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"name":"ci"}`)))
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		a.tokens.Handler(a.sessions).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		r = httptest.NewRequest(http.MethodDelete, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w = httptest.NewRecorder()
+		a.sessions.Handler().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		// impersonation ends with the impersonator's account
+		disabled := agent
+		disabled.Status = models.StatusDisabled
+		require.NoError(t, a.user.Query(database.WithFilter("id", agent.ID)).Update(disabled))
+		assert.Equal(t, http.StatusUnauthorized, call(tok))
+		require.NoError(t, a.user.Query(database.WithFilter("id", agent.ID)).Update(agent))
+	})
+
+	t.Run("End", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do(http.MethodDelete, customerTok, nil).Code)
+		require.Equal(t, http.StatusOK, do(http.MethodDelete, tok, nil).Code)
+		assert.Equal(t, http.StatusUnauthorized, do(http.MethodDelete, tok, nil).Code)
+		// the user's own session is untouched
+		_, err := a.sessions.Lookup(ctx, customerTok)
+		assert.NoError(t, err)
+
+		a.events.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, published, 2)
+		byType := map[events.Type]events.Event{}
+		for _, e := range published {
+			byType[e.Type] = e
+		}
+		started, ended := byType[events.ImpersonationStarted], byType[events.ImpersonationEnded]
+		assert.Equal(t, customer.ID.String(), started.UserID)
+		assert.Equal(t, "ticket 42", started.Reason)
+		assert.Equal(t, agent.ID.String(), started.Data["impersonator_id"])
+		assert.Equal(t, agent.ID.String(), started.ActorID)
+		assert.Equal(t, customer.ID.String(), ended.UserID)
+		assert.Equal(t, agent.ID.String(), ended.Data["impersonator_id"])
+		assert.Equal(t, agent.ID.String(), ended.ActorID)
+	})
+	t.Run("Admin", func(t *testing.T) {
+		w := start(agentTok, admin.ID, "ticket 43")
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		tok := w.Header().Get("Auth-Token")
+		status := func(tok string) int {
+			r := httptest.NewRequest(http.MethodGet, "/"+customer.ID.String()+"/status", nil)
+			r.Header.Set("Authorization", "Bearer "+tok)
+			w := httptest.NewRecorder()
+			a.usersHandler().ServeHTTP(w, r)
+			return w.Code
+		}
+		// the admin permissions of the target are out of reach
+		assert.Equal(t, http.StatusOK, status(login(admin)))
+		assert.Equal(t, http.StatusForbidden, status(tok))
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w = httptest.NewRecorder()
+		a.Middleware(RequirePermission(audit.Permission))(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(w, r)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
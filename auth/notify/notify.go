@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	EmailVerification Kind = "email_verification"
+	PasswordReset     Kind = "password_reset"
+	AccountUnlock     Kind = "account_unlock"
+	MagicLink         Kind = "magic_link"
+	LoginCode         Kind = "login_code"
+	NewLogin          Kind = "new_login"
+)
+
+// Message is a notification to a user. It is the data templates are
+// rendered with, e.g {{.Token}} or {{.Data.name}}.
+type Message struct {
+	Kind      Kind           `json:"kind"`
+	To        string         `json:"to"`
+	Locale    string         `json:"locale,omitempty"`
+	Token     string         `json:"token,omitempty"`
+	Link      string         `json:"link,omitempty"`
+	ExpiresAt time.Time      `json:"expires_at,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, msg Message) error
+}
+
+// NotifierFunc adapts a function into a Notifier.
+type NotifierFunc func(ctx context.Context, msg Message) error
+
+func (f NotifierFunc) Notify(ctx context.Context, msg Message) error {
+	return f(ctx, msg)
+}
+
+// Stdout prints messages instead of delivering them, it is the default
+// notifier of the providers and only meant for development.
+var Stdout = NotifierFunc(func(ctx context.Context, msg Message) error {
+	fmt.Printf("kind: %v, email: %v, token: %v, link: %v\n", msg.Kind, msg.To, msg.Token, msg.Link)
+	return nil
+})
+
+// LocaleFromRequest returns the first language of the request's
+// Accept-Language header.
+func LocaleFromRequest(r *http.Request) string {
+	lang, _, _ := strings.Cut(r.Header.Get("Accept-Language"), ",")
+	lang, _, _ = strings.Cut(lang, ";")
+	return strings.TrimSpace(lang)
+}
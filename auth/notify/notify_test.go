@@ -0,0 +1,210 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderer(t *testing.T) {
+	t.Run("Default Templates", func(t *testing.T) {
+		r := NewRenderer()
+		for _, kind := range []Kind{EmailVerification, PasswordReset, AccountUnlock, MagicLink} {
+			res, err := r.Render(Message{Kind: kind, To: "jon@doe.com", Token: "123456", Link: "https://example.com/?a=1&b=2"})
+			require.NoError(t, err, kind)
+			assert.NotEmpty(t, res.Subject, kind)
+			assert.Contains(t, res.Text, "https://example.com/?a=1&b=2", kind)
+			assert.Contains(t, res.HTML, "https://example.com/?a=1&amp;b=2", kind)
+		}
+
+		res, err := r.Render(Message{Kind: LoginCode, To: "jon@doe.com", Token: "123456"})
+		require.NoError(t, err)
+		assert.Contains(t, res.Text, "123456")
+
+		res, err = r.Render(Message{Kind: NewLogin, To: "jon@doe.com",
+			Data: map[string]any{"device": "Firefox on Linux", "ip": "192.0.2.1", "country": "GB"}})
+		require.NoError(t, err)
+		assert.Contains(t, res.Text, "Firefox on Linux at 192.0.2.1 (GB)")
+		assert.Contains(t, res.HTML, "<strong>Firefox on Linux</strong>")
+	})
+
+	t.Run("Locale Fallback", func(t *testing.T) {
+		r := NewRenderer(WithTemplates(fstest.MapFS{
+			"fr/password_reset.tmpl": {Data: []byte(`{{define "subject"}}Réinitialiser{{end}}` +
+				`{{define "text"}}Code {{.Token}}{{end}}{{define "html"}}<b>{{.Data.name}}</b>{{end}}`)},
+		}))
+		res, err := r.Render(Message{Kind: PasswordReset, Locale: "fr-CA", Token: "42",
+			Data: map[string]any{"name": "<jon>"}})
+		require.NoError(t, err)
+		assert.Equal(t, "Réinitialiser", res.Subject)
+		assert.Equal(t, "Code 42", res.Text)
+		assert.Equal(t, "<b>&lt;jon&gt;</b>", res.HTML)
+
+		res, err = r.Render(Message{Kind: PasswordReset, Locale: "de", Token: "42"})
+		require.NoError(t, err)
+		assert.Equal(t, "Reset your password", res.Subject)
+
+		_, err = r.Render(Message{Kind: "unknown"})
+		assert.ErrorIs(t, err, errNoTemplate)
+	})
+
+	t.Run("Locale From Request", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", "fr-CA;q=0.9, en;q=0.8")
+		assert.Equal(t, "fr-CA", LocaleFromRequest(req))
+		assert.Equal(t, []string{"fr-ca", "fr", "en"}, locales("fr_CA", "en"))
+		assert.Equal(t, []string{"en"}, locales("../en", "en"))
+	})
+}
+
+func TestSMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	received := make(chan string, 1)
+	go serveSMTP(l, received)
+
+	n := NewSMTP(l.Addr().String(), "no-reply@example.com")
+	err = n.Notify(context.Background(), Message{
+		Kind:      EmailVerification,
+		To:        "jon@doe.com",
+		Token:     "123456",
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	var data string
+	select {
+	case data = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "jon@doe.com", msg.Header.Get("To"))
+	assert.Equal(t, "Verify your email address", msg.Header.Get("Subject"))
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(p)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "123456")
+		types = append(types, strings.Split(p.Header.Get("Content-Type"), ";")[0])
+	}
+	assert.Equal(t, []string{"text/plain", "text/html"}, types)
+}
+
+// serveSMTP accepts a single connection and answers just enough of the
+// protocol for net/smtp to send a message.
+func serveSMTP(l net.Listener, received chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	reply := func(line string) {
+		_, _ = rw.WriteString(line + "\r\n")
+		_ = rw.Flush()
+	}
+	reply("220 localhost ESMTP")
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				l, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			received <- data.String()
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.Background()
+	model := testdb.New[OutboxMessage]()
+	o := NewOutbox(model, WithMaxAttempts(2))
+	require.NoError(t, o.Notify(ctx, Message{Kind: PasswordReset, To: "jon@doe.com", Token: "secret", ExpiresAt: time.Now().Add(time.Hour)}))
+	require.NoError(t, o.Notify(ctx, Message{Kind: PasswordReset, To: "arya@doe.com", Token: "expired", ExpiresAt: time.Now().Add(-time.Second)}))
+
+	down := NotifierFunc(func(ctx context.Context, msg Message) error { return errors.New("smtp: connection refused") })
+	n, err := o.Dispatch(ctx, down)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+	// expired messages are dropped
+	pending, err := model.Query().All()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "jon@doe.com", pending[0].To)
+
+	// sent messages are deleted
+	var sent []Message
+	n, err = o.Dispatch(ctx, NotifierFunc(func(ctx context.Context, msg Message) error {
+		sent = append(sent, msg)
+		return nil
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, sent, 1)
+	assert.Equal(t, "secret", sent[0].Token)
+	count, err := model.Query().Count()
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	// failed messages don't keep their token
+	require.NoError(t, o.Notify(ctx, Message{Kind: PasswordReset, To: "jon@doe.com", Token: "secret"}))
+	for range 2 {
+		_, err = o.Dispatch(ctx, down)
+		require.NoError(t, err)
+	}
+	failed, err := model.Query().First()
+	require.NoError(t, err)
+	assert.Equal(t, StatusFailed, failed.Status)
+	assert.Empty(t, failed.Payload)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), failed.ExpiresAt, time.Minute)
+}
@@ -0,0 +1,172 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+)
+
+const (
+	StatusPending = "pending"
+	StatusFailed  = "failed"
+)
+
+// OutboxMessage is a message stored for asynchronous delivery. The
+// message is kept as JSON since the database layer stores flat
+// documents. Messages carry live tokens, so they are only kept until
+// they are delivered or expire: sent and expired messages are deleted,
+// and the payload of failed ones is cleared.
+type OutboxMessage struct {
+	ID        uuid.UUID `json:"id" db:"id,index,required,unique"`
+	Kind      string    `json:"kind" db:"kind"`
+	To        string    `json:"to" db:"to"`
+	Payload   string    `json:"payload" db:"payload"`
+	Status    string    `json:"status" db:"status,index"`
+	Attempts  int       `json:"attempts" db:"attempts"`
+	LastError string    `json:"last_error" db:"last_error"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	// ExpiresAt is when the message is dropped if it wasn't delivered,
+	// the expiry of its token or MaxAge after it was stored.
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+type OutboxOptions func(*Outbox)
+
+// Outbox is a Notifier that stores messages instead of delivering them,
+// so a slow or unavailable mail server doesn't fail or slow down the
+// request that triggered the message. Dispatch or Run deliver the
+// stored messages with another notifier.
+type Outbox struct {
+	model        database.Model[OutboxMessage]
+	max_attempts int
+	max_age      time.Duration
+	batch        int64
+}
+
+// WithMaxAttempts sets how many times delivery of a message is tried
+// before it is marked as failed. Defaults to 5.
+func WithMaxAttempts(n int) OutboxOptions {
+	return func(o *Outbox) {
+		o.max_attempts = n
+	}
+}
+
+// WithMaxAge sets how long messages without an expiry are kept for
+// delivery. Defaults to a day.
+func WithMaxAge(d time.Duration) OutboxOptions {
+	return func(o *Outbox) {
+		o.max_age = d
+	}
+}
+
+// WithBatchSize sets how many messages a Dispatch delivers at most.
+// Defaults to 100.
+func WithBatchSize(n int64) OutboxOptions {
+	return func(o *Outbox) {
+		o.batch = n
+	}
+}
+
+// NewOutbox returns an outbox storing messages in model, registered by
+// the caller e.g mongodb.RegisterModel(db, "auth_outbox", notify.OutboxMessage{}).
+func NewOutbox(model database.Model[OutboxMessage], opts ...OutboxOptions) *Outbox {
+	o := &Outbox{
+		model:        model,
+		max_attempts: 5,
+		max_age:      24 * time.Hour,
+		batch:        100,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+func (o *Outbox) Notify(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	expires := msg.ExpiresAt
+	if expires.IsZero() {
+		expires = now.Add(o.max_age)
+	}
+	return o.model.WithContext(ctx).Save(OutboxMessage{
+		ID:        uuid.New(),
+		Kind:      string(msg.Kind),
+		To:        msg.To,
+		Payload:   string(payload),
+		Status:    StatusPending,
+		CreatedAt: now,
+		ExpiresAt: expires,
+	})
+}
+
+// Dispatch delivers pending messages, oldest first, and returns the
+// number of messages sent. Sent messages are deleted.
+func (o *Outbox) Dispatch(ctx context.Context, n Notifier) (int, error) {
+	pending, err := o.model.WithContext(ctx).Query(
+		database.WithFilter("status", StatusPending),
+		database.WithOrder("created_at", database.ASC),
+		database.WithLimit(o.batch),
+	).All()
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, m := range pending {
+		if ctx.Err() != nil {
+			return sent, ctx.Err()
+		}
+		// the token of an expired message is of no use anymore
+		if time.Now().After(m.ExpiresAt) {
+			if err := o.model.WithContext(ctx).Query(database.WithFilter("id", m.ID)).Delete(); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		var msg Message
+		err := json.Unmarshal([]byte(m.Payload), &msg)
+		if err == nil {
+			err = n.Notify(ctx, msg)
+		}
+		if err == nil {
+			if err := o.model.WithContext(ctx).Query(database.WithFilter("id", m.ID)).Delete(); err != nil {
+				return sent, err
+			}
+			sent++
+			continue
+		}
+		m.Attempts++
+		m.LastError = err.Error()
+		if m.Attempts >= o.max_attempts {
+			m.Status = StatusFailed
+			m.Payload = ""
+		}
+		if err := o.model.WithContext(ctx).Query(database.WithFilter("id", m.ID)).Update(*m); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Run dispatches pending messages every interval until ctx is done.
+// Errors are passed to onError, which may be nil.
+func (o *Outbox) Run(ctx context.Context, n Notifier, interval time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := o.Dispatch(ctx, n); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
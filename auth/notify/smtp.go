@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+type SMTPOptions func(*SMTP)
+
+// SMTP delivers rendered messages through an SMTP server, as
+// multipart/alternative emails with a text and an html part.
+type SMTP struct {
+	addr     string
+	from     string
+	auth     smtp.Auth
+	renderer *Renderer
+	timeout  time.Duration
+}
+
+// WithAuth sets the authentication used with the server, usually
+// smtp.PlainAuth. The server must offer STARTTLS for PLAIN auth to be
+// used outside of localhost.
+func WithAuth(auth smtp.Auth) SMTPOptions {
+	return func(s *SMTP) {
+		s.auth = auth
+	}
+}
+
+func WithRenderer(r *Renderer) SMTPOptions {
+	return func(s *SMTP) {
+		s.renderer = r
+	}
+}
+
+func WithTimeout(d time.Duration) SMTPOptions {
+	return func(s *SMTP) {
+		s.timeout = d
+	}
+}
+
+// NewSMTP returns a notifier sending from the address from through the
+// server at addr (host:port).
+func NewSMTP(addr, from string, opts ...SMTPOptions) *SMTP {
+	s := &SMTP{
+		addr:     addr,
+		from:     from,
+		renderer: NewRenderer(),
+		timeout:  30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *SMTP) Notify(ctx context.Context, msg Message) error {
+	rendered, err := s.renderer.Render(msg)
+	if err != nil {
+		return err
+	}
+	body, err := s.compose(msg.To, rendered)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(s.addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(nil); err != nil {
+			return err
+		}
+	}
+	if s.auth != nil {
+		if err := c.Auth(s.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(body); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (s *SMTP) compose(to string, msg *Rendered) ([]byte, error) {
+	boundary := randomBoundary()
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", s.from)
+	header.Set("To", to)
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", msg.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", "multipart/alternative; boundary="+boundary)
+	for _, k := range []string{"From", "To", "Subject", "Date", "MIME-Version", "Content-Type"} {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, header.Get(k))
+	}
+	buf.WriteString("\r\n")
+
+	parts := []struct{ kind, body string }{
+		{"text/plain", msg.Text},
+		{"text/html", msg.HTML},
+	}
+	for _, p := range parts {
+		if p.body == "" {
+			continue
+		}
+		fmt.Fprintf(&buf, "--%s\r\n", boundary)
+		fmt.Fprintf(&buf, "Content-Type: %s; charset=utf-8\r\n", p.kind)
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&buf)
+		if _, err := qp.Write([]byte(p.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		buf.WriteString("\r\n")
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return buf.Bytes(), nil
+}
+
+func randomBoundary() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,175 @@
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+var errNoTemplate = errors.New("notify: no template for message kind")
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+// Rendered is a message rendered for delivery.
+type Rendered struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+type RendererOptions func(*Renderer)
+
+// Renderer renders messages with the template <locale>/<kind>.tmpl,
+// which defines the templates "subject", "text" and "html". The subject
+// and text are rendered with text/template, the html with html/template.
+//
+// A locale such as fr-CA falls back to fr and then to the default
+// locale, so overrides only need to provide the languages they support.
+type Renderer struct {
+	sources        []fs.FS
+	default_locale string
+
+	mu    sync.Mutex
+	cache map[string]*templates
+}
+
+type templates struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// WithTemplates adds a file system of templates laid out as
+// <locale>/<kind>.tmpl, with lower cased locales. Templates of later
+// calls take precedence over earlier ones, which take precedence over
+// the built-in english ones.
+func WithTemplates(fsys fs.FS) RendererOptions {
+	return func(r *Renderer) {
+		r.sources = append([]fs.FS{fsys}, r.sources...)
+	}
+}
+
+// WithDefaultLocale sets the locale used when a message has none, or
+// none of its templates exist. Defaults to en.
+func WithDefaultLocale(locale string) RendererOptions {
+	return func(r *Renderer) {
+		r.default_locale = strings.ToLower(locale)
+	}
+}
+
+func NewRenderer(opts ...RendererOptions) *Renderer {
+	sub, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	r := &Renderer{
+		sources:        []fs.FS{sub},
+		default_locale: "en",
+		cache:          make(map[string]*templates),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *Renderer) Render(msg Message) (*Rendered, error) {
+	t, err := r.lookup(msg.Kind, msg.Locale)
+	if err != nil {
+		return nil, err
+	}
+	res := &Rendered{}
+	var buf bytes.Buffer
+	if t.text.Lookup("subject") != nil {
+		if err := t.text.ExecuteTemplate(&buf, "subject", msg); err != nil {
+			return nil, err
+		}
+		res.Subject = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if t.text.Lookup("text") != nil {
+		if err := t.text.ExecuteTemplate(&buf, "text", msg); err != nil {
+			return nil, err
+		}
+		res.Text = strings.TrimSpace(buf.String())
+		buf.Reset()
+	}
+	if t.html.Lookup("html") != nil {
+		if err := t.html.ExecuteTemplate(&buf, "html", msg); err != nil {
+			return nil, err
+		}
+		res.HTML = strings.TrimSpace(buf.String())
+	}
+	return res, nil
+}
+
+// lookup returns the parsed templates of the first locale in the
+// fallback chain that has a template for kind.
+func (r *Renderer) lookup(kind Kind, locale string) (*templates, error) {
+	for _, l := range locales(locale, r.default_locale) {
+		name := l + "/" + string(kind) + ".tmpl"
+		r.mu.Lock()
+		t, ok := r.cache[name]
+		r.mu.Unlock()
+		if ok {
+			return t, nil
+		}
+		for _, src := range r.sources {
+			b, err := fs.ReadFile(src, name)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			t, err := parse(name, string(b))
+			if err != nil {
+				return nil, err
+			}
+			r.mu.Lock()
+			r.cache[name] = t
+			r.mu.Unlock()
+			return t, nil
+		}
+	}
+	return nil, errNoTemplate
+}
+
+func parse(name, src string) (*templates, error) {
+	text, err := texttemplate.New(name).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	html, err := htmltemplate.New(name).Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	return &templates{text: text, html: html}, nil
+}
+
+// locales returns the fallback chain of locale e.g fr-CA, fr, en.
+func locales(locale, fallback string) []string {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	var res []string
+	add := func(l string) {
+		for _, v := range res {
+			if v == l {
+				return
+			}
+		}
+		if l != "" && !strings.ContainsAny(l, "/.") {
+			res = append(res, l)
+		}
+	}
+	add(locale)
+	if lang, _, ok := strings.Cut(locale, "-"); ok {
+		add(lang)
+	}
+	add(fallback)
+	return res
+}
@@ -0,0 +1,385 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/utilities"
+)
+
+var (
+	ErrUnauthenticated  = errors.New("auth: no valid session")
+	ErrEmailNotVerified = errors.New("auth: email address is not verified")
+	ErrAccountInactive  = errors.New("auth: the account is not active")
+	// ErrInsufficientScope is returned when the token of the request
+	// lacks a scope the route requires.
+	ErrInsufficientScope = errors.New("auth: the token lacks a required scope")
+	// ErrStepUpRequired is returned when the session is not strong or
+	// recent enough for a route, see Challenge.
+	ErrStepUpRequired = errors.New("auth: the route requires a stronger or more recent authentication")
+)
+
+// Principal is the authenticated user or service account of a request.
+type Principal struct {
+	UserID        uuid.UUID `json:"user_id"`
+	Email         string    `json:"email"`
+	EmailVerified bool      `json:"email_verified"`
+	SessionID     uuid.UUID `json:"session_id"`
+	Provider      string    `json:"provider"`
+	// AMR lists the methods the user authenticated with, ACR is the
+	// assurance level they reach and AuthTime when the user last
+	// authenticated.
+	AMR      []string  `json:"amr"`
+	ACR      string    `json:"acr"`
+	AuthTime time.Time `json:"auth_time"`
+	// RequiredACR is the level the session has to be stepped up to
+	// before it can be used, after a risky sign in.
+	RequiredACR string `json:"required_acr,omitempty"`
+	// TokenID is set when the request was authenticated with a personal
+	// access token, which restricts the principal to Scopes.
+	TokenID uuid.UUID `json:"token_id,omitempty"`
+	Scopes  []string  `json:"scopes,omitempty"`
+	// ServiceAccountID is set, instead of UserID, for service accounts.
+	// Their access tokens are restricted to Scopes when issued with
+	// scopes.
+	ServiceAccountID uuid.UUID `json:"service_account_id,omitempty"`
+	// ImpersonatorID is set when an administrator acts as the user, see
+	// EnableImpersonation.
+	ImpersonatorID    uuid.UUID `json:"impersonator_id,omitempty"`
+	ImpersonatorEmail string    `json:"impersonator_email,omitempty"`
+}
+
+// Impersonated reports whether an administrator acts as the user.
+func (p *Principal) Impersonated() bool {
+	return p.ImpersonatorID != uuid.Nil
+}
+
+func (p *Principal) scoped() bool {
+	return p.TokenID != uuid.Nil || (p.ServiceAccountID != uuid.Nil && p.Scopes != nil)
+}
+
+// Subject returns p as an acl subject, scoped when p authenticated with
+// a token and carrying the impersonator when p is impersonated.
+func (p *Principal) Subject() acl.Subject {
+	s := acl.Subject{Kind: acl.User, ID: p.UserID.String()}
+	if p.ServiceAccountID != uuid.Nil {
+		s = acl.Subject{Kind: acl.ServiceAccount, ID: p.ServiceAccountID.String()}
+	}
+	if p.scoped() {
+		s.Scopes = append([]string{}, p.Scopes...)
+	}
+	if p.Impersonated() {
+		s.Impersonator = acl.Subject{Kind: acl.User, ID: p.ImpersonatorID.String()}.String()
+	}
+	return s
+}
+
+// HasScope reports whether p may act within scope, sessions aren't
+// restricted to scopes.
+func (p *Principal) HasScope(scope string) bool {
+	if !p.scoped() {
+		return true
+	}
+	return slices.ContainsFunc(p.Scopes, func(s string) bool { return acl.Match(s, scope) })
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal put into ctx by the middleware.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// Principal validates the session of the request with the session
+// backend and the session records, or the personal access token or
+// service account access token of the request, and loads its user or
+// service account. It can only be called after Build.
+func (a *Auth) Principal(r *http.Request) (*Principal, error) {
+	credential := a.sessions.Credential(r)
+	if credential == "" {
+		return nil, ErrUnauthenticated
+	}
+	if a.service_accounts.Is(credential) {
+		access, err := a.service_accounts.Verify(r.Context(), credential)
+		if err != nil {
+			return nil, ErrUnauthenticated
+		}
+		return &Principal{
+			Provider:         "client_credentials",
+			AuthTime:         access.IssuedAt,
+			Scopes:           access.Scopes,
+			ServiceAccountID: access.Account.ID,
+		}, nil
+	}
+	if a.tokens.Is(credential) {
+		t, err := a.tokens.Lookup(r.Context(), credential)
+		if err != nil {
+			return nil, ErrUnauthenticated
+		}
+		user, err := a.user.WithContext(r.Context()).Query(database.WithFilter("id", t.UserID)).First()
+		if err != nil {
+			return nil, ErrUnauthenticated
+		}
+		if user.CheckStatus(time.Now()) != nil {
+			return nil, ErrAccountInactive
+		}
+		return &Principal{
+			UserID:        user.ID,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			Provider:      "token",
+			AuthTime:      t.CreatedAt,
+			TokenID:       t.ID,
+			Scopes:        t.ScopeList(),
+		}, nil
+	}
+	rec, err := a.sessions.Lookup(r.Context(), credential)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	user, err := a.user.WithContext(r.Context()).Query(database.WithFilter("id", rec.UserID)).First()
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+	if user.CheckStatus(time.Now()) != nil {
+		return nil, ErrAccountInactive
+	}
+	// impersonation ends with the impersonator's account
+	if rec.Impersonated() {
+		impersonator, err := a.user.WithContext(r.Context()).Query(database.WithFilter("id", rec.ImpersonatorID)).First()
+		if err != nil || impersonator.CheckStatus(time.Now()) != nil {
+			return nil, ErrUnauthenticated
+		}
+	}
+	authTime := rec.AuthTime
+	if authTime.IsZero() {
+		authTime = rec.CreatedAt
+	}
+	return &Principal{
+		UserID:        user.ID,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		SessionID:     rec.ID,
+		Provider:      rec.Provider,
+		AMR:           rec.Methods(),
+		ACR:           sessions.ACR(rec.Methods()),
+		AuthTime:      authTime,
+		RequiredACR:   rec.RequiredACR,
+
+		ImpersonatorID:    rec.ImpersonatorID,
+		ImpersonatorEmail: rec.ImpersonatorEmail,
+	}, nil
+}
+
+// Challenge tells a client how to re-authenticate to meet the
+// requirements of a route, in the terms of RFC 9470: the assurance level
+// and maximum authentication age required, and the providers that reach
+// them. Authenticating with one of them while sending the current
+// session steps the session up, see sessions.Manager.Create.
+type Challenge struct {
+	Error     string   `json:"error"`
+	ACR       string   `json:"acr_values,omitempty"`
+	MaxAge    int      `json:"max_age,omitempty"`
+	Providers []string `json:"providers"`
+}
+
+type MiddlewareOptions func(*middlewareConfig)
+
+type middlewareConfig struct {
+	verified_email bool
+	scopes         []string
+	permission     string
+	acr            string
+	max_age        time.Duration
+	optional       bool
+}
+
+// RequireVerifiedEmail rejects users whose email address isn't verified.
+func RequireVerifiedEmail() MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.verified_email = true
+	}
+}
+
+// RequireScope rejects tokens lacking one of scopes. Sessions aren't
+// restricted to scopes.
+func RequireScope(scopes ...string) MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.scopes = append(mc.scopes, scopes...)
+	}
+}
+
+// RequirePermission rejects principals the ACL of the Auth doesn't grant
+// permission to, taking the scopes of tokens into account. It requires
+// RegisterACL.
+func RequirePermission(permission string) MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.permission = permission
+	}
+}
+
+// RequireACR challenges sessions below the assurance level acr, one of
+// sessions.AAL1 and sessions.AAL2.
+func RequireACR(acr string) MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.acr = acr
+	}
+}
+
+// RequireMFA challenges sessions created without a second factor, it is
+// RequireACR(sessions.AAL2).
+func RequireMFA() MiddlewareOptions {
+	return RequireACR(sessions.AAL2)
+}
+
+// MaxAuthAge challenges sessions whose user authenticated more than d
+// ago, for sensitive routes such as changing the email address or
+// deleting the account.
+func MaxAuthAge(d time.Duration) MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.max_age = d
+	}
+}
+
+// Optional lets requests without a valid session through, without a
+// principal.
+func Optional() MiddlewareOptions {
+	return func(mc *middlewareConfig) {
+		mc.optional = true
+	}
+}
+
+// Middleware puts the principal of the session into the request
+// context, see PrincipalFrom, and rejects requests without a valid
+// session or not meeting the requirements of opts. Sessions that aren't
+// strong or recent enough get a 401 with a Challenge.
+func (a *Auth) Middleware(opts ...MiddlewareOptions) func(http.Handler) http.Handler {
+	cfg := &middlewareConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.Principal(r)
+			if err != nil {
+				if cfg.optional {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				deny(w, err, http.StatusUnauthorized, nil)
+				return
+			}
+			if cfg.verified_email && !p.EmailVerified {
+				deny(w, ErrEmailNotVerified, http.StatusForbidden, nil)
+				return
+			}
+			for _, scope := range cfg.scopes {
+				if !p.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(cfg.scopes, " ")))
+					deny(w, ErrInsufficientScope, http.StatusForbidden, nil)
+					return
+				}
+			}
+			if cfg.permission != "" {
+				if err := a.authorize(r.Context(), p, cfg.permission); err != nil {
+					status := http.StatusInternalServerError
+					if errors.Is(err, acl.ErrDenied) {
+						status = http.StatusForbidden
+					}
+					deny(w, err, status, nil)
+					return
+				}
+			}
+			need := cfg
+			// sessions of risky sign ins have to be stepped up first
+			if sessions.Level(p.RequiredACR) > sessions.Level(cfg.acr) {
+				raised := *cfg
+				raised.acr = p.RequiredACR
+				need = &raised
+			}
+			if sessions.Level(p.ACR) < sessions.Level(need.acr) ||
+				(need.max_age > 0 && time.Since(p.AuthTime) > need.max_age) {
+				ch := a.challenge(p, need)
+				header := fmt.Sprintf(`Bearer error=%q, error_description=%q`, ch.Error, ErrStepUpRequired.Error())
+				if ch.ACR != "" {
+					header += fmt.Sprintf(`, acr_values=%q`, ch.ACR)
+				}
+				if ch.MaxAge > 0 {
+					header += fmt.Sprintf(`, max_age=%d`, ch.MaxAge)
+				}
+				w.Header().Set("WWW-Authenticate", header)
+				deny(w, ErrStepUpRequired, http.StatusUnauthorized, ch)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// challenge lists the providers that meet the requirements of cfg when
+// p authenticates with them, the provider of the session first.
+func (a *Auth) challenge(p *Principal, cfg *middlewareConfig) *Challenge {
+	ch := &Challenge{
+		Error:     "insufficient_user_authentication",
+		ACR:       cfg.acr,
+		MaxAge:    int(cfg.max_age.Seconds()),
+		Providers: []string{},
+	}
+	for _, pr := range a.providers {
+		if len(pr.AMR) == 0 {
+			continue
+		}
+		// the best method of the provider is assumed to be used
+		reached := 0
+		for _, m := range pr.AMR {
+			reached = max(reached, sessions.Level(sessions.ACR(append(slices.Clone(p.AMR), m))))
+		}
+		if reached < sessions.Level(cfg.acr) {
+			continue
+		}
+		if pr.Name == p.Provider {
+			ch.Providers = slices.Insert(ch.Providers, 0, pr.Name)
+		} else {
+			ch.Providers = append(ch.Providers, pr.Name)
+		}
+	}
+	return ch
+}
+
+// authorize checks permission for p with the ACL of the Auth.
+func (a *Auth) authorize(ctx context.Context, p *Principal, permission string) error {
+	if a.acl == nil {
+		return acl.ErrDenied
+	}
+	if p.Impersonated() && slices.ContainsFunc(impersonationDenied, func(denied string) bool {
+		return acl.Match(permission, denied)
+	}) {
+		return acl.ErrDenied
+	}
+	return a.acl.Authorize(ctx, p.Subject(), permission)
+}
+
+func deny(w http.ResponseWriter, err error, status int, data any) {
+	res := utilities.JSON(w).SetStatus(utilities.ResponseFail).SetStatusCode(status).
+		SetMessage(err.Error())
+	if data != nil {
+		res = res.SetData(data)
+	}
+	res.Send()
+}
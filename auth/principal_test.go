@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/serviceaccounts"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/tokens"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	a := New()
+	a.user = testdb.New[models.User]()
+	a.sessions = sessions.New(testdb.New[sessions.Record](), a.session)
+	a.tokens = tokens.New(testdb.New[tokens.Token]())
+	a.providers = []*providers.Provider{
+		{Name: "password", AMR: []string{sessions.AMRPassword}},
+		{Name: "passwordless", AMR: []string{sessions.AMROTP, sessions.AMREmail}},
+	}
+
+	verified := models.User{ID: uuid.New(), Email: "jon@doe.com", EmailVerified: true}
+	unverified := models.User{ID: uuid.New(), Email: "jane@doe.com"}
+	require.NoError(t, a.user.Save(verified, unverified))
+	login := func(u models.User) string {
+		w := httptest.NewRecorder()
+		_, err := a.sessions.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), u.ID, u.Email, "password", sessions.AMRPassword)
+		require.NoError(t, err)
+		return w.Header().Get("Auth-Token")
+	}
+	verifiedTok, unverifiedTok := login(verified), login(unverified)
+
+	var got *Principal
+	var res *httptest.ResponseRecorder
+	handler := func(opts ...MiddlewareOptions) http.Handler {
+		return a.Middleware(opts...)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = PrincipalFrom(r.Context())
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	call := func(h http.Handler, tok string) int {
+		got = nil
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tok != "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		res = httptest.NewRecorder()
+		h.ServeHTTP(res, r)
+		return res.Code
+	}
+
+	t.Run("Session", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(handler(), verifiedTok))
+		require.NotNil(t, got)
+		assert.Equal(t, verified.ID, got.UserID)
+		assert.Equal(t, "password", got.Provider)
+		assert.Equal(t, []string{sessions.AMRPassword}, got.AMR)
+		assert.Equal(t, sessions.AAL1, got.ACR)
+
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), ""))
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), "not-a-jwt"))
+
+		// a valid JWT without a session record, e.g. after revocation
+		w := httptest.NewRecorder()
+		require.NoError(t, session.NewJWTSession().Generate(w, uuid.NewString()))
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), w.Header().Get("Auth-Token")))
+
+		// disabled users are rejected while their sessions last
+		disabled := unverified
+		disabled.Status = models.StatusDisabled
+		require.NoError(t, a.user.Query(database.WithFilter("id", unverified.ID)).Update(disabled))
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), unverifiedTok))
+		require.NoError(t, a.user.Query(database.WithFilter("id", unverified.ID)).Update(unverified))
+	})
+
+	t.Run("Optional", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(handler(Optional()), ""))
+		assert.Nil(t, got)
+	})
+
+	t.Run("Requirements", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(handler(RequireVerifiedEmail()), verifiedTok))
+		assert.Equal(t, http.StatusForbidden, call(handler(RequireVerifiedEmail()), unverifiedTok))
+		assert.Equal(t, http.StatusOK, call(handler(MaxAuthAge(time.Hour)), verifiedTok))
+	})
+
+	t.Run("Step Up", func(t *testing.T) {
+		challenge := func() Challenge {
+			var body struct {
+				Data Challenge `json:"data"`
+			}
+			require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+			return body.Data
+		}
+		require.Equal(t, http.StatusUnauthorized, call(handler(RequireMFA()), verifiedTok))
+		assert.Contains(t, res.Header().Get("WWW-Authenticate"), `error="insufficient_user_authentication"`)
+		assert.Contains(t, res.Header().Get("WWW-Authenticate"), `acr_values="aal2"`)
+		assert.Equal(t, []string{"passwordless"}, challenge().Providers)
+
+		require.Equal(t, http.StatusUnauthorized, call(handler(MaxAuthAge(time.Nanosecond)), verifiedTok))
+		ch := challenge()
+		assert.Equal(t, []string{"password", "passwordless"}, ch.Providers)
+
+		// authenticating with a code while signed in with a password
+		time.Sleep(time.Second) // so the new JWT differs from the old one
+		r := httptest.NewRequest(http.MethodPost, "/passwordless/authorize", nil)
+		r.Header.Set("Authorization", "Bearer "+verifiedTok)
+		w := httptest.NewRecorder()
+		rec, err := a.sessions.Create(w, r, verified.ID, verified.Email, "passwordless", sessions.AMROTP)
+		require.NoError(t, err)
+		assert.Equal(t, sessions.AAL2, rec.ACR)
+		stepped := w.Header().Get("Auth-Token")
+		assert.Equal(t, http.StatusOK, call(handler(RequireMFA(), MaxAuthAge(time.Minute)), stepped))
+		assert.Equal(t, []string{sessions.AMRPassword, sessions.AMROTP}, got.AMR)
+		// the stepped up session replaces the old one
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), verifiedTok))
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		_, secret, err := a.tokens.Create(context.Background(), verified.ID, "ci", []string{"repo:read"}, time.Time{})
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, call(handler(RequireScope("repo:read")), secret))
+		assert.Equal(t, verified.ID, got.UserID)
+		assert.Equal(t, []string{"repo:read"}, got.Scopes)
+		assert.Equal(t, http.StatusForbidden, call(handler(RequireScope("repo:write")), secret))
+		assert.Contains(t, res.Header().Get("WWW-Authenticate"), `error="insufficient_scope"`)
+		// tokens never meet step-up requirements
+		assert.Equal(t, http.StatusUnauthorized, call(handler(RequireMFA()), secret))
+		assert.Equal(t, http.StatusUnauthorized, call(handler(), secret+"x"))
+
+		bindings, err := acl.New(acl.WithBindings(testdb.New[acl.Binding]()), acl.WithRole("maintainer", "repo:*"))
+		require.NoError(t, err)
+		a.acl = bindings
+		require.NoError(t, a.acl.Bind(context.Background(), acl.Subject{Kind: acl.User, ID: verified.ID.String()}, "maintainer"))
+		assert.Equal(t, http.StatusOK, call(handler(RequirePermission("repo:read")), secret))
+		assert.Equal(t, http.StatusForbidden, call(handler(RequirePermission("repo:write")), secret))
+		assert.Equal(t, http.StatusForbidden, call(handler(RequirePermission("repo:write")), unverifiedTok))
+	})
+
+	t.Run("Service Account", func(t *testing.T) {
+		a.service_accounts = serviceaccounts.New(testdb.New[serviceaccounts.ServiceAccount](), testdb.New[serviceaccounts.Credential]())
+		sa, err := a.service_accounts.Create(context.Background(), "billing", "", nil)
+		require.NoError(t, err)
+		_, secret, err := a.service_accounts.AddSecret(context.Background(), sa.ID, time.Time{})
+		require.NoError(t, err)
+		r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type=client_credentials"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(sa.ID.String(), secret)
+		w := httptest.NewRecorder()
+		a.service_accounts.Token(w, r)
+		var body struct {
+			AccessToken string `json:"access_token"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+
+		require.Equal(t, http.StatusOK, call(handler(), body.AccessToken))
+		assert.Equal(t, sa.ID, got.ServiceAccountID)
+		assert.Equal(t, uuid.Nil, got.UserID)
+		assert.True(t, got.HasScope("repo:write"))
+		assert.Equal(t, http.StatusForbidden, call(handler(RequirePermission("repo:read")), body.AccessToken))
+		require.NoError(t, a.acl.Bind(context.Background(), acl.Subject{Kind: acl.ServiceAccount, ID: sa.ID.String()}, "maintainer"))
+		assert.Equal(t, http.StatusOK, call(handler(RequirePermission("repo:read")), body.AccessToken))
+	})
+}
@@ -0,0 +1,142 @@
+package profile
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/utilities"
+)
+
+var errNotAuthorized = errors.New("profile: no valid session")
+
+// Handler serves the profile of the user signed in with a session of s:
+//
+//	GET    /   the profile, without its AppMetadata
+//	PATCH  /   applies an Update, AppMetadata can't be changed
+//
+// Sessions yet to be stepped up, see sessions.Manager.RequireACR, can't
+// update the profile.
+func (m *Manager) Handler(s *sessions.Manager) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := s.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		p, err := m.Get(r.Context(), current.UserID)
+		if err != nil {
+			failProfile(w, err)
+			return
+		}
+		p.AppMetadata = nil
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(p).Send()
+	})
+	r.Patch("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := s.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		if current.Restricted() {
+			fail(w, sessions.ErrStepUpRequired, http.StatusForbidden)
+			return
+		}
+		var u Update
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			fail(w, err, http.StatusBadRequest)
+			return
+		}
+		if u.AppMetadata != nil {
+			fail(w, ErrAdminOnly, http.StatusForbidden)
+			return
+		}
+		e := events.FromRequest(r, events.ProfileUpdated, "")
+		if current.Impersonated() {
+			e.ActorID = current.ImpersonatorID.String()
+		}
+		p, err := m.update(r.Context(), e, current.UserID, u)
+		if err != nil {
+			failProfile(w, err)
+			return
+		}
+		p.AppMetadata = nil
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(p).Send()
+	})
+	return r
+}
+
+// AdminHandler serves the profile of any user, including AppMetadata, to
+// be mounted behind a check of Permission at a path with an {id}
+// parameter, the id of the user. actor returns the id of the
+// administrator making the request.
+//
+//	GET    /   the profile
+//	PATCH  /   applies an Update
+func (m *Manager) AdminHandler(actor func(r *http.Request) string) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			fail(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+		p, err := m.Get(r.Context(), id)
+		if err != nil {
+			failProfile(w, err)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(p).Send()
+	})
+	r.Patch("/", func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			fail(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+		var u Update
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			fail(w, err, http.StatusBadRequest)
+			return
+		}
+		e := events.FromRequest(r, events.ProfileUpdated, "")
+		e.ActorID = actor(r)
+		p, err := m.update(r.Context(), e, id, u)
+		if err != nil {
+			failProfile(w, err)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(p).Send()
+	})
+	return r
+}
+
+func failProfile(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, events.ErrVetoed):
+		status = http.StatusForbidden
+	}
+	fail(w, err, status)
+}
+
+func fail(w http.ResponseWriter, err error, status int) {
+	res := utilities.ResponseFail
+	if status >= http.StatusInternalServerError {
+		res = utilities.ResponseError
+	}
+	utilities.JSON(w).SetStatus(res).SetStatusCode(status).SetMessage(err.Error()).Send()
+}
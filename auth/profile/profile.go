@@ -0,0 +1,327 @@
+// Package profile manages the profile of users: their names, picture,
+// locale, timezone and phone number, and two JSON objects of application
+// data, Metadata which users can edit and AppMetadata which only
+// administrators can. Applications keep their own profile fields in
+// these objects and validate them with a Validator, such as one returned
+// by Schema, instead of extending models.User.
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/internal/models"
+	"golang.org/x/text/language"
+)
+
+// Permission is the permission needed to read and edit the profile of
+// other users, including their AppMetadata, through AdminHandler.
+const Permission = "users:profile"
+
+const (
+	maxName    = 256
+	maxPicture = 2048
+)
+
+var (
+	ErrNotFound = errors.New("profile: user not found")
+	// ErrInvalid is wrapped by the errors of profiles that fail
+	// validation, including the errors of validators.
+	ErrInvalid   = errors.New("profile: invalid profile")
+	ErrAdminOnly = errors.New("profile: app_metadata can only be changed by administrators")
+)
+
+var phoneNumber = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// Profile is the profile of a user. Metadata and AppMetadata are never
+// nil, except AppMetadata in the responses of Handler which doesn't show
+// it to users.
+type Profile struct {
+	UserID      uuid.UUID      `json:"user_id"`
+	GivenName   string         `json:"given_name,omitempty"`
+	FamilyName  string         `json:"family_name,omitempty"`
+	DisplayName string         `json:"display_name,omitempty"`
+	Picture     string         `json:"picture,omitempty"`
+	Locale      string         `json:"locale,omitempty"`
+	Timezone    string         `json:"timezone,omitempty"`
+	Phone       string         `json:"phone_number,omitempty"`
+	Metadata    map[string]any `json:"metadata"`
+	AppMetadata map[string]any `json:"app_metadata,omitempty"`
+}
+
+// Update is a partial update of a profile. Nil fields are left as they
+// are and empty ones cleared. Metadata and AppMetadata are merged into
+// the current objects key by key, keys set to nil are removed.
+type Update struct {
+	GivenName   *string        `json:"given_name"`
+	FamilyName  *string        `json:"family_name"`
+	DisplayName *string        `json:"display_name"`
+	Picture     *string        `json:"picture"`
+	Locale      *string        `json:"locale"`
+	Timezone    *string        `json:"timezone"`
+	Phone       *string        `json:"phone_number"`
+	Metadata    map[string]any `json:"metadata"`
+	AppMetadata map[string]any `json:"app_metadata"`
+}
+
+// Validator validates a profile before it is saved, with the update
+// already applied. Its errors are returned wrapped in ErrInvalid.
+type Validator func(ctx context.Context, p *Profile) error
+
+type Options func(*Manager)
+
+type Manager struct {
+	users        database.Model[models.User]
+	events       *events.Bus
+	validators   []Validator
+	max_metadata int
+}
+
+// WithValidator adds validators run, in order, on every update after
+// the standard fields are validated.
+func WithValidator(v ...Validator) Options {
+	return func(m *Manager) {
+		m.validators = append(m.validators, v...)
+	}
+}
+
+// WithMaxMetadataSize sets the maximum size in bytes of Metadata and of
+// AppMetadata once JSON encoded, 16KiB by default.
+func WithMaxMetadataSize(n int) Options {
+	return func(m *Manager) {
+		m.max_metadata = n
+	}
+}
+
+// WithEvents publishes events.ProfileUpdated on bus for every update,
+// pre-hooks can veto updates.
+func WithEvents(bus *events.Bus) Options {
+	return func(m *Manager) {
+		m.events = bus
+	}
+}
+
+func New(users database.Model[models.User], opts ...Options) *Manager {
+	m := &Manager{
+		users:        users,
+		max_metadata: 16 << 10,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Get returns the profile of the user id.
+func (m *Manager) Get(ctx context.Context, id uuid.UUID) (*Profile, error) {
+	user, err := m.users.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return Of(user)
+}
+
+// Update applies u to the profile of the user id, on behalf of the user
+// actorID when it is set, and returns the updated profile.
+func (m *Manager) Update(ctx context.Context, id uuid.UUID, u Update, actorID string) (*Profile, error) {
+	e := events.Event{
+		ID:        uuid.NewString(),
+		Type:      events.ProfileUpdated,
+		ActorID:   actorID,
+		CreatedAt: time.Now().UTC(),
+	}
+	return m.update(ctx, e, id, u)
+}
+
+func (m *Manager) update(ctx context.Context, e events.Event, id uuid.UUID, u Update) (*Profile, error) {
+	user, err := m.users.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	p, err := Of(user)
+	if err != nil {
+		return nil, err
+	}
+	fields := p.apply(u)
+	if err := m.validate(ctx, p); err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return p, nil
+	}
+	if m.events != nil {
+		e.UserID = user.ID.String()
+		e.Email = user.Email
+		e.Data = map[string]any{"fields": fields}
+		if err := m.events.Check(ctx, e); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.to(user); err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = time.Now().UTC()
+	if err := m.users.WithContext(ctx).Query(database.WithFilter("id", id)).Update(*user); err != nil {
+		return nil, err
+	}
+	if m.events != nil {
+		m.events.Publish(ctx, e)
+	}
+	return p, nil
+}
+
+// validate checks the standard fields of p, normalizing the locale and
+// phone number, then runs the validators.
+func (m *Manager) validate(ctx context.Context, p *Profile) error {
+	for field, name := range map[string]string{"given_name": p.GivenName, "family_name": p.FamilyName, "display_name": p.DisplayName} {
+		if utf8.RuneCountInString(name) > maxName {
+			return fmt.Errorf("%w: %s is longer than %d characters", ErrInvalid, field, maxName)
+		}
+	}
+	if p.Picture != "" {
+		u, err := url.Parse(p.Picture)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(p.Picture) > maxPicture {
+			return fmt.Errorf("%w: picture must be an http or https url", ErrInvalid)
+		}
+	}
+	if p.Locale != "" {
+		tag, err := language.Parse(p.Locale)
+		if err != nil {
+			return fmt.Errorf("%w: locale must be a BCP 47 language tag", ErrInvalid)
+		}
+		p.Locale = tag.String()
+	}
+	if p.Timezone != "" {
+		if _, err := time.LoadLocation(p.Timezone); err != nil || p.Timezone == "Local" {
+			return fmt.Errorf("%w: timezone must be an IANA time zone", ErrInvalid)
+		}
+	}
+	if p.Phone != "" {
+		p.Phone = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(p.Phone)
+		if !phoneNumber.MatchString(p.Phone) {
+			return fmt.Errorf("%w: phone_number must be in E.164 format", ErrInvalid)
+		}
+	}
+	for field, meta := range map[string]map[string]any{"metadata": p.Metadata, "app_metadata": p.AppMetadata} {
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalid, field, err)
+		}
+		if len(b) > m.max_metadata {
+			return fmt.Errorf("%w: %s is larger than %d bytes", ErrInvalid, field, m.max_metadata)
+		}
+	}
+	for _, v := range m.validators {
+		if err := v(ctx, p); err != nil {
+			if errors.Is(err, ErrInvalid) {
+				return err
+			}
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+	return nil
+}
+
+// Of returns the profile of user.
+func Of(user *models.User) (*Profile, error) {
+	p := &Profile{
+		UserID:      user.ID,
+		GivenName:   user.GivenName,
+		FamilyName:  user.FamilyName,
+		DisplayName: user.DisplayName,
+		Picture:     user.Picture,
+		Locale:      user.Locale,
+		Timezone:    user.Timezone,
+		Phone:       user.Phone,
+		Metadata:    map[string]any{},
+		AppMetadata: map[string]any{},
+	}
+	if user.Metadata != "" {
+		if err := json.Unmarshal([]byte(user.Metadata), &p.Metadata); err != nil {
+			return nil, err
+		}
+	}
+	if user.AppMetadata != "" {
+		if err := json.Unmarshal([]byte(user.AppMetadata), &p.AppMetadata); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// to copies p to user.
+func (p *Profile) to(user *models.User) error {
+	metadata, err := json.Marshal(p.Metadata)
+	if err != nil {
+		return err
+	}
+	appMetadata, err := json.Marshal(p.AppMetadata)
+	if err != nil {
+		return err
+	}
+	user.GivenName = p.GivenName
+	user.FamilyName = p.FamilyName
+	user.DisplayName = p.DisplayName
+	user.Picture = p.Picture
+	user.Locale = p.Locale
+	user.Timezone = p.Timezone
+	user.Phone = p.Phone
+	user.Metadata = string(metadata)
+	user.AppMetadata = string(appMetadata)
+	return nil
+}
+
+// apply applies u to p and returns the names of the fields it changes.
+func (p *Profile) apply(u Update) []string {
+	var fields []string
+	set := func(field string, dst *string, v *string) {
+		if v != nil && *dst != strings.TrimSpace(*v) {
+			*dst = strings.TrimSpace(*v)
+			fields = append(fields, field)
+		}
+	}
+	set("given_name", &p.GivenName, u.GivenName)
+	set("family_name", &p.FamilyName, u.FamilyName)
+	set("display_name", &p.DisplayName, u.DisplayName)
+	set("picture", &p.Picture, u.Picture)
+	set("locale", &p.Locale, u.Locale)
+	set("timezone", &p.Timezone, u.Timezone)
+	set("phone_number", &p.Phone, u.Phone)
+	if merge(p.Metadata, u.Metadata) {
+		fields = append(fields, "metadata")
+	}
+	if merge(p.AppMetadata, u.AppMetadata) {
+		fields = append(fields, "app_metadata")
+	}
+	return fields
+}
+
+// merge merges src into dst, removing the keys set to nil, and reports
+// whether dst changed.
+func merge(dst, src map[string]any) bool {
+	if len(src) == 0 {
+		return false
+	}
+	before := maps.Clone(dst)
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		dst[k] = v
+	}
+	a, _ := json.Marshal(before)
+	b, _ := json.Marshal(dst)
+	return string(a) != string(b)
+}
@@ -0,0 +1,176 @@
+package profile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ptr(s string) *string { return &s }
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	users := testdb.New[models.User]()
+	user := models.User{ID: uuid.New(), Email: "jon@doe.com", GivenName: "Jon"}
+	require.NoError(t, users.Save(user))
+	bus := events.New()
+	var mu sync.Mutex
+	var updates []events.Event
+	bus.After(events.ProfileUpdated, func(ctx context.Context, e events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		updates = append(updates, e)
+		return nil
+	})
+	m := New(users, WithEvents(bus), WithMaxMetadataSize(64),
+		WithValidator(Schema(map[string]Field{
+			"theme":    {Kind: String, Enum: []string{"light", "dark"}},
+			"tags":     {Kind: List, MaxLength: 2},
+			"newbie":   {Kind: Bool},
+			"settings": {Kind: Object},
+		})),
+		WithValidator(AppSchema(map[string]Field{
+			"plan": {Kind: String, Required: true},
+		})),
+	)
+
+	t.Run("Get", func(t *testing.T) {
+		p, err := m.Get(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, "Jon", p.GivenName)
+		assert.NotNil(t, p.Metadata)
+		_, err = m.Get(ctx, uuid.New())
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		p, err := m.Update(ctx, user.ID, Update{
+			FamilyName:  ptr(" Doe "),
+			Locale:      ptr("en-gb"),
+			Timezone:    ptr("Europe/London"),
+			Phone:       ptr("+44 20 7946 0958"),
+			Picture:     ptr("https://example.com/jon.png"),
+			Metadata:    map[string]any{"theme": "dark", "newbie": true},
+			AppMetadata: map[string]any{"plan": "pro"},
+		}, "")
+		require.NoError(t, err)
+		assert.Equal(t, "Doe", p.FamilyName)
+		assert.Equal(t, "en-GB", p.Locale)
+		assert.Equal(t, "+442079460958", p.Phone)
+
+		// metadata is merged, null removes a key
+		p, err = m.Update(ctx, user.ID, Update{GivenName: ptr(""), Metadata: map[string]any{"newbie": nil}}, "")
+		require.NoError(t, err)
+		assert.Empty(t, p.GivenName)
+		assert.Equal(t, map[string]any{"theme": "dark"}, p.Metadata)
+		assert.Equal(t, map[string]any{"plan": "pro"}, p.AppMetadata)
+
+		stored, err := m.Get(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, p, stored)
+
+		bus.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, updates, 2)
+		assert.Contains(t, []any{updates[0].Data["fields"], updates[1].Data["fields"]}, []string{"given_name", "metadata"})
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		for name, u := range map[string]Update{
+			"locale":      {Locale: ptr("not a locale!")},
+			"timezone":    {Timezone: ptr("Mars/Olympus")},
+			"phone":       {Phone: ptr("020 7946 0958")},
+			"picture":     {Picture: ptr("javascript:alert(1)")},
+			"name":        {DisplayName: ptr(strings.Repeat("a", 257))},
+			"unknown key": {Metadata: map[string]any{"color": "red"}},
+			"kind":        {Metadata: map[string]any{"theme": 1.0}},
+			"enum":        {Metadata: map[string]any{"theme": "blue"}},
+			"max length":  {Metadata: map[string]any{"tags": []any{"a", "b", "c"}}},
+			"required":    {AppMetadata: map[string]any{"plan": nil}},
+			"size":        {Metadata: map[string]any{"settings": map[string]any{"a": strings.Repeat("a", 64)}}},
+		} {
+			_, err := m.Update(ctx, user.ID, u, "")
+			assert.ErrorIs(t, err, ErrInvalid, name)
+		}
+		p, err := m.Get(ctx, user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"theme": "dark"}, p.Metadata)
+	})
+
+	t.Run("Veto", func(t *testing.T) {
+		bus.Before(events.ProfileUpdated, func(ctx context.Context, e events.Event) error {
+			return errors.New("profiles are frozen")
+		})
+		_, err := m.Update(ctx, user.ID, Update{DisplayName: ptr("jd")}, "")
+		assert.ErrorIs(t, err, events.ErrVetoed)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	users := testdb.New[models.User]()
+	user := models.User{ID: uuid.New(), Email: "jon@doe.com"}
+	require.NoError(t, users.Save(user))
+	m := New(users)
+	s := sessions.New(testdb.New[sessions.Record](), session.NewJWTSession())
+	w := httptest.NewRecorder()
+	_, err := s.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), user.ID, user.Email, "password")
+	require.NoError(t, err)
+	access := w.Header().Get("Auth-Token")
+	admin := uuid.NewString()
+
+	r := chi.NewRouter()
+	r.Mount("/profile", m.Handler(s))
+	r.Mount("/users/{id}/profile", m.AdminHandler(func(*http.Request) string { return admin }))
+	request := func(method, target, tok, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if tok != "" {
+			req.Header.Set("Authorization", "Bearer "+tok)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) Profile {
+		var res struct {
+			Data Profile `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		return res.Data
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/profile", "", "").Code)
+	res := request(http.MethodPatch, "/profile", access, `{"display_name":"jd","metadata":{"theme":"dark"}}`)
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "jd", decode(res).DisplayName)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPatch, "/profile", access, `{"timezone":"nowhere"}`).Code)
+	// users can't change their app metadata
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPatch, "/profile", access, `{"app_metadata":{"plan":"pro"}}`).Code)
+
+	res = request(http.MethodPatch, "/users/"+user.ID.String()+"/profile", "", `{"app_metadata":{"plan":"pro"}}`)
+	require.Equal(t, http.StatusOK, res.Code)
+	p := decode(res)
+	assert.Equal(t, "dark", p.Metadata["theme"])
+	assert.Equal(t, "pro", p.AppMetadata["plan"])
+	assert.Equal(t, http.StatusNotFound, request(http.MethodGet, "/users/"+uuid.NewString()+"/profile", "", "").Code)
+
+	// and don't see it
+	res = request(http.MethodGet, "/profile", access, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.NotContains(t, res.Body.String(), "app_metadata")
+}
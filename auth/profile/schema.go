@@ -0,0 +1,98 @@
+package profile
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+// Kind is the JSON type of a metadata field.
+type Kind string
+
+const (
+	String Kind = "string"
+	Number Kind = "number"
+	Bool   Kind = "boolean"
+	Object Kind = "object"
+	List   Kind = "array"
+)
+
+// Field describes a metadata field of a Schema.
+type Field struct {
+	Kind Kind
+	// Required fields must be set for any update of the profile to
+	// succeed.
+	Required bool
+	// MaxLength is the maximum length of strings and lists, unlimited
+	// when 0.
+	MaxLength int
+	// Enum lists the values strings can take, any when empty.
+	Enum []string
+}
+
+// Schema returns a Validator checking that Metadata only has the given
+// fields, of the right kind.
+func Schema(fields map[string]Field) Validator {
+	return func(ctx context.Context, p *Profile) error {
+		return check("metadata", p.Metadata, fields)
+	}
+}
+
+// AppSchema is Schema for AppMetadata.
+func AppSchema(fields map[string]Field) Validator {
+	return func(ctx context.Context, p *Profile) error {
+		return check("app_metadata", p.AppMetadata, fields)
+	}
+}
+
+func check(name string, meta map[string]any, fields map[string]Field) error {
+	for key := range meta {
+		if _, ok := fields[key]; !ok {
+			return fmt.Errorf("%s.%s is not a known field", name, key)
+		}
+	}
+	for key, f := range fields {
+		v, ok := meta[key]
+		if !ok {
+			if f.Required {
+				return fmt.Errorf("%s.%s is required", name, key)
+			}
+			continue
+		}
+		if kindOf(v) != f.Kind {
+			return fmt.Errorf("%s.%s must be of type %s", name, key, f.Kind)
+		}
+		length := -1
+		switch v := v.(type) {
+		case string:
+			length = utf8.RuneCountInString(v)
+			if len(f.Enum) > 0 && !slices.Contains(f.Enum, v) {
+				return fmt.Errorf("%s.%s must be one of %v", name, key, f.Enum)
+			}
+		case []any:
+			length = len(v)
+		}
+		if f.MaxLength > 0 && length > f.MaxLength {
+			return fmt.Errorf("%s.%s is longer than %d", name, key, f.MaxLength)
+		}
+	}
+	return nil
+}
+
+// kindOf returns the kind of a JSON decoded value.
+func kindOf(v any) Kind {
+	switch v.(type) {
+	case string:
+		return String
+	case float64, int, int64:
+		return Number
+	case bool:
+		return Bool
+	case map[string]any:
+		return Object
+	case []any:
+		return List
+	}
+	return ""
+}
@@ -0,0 +1,486 @@
+// Package ldap signs users in against an LDAP directory or Active
+// Directory: the provider searches the user with a service account, then
+// binds as the user with the password to check it.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	goldap "github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/utilities"
+)
+
+var (
+	errInvalidCredentials = errors.New("ldap: your username or password maybe incorrect")
+	errNoEmail            = errors.New("ldap: the directory entry has no email address")
+	errNotProvisioned     = errors.New("ldap: the user doesn't exist")
+	errUnavailable        = errors.New("ldap: the directory is unavailable")
+)
+
+const name = "ldap"
+
+type Option func(*ldapProviderConfig)
+
+// Attributes names the directory attributes user fields are read from,
+// the first one present is used.
+type Attributes struct {
+	Email       []string
+	GivenName   []string
+	FamilyName  []string
+	DisplayName []string
+	// MemberOf lists the groups of the user, as set by Active Directory
+	// and the memberof overlay of OpenLDAP.
+	MemberOf string
+}
+
+type ldapProviderConfig struct {
+	url           string
+	start_tls     bool
+	tls_config    *tls.Config
+	bind_dn       string
+	bind_password string
+	base_dn       string
+	user_filter   string
+	group_base_dn string
+	group_filter  string
+	attributes    Attributes
+	group_roles   map[string][]string
+	acl           *acl.ACL
+	pool_size     int
+	timeout       time.Duration
+	provision     bool
+	success       func(w http.ResponseWriter, status_code int, data interface{})
+	error         func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int)
+}
+
+// WithURL sets the directory to connect to, e.g. ldap://dc1.example.com
+// or ldaps://dc1.example.com:636.
+func WithURL(u string) Option {
+	return func(c *ldapProviderConfig) {
+		c.url = u
+	}
+}
+
+// WithStartTLS upgrades ldap:// connections to TLS before binding. config
+// may be nil, the server name is taken from the url when it isn't set.
+func WithStartTLS(config *tls.Config) Option {
+	return func(c *ldapProviderConfig) {
+		c.start_tls = true
+		if config != nil {
+			c.tls_config = config
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of ldaps:// connections, e.g.
+// to trust the CA of the directory.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(c *ldapProviderConfig) {
+		c.tls_config = config
+	}
+}
+
+// WithBindCredentials sets the service account users are searched with,
+// searches are anonymous without one.
+func WithBindCredentials(dn, password string) Option {
+	return func(c *ldapProviderConfig) {
+		c.bind_dn = dn
+		c.bind_password = password
+	}
+}
+
+// WithBaseDN sets the subtree users are searched in.
+func WithBaseDN(dn string) Option {
+	return func(c *ldapProviderConfig) {
+		c.base_dn = dn
+	}
+}
+
+// WithUserFilter sets the filter users are searched with, {username} is
+// replaced by the escaped username. The default matches uid, mail,
+// sAMAccountName and userPrincipalName.
+func WithUserFilter(filter string) Option {
+	return func(c *ldapProviderConfig) {
+		c.user_filter = filter
+	}
+}
+
+// WithGroupSearch reads the groups of users by searching filter below
+// baseDN instead of from their memberOf attribute, for directories
+// without it. {dn} and {username} are replaced by the escaped dn and
+// username of the user, e.g. (member={dn}).
+func WithGroupSearch(baseDN, filter string) Option {
+	return func(c *ldapProviderConfig) {
+		c.group_base_dn = baseDN
+		c.group_filter = filter
+	}
+}
+
+// WithAttributes sets the attributes user fields are read from. The
+// defaults cover Active Directory and inetOrgPerson.
+func WithAttributes(a Attributes) Option {
+	return func(c *ldapProviderConfig) {
+		c.attributes = a
+	}
+}
+
+// WithGroupRole grants role to the members of the group groupDN. Roles
+// are synced with WithACL on every login: they are bound while the user
+// is in a group granting them and unbound once it isn't.
+func WithGroupRole(groupDN string, role string) Option {
+	return func(c *ldapProviderConfig) {
+		c.group_roles[groupDN] = append(c.group_roles[groupDN], role)
+	}
+}
+
+// WithACL sets the ACL roles granted with WithGroupRole are bound in.
+func WithACL(a *acl.ACL) Option {
+	return func(c *ldapProviderConfig) {
+		c.acl = a
+	}
+}
+
+// WithPoolSize sets how many idle service connections are kept, 4 by
+// default.
+func WithPoolSize(n int) Option {
+	return func(c *ldapProviderConfig) {
+		c.pool_size = n
+	}
+}
+
+// WithTimeout sets how long connecting and each request may take, 10
+// seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(c *ldapProviderConfig) {
+		c.timeout = d
+	}
+}
+
+// WithoutProvisioning rejects users that don't exist yet, instead of
+// creating them on their first login.
+func WithoutProvisioning() Option {
+	return func(c *ldapProviderConfig) {
+		c.provision = false
+	}
+}
+
+func LDAPProvider(opts ...Option) *providers.Provider {
+	cfg := &ldapProviderConfig{
+		url: "ldap://localhost:389",
+		user_filter: "(&(objectClass=person)(|(uid={username})(mail={username})" +
+			"(sAMAccountName={username})(userPrincipalName={username})))",
+		attributes: Attributes{
+			Email:       []string{"mail", "userPrincipalName"},
+			GivenName:   []string{"givenName"},
+			FamilyName:  []string{"sn"},
+			DisplayName: []string{"displayName", "cn"},
+			MemberOf:    "memberOf",
+		},
+		group_roles: map[string][]string{},
+		pool_size:   4,
+		timeout:     dialTimeout,
+		provision:   true,
+		success: func(w http.ResponseWriter, status_code int, data interface{}) {
+			utilities.JSON(w).SetStatus(utilities.ResponseSuccess).
+				SetStatusCode(status_code).SetData(data).Send()
+		},
+		error: func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int) {
+			utilities.JSON(w).SetStatus(status).SetStatusCode(status_code).
+				SetMessage(err.Error()).Send()
+		},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	conns := newPool(cfg.pool_size, cfg.dial)
+	return &providers.Provider{
+		Name: name,
+		AMR:  []string{sessions.AMRPassword},
+		Init: func(r chi.Router, ctx *providers.ProviderConfig) {
+			r.Post("/authorize", func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Username string `json:"username"`
+					Password string `json:"password"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
+				// an empty password would be an unauthenticated bind,
+				// which directories accept
+				if body.Username == "" || body.Password == "" {
+					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
+					return
+				}
+				entry, groups, err := cfg.authenticate(conns, body.Username, body.Password)
+				if err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Username, err.Error()))
+					if errors.Is(err, errUnavailable) {
+						cfg.error(w, utilities.ResponseError, err, http.StatusServiceUnavailable)
+						return
+					}
+					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
+					return
+				}
+				user, status, err := cfg.login(w, r, ctx, body.Username, entry, groups)
+				if err != nil {
+					cfg.error(w, utilities.ResponseFail, err, status)
+					return
+				}
+				cfg.success(w, http.StatusOK, user)
+			})
+		},
+	}
+}
+
+// authenticate searches the entry of username and binds as it with
+// password, returning the entry and the dns of its groups.
+func (c *ldapProviderConfig) authenticate(conns *pool, username, password string) (*goldap.Entry, []string, error) {
+	conn, err := conns.get()
+	if err != nil {
+		return nil, nil, errors.Join(errUnavailable, err)
+	}
+	entry, err := c.search(conn, username)
+	if err != nil {
+		c.release(conns, conn, false)
+		return nil, nil, err
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		c.release(conns, conn, true)
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+			return nil, nil, errInvalidCredentials
+		}
+		return nil, nil, errors.Join(errUnavailable, err)
+	}
+	// groups are read with the service account, users may not be
+	// allowed to
+	if err := c.bindService(conn); err != nil {
+		conn.Close()
+		return nil, nil, errors.Join(errUnavailable, err)
+	}
+	groups, err := c.groups(conn, username, entry)
+	c.release(conns, conn, false)
+	if err != nil {
+		return nil, nil, errors.Join(errUnavailable, err)
+	}
+	return entry, groups, nil
+}
+
+// release returns conn to the pool, binding it as the service account
+// again first when rebind is set.
+func (c *ldapProviderConfig) release(conns *pool, conn *goldap.Conn, rebind bool) {
+	if rebind {
+		if err := c.bindService(conn); err != nil {
+			conn.Close()
+			return
+		}
+	}
+	conns.put(conn)
+}
+
+// search returns the single entry matching username.
+func (c *ldapProviderConfig) search(conn *goldap.Conn, username string) (*goldap.Entry, error) {
+	attrs := []string{c.attributes.MemberOf}
+	for _, names := range [][]string{c.attributes.Email, c.attributes.GivenName,
+		c.attributes.FamilyName, c.attributes.DisplayName} {
+		attrs = append(attrs, names...)
+	}
+	filter := strings.ReplaceAll(c.user_filter, "{username}", goldap.EscapeFilter(username))
+	res, err := conn.Search(goldap.NewSearchRequest(
+		c.base_dn, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		2, int(c.timeout.Seconds()), false, filter, attrs, nil,
+	))
+	if err != nil {
+		if goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+			return nil, errInvalidCredentials
+		}
+		return nil, errors.Join(errUnavailable, err)
+	}
+	// an ambiguous username matches nobody
+	if len(res.Entries) != 1 {
+		return nil, errInvalidCredentials
+	}
+	return res.Entries[0], nil
+}
+
+// groups returns the dns of the groups of entry.
+func (c *ldapProviderConfig) groups(conn *goldap.Conn, username string, entry *goldap.Entry) ([]string, error) {
+	if c.group_filter == "" {
+		return entry.GetEqualFoldAttributeValues(c.attributes.MemberOf), nil
+	}
+	filter := strings.NewReplacer(
+		"{dn}", goldap.EscapeFilter(entry.DN),
+		"{username}", goldap.EscapeFilter(username),
+	).Replace(c.group_filter)
+	res, err := conn.Search(goldap.NewSearchRequest(
+		c.group_base_dn, goldap.ScopeWholeSubtree, goldap.NeverDerefAliases,
+		0, int(c.timeout.Seconds()), false, filter, []string{"dn"}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]string, 0, len(res.Entries))
+	for _, e := range res.Entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// login signs in the user of entry, creating it when it doesn't exist
+// yet and updating its name and roles from the directory.
+func (c *ldapProviderConfig) login(w http.ResponseWriter, r *http.Request, ctx *providers.ProviderConfig,
+	username string, entry *goldap.Entry, groups []string) (*models.User, int, error) {
+	email := models.NormalizeEmail(attribute(entry, c.attributes.Email...))
+	if email == "" {
+		ctx.Events.Publish(r.Context(), failedLogin(r, username, errNoEmail.Error()))
+		return nil, http.StatusBadRequest, errNoEmail
+	}
+	now := time.Now().UTC()
+	user, err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", email)).First()
+	if err != nil {
+		if !c.provision {
+			ctx.Events.Publish(r.Context(), failedLogin(r, email, "unknown user"))
+			return nil, http.StatusForbidden, errNotProvisioned
+		}
+		// the directory vouches for the address of its users
+		user = &models.User{
+			ID:              uuid.New(),
+			Email:           email,
+			EmailVerified:   true,
+			EmailVerifiedAt: now,
+			CreatedAt:       now,
+		}
+		c.profile(user, entry)
+		e := newEvent(r, events.UserRegistered, user)
+		if err := ctx.Events.Check(r.Context(), e); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+		if err := ctx.User.WithContext(r.Context()).Save(*user); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		ctx.Events.Publish(r.Context(), e)
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		ctx.Events.Publish(r.Context(), failedLogin(r, email, err.Error()))
+		return nil, http.StatusForbidden, fmt.Errorf("ldap: %w", err)
+	}
+	e := newEvent(r, events.LoginSucceeded, user)
+	if err := ctx.Events.Check(r.Context(), e); err != nil {
+		ctx.Events.Publish(r.Context(), events.LoginRejected(e, err))
+		return nil, http.StatusForbidden, err
+	}
+	if err := c.syncRoles(r.Context(), user, groups); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	c.profile(user, entry)
+	user.LastLogin = now.Unix()
+	if err := ctx.NewSession(w, r, user, name, sessions.AMRPassword); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("id", user.ID)).
+		Update(*user); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	ctx.Events.Publish(r.Context(), e)
+	return user, http.StatusOK, nil
+}
+
+// syncRoles binds the roles the groups of user grant and unbinds the
+// other roles granted with WithGroupRole. Roles bound otherwise are left
+// alone.
+func (c *ldapProviderConfig) syncRoles(ctx context.Context, user *models.User, groups []string) error {
+	if c.acl == nil || len(c.group_roles) == 0 {
+		return nil
+	}
+	granted := map[string]bool{}
+	for groupDN, roles := range c.group_roles {
+		member := false
+		for _, g := range groups {
+			if sameDN(g, groupDN) {
+				member = true
+				break
+			}
+		}
+		for _, role := range roles {
+			granted[role] = granted[role] || member
+		}
+	}
+	s := acl.Subject{Kind: acl.User, ID: user.ID.String()}
+	for role, ok := range granted {
+		if ok {
+			if err := c.acl.Bind(ctx, s, role); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.acl.Unbind(ctx, s, role); err != nil && !errors.Is(err, acl.ErrBindingMissing) {
+			return err
+		}
+	}
+	return nil
+}
+
+// profile sets the name fields of user from the attributes entry has.
+func (c *ldapProviderConfig) profile(user *models.User, entry *goldap.Entry) {
+	if v := attribute(entry, c.attributes.GivenName...); v != "" {
+		user.GivenName = v
+	}
+	if v := attribute(entry, c.attributes.FamilyName...); v != "" {
+		user.FamilyName = v
+	}
+	if v := attribute(entry, c.attributes.DisplayName...); v != "" {
+		user.DisplayName = v
+	}
+}
+
+// attribute returns the first value of the first of names entry has.
+func attribute(entry *goldap.Entry, names ...string) string {
+	for _, n := range names {
+		if v := entry.GetEqualFoldAttributeValue(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// sameDN compares dns as the directory does, ignoring case and spacing.
+func sameDN(a, b string) bool {
+	x, err := goldap.ParseDN(a)
+	if err != nil {
+		return strings.EqualFold(a, b)
+	}
+	y, err := goldap.ParseDN(b)
+	if err != nil {
+		return strings.EqualFold(a, b)
+	}
+	return x.EqualFold(y)
+}
+
+func newEvent(r *http.Request, t events.Type, user *models.User) events.Event {
+	e := events.FromRequest(r, t, name)
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	return e
+}
+
+func failedLogin(r *http.Request, username, reason string) events.Event {
+	e := events.FromRequest(r, events.LoginFailed, name)
+	e.Email = username
+	e.Reason = reason
+	return e
+}
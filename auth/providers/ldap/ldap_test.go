@@ -0,0 +1,433 @@
+package ldap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-chi/chi/v5"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	baseDN    = "dc=example,dc=com"
+	serviceDN = "cn=svc,ou=services,dc=example,dc=com"
+	jonDN     = "uid=jon,ou=people,dc=example,dc=com"
+	adminsDN  = "cn=admins,ou=groups,dc=example,dc=com"
+)
+
+// entry is an entry of the stub directory.
+type entry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// directory is an in-process LDAP server answering bind, search,
+// StartTLS and unbind requests, enough for search-then-bind logins.
+type directory struct {
+	mu      sync.Mutex
+	entries []*entry
+	tls     *tls.Config
+	dials   atomic.Int32
+	ln      net.Listener
+}
+
+func newDirectory(t *testing.T, ldaps bool) *directory {
+	d := &directory{tls: serverTLS(t)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if ldaps {
+		ln = tls.NewListener(ln, d.tls)
+	}
+	d.ln = ln
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			d.dials.Add(1)
+			go d.serve(conn)
+		}
+	}()
+	d.add(serviceDN, "secret", nil)
+	d.add(jonDN, "winter", map[string][]string{
+		"objectClass": {"person", "inetOrgPerson"},
+		"uid":         {"jon"},
+		"mail":        {"Jon@Example.com"},
+		"givenName":   {"Jon"},
+		"sn":          {"Snow"},
+		"memberOf":    {"CN=Admins,OU=Groups,DC=example,DC=com"},
+	})
+	return d
+}
+
+func (d *directory) add(dn, password string, attrs map[string][]string) *entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := &entry{dn: dn, password: password, attrs: attrs}
+	d.entries = append(d.entries, e)
+	return e
+}
+
+func (d *directory) url(scheme string) string {
+	return scheme + "://" + d.ln.Addr().String()
+}
+
+func (d *directory) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value.(int64)
+		op := p.Children[1]
+		switch op.Tag {
+		case ber.Tag(0): // bind
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			code := int64(49)
+			if dn == "" && password == "" {
+				code = 0
+			} else if e := d.find(dn); e != nil && password != "" && e.password == password {
+				code = 0
+			}
+			if code == 0 {
+				bound = dn
+			}
+			d.send(conn, id, result(1, code))
+		case ber.Tag(2): // unbind
+			return
+		case ber.Tag(3): // search
+			// only the service account may search
+			if bound != serviceDN {
+				d.send(conn, id, result(5, 50))
+				continue
+			}
+			base := op.Children[0].Value.(string)
+			limit := op.Children[3].Value.(int64)
+			code, n := int64(0), int64(0)
+			for _, e := range d.search(base, op.Children[6]) {
+				if limit > 0 && n == limit {
+					code = 4
+					break
+				}
+				d.send(conn, id, e.packet())
+				n++
+			}
+			d.send(conn, id, result(5, code))
+		case ber.Tag(23): // StartTLS
+			d.send(conn, id, result(24, 0))
+			tlsConn := tls.Server(conn, d.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+		default:
+			return
+		}
+	}
+}
+
+func (d *directory) find(dn string) *entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, e := range d.entries {
+		if strings.EqualFold(e.dn, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (d *directory) search(base string, filter *ber.Packet) []*entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var res []*entry
+	for _, e := range d.entries {
+		if strings.HasSuffix(strings.ToLower(e.dn), strings.ToLower(base)) && e.match(filter) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// match evaluates the and, or, not, equality and presence filters.
+func (e *entry) match(f *ber.Packet) bool {
+	switch f.Tag {
+	case 0:
+		for _, c := range f.Children {
+			if !e.match(c) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, c := range f.Children {
+			if e.match(c) {
+				return true
+			}
+		}
+		return false
+	case 2:
+		return !e.match(f.Children[0])
+	case 3:
+		for _, v := range e.values(f.Children[0].Value.(string)) {
+			if strings.EqualFold(v, f.Children[1].Value.(string)) {
+				return true
+			}
+		}
+		return false
+	case 7:
+		return len(e.values(f.Data.String())) > 0
+	}
+	return false
+}
+
+func (e *entry) values(attr string) []string {
+	for k, v := range e.attrs {
+		if strings.EqualFold(k, attr) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (e *entry) packet() *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, 4, nil, "")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, ""))
+	attrs := ber.NewSequence("")
+	for k, vs := range e.attrs {
+		attr := ber.NewSequence("")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, k, ""))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		for _, v := range vs {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, ""))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+func result(tag ber.Tag, code int64) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return p
+}
+
+func (d *directory) send(conn net.Conn, id int64, op *ber.Packet) {
+	p := ber.NewSequence("")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	p.AppendChild(op)
+	_, _ = conn.Write(p.Bytes())
+}
+
+// serverTLS returns a self-signed certificate for 127.0.0.1.
+func serverTLS(t *testing.T) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func clientTLS(d *directory) *tls.Config {
+	cert, _ := x509.ParseCertificate(d.tls.Certificates[0].Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{RootCAs: roots}
+}
+
+func TestProvider(t *testing.T) {
+	d := newDirectory(t, false)
+	users := testdb.New[models.User]()
+	a, err := acl.New(acl.WithRole("admin", "*"), acl.WithRole("support", "users:read"),
+		acl.WithBindings(testdb.New[acl.Binding]()))
+	require.NoError(t, err)
+	router := func(opts ...Option) http.Handler {
+		p := LDAPProvider(append([]Option{
+			WithURL(d.url("ldap")),
+			WithBindCredentials(serviceDN, "secret"),
+			WithBaseDN(baseDN),
+			WithACL(a),
+			WithGroupRole(adminsDN, "admin"),
+		}, opts...)...)
+		r := chi.NewRouter()
+		p.Init(r, &providers.ProviderConfig{
+			User:    users,
+			Session: session.NewJWTSession(),
+			Events:  events.New(),
+		})
+		return r
+	}
+	login := func(h http.Handler, username, password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/authorize", bytes.NewReader(body)))
+		return w
+	}
+	h := router()
+	jon := func() *models.User {
+		user, err := users.Query(database.WithFilter("email", "jon@example.com")).First()
+		require.NoError(t, err)
+		return user
+	}
+	roles := func() []string {
+		roles, err := a.Roles(context.Background(), acl.Subject{Kind: acl.User, ID: jon().ID.String()})
+		require.NoError(t, err)
+		return roles
+	}
+
+	t.Run("Authorize", func(t *testing.T) {
+		w := login(h, "jon", "winter")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("Auth-Token"))
+		user := jon()
+		assert.True(t, user.EmailVerified)
+		assert.Equal(t, "Jon", user.GivenName)
+		assert.Equal(t, "Snow", user.FamilyName)
+		assert.Equal(t, []string{"admin"}, roles())
+
+		// the user is found by any of its names
+		assert.Equal(t, http.StatusOK, login(h, "jon@example.com", "winter").Code)
+		// searches and binds share a single pooled connection
+		assert.EqualValues(t, 1, d.dials.Load())
+	})
+
+	t.Run("Invalid Credentials", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, login(h, "jon", "summer").Code)
+		assert.Equal(t, http.StatusBadRequest, login(h, "jon", "").Code)
+		assert.Equal(t, http.StatusBadRequest, login(h, "arya", "winter").Code)
+		// filters can't be injected
+		assert.Equal(t, http.StatusBadRequest, login(h, "*", "winter").Code)
+		// the connection is bound as the service account again
+		assert.Equal(t, http.StatusOK, login(h, "jon", "winter").Code)
+	})
+
+	t.Run("Ambiguous", func(t *testing.T) {
+		d.add("uid=jon,ou=contractors,dc=example,dc=com", "winter", map[string][]string{
+			"objectClass": {"person"}, "uid": {"jon"}, "mail": {"jon@contractor.com"},
+		})
+		defer func() {
+			d.mu.Lock()
+			d.entries = d.entries[:len(d.entries)-1]
+			d.mu.Unlock()
+		}()
+		assert.Equal(t, http.StatusBadRequest, login(h, "jon", "winter").Code)
+	})
+
+	t.Run("Role Sync", func(t *testing.T) {
+		s := acl.Subject{Kind: acl.User, ID: jon().ID.String()}
+		require.NoError(t, a.Bind(context.Background(), s, "support"))
+		e := d.find(jonDN)
+		d.mu.Lock()
+		e.attrs["memberOf"] = nil
+		d.mu.Unlock()
+		require.Equal(t, http.StatusOK, login(h, "jon", "winter").Code)
+		// roles bound otherwise are kept
+		assert.Equal(t, []string{"support"}, roles())
+
+		// groups can be searched instead
+		d.add(adminsDN, "", map[string][]string{"objectClass": {"groupOfNames"}, "member": {jonDN}})
+		h := router(WithGroupSearch("ou=groups,"+baseDN, "(&(objectClass=groupOfNames)(member={dn}))"))
+		require.Equal(t, http.StatusOK, login(h, "jon", "winter").Code)
+		assert.ElementsMatch(t, []string{"admin", "support"}, roles())
+	})
+
+	t.Run("Provisioning", func(t *testing.T) {
+		d.add("uid=arya,ou=people,dc=example,dc=com", "needle", map[string][]string{
+			"objectClass": {"person"}, "uid": {"arya"}, "mail": {"arya@example.com"},
+		})
+		assert.Equal(t, http.StatusForbidden, login(router(WithoutProvisioning()), "arya", "needle").Code)
+
+		user := jon()
+		user.Status = models.StatusBanned
+		require.NoError(t, users.Query(database.WithFilter("id", user.ID)).Update(*user))
+		assert.Equal(t, http.StatusForbidden, login(h, "jon", "winter").Code)
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		h := router(WithURL("ldap://127.0.0.1:1"), WithTimeout(time.Second))
+		assert.Equal(t, http.StatusServiceUnavailable, login(h, "jon", "winter").Code)
+	})
+}
+
+func TestTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		ldaps  bool
+		option func(*directory) Option
+		url    string
+	}{
+		{"LDAPS", true, func(d *directory) Option { return WithTLSConfig(clientTLS(d)) }, "ldaps"},
+		{"StartTLS", false, func(d *directory) Option { return WithStartTLS(clientTLS(d)) }, "ldap"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newDirectory(t, tc.ldaps)
+			p := LDAPProvider(WithURL(d.url(tc.url)), WithBindCredentials(serviceDN, "secret"),
+				WithBaseDN(baseDN), tc.option(d))
+			r := chi.NewRouter()
+			p.Init(r, &providers.ProviderConfig{
+				User:    testdb.New[models.User](),
+				Session: session.NewJWTSession(),
+				Events:  events.New(),
+			})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/authorize",
+				strings.NewReader(`{"username":"jon","password":"winter"}`)))
+			assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+			// an untrusted certificate is refused
+			p = LDAPProvider(WithURL(d.url(tc.url)), WithBindCredentials(serviceDN, "secret"),
+				WithBaseDN(baseDN), WithStartTLS(nil))
+			if tc.ldaps {
+				p = LDAPProvider(WithURL(d.url(tc.url)), WithBindCredentials(serviceDN, "secret"),
+					WithBaseDN(baseDN))
+			}
+			r = chi.NewRouter()
+			p.Init(r, &providers.ProviderConfig{User: testdb.New[models.User](), Session: session.NewJWTSession()})
+			w = httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/authorize",
+				strings.NewReader(`{"username":"jon","password":"winter"}`)))
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		})
+	}
+}
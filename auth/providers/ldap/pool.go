@@ -0,0 +1,94 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+// pool keeps connections bound as the service account, to search the
+// directory without dialing and binding for every login.
+type pool struct {
+	conns chan *goldap.Conn
+	dial  func() (*goldap.Conn, error)
+}
+
+func newPool(size int, dial func() (*goldap.Conn, error)) *pool {
+	return &pool{conns: make(chan *goldap.Conn, size), dial: dial}
+}
+
+// get returns an idle connection, or a new one when there is none.
+func (p *pool) get() (*goldap.Conn, error) {
+	for {
+		select {
+		case conn := <-p.conns:
+			if conn.IsClosing() {
+				continue
+			}
+			return conn, nil
+		default:
+			return p.dial()
+		}
+	}
+}
+
+// put returns conn to the pool, closing it when the pool is full.
+func (p *pool) put(conn *goldap.Conn) {
+	if conn.IsClosing() {
+		return
+	}
+	select {
+	case p.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// dial connects to the directory, upgrading the connection with
+// StartTLS when it is enabled, and binds as the service account.
+func (c *ldapProviderConfig) dial() (*goldap.Conn, error) {
+	conn, err := goldap.DialURL(c.url,
+		goldap.DialWithDialer(&net.Dialer{Timeout: c.timeout}),
+		goldap.DialWithTLSConfig(c.tls_config),
+	)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(c.timeout)
+	if c.start_tls {
+		tlsConfig := &tls.Config{}
+		if c.tls_config != nil {
+			tlsConfig = c.tls_config.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			if u, err := url.Parse(c.url); err == nil {
+				tlsConfig.ServerName = u.Hostname()
+			}
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := c.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// bindService binds conn as the service account, searches are anonymous
+// without one.
+func (c *ldapProviderConfig) bindService(conn *goldap.Conn) error {
+	if c.bind_dn == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(c.bind_dn, c.bind_password)
+}
+
+// dialTimeout is how long connecting and each request may take by
+// default.
+const dialTimeout = 10 * time.Second
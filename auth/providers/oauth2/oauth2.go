@@ -8,6 +8,8 @@ import (
 	"strings"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neghi-go/iam/auth/events"
 	"github.com/neghi-go/iam/auth/providers"
 	"github.com/neghi-go/utilities"
 )
@@ -112,6 +114,12 @@ func newOauthProvider(name string, opts ...OauthOptions) *providers.Provider {
 	return &providers.Provider{
 		Name: name,
 		Init: func(r chi.Router, ctx *providers.ProviderConfig) {
+			failed := func(w http.ResponseWriter, r *http.Request, reason string, status utilities.ResponseStatus, code int) {
+				e := events.FromRequest(r, events.LoginFailed, name)
+				e.Reason = reason
+				ctx.Events.Publish(r.Context(), e)
+				utilities.JSON(w).SetStatus(status).SetStatusCode(code).SetMessage(reason).Send()
+			}
 			r.Get("/authorize", func(w http.ResponseWriter, r *http.Request) {
 				var buf bytes.Buffer
 				url := strings.Split(r.RequestURI, "/")
@@ -141,20 +149,60 @@ func newOauthProvider(name string, opts ...OauthOptions) *providers.Provider {
 
 				res, err := http.PostForm(cfg.endpoint.token_url, v)
 				if err != nil {
-					utilities.JSON(w).SetStatus(utilities.ResponseError).
-						SetStatusCode(http.StatusInternalServerError).SetMessage(err.Error()).Send()
+					failed(w, r, err.Error(), utilities.ResponseError, http.StatusInternalServerError)
 					return
 				}
 
 				defer res.Body.Close()
 
+				if res.StatusCode < 200 || res.StatusCode > 299 {
+					reason := "token endpoint: " + res.Status
+					var body struct {
+						Error string `json:"error"`
+					}
+					if json.NewDecoder(res.Body).Decode(&body) == nil && body.Error != "" {
+						reason += ": " + body.Error
+					}
+					failed(w, r, reason, utilities.ResponseFail, http.StatusBadRequest)
+					return
+				}
 				var response map[string]interface{}
 				if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
-					utilities.JSON(w).SetStatus(utilities.ResponseError).SetStatusCode(http.StatusBadRequest).Send()
+					failed(w, r, err.Error(), utilities.ResponseError, http.StatusBadRequest)
 					return
 				}
+				e := events.FromRequest(r, events.LoginSucceeded, name)
+				identify(&e, response)
+				if err := ctx.Events.Check(r.Context(), e); err != nil {
+					ctx.Events.Publish(r.Context(), events.LoginRejected(e, err))
+					utilities.JSON(w).SetStatus(utilities.ResponseFail).SetStatusCode(http.StatusForbidden).
+						SetMessage(err.Error()).Send()
+					return
+				}
+				ctx.Events.Publish(r.Context(), e)
 				utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).SetData(response).Send()
 			})
 		},
 	}
 }
+
+// identify sets the user of e from the id_token of an OpenID Connect
+// token response, when there is one. It was received from the token
+// endpoint itself, which OpenID Connect accepts in place of checking
+// its signature.
+func identify(e *events.Event, response map[string]interface{}) {
+	raw, ok := response["id_token"].(string)
+	if !ok {
+		return
+	}
+	tok, err := jwt.ParseInsecure([]byte(raw))
+	if err != nil {
+		return
+	}
+	if email, ok := tok.PrivateClaims()["email"].(string); ok {
+		e.Email = email
+	}
+	if tok.Subject() != "" {
+		e.Data = map[string]any{"subject": tok.Subject()}
+	}
+}
@@ -0,0 +1,79 @@
+package oauth2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallback(t *testing.T) {
+	idToken, err := jwt.NewBuilder().Subject("1234").Claim("email", "jon@doe.com").Build()
+	require.NoError(t, err)
+	signed, err := jwt.Sign(idToken, jwt.WithKey(jwa.HS256, []byte("secret")))
+	require.NoError(t, err)
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"access_token": "abc", "id_token": string(signed)})
+	}))
+	defer srv.Close()
+
+	bus := events.New()
+	var mu sync.Mutex
+	var published []events.Event
+	bus.After(events.All, func(ctx context.Context, e events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		published = append(published, e)
+		return nil
+	})
+	router := chi.NewRouter()
+	newOauthProvider("test", withEndpoint(srv.URL, "https://example.com/auth")).
+		Init(router, &providers.ProviderConfig{Events: bus})
+	callback := func() (int, events.Event) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/callback?code=xyz&state=abc", nil))
+		bus.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.NotEmpty(t, published)
+		return w.Code, published[len(published)-1]
+	}
+
+	code, e := callback()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, events.LoginSucceeded, e.Type)
+	assert.Equal(t, "jon@doe.com", e.Email)
+	assert.Equal(t, "1234", e.Data["subject"])
+
+	status = http.StatusBadRequest
+	code, e = callback()
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, events.LoginFailed, e.Type)
+	assert.Contains(t, e.Reason, "invalid_grant")
+
+	status = http.StatusOK
+	bus.Before(events.LoginSucceeded, func(ctx context.Context, e events.Event) error {
+		return errors.New("blocked")
+	})
+	code, e = callback()
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Equal(t, events.LoginFailed, e.Type)
+	assert.Equal(t, "jon@doe.com", e.Email)
+}
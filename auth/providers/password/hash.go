@@ -0,0 +1,353 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	errMismatchedHash  = errors.New("password: password does not match hash")
+	errUnsupportedHash = errors.New("password: unsupported password hash")
+)
+
+// Hasher hashes passwords into PHC formatted strings
+// ($<id>$<params>$<salt>$<hash>), embedding the salt and the parameters
+// so hashes stay verifiable after the parameters are changed.
+type Hasher interface {
+	// ID is the PHC identifier of the algorithm e.g argon2id.
+	ID() string
+	Hash(password string) (string, error)
+	// Verify returns nil when password matches encoded.
+	Verify(password, encoded string) error
+	// NeedsRehash reports whether encoded was produced with parameters
+	// other than the hasher's current ones.
+	NeedsRehash(encoded string) bool
+}
+
+// WithHasher sets the hasher used for new passwords. Stored hashes of the
+// other built-in algorithms remain verifiable and are upgraded to the
+// hasher on the next successful login.
+func WithHasher(h Hasher) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.hash = h
+	}
+}
+
+// verify checks password against an encoded hash and reports whether the
+// hash should be replaced with one from the current hasher. salt is only
+// used by hashes produced before PHC strings were stored.
+func (c *passwordProviderConfig) verify(password, salt, encoded string) (bool, error) {
+	if encoded == "" {
+		return false, errMismatchedHash
+	}
+	if isLegacy(encoded) {
+		if err := verifyLegacy(password, encoded); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if !strings.HasPrefix(encoded, "$") {
+		if err := verifyLegacyArgon(password, salt, encoded); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	id := phcID(encoded)
+	h := c.hasher(id)
+	if h == nil {
+		return false, errUnsupportedHash
+	}
+	if err := h.Verify(password, encoded); err != nil {
+		return false, err
+	}
+	return h.ID() != c.hash.ID() || c.hash.NeedsRehash(encoded), nil
+}
+
+func (c *passwordProviderConfig) hasher(id string) Hasher {
+	if id == c.hash.ID() {
+		return c.hash
+	}
+	switch id {
+	case "argon2id":
+		return NewArgon2Hasher(0, 0, 0)
+	case "scrypt":
+		return NewScryptHasher(0, 0, 0)
+	case "2a", "2b", "2y":
+		return NewBcryptHasher(0)
+	}
+	return nil
+}
+
+// SupportedHash reports whether encoded is a hash the provider can
+// verify, either from one of the built-in hashers or a legacy format.
+func SupportedHash(encoded string) bool {
+	if isLegacy(encoded) {
+		return checkLegacy(encoded) == nil
+	}
+	switch id := phcID(encoded); id {
+	case "argon2id", "scrypt":
+		_, _, _, err := parsePHC(encoded, id)
+		return err == nil
+	case "2a", "2b", "2y":
+		return checkBcrypt(encoded) == nil
+	}
+	return false
+}
+
+func phcID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[1]
+}
+
+// phcBounds are the ranges accepted for the parameters of stored hashes,
+// so that a corrupt or hostile hash can't crash the server or make it
+// spend gigabytes of memory on a login.
+var phcBounds = map[string]map[string][2]uint32{
+	"argon2id": {"m": {8, 1 << 20}, "t": {1, 64}, "p": {1, 255}},
+	"scrypt":   {"ln": {1, 24}, "r": {1, 64}, "p": {1, 64}},
+}
+
+const (
+	minKeyLen = 16
+	maxKeyLen = 128
+	maxSalt   = 128
+	// maxScryptMemory bounds the 128*r*2^ln bytes scrypt allocates.
+	maxScryptMemory = 1 << 30
+	maxBcryptCost   = 16
+)
+
+// parsePHC splits $id$[v=version$]params$salt$hash, returning the
+// parameters as a map once they are checked against phcBounds.
+func parsePHC(encoded, id string) (map[string]string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(encoded, "$"), "$")
+	if len(parts) > 0 && parts[0] == id && len(parts) == 5 {
+		// drop the version segment
+		parts = append(parts[:1], parts[2:]...)
+	}
+	if len(parts) != 4 || parts[0] != id {
+		return nil, nil, nil, errUnsupportedHash
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Split(parts[1], ",") {
+		k, v, _ := strings.Cut(p, "=")
+		params[k] = v
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, nil, errUnsupportedHash
+	}
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(salt) > maxSalt || len(hash) < minKeyLen || len(hash) > maxKeyLen {
+		return nil, nil, nil, errUnsupportedHash
+	}
+	for k, b := range phcBounds[id] {
+		v, err := strconv.ParseUint(params[k], 10, 32)
+		if err != nil || uint32(v) < b[0] || uint32(v) > b[1] {
+			return nil, nil, nil, errUnsupportedHash
+		}
+	}
+	if id == "scrypt" && 128*uint64(param(params, "r"))<<param(params, "ln") > maxScryptMemory {
+		return nil, nil, nil, errUnsupportedHash
+	}
+	return params, salt, hash, nil
+}
+
+// checkBcrypt rejects bcrypt hashes too costly to verify.
+func checkBcrypt(encoded string) error {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil || cost > maxBcryptCost {
+		return errUnsupportedHash
+	}
+	return nil
+}
+
+func param(params map[string]string, key string) uint32 {
+	var v uint32
+	_, _ = fmt.Sscan(params[key], &v)
+	return v
+}
+
+func salt(length int) []byte {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return buf
+}
+
+type argonHasher struct {
+	time    uint32
+	memory  uint32 // in KiB
+	threads uint8
+	key_len uint32
+}
+
+// NewArgon2Hasher returns an argon2id hasher, zero values default to
+// the OWASP recommendation of 19 MiB of memory, 2 iterations and 1
+// thread.
+func NewArgon2Hasher(time, memory uint32, threads uint8) Hasher {
+	h := &argonHasher{time: 2, memory: 19 * 1024, threads: 1, key_len: 32}
+	if time > 0 {
+		h.time = time
+	}
+	if memory > 0 {
+		h.memory = memory
+	}
+	if threads > 0 {
+		h.threads = threads
+	}
+	return h
+}
+
+func (a *argonHasher) ID() string { return "argon2id" }
+
+func (a *argonHasher) Hash(password string) (string, error) {
+	s := salt(16)
+	key := argon2.IDKey([]byte(password), s, a.time, a.memory, a.threads, a.key_len)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, a.memory, a.time, a.threads,
+		base64.RawStdEncoding.EncodeToString(s), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argonHasher) Verify(password, encoded string) error {
+	params, s, hash, err := parsePHC(encoded, a.ID())
+	if err != nil {
+		return err
+	}
+	key := argon2.IDKey([]byte(password), s, param(params, "t"), param(params, "m"),
+		uint8(param(params, "p")), uint32(len(hash)))
+	if subtle.ConstantTimeCompare(key, hash) != 1 {
+		return errMismatchedHash
+	}
+	return nil
+}
+
+func (a *argonHasher) NeedsRehash(encoded string) bool {
+	params, _, hash, err := parsePHC(encoded, a.ID())
+	if err != nil {
+		return true
+	}
+	return !strings.Contains(encoded, fmt.Sprintf("$v=%d$", argon2.Version)) ||
+		param(params, "m") != a.memory || param(params, "t") != a.time ||
+		param(params, "p") != uint32(a.threads) || uint32(len(hash)) != a.key_len
+}
+
+// verifyLegacyArgon verifies the raw base64 argon2id hashes stored with
+// a separate salt before hashes were PHC encoded.
+func verifyLegacyArgon(password, salt, encoded string) error {
+	key := argon2.IDKey([]byte(password), []byte(salt), 2, 19*1024, 1, 32)
+	if subtle.ConstantTimeCompare([]byte(base64.RawStdEncoding.EncodeToString(key)), []byte(encoded)) != 1 {
+		return errMismatchedHash
+	}
+	return nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a bcrypt hasher, a zero cost defaults to
+// bcrypt.DefaultCost. bcrypt hashes keep their modular crypt format
+// ($2a$<cost>$...) which is already self describing.
+func NewBcryptHasher(cost int) Hasher {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return &bcryptHasher{cost: cost}
+}
+
+func (b *bcryptHasher) ID() string { return "2a" }
+
+func (b *bcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func (b *bcryptHasher) Verify(password, encoded string) error {
+	if err := checkBcrypt(encoded); err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password)); err != nil {
+		return errMismatchedHash
+	}
+	return nil
+}
+
+func (b *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != b.cost
+}
+
+type scryptHasher struct {
+	log_n   uint32
+	r, p    uint32
+	key_len int
+}
+
+// NewScryptHasher returns a scrypt hasher with a cost of 2^logN, zero
+// values default to logN=15, r=8, p=1.
+func NewScryptHasher(logN, r, p uint32) Hasher {
+	h := &scryptHasher{log_n: 15, r: 8, p: 1, key_len: 32}
+	if logN > 0 {
+		h.log_n = logN
+	}
+	if r > 0 {
+		h.r = r
+	}
+	if p > 0 {
+		h.p = p
+	}
+	return h
+}
+
+func (s *scryptHasher) ID() string { return "scrypt" }
+
+func (s *scryptHasher) Hash(password string) (string, error) {
+	sa := salt(16)
+	key, err := scrypt.Key([]byte(password), sa, 1<<s.log_n, int(s.r), int(s.p), s.key_len)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s", s.log_n, s.r, s.p,
+		base64.RawStdEncoding.EncodeToString(sa), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (s *scryptHasher) Verify(password, encoded string) error {
+	params, sa, hash, err := parsePHC(encoded, s.ID())
+	if err != nil {
+		return err
+	}
+	key, err := scrypt.Key([]byte(password), sa, 1<<param(params, "ln"), int(param(params, "r")),
+		int(param(params, "p")), len(hash))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(key, hash) != 1 {
+		return errMismatchedHash
+	}
+	return nil
+}
+
+func (s *scryptHasher) NeedsRehash(encoded string) bool {
+	params, _, hash, err := parsePHC(encoded, s.ID())
+	if err != nil {
+		return true
+	}
+	return param(params, "ln") != s.log_n || param(params, "r") != s.r ||
+		param(params, "p") != s.p || len(hash) != s.key_len
+}
@@ -0,0 +1,153 @@
+package password
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHashers(t *testing.T) {
+	hashers := []Hasher{
+		NewArgon2Hasher(1, 1024, 1),
+		NewBcryptHasher(4),
+		NewScryptHasher(10, 8, 1),
+	}
+	for _, h := range hashers {
+		t.Run(h.ID(), func(t *testing.T) {
+			encoded, err := h.Hash("Password1234")
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(encoded, "$"+h.ID()+"$"))
+
+			assert.NoError(t, h.Verify("Password1234", encoded))
+			assert.ErrorIs(t, h.Verify("Password5678", encoded), errMismatchedHash)
+			assert.False(t, h.NeedsRehash(encoded))
+		})
+	}
+
+	t.Run("PHC Format", func(t *testing.T) {
+		encoded, err := NewArgon2Hasher(3, 2048, 2).Hash("Password1234")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=2048,t=3,p=2$"))
+	})
+}
+
+func TestRehash(t *testing.T) {
+	cfg := &passwordProviderConfig{hash: NewArgon2Hasher(1, 1024, 1)}
+
+	t.Run("Current Parameters", func(t *testing.T) {
+		encoded, _ := cfg.hash.Hash("Password1234")
+		rehash, err := cfg.verify("Password1234", "", encoded)
+		require.NoError(t, err)
+		assert.False(t, rehash)
+	})
+
+	t.Run("Outdated Parameters", func(t *testing.T) {
+		encoded, _ := NewArgon2Hasher(1, 512, 1).Hash("Password1234")
+		rehash, err := cfg.verify("Password1234", "", encoded)
+		require.NoError(t, err)
+		assert.True(t, rehash)
+	})
+
+	t.Run("Other Algorithm", func(t *testing.T) {
+		encoded, _ := NewBcryptHasher(4).Hash("Password1234")
+		rehash, err := cfg.verify("Password1234", "", encoded)
+		require.NoError(t, err)
+		assert.True(t, rehash)
+	})
+
+	t.Run("Legacy Salted Hash", func(t *testing.T) {
+		key := argon2.IDKey([]byte("Password1234"), []byte("salt"), 2, 19*1024, 1, 32)
+		rehash, err := cfg.verify("Password1234", "salt", base64.RawStdEncoding.EncodeToString(key))
+		require.NoError(t, err)
+		assert.True(t, rehash)
+
+		_, err = cfg.verify("Password5678", "salt", base64.RawStdEncoding.EncodeToString(key))
+		assert.Error(t, err)
+	})
+}
+
+func TestLegacyHashes(t *testing.T) {
+	cfg := &passwordProviderConfig{hash: NewArgon2Hasher(1, 1024, 1)}
+	hashes := map[string]string{
+		"Django PBKDF2":     "pbkdf2_sha256$1000$seasalt$C9OeutuPdUw6LMRV02FmILwQ91h66owcCyxxOpmefko=",
+		"Salted SHA-1":      "sha1$abc$e79d29f40317a4e2e118a739f5e5c76c9e5cdc29",
+		"Salted MD5 Suffix": "md5$xyz$5932e2379568ce42465266bde447bff7",
+		"bcrypt From Auth0": mustHash(t, NewBcryptHasher(4)),
+		"scrypt":            mustHash(t, NewScryptHasher(10, 8, 1)),
+	}
+	for name, encoded := range hashes {
+		t.Run(name, func(t *testing.T) {
+			assert.True(t, SupportedHash(encoded))
+			rehash, err := cfg.verify("Password1234", "", encoded)
+			require.NoError(t, err)
+			assert.True(t, rehash)
+
+			_, err = cfg.verify("Password5678", "", encoded)
+			assert.Error(t, err)
+		})
+	}
+	assert.False(t, SupportedHash("sha512$abc$def"))
+}
+
+func TestHashBounds(t *testing.T) {
+	cfg := &passwordProviderConfig{hash: NewArgon2Hasher(1, 1024, 1)}
+	s := base64.RawStdEncoding.EncodeToString([]byte("saltsaltsaltsalt"))
+	key := base64.RawStdEncoding.EncodeToString(make([]byte, 32))
+	for name, encoded := range map[string]string{
+		"argon2 No Iterations":  "$argon2id$v=19$m=1024,t=0,p=1$" + s + "$" + key,
+		"argon2 No Threads":     "$argon2id$v=19$m=1024,t=1,p=0$" + s + "$" + key,
+		"argon2 Memory":         "$argon2id$v=19$m=4294967295,t=1,p=1$" + s + "$" + key,
+		"argon2 Missing":        "$argon2id$v=19$m=1024,t=1$" + s + "$" + key,
+		"argon2 Short Key":      "$argon2id$v=19$m=1024,t=1,p=1$" + s + "$" + base64.RawStdEncoding.EncodeToString([]byte("short")),
+		"argon2 Key Length":     "$argon2id$v=19$m=1024,t=1,p=1$" + s + "$" + base64.RawStdEncoding.EncodeToString(make([]byte, 4096)),
+		"scrypt Cost":           "$scrypt$ln=40,r=8,p=1$" + s + "$" + key,
+		"scrypt Memory":         "$scrypt$ln=24,r=64,p=1$" + s + "$" + key,
+		"scrypt No Parallelism": "$scrypt$ln=10,r=8,p=0$" + s + "$" + key,
+		"bcrypt Cost":           "$2a$31$" + strings.Repeat("a", 53),
+		"PBKDF2 Iterations":     "pbkdf2_sha256$999999999$seasalt$C9OeutuPdUw6LMRV02FmILwQ91h66owcCyxxOpmefko=",
+		"PBKDF2 Digest Length":  "pbkdf2_sha256$1000$seasalt$" + base64.StdEncoding.EncodeToString(make([]byte, 65)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.False(t, SupportedHash(encoded))
+			_, err := cfg.verify("Password1234", "", encoded)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	t.Run("CSV", func(t *testing.T) {
+		records, err := readRecords(strings.NewReader("email,password,email_verified\n"+
+			"jon@doe.com,md5$xyz$5932e2379568ce42465266bde447bff7,true\n"), CSV)
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "jon@doe.com", records[0].Email)
+		assert.True(t, records[0].EmailVerified)
+		assert.Equal(t, "md5$xyz$5932e2379568ce42465266bde447bff7", records[0].PasswordHash)
+	})
+
+	t.Run("Newline Delimited JSON", func(t *testing.T) {
+		records, err := readRecords(strings.NewReader(`{"email":"jon@doe.com","passwordHash":"$2b$10$abc"}`+"\n"+
+			`{"email":"jane@doe.com","email_verified":true}`), JSON)
+		require.NoError(t, err)
+		require.Len(t, records, 2)
+		assert.Equal(t, "$2b$10$abc", records[0].PasswordHashAlt)
+		assert.True(t, records[1].EmailVerified)
+	})
+
+	t.Run("JSON Array", func(t *testing.T) {
+		records, err := readRecords(strings.NewReader(` [{"email":"jon@doe.com"}]`), JSON)
+		require.NoError(t, err)
+		assert.Len(t, records, 1)
+	})
+}
+
+func mustHash(t *testing.T, h Hasher) string {
+	encoded, err := h.Hash("Password1234")
+	require.NoError(t, err)
+	return encoded
+}
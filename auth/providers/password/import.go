@@ -0,0 +1,196 @@
+package password
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+var errUnknownFormat = errors.New("password: unknown import format")
+
+type Format string
+
+const (
+	// CSV expects a header row naming the columns email, email_verified
+	// and password_hash (or password, as in Django exports).
+	CSV Format = "csv"
+	// JSON accepts an array of objects or newline delimited objects, as
+	// produced by Auth0 user exports, with the fields email,
+	// email_verified and password_hash (or passwordHash).
+	JSON Format = "json"
+)
+
+// ImportRecord is a single user read from an export.
+type ImportRecord struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	PasswordHash  string `json:"password_hash"`
+	// PasswordHashAlt holds the camel cased field used by Auth0 exports.
+	PasswordHashAlt string `json:"passwordHash"`
+}
+
+type ImportResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+type ImportError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email,omitempty"`
+	Error string `json:"error"`
+}
+
+// Import creates a user for every record of the export read from r.
+// Records whose email already exists are skipped, records with a hash
+// the provider can't verify are reported as errors. Imported hashes are
+// replaced with the provider's hasher on the user's first login.
+func Import(ctx context.Context, user database.Model[models.User], r io.Reader, format Format) (*ImportResult, error) {
+	records, err := readRecords(r, format)
+	if err != nil {
+		return nil, err
+	}
+	res := &ImportResult{}
+	for i, rec := range records {
+		line := i + 1
+		if format == CSV {
+			// account for the header row
+			line++
+		}
+		email := models.NormalizeEmail(rec.Email)
+		hash := rec.PasswordHash
+		if hash == "" {
+			hash = rec.PasswordHashAlt
+		}
+		if email == "" {
+			res.Errors = append(res.Errors, ImportError{Line: line, Error: "missing email"})
+			continue
+		}
+		if hash != "" && !SupportedHash(hash) {
+			res.Errors = append(res.Errors, ImportError{Line: line, Email: email, Error: errUnsupportedHash.Error()})
+			continue
+		}
+		if _, err := user.WithContext(ctx).Query(database.WithFilter("email", email)).First(); err == nil {
+			res.Skipped++
+			continue
+		}
+		u := models.User{
+			ID:                uuid.New(),
+			Email:             email,
+			EmailVerified:     rec.EmailVerified,
+			Password:          hash,
+			PasswordUpdatedOn: time.Now().UTC(),
+			CreatedAt:         time.Now().UTC(),
+		}
+		if rec.EmailVerified {
+			u.EmailVerifiedAt = time.Now().UTC()
+		}
+		if err := user.WithContext(ctx).Save(u); err != nil {
+			res.Errors = append(res.Errors, ImportError{Line: line, Email: email, Error: err.Error()})
+			continue
+		}
+		res.Imported++
+	}
+	return res, nil
+}
+
+func readRecords(r io.Reader, format Format) ([]ImportRecord, error) {
+	switch format {
+	case CSV:
+		return readCSV(r)
+	case JSON:
+		return readJSON(r)
+	default:
+		return nil, errUnknownFormat
+	}
+}
+
+func readCSV(r io.Reader) ([]ImportRecord, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, fmt.Errorf("password: csv header is missing the email column")
+	}
+	get := func(row []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+		}
+		return ""
+	}
+
+	var res []ImportRecord
+	for _, row := range rows[1:] {
+		verified, _ := strconv.ParseBool(get(row, "email_verified"))
+		res = append(res, ImportRecord{
+			Email:         get(row, "email"),
+			EmailVerified: verified,
+			PasswordHash:  get(row, "password_hash", "password"),
+		})
+	}
+	return res, nil
+}
+
+func readJSON(r io.Reader) ([]ImportRecord, error) {
+	br := bufio.NewReader(r)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []ImportRecord
+	if first == '[' {
+		if err := json.NewDecoder(br).Decode(&res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	dec := json.NewDecoder(br)
+	for {
+		var rec ImportRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return res, nil
+			}
+			return nil, err
+		}
+		res = append(res, rec)
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		if len(bytes.TrimSpace(b)) > 0 {
+			return b[0], nil
+		}
+		_, _ = r.ReadByte()
+	}
+}
@@ -0,0 +1,131 @@
+package password
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Legacy hashes imported from other systems. They are only ever
+// verified, a successful login replaces them with a hash of the
+// current hasher.
+//
+//	pbkdf2_sha256$<iterations>$<salt>$<base64 hash>   Django
+//	pbkdf2_sha1$<iterations>$<salt>$<base64 hash>     Django
+//	sha1$<salt>$<hex digest>                           salted SHA-1
+//	md5$<salt>$<hex digest>                            salted MD5
+//
+// The digest of salted SHA-1 and MD5 hashes is computed over the salt
+// followed by the password, as Django does, or the password followed
+// by the salt, as many PHP applications did. bcrypt hashes exported
+// from Auth0 or PHP's password_hash are handled by the bcrypt hasher.
+var legacyHashes = map[string]func(password string, parts []string) bool{
+	"pbkdf2_sha256": func(password string, parts []string) bool {
+		return verifyPBKDF2(sha256.New, sha256.Size, password, parts)
+	},
+	"pbkdf2_sha1": func(password string, parts []string) bool {
+		return verifyPBKDF2(sha1.New, sha1.Size, password, parts)
+	},
+	"sha1": func(password string, parts []string) bool {
+		return verifySalted(sha1.New, password, parts)
+	},
+	"md5": func(password string, parts []string) bool {
+		return verifySalted(md5.New, password, parts)
+	},
+}
+
+// isLegacy reports whether encoded is in one of the legacy formats.
+func isLegacy(encoded string) bool {
+	id, _, ok := strings.Cut(encoded, "$")
+	_, known := legacyHashes[id]
+	return ok && known
+}
+
+// maxPBKDF2Iterations bounds the iterations of imported PBKDF2 hashes,
+// above the 1.2 million Django uses but low enough that a hostile hash
+// can't tie up the server on every login.
+const maxPBKDF2Iterations = 5_000_000
+
+// maxPBKDF2Digest bounds the length of the digests of imported PBKDF2
+// hashes, which are derived again to the same length on every login.
+const maxPBKDF2Digest = 64
+
+// checkLegacy rejects legacy hashes too costly to verify.
+func checkLegacy(encoded string) error {
+	parts := strings.Split(encoded, "$")
+	if !strings.HasPrefix(parts[0], "pbkdf2_") {
+		return nil
+	}
+	if len(parts) != 4 || !validIterations(parts[1]) {
+		return errUnsupportedHash
+	}
+	if _, ok := pbkdf2Digest(parts[3]); !ok {
+		return errUnsupportedHash
+	}
+	return nil
+}
+
+func validIterations(s string) bool {
+	iterations, err := strconv.Atoi(s)
+	return err == nil && iterations >= 1 && iterations <= maxPBKDF2Iterations
+}
+
+func verifyLegacy(password, encoded string) error {
+	parts := strings.Split(encoded, "$")
+	verify, ok := legacyHashes[parts[0]]
+	if !ok {
+		return errUnsupportedHash
+	}
+	if !verify(password, parts[1:]) {
+		return errMismatchedHash
+	}
+	return nil
+}
+
+func verifyPBKDF2(h func() hash.Hash, size int, password string, parts []string) bool {
+	if len(parts) != 3 || !validIterations(parts[0]) {
+		return false
+	}
+	iterations, _ := strconv.Atoi(parts[0])
+	expected, ok := pbkdf2Digest(parts[2])
+	if !ok {
+		return false
+	}
+	key := pbkdf2.Key([]byte(password), []byte(parts[1]), iterations, max(len(expected), size), h)
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// pbkdf2Digest decodes the digest of a PBKDF2 hash, reporting false
+// when it is invalid or longer than maxPBKDF2Digest.
+func pbkdf2Digest(s string) ([]byte, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	return decoded, err == nil && len(decoded) > 0 && len(decoded) <= maxPBKDF2Digest
+}
+
+func verifySalted(h func() hash.Hash, password string, parts []string) bool {
+	if len(parts) != 2 {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.ToLower(parts[1]))
+	if err != nil {
+		return false
+	}
+	salt := parts[0]
+	prefixed := digest(h, salt+password)
+	suffixed := digest(h, password+salt)
+	return subtle.ConstantTimeCompare(prefixed, expected)|subtle.ConstantTimeCompare(suffixed, expected) == 1
+}
+
+func digest(h func() hash.Hash, value string) []byte {
+	d := h()
+	d.Write([]byte(value))
+	return d.Sum(nil)
+}
@@ -0,0 +1,148 @@
+package password
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+var (
+	errLocked          = errors.New("password: account is temporarily locked")
+	errTooManyAttempts = errors.New("password: too many failed attempts, try again later")
+)
+
+type lockoutConfig struct {
+	max_attempts  int           // failed logins before the account is locked
+	duration      time.Duration // how long the account stays locked
+	delay         time.Duration // base of the progressive delay between failed logins
+	delay_after   int           // failed logins tolerated before delays kick in
+	ip_attempts   int           // failed logins allowed from a single ip within ip_window
+	ip_window     time.Duration
+	token_attempt int // guesses allowed per verification or reset token
+}
+
+// WithLockout locks an account for duration after attempts consecutive
+// failed logins. After the third failure, logins are throttled with a
+// delay that doubles on each further failure, starting at delay.
+func WithLockout(attempts int, duration, delay time.Duration) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.lockout.max_attempts = attempts
+		ppc.lockout.duration = duration
+		ppc.lockout.delay = delay
+	}
+}
+
+// WithIPLimit rejects logins from an ip once it has failed attempts
+// times within window, regardless of the account targeted.
+func WithIPLimit(attempts int, window time.Duration) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.lockout.ip_attempts = attempts
+		ppc.lockout.ip_window = window
+	}
+}
+
+// WithTokenAttempts sets how many wrong guesses a verification or reset
+// token tolerates before it is invalidated.
+func WithTokenAttempts(attempts int) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.lockout.token_attempt = attempts
+	}
+}
+
+// retryError carries the time a client has to wait before retrying.
+type retryError struct {
+	err   error
+	after time.Duration
+}
+
+func (r *retryError) Error() string { return r.err.Error() }
+func (r *retryError) Unwrap() error { return r.err }
+
+// check returns a *retryError when the user is locked or has to wait
+// out the progressive delay of its previous failures.
+func (l lockoutConfig) check(user *models.User, now time.Time) error {
+	if now.Before(user.LockedUntil) {
+		return &retryError{err: errLocked, after: user.LockedUntil.Sub(now)}
+	}
+	if user.FailedLoginAttempt < max(l.delay_after, 1) || l.delay <= 0 {
+		return nil
+	}
+	next := user.LastFailedLogin.Add(l.backoff(user.FailedLoginAttempt - l.delay_after + 1))
+	if now.Before(next) {
+		return &retryError{err: errTooManyAttempts, after: next.Sub(now)}
+	}
+	return nil
+}
+
+func (l lockoutConfig) backoff(attempts int) time.Duration {
+	delay := l.delay
+	for i := 1; i < attempts && delay < l.duration; i++ {
+		delay *= 2
+	}
+	return min(delay, l.duration)
+}
+
+// fail records a failed login and reports whether it locked the account.
+func (l lockoutConfig) fail(user *models.User, now time.Time) bool {
+	user.FailedLoginAttempt++
+	user.LastFailedLogin = now
+	if l.max_attempts > 0 && user.FailedLoginAttempt >= l.max_attempts {
+		user.FailedLoginAttempt = 0
+		user.LockedUntil = now.Add(l.duration)
+		return true
+	}
+	return false
+}
+
+func (l lockoutConfig) reset(user *models.User) {
+	user.FailedLoginAttempt = 0
+	user.LastFailedLogin = time.Time{}
+	user.LockedUntil = time.Time{}
+	user.UnlockToken = ""
+	user.UnlockAttempt = 0
+	user.UnlockTokenExpiresAt = time.Time{}
+}
+
+func ipKey(r *http.Request) string {
+	return "password:failed:ip:" + events.ClientIP(r)
+}
+
+func (l lockoutConfig) checkIP(ctx context.Context, store storage.Storage, r *http.Request) error {
+	if l.ip_attempts <= 0 {
+		return nil
+	}
+	b, err := store.Get(ctx, ipKey(r))
+	if err != nil {
+		return nil
+	}
+	count, _ := strconv.Atoi(string(b))
+	if count >= l.ip_attempts {
+		return &retryError{err: errTooManyAttempts, after: l.ip_window}
+	}
+	return nil
+}
+
+func (l lockoutConfig) failIP(ctx context.Context, store storage.Storage, r *http.Request) {
+	if l.ip_attempts <= 0 {
+		return
+	}
+	_, _ = store.Incr(ctx, ipKey(r), l.ip_window)
+}
+
+func retryAfter(w http.ResponseWriter, err error) int {
+	var retry *retryError
+	if !errors.As(err, &retry) {
+		return http.StatusBadRequest
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retry.after.Seconds())+1))
+	if errors.Is(err, errLocked) {
+		return http.StatusLocked
+	}
+	return http.StatusTooManyRequests
+}
@@ -1,8 +1,6 @@
 package password
 
 import (
-	"crypto/subtle"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,10 +10,14 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/notify"
 	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/utilities"
-	"golang.org/x/crypto/argon2"
 )
 
 var (
@@ -26,6 +28,8 @@ var (
 	errMismatchPasswords  = errors.New("password: passwords do not match")
 )
 
+const name = "password"
+
 type Action string
 
 var (
@@ -35,21 +39,50 @@ var (
 	change Action = "change"
 )
 
+// purposes the stored token hashes are bound to
+const (
+	purposeVerify = "email_verify"
+	purposeReset  = "password_reset"
+	purposeUnlock = "account_unlock"
+)
+
 type PasswordProviderOptions func(*passwordProviderConfig)
 
 type passwordProviderConfig struct {
 	token_length int
 	token_expiry time.Duration
-	salt_length  int
+	token_format token.Format
+	tokens       *token.Hasher
 	hash         Hasher
-	notify       func(email, token string) error
+	lockout      lockoutConfig
+	policy       Policy
+	notify       notify.Notifier
 	success      func(w http.ResponseWriter, status_code int, data interface{})
 	error        func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int)
 }
 
-func WithNotifier(notify func(email, token string) error) PasswordProviderOptions {
+// WithNotifier sets how verification, reset and unlock codes are sent to
+// users. Messages are printed to stdout by default.
+func WithNotifier(n notify.Notifier) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.notify = n
+	}
+}
+
+// WithTokenSecret sets the key verification, reset and unlock tokens are
+// hashed with before they are stored. It must be shared by every
+// instance of the provider, a random key is used when it isn't set.
+func WithTokenSecret(secret string) PasswordProviderOptions {
 	return func(ppc *passwordProviderConfig) {
-		ppc.notify = notify
+		ppc.tokens = token.NewHasher([]byte(secret))
+	}
+}
+
+// WithTokenFormat sets whether tokens are sent as short numeric codes or
+// long random strings suited for links. Numeric codes are the default.
+func WithTokenFormat(format token.Format) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.token_format = format
 	}
 }
 
@@ -57,8 +90,18 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 	cfg := &passwordProviderConfig{
 		token_length: 6,
 		token_expiry: time.Hour, // 1 hour
-		salt_length:  16,        // length of generated password salt
-		hash:         &argonHasher{},
+		token_format: token.Numeric,
+		hash:         NewArgon2Hasher(0, 0, 0),
+		policy:       DefaultPolicy(),
+		lockout: lockoutConfig{
+			max_attempts:  5,
+			duration:      15 * time.Minute,
+			delay:         time.Second,
+			delay_after:   3,
+			ip_attempts:   50,
+			ip_window:     15 * time.Minute,
+			token_attempt: 5,
+		},
 		success: func(w http.ResponseWriter, status_code int, data interface{}) {
 			utilities.JSON(w).SetStatus(utilities.ResponseSuccess).
 				SetStatusCode(status_code).SetData(data).Send()
@@ -67,18 +110,46 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 			utilities.JSON(w).SetStatus(status).SetStatusCode(status_code).
 				SetMessage(err.Error()).Send()
 		},
-		notify: func(email, token string) error {
-			fmt.Printf("email: %v, token: %v\n", email, token)
-			return nil
-		},
+		notify: notify.Stdout,
 	}
 
 	for _, opt := range opts {
 		opt(cfg)
 	}
+	if cfg.tokens == nil {
+		cfg.tokens = token.NewHasher(nil)
+	}
 	return &providers.Provider{
-		Name: "password",
+		Name: name,
+		AMR:  []string{sessions.AMRPassword},
 		Init: func(r chi.Router, ctx *providers.ProviderConfig) {
+			store := ctx.Store
+			if store == nil {
+				store = storage.NewMemoryStorage()
+			}
+			// wrongPassword counts a wrong password of user against the
+			// lockout of the account and of the IP of r, sending an unlock
+			// token once the account locks.
+			wrongPassword := func(r *http.Request, user *models.User, now time.Time) error {
+				cfg.lockout.failIP(r.Context(), store, r)
+				locked := cfg.lockout.fail(user, now)
+				var unlockToken string
+				if locked {
+					unlockToken = cfg.newToken()
+					user.UnlockToken = cfg.tokens.Hash(purposeUnlock, unlockToken)
+					user.UnlockAttempt = 0
+					user.UnlockTokenExpiresAt = user.LockedUntil
+				}
+				if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+					Update(*user); err != nil {
+					return err
+				}
+				if !locked {
+					return nil
+				}
+				ctx.Events.Publish(r.Context(), newEvent(r, events.AccountLocked, user))
+				return cfg.send(r, notify.AccountUnlock, user.Email, unlockToken, user.UnlockTokenExpiresAt)
+			}
 			r.Post("/authorize", func(w http.ResponseWriter, r *http.Request) {
 				var body struct {
 					Email    string `json:"email"`
@@ -88,34 +159,81 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
 					return
 				}
+				body.Email = models.NormalizeEmail(body.Email)
+				if err := cfg.lockout.checkIP(r.Context(), store, r); err != nil {
+					cfg.error(w, utilities.ResponseFail, err, retryAfter(w, err))
+					return
+				}
 				//fetch user
 				user, err := ctx.User.WithContext(r.Context()).
 					Query(database.WithFilter("email", body.Email)).
 					First()
 				if err != nil {
+					cfg.lockout.failIP(r.Context(), store, r)
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, nil, "unknown user"))
 					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 					return
 				}
 
+				now := time.Now().UTC()
+				if err := cfg.lockout.check(user, now); err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, user, err.Error()))
+					cfg.error(w, utilities.ResponseFail, err, retryAfter(w, err))
+					return
+				}
+
+				if err := user.CheckStatus(now); err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, user, err.Error()))
+					cfg.error(w, utilities.ResponseFail, fmt.Errorf("password: %w", err), http.StatusForbidden)
+					return
+				}
+
 				//check if user email is verified
 				if !user.EmailVerified {
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, user, "email not verified"))
 					cfg.error(w, utilities.ResponseFail, errNotVerified, http.StatusBadRequest)
 					return
 				}
 
 				//validate Password
-				if err := cfg.hash.compare(body.Password, user.PasswordSalt, user.Password); err != nil {
+				rehash, err := cfg.verify(body.Password, user.PasswordSalt, user.Password)
+				if err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, user, "invalid password"))
+					if err := wrongPassword(r, user, now); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
 					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 					return
 				}
+				e := newEvent(r, events.LoginSucceeded, user)
+				if err := ctx.Events.Check(r.Context(), e); err != nil {
+					ctx.Events.Publish(r.Context(), events.LoginRejected(e, err))
+					cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+					return
+				}
+				if rehash {
+					hashed, err := cfg.hash.Hash(body.Password)
+					if err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					user.Password = hashed
+					user.PasswordSalt = ""
+				}
 				//update user last login
+				cfg.lockout.reset(user)
 				user.LastLogin = time.Now().UTC().Unix()
 				if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
 					Update(*user); err != nil {
 					cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
 					return
 				}
-				_ = ctx.Session.Generate(w, user.ID.String(), user.Email)
+				if err := ctx.NewSession(w, r, user, name, sessions.AMRPassword); err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
+				ctx.Events.Publish(r.Context(), e)
 				cfg.success(w, http.StatusOK, user)
 
 			})
@@ -131,6 +249,7 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
 					return
 				}
+				body.Email = models.NormalizeEmail(body.Email)
 
 				if body.Password != body.Repeat {
 					cfg.error(w, utilities.ResponseFail, errMismatchPasswords, http.StatusBadRequest)
@@ -152,7 +271,21 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						return
 					}
 
-					if user.EmailVerifyToken != body.Token {
+					if user.EmailVerifyAttempt >= cfg.lockout.token_attempt {
+						cfg.error(w, utilities.ResponseFail, errTooManyAttempts, http.StatusTooManyRequests)
+						return
+					}
+
+					if !cfg.tokens.Equal(purposeVerify, body.Token, user.EmailVerifyToken) {
+						user.EmailVerifyAttempt++
+						if user.EmailVerifyAttempt >= cfg.lockout.token_attempt {
+							user.EmailVerifyToken = ""
+						}
+						if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+							Update(*user); err != nil {
+							cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+							return
+						}
 						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
 						return
 					}
@@ -162,7 +295,14 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						return
 					}
 
+					e := newEvent(r, events.EmailVerified, user)
+					if err := ctx.Events.Check(r.Context(), e); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+						return
+					}
+
 					user.EmailVerifyToken = ""
+					user.EmailVerifyAttempt = 0
 					user.EmailVerifyTokenCreatedAt = time.Time{}
 					user.EmailVerifyTokenExpiresAt = time.Time{}
 					user.EmailVerified = true
@@ -172,6 +312,7 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
 						return
 					}
+					ctx.Events.Publish(r.Context(), e)
 					cfg.success(w, http.StatusOK, nil)
 					return
 				case resend:
@@ -190,7 +331,9 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						return
 					}
 
-					user.EmailVerifyToken = utilities.Generate(cfg.token_length)
+					verifyToken := cfg.newToken()
+					user.EmailVerifyToken = cfg.tokens.Hash(purposeVerify, verifyToken)
+					user.EmailVerifyAttempt = 0
 					user.EmailVerifyTokenCreatedAt = time.Now().UTC()
 					user.EmailVerifyTokenExpiresAt = time.Now().Add(time.Second * time.Duration(cfg.token_expiry.Seconds())).UTC()
 					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
@@ -198,26 +341,40 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
 						return
 					}
-					if err := cfg.notify(user.Email, user.EmailVerifyToken); err != nil {
+					if err := cfg.send(r, notify.EmailVerification, user.Email, verifyToken, user.EmailVerifyTokenExpiresAt); err != nil {
 						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
 						return
 					}
+					ctx.Events.Publish(r.Context(), newEvent(r, events.VerificationSent, user))
 					cfg.success(w, http.StatusOK, nil)
 					return
 				default:
 					//store validated user
+					verifyToken := cfg.newToken()
 					user := models.User{
 						ID:                        uuid.New(),
 						Email:                     body.Email,
-						EmailVerifyToken:          utilities.Generate(cfg.token_length),
+						EmailVerifyToken:          cfg.tokens.Hash(purposeVerify, verifyToken),
 						EmailVerifyTokenCreatedAt: time.Now().UTC(),
 						EmailVerifyTokenExpiresAt: time.Now().Add(time.Second * time.Duration(cfg.token_expiry.Seconds())).UTC(),
-
-						PasswordSalt: utilities.Generate(cfg.salt_length),
+						CreatedAt:                 time.Now().UTC(),
+					}
+					if err := cfg.policy.check(r.Context(), cfg, body.Password, &user); err != nil {
+						policyFailed(w, err)
+						return
+					}
+					e := newEvent(r, events.UserRegistered, &user)
+					if err := ctx.Events.Check(r.Context(), e); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+						return
 					}
 
 					//hash passwords
-					hashedPassword := cfg.hash.hash(body.Password, user.PasswordSalt)
+					hashedPassword, err := cfg.hash.Hash(body.Password)
+					if err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
 					user.Password = hashedPassword
 
 					//persist user data
@@ -226,14 +383,99 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						return
 					}
 
+					ctx.Events.Publish(r.Context(), e)
+
 					//send notification with token
-					if err := cfg.notify(user.Email, user.EmailVerifyToken); err != nil {
+					if err := cfg.send(r, notify.EmailVerification, user.Email, verifyToken, user.EmailVerifyTokenExpiresAt); err != nil {
 						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
 						return
 					}
+					ctx.Events.Publish(r.Context(), newEvent(r, events.VerificationSent, &user))
 					cfg.success(w, http.StatusCreated, nil)
 				}
 			})
+			r.Post("/unlock", func(w http.ResponseWriter, r *http.Request) {
+				action := Action(r.URL.Query().Get("action"))
+				var body struct {
+					Email string `json:"email"`
+					Token string `json:"token"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
+				body.Email = models.NormalizeEmail(body.Email)
+				// changing the password checks the current one, as
+				// guessable as a sign in
+				if action == change {
+					if err := cfg.lockout.checkIP(r.Context(), store, r); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, retryAfter(w, err))
+						return
+					}
+				}
+				user, err := ctx.User.WithContext(r.Context()).
+					Query(database.WithFilter("email", body.Email)).First()
+				if err != nil {
+					if action == change {
+						cfg.lockout.failIP(r.Context(), store, r)
+					}
+					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
+					return
+				}
+				now := time.Now().UTC()
+				if !now.Before(user.LockedUntil) {
+					cfg.success(w, http.StatusOK, nil)
+					return
+				}
+
+				switch action {
+				case verify:
+					if user.UnlockAttempt >= cfg.lockout.token_attempt {
+						cfg.error(w, utilities.ResponseFail, errTooManyAttempts, http.StatusTooManyRequests)
+						return
+					}
+					if !cfg.tokens.Equal(purposeUnlock, body.Token, user.UnlockToken) {
+						user.UnlockAttempt++
+						if user.UnlockAttempt >= cfg.lockout.token_attempt {
+							user.UnlockToken = ""
+						}
+						if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+							Update(*user); err != nil {
+							cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+							return
+						}
+						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
+						return
+					}
+					if now.After(user.UnlockTokenExpiresAt) {
+						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
+						return
+					}
+					cfg.lockout.reset(user)
+					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+						Update(*user); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					ctx.Events.Publish(r.Context(), newEvent(r, events.AccountUnlocked, user))
+					cfg.success(w, http.StatusOK, nil)
+				default:
+					unlockToken := cfg.newToken()
+					user.UnlockToken = cfg.tokens.Hash(purposeUnlock, unlockToken)
+					user.UnlockAttempt = 0
+					user.UnlockTokenExpiresAt = user.LockedUntil
+					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+						Update(*user); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					if err := cfg.send(r, notify.AccountUnlock, user.Email, unlockToken, user.UnlockTokenExpiresAt); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					cfg.success(w, http.StatusOK, nil)
+				}
+			})
 			r.Post("/change", func(w http.ResponseWriter, r *http.Request) {
 				action := Action(r.URL.Query().Get("action"))
 				var body struct {
@@ -247,15 +489,29 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
 					return
 				}
+				body.Email = models.NormalizeEmail(body.Email)
+				// changing the password checks the current one, as
+				// guessable as a sign in
+				if action == change {
+					if err := cfg.lockout.checkIP(r.Context(), store, r); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, retryAfter(w, err))
+						return
+					}
+				}
 				user, err := ctx.User.WithContext(r.Context()).
 					Query(database.WithFilter("email", body.Email)).First()
 				if err != nil {
+					if action == change {
+						cfg.lockout.failIP(r.Context(), store, r)
+					}
 					cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 					return
 				}
 
 				if action == reset || action == resend {
-					user.PasswordResetToken = utilities.Generate(cfg.token_length)
+					resetToken := cfg.newToken()
+					user.PasswordResetToken = cfg.tokens.Hash(purposeReset, resetToken)
+					user.PasswordResetAttempt = 0
 					user.PasswordResetTokenCreatedAt = time.Now().UTC()
 					user.PasswordResetTokenExpiresAt = time.Now().Add(time.Second * time.Duration(cfg.token_expiry.Seconds()))
 					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
@@ -264,10 +520,11 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						return
 					}
 
-					if err := cfg.notify(user.Email, user.PasswordResetToken); err != nil {
+					if err := cfg.send(r, notify.PasswordReset, user.Email, resetToken, user.PasswordResetTokenExpiresAt); err != nil {
 						cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 						return
 					}
+					ctx.Events.Publish(r.Context(), newEvent(r, events.PasswordResetRequested, user))
 					cfg.success(w, http.StatusOK, nil)
 					return
 				}
@@ -276,22 +533,65 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 						cfg.error(w, utilities.ResponseFail, errMismatchPasswords, http.StatusBadRequest)
 						return
 					}
-					if err := cfg.hash.compare(body.Current, user.PasswordSalt, user.Password); err != nil {
+					now := time.Now().UTC()
+					if err := cfg.lockout.check(user, now); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, retryAfter(w, err))
+						return
+					}
+					if _, err := cfg.verify(body.Current, user.PasswordSalt, user.Password); err != nil {
+						if err := wrongPassword(r, user, now); err != nil {
+							cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+							return
+						}
 						cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 						return
 					}
-					user.PasswordSalt = utilities.Generate(cfg.salt_length)
-					user.Password = cfg.hash.hash(body.Password, user.PasswordSalt)
-					user.PasswordUpdatedOn = time.Now().UTC()
+					if err := cfg.policy.check(r.Context(), cfg, body.Password, user); err != nil {
+						policyFailed(w, err)
+						return
+					}
+					e := newEvent(r, events.PasswordChanged, user)
+					if err := ctx.Events.Check(r.Context(), e); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+						return
+					}
+					hashed, err := cfg.hash.Hash(body.Password)
+					if err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					cfg.lockout.reset(user)
+					cfg.policy.remember(user)
+					user.PasswordSalt = ""
+					user.Password = hashed
+					user.PasswordUpdatedOn = now
 					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
 						Update(*user); err != nil {
 						cfg.error(w, utilities.ResponseError, err, http.StatusBadRequest)
 						return
 					}
+					if err := ctx.SignOut(r.Context(), user.ID); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
+					ctx.Events.Publish(r.Context(), e)
 					cfg.success(w, http.StatusOK, nil)
 					return
 				}
-				if body.Token != user.PasswordResetToken {
+				if user.PasswordResetAttempt >= cfg.lockout.token_attempt {
+					cfg.error(w, utilities.ResponseFail, errTooManyAttempts, http.StatusTooManyRequests)
+					return
+				}
+				if !cfg.tokens.Equal(purposeReset, body.Token, user.PasswordResetToken) {
+					user.PasswordResetAttempt++
+					if user.PasswordResetAttempt >= cfg.lockout.token_attempt {
+						user.PasswordResetToken = ""
+					}
+					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", user.Email)).
+						Update(*user); err != nil {
+						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+						return
+					}
 					cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
 					return
 				}
@@ -300,9 +600,28 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 					return
 				}
 
+				if err := cfg.policy.check(r.Context(), cfg, body.Password, user); err != nil {
+					policyFailed(w, err)
+					return
+				}
+
+				e := newEvent(r, events.PasswordReset, user)
+				if err := ctx.Events.Check(r.Context(), e); err != nil {
+					cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+					return
+				}
+
+				hashed, err := cfg.hash.Hash(body.Password)
+				if err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
 				user.PasswordResetToken = ""
-				user.PasswordSalt = utilities.Generate(cfg.salt_length)
-				user.Password = cfg.hash.hash(body.Password, user.PasswordSalt)
+				user.PasswordResetAttempt = 0
+				cfg.lockout.reset(user)
+				cfg.policy.remember(user)
+				user.PasswordSalt = ""
+				user.Password = hashed
 				user.PasswordUpdatedOn = time.Now().UTC()
 				user.PasswordResetTokenCreatedAt = time.Time{}
 				user.PasswordResetTokenExpiresAt = time.Time{}
@@ -312,27 +631,45 @@ func PasswordProvider(opts ...PasswordProviderOptions) *providers.Provider {
 					cfg.error(w, utilities.ResponseError, err, http.StatusBadRequest)
 					return
 				}
+				if err := ctx.SignOut(r.Context(), user.ID); err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
+				ctx.Events.Publish(r.Context(), e)
 				cfg.success(w, http.StatusOK, nil)
 			})
 		},
 	}
 }
 
-type Hasher interface {
-	hash(password string, salt string) string
-	compare(password, salt, compare string) error
+func newEvent(r *http.Request, t events.Type, user *models.User) events.Event {
+	e := events.FromRequest(r, t, name)
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	return e
 }
 
-type argonHasher struct{}
+func failedLogin(r *http.Request, email string, user *models.User, reason string) events.Event {
+	e := events.FromRequest(r, events.LoginFailed, name)
+	if user != nil {
+		e.UserID = user.ID.String()
+	}
+	e.Email = email
+	e.Reason = reason
+	return e
+}
 
-func (a *argonHasher) hash(password string, salt string) string {
-	buf := argon2.IDKey([]byte(password), []byte(salt), 2, 19*1024, 1, 32)
-	return base64.RawStdEncoding.EncodeToString(buf)
+func (c *passwordProviderConfig) newToken() string {
+	return token.Generate(c.token_format, c.token_length)
 }
-func (a *argonHasher) compare(password, salt, compare string) error {
-	pass := a.hash(password, salt)
-	if subtle.ConstantTimeCompare([]byte(pass), []byte(compare)) != 1 {
-		return errors.New("passwords don't Match")
-	}
-	return nil
+
+// send notifies the user of a token, in the language of the request.
+func (c *passwordProviderConfig) send(r *http.Request, kind notify.Kind, email, token string, expires time.Time) error {
+	return c.notify.Notify(r.Context(), notify.Message{
+		Kind:      kind,
+		To:        email,
+		Locale:    notify.LocaleFromRequest(r),
+		Token:     token,
+		ExpiresAt: expires,
+	})
 }
@@ -8,9 +8,11 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/neghi-go/database/mongodb"
+	"github.com/neghi-go/iam/auth/notify"
 	"github.com/neghi-go/iam/auth/providers"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/session"
@@ -57,10 +59,10 @@ func TestPassword(t *testing.T) {
 
 	j := session.NewJWTSession()
 
-	PasswordProvider(WithNotifier(func(email, token string) error {
-		auth_token = token
+	PasswordProvider(WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+		auth_token = msg.Token
 		return nil
-	})).Init(router, &providers.ProviderConfig{
+	}))).Init(router, &providers.ProviderConfig{
 		Session: j,
 		User:    userModel,
 	})
@@ -133,6 +135,22 @@ func TestPassword(t *testing.T) {
 			router.ServeHTTP(res, req)
 			assert.Equal(t, http.StatusOK, res.Code)
 		})
+
+		t.Run("User Login With Differently Cased Email", func(t *testing.T) {
+			var buf bytes.Buffer
+			user := map[string]string{
+				"email":    " Jon@Doe.COM",
+				"password": "password123.",
+			}
+			err := json.NewEncoder(&buf).Encode(user)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/authorize", &buf)
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+		})
 	})
 
 	t.Run("Test Password-Reset Flow", func(t *testing.T) {
@@ -199,4 +217,92 @@ func TestPassword(t *testing.T) {
 			assert.Equal(t, http.StatusOK, res.Code)
 		})
 	})
+
+	t.Run("Test Account Lockout Flow", func(t *testing.T) {
+		var unlock_token string
+		lockRouter := chi.NewRouter()
+		PasswordProvider(WithLockout(2, time.Minute, 0), WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+			unlock_token = msg.Token
+			return nil
+		}))).Init(lockRouter, &providers.ProviderConfig{
+			Session: j,
+			User:    userModel,
+		})
+
+		login := func(password string) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(map[string]string{
+				"email":    "jon@doe.com",
+				"password": password,
+			})
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/authorize", &buf)
+			res := httptest.NewRecorder()
+			lockRouter.ServeHTTP(res, req)
+			return res
+		}
+
+		t.Run("Lock After Failed Attempts", func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, login("wrong-password").Code)
+			assert.Equal(t, http.StatusBadRequest, login("wrong-password").Code)
+
+			res := login("Pass1234.")
+			assert.Equal(t, http.StatusLocked, res.Code)
+			assert.NotEmpty(t, res.Header().Get("Retry-After"))
+		})
+
+		unlock := func(token string) *httptest.ResponseRecorder {
+			var buf bytes.Buffer
+			err := json.NewEncoder(&buf).Encode(map[string]string{
+				"email": "jon@doe.com",
+				"token": token,
+			})
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/unlock?action=verify", &buf)
+			res := httptest.NewRecorder()
+			lockRouter.ServeHTTP(res, req)
+			return res
+		}
+
+		t.Run("Unlock By Email", func(t *testing.T) {
+			assert.Equal(t, http.StatusOK, unlock(unlock_token).Code)
+			assert.Equal(t, http.StatusOK, login("Pass1234.").Code)
+		})
+
+		t.Run("Lock After Failed Changes", func(t *testing.T) {
+			change := func(current string) *httptest.ResponseRecorder {
+				var buf bytes.Buffer
+				err := json.NewEncoder(&buf).Encode(map[string]string{
+					"email":            "jon@doe.com",
+					"current_password": current,
+					"password":         "Changed1234.",
+					"confirm_password": "Changed1234.",
+				})
+				require.NoError(t, err)
+				req := httptest.NewRequest(http.MethodPost, "/change?action=change", &buf)
+				res := httptest.NewRecorder()
+				lockRouter.ServeHTTP(res, req)
+				return res
+			}
+			assert.Equal(t, http.StatusBadRequest, change("wrong-password").Code)
+			assert.Equal(t, http.StatusBadRequest, change("wrong-password").Code)
+			// guessing the current password locks the account like signing in
+			assert.Equal(t, http.StatusLocked, change("Pass1234.").Code)
+			assert.Equal(t, http.StatusLocked, login("Pass1234.").Code)
+
+			assert.Equal(t, http.StatusOK, unlock(unlock_token).Code)
+			assert.Equal(t, http.StatusOK, login("Pass1234.").Code)
+		})
+
+		t.Run("Unlock Token Attempts", func(t *testing.T) {
+			assert.Equal(t, http.StatusBadRequest, login("wrong-password").Code)
+			assert.Equal(t, http.StatusBadRequest, login("wrong-password").Code)
+			for range 5 {
+				assert.Equal(t, http.StatusBadRequest, unlock("wrong-token").Code)
+			}
+			// the token is void after too many wrong guesses
+			assert.Equal(t, http.StatusTooManyRequests, unlock(unlock_token).Code)
+			assert.Equal(t, http.StatusLocked, login("Pass1234.").Code)
+		})
+	})
 }
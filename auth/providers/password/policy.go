@@ -0,0 +1,274 @@
+package password
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/utilities"
+)
+
+var errPolicy = errors.New("password: password does not meet the password policy")
+
+type Rule string
+
+const (
+	RuleMinLength   Rule = "min_length"
+	RuleMaxLength   Rule = "max_length"
+	RuleUpper       Rule = "uppercase"
+	RuleLower       Rule = "lowercase"
+	RuleDigit       Rule = "digit"
+	RuleSymbol      Rule = "symbol"
+	RuleNoIdentity  Rule = "no_identity"
+	RuleNoReuse     Rule = "no_reuse"
+	RuleNotBreached Rule = "not_breached"
+)
+
+type Violation struct {
+	Rule    Rule   `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PolicyError lists every rule of the policy a password violates.
+type PolicyError struct {
+	Violations []Violation
+}
+
+func (p *PolicyError) Error() string {
+	return errPolicy.Error()
+}
+
+func (p *PolicyError) Unwrap() error {
+	return errPolicy
+}
+
+// BreachChecker reports how many times a password appears in a corpus
+// of breached passwords.
+type BreachChecker interface {
+	Breached(ctx context.Context, password string) (int, error)
+}
+
+type Policy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// DisallowIdentity rejects passwords containing the email address
+	// or the username part of it.
+	DisallowIdentity bool
+	// History is the number of previous passwords that can't be reused.
+	History  int
+	Breached BreachChecker
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength:        8,
+		MaxLength:        128,
+		DisallowIdentity: true,
+	}
+}
+
+func WithPolicy(policy Policy) PasswordProviderOptions {
+	return func(ppc *passwordProviderConfig) {
+		ppc.policy = policy
+	}
+}
+
+// Validate checks password against every stateless rule of the policy
+// and returns nil or a *PolicyError.
+func (p Policy) Validate(ctx context.Context, password, email string) error {
+	var res []Violation
+	add := func(rule Rule, format string, args ...any) {
+		res = append(res, Violation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < max(p.MinLength, 1) {
+		add(RuleMinLength, "must be at least %d characters long", max(p.MinLength, 1))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		add(RuleMaxLength, "must be at most %d characters long", p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsDigit(c):
+			digit = true
+		case unicode.IsPunct(c) || unicode.IsSymbol(c) || unicode.IsSpace(c):
+			symbol = true
+		}
+	}
+	if p.RequireUpper && !upper {
+		add(RuleUpper, "must contain an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		add(RuleLower, "must contain a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		add(RuleDigit, "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		add(RuleSymbol, "must contain a symbol")
+	}
+
+	if p.DisallowIdentity && email != "" {
+		lowered := strings.ToLower(password)
+		username, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if strings.Contains(lowered, strings.ToLower(email)) ||
+			(len(username) >= 3 && strings.Contains(lowered, username)) {
+			add(RuleNoIdentity, "must not contain your email address or username")
+		}
+	}
+
+	if p.Breached != nil && length > 0 {
+		count, err := p.Breached.Breached(ctx, password)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			add(RuleNotBreached, "has appeared in a data breach and can't be used")
+		}
+	}
+
+	if len(res) > 0 {
+		return &PolicyError{Violations: res}
+	}
+	return nil
+}
+
+// reused reports whether password matches the user's current password
+// or one of the previous passwords kept by the policy.
+func (p Policy) reused(c *passwordProviderConfig, password string, user *models.User) bool {
+	if p.History <= 0 {
+		return false
+	}
+	if _, err := c.verify(password, user.PasswordSalt, user.Password); err == nil {
+		return true
+	}
+	for _, entry := range passwordHistory(user) {
+		salt, hash, _ := strings.Cut(entry, ":")
+		if _, err := c.verify(password, salt, hash); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// remember pushes the user's current password onto its history before
+// it is replaced, keeping at most History entries.
+func (p Policy) remember(user *models.User) {
+	if p.History <= 0 || user.Password == "" {
+		return
+	}
+	history := append([]string{user.PasswordSalt + ":" + user.Password}, passwordHistory(user)...)
+	if len(history) > p.History {
+		history = history[:p.History]
+	}
+	user.PasswordHistory = strings.Join(history, "\n")
+}
+
+// check runs every rule of the policy against the password of user,
+// which must not be nil, including reuse of its current and previous
+// passwords. Users being registered have none, so only the rules of
+// Validate apply to them.
+func (p Policy) check(ctx context.Context, c *passwordProviderConfig, password string, user *models.User) error {
+	err := p.Validate(ctx, password, user.Email)
+	var policyErr *PolicyError
+	if err != nil && !errors.As(err, &policyErr) {
+		return err
+	}
+	if p.reused(c, password, user) {
+		if policyErr == nil {
+			policyErr = &PolicyError{}
+		}
+		policyErr.Violations = append(policyErr.Violations, Violation{
+			Rule:    RuleNoReuse,
+			Message: fmt.Sprintf("must not be one of your last %d passwords", p.History),
+		})
+	}
+	if policyErr != nil {
+		return policyErr
+	}
+	return nil
+}
+
+func passwordHistory(user *models.User) []string {
+	if user.PasswordHistory == "" {
+		return nil
+	}
+	return strings.Split(user.PasswordHistory, "\n")
+}
+
+// policyFailed writes the violations of a *PolicyError as the response
+// data, any other error is reported as an internal error.
+func policyFailed(w http.ResponseWriter, err error) {
+	var policyErr *PolicyError
+	if !errors.As(err, &policyErr) {
+		utilities.JSON(w).SetStatus(utilities.ResponseError).SetStatusCode(http.StatusInternalServerError).
+			SetMessage(err.Error()).Send()
+		return
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseFail).SetStatusCode(http.StatusBadRequest).
+		SetMessage(err.Error()).SetData(policyErr.Violations).Send()
+}
+
+// HIBPDirectory checks passwords against a local copy of the Have I Been
+// Pwned range API. The directory holds one file per 5 character SHA-1
+// prefix, named after the prefix with an optional .txt extension, whose
+// lines are "SUFFIX:COUNT". Only the prefix of the hash is used to pick
+// the file, as with the online k-anonymity API.
+func HIBPDirectory(dir string) BreachChecker {
+	return hibpDirectory(dir)
+}
+
+type hibpDirectory string
+
+func (h hibpDirectory) Breached(_ context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(string(h), prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err = os.Open(filepath.Join(string(h), prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(line, suffix) {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 {
+				n = 1
+			}
+			return n, nil
+		}
+	}
+	return 0, scanner.Err()
+}
@@ -0,0 +1,83 @@
+package password
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{
+		MinLength:        10,
+		MaxLength:        16,
+		RequireUpper:     true,
+		RequireDigit:     true,
+		DisallowIdentity: true,
+		History:          2,
+	}
+
+	rules := func(err error) []Rule {
+		var res []Rule
+		if policyErr, ok := err.(*PolicyError); ok {
+			for _, v := range policyErr.Violations {
+				res = append(res, v.Rule)
+			}
+		}
+		return res
+	}
+
+	t.Run("Empty Password", func(t *testing.T) {
+		err := policy.Validate(context.Background(), "", "jon@doe.com")
+		assert.ErrorIs(t, err, errPolicy)
+		assert.Contains(t, rules(err), RuleMinLength)
+	})
+
+	t.Run("Character Classes And Identity", func(t *testing.T) {
+		err := policy.Validate(context.Background(), "jonathan-pass", "jonathan@doe.com")
+		assert.ElementsMatch(t, []Rule{RuleUpper, RuleDigit, RuleNoIdentity}, rules(err))
+	})
+
+	t.Run("Maximum Length", func(t *testing.T) {
+		err := policy.Validate(context.Background(), "Password1234567890", "jon@doe.com")
+		assert.Equal(t, []Rule{RuleMaxLength}, rules(err))
+	})
+
+	t.Run("Password Reuse", func(t *testing.T) {
+		cfg := &passwordProviderConfig{hash: NewArgon2Hasher(1, 1024, 1)}
+		user := &models.User{Email: "jon@doe.com"}
+		user.Password, _ = cfg.hash.Hash("Password1234")
+
+		policy.remember(user)
+		user.Password, _ = cfg.hash.Hash("Password5678")
+
+		assert.Equal(t, []Rule{RuleNoReuse}, rules(policy.check(context.Background(), cfg, "Password1234", user)))
+		assert.Equal(t, []Rule{RuleNoReuse}, rules(policy.check(context.Background(), cfg, "Password5678", user)))
+		assert.NoError(t, policy.check(context.Background(), cfg, "Password9012", user))
+	})
+}
+
+func TestHIBPDirectory(t *testing.T) {
+	dir := t.TempDir()
+	sum := sha1.Sum([]byte("Password1234"))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	err := os.WriteFile(filepath.Join(dir, hash[:5]+".txt"),
+		[]byte("0018A45C4D1DEF81644B54AB7F969B88D65:3\r\n"+hash[5:]+":42\r\n"), 0o600)
+	require.NoError(t, err)
+
+	checker := HIBPDirectory(dir)
+	count, err := checker.Breached(context.Background(), "Password1234")
+	require.NoError(t, err)
+	assert.Equal(t, 42, count)
+
+	count, err = checker.Breached(context.Background(), "Unbreached-Password")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
@@ -0,0 +1,139 @@
+package passwordless
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+var (
+	errCooldown        = errors.New("passwordless: wait before requesting another code")
+	errTooManyAttempts = errors.New("passwordless: too many attempts, request a new code")
+)
+
+// Mode is how a user proves ownership of their email address.
+type Mode string
+
+const (
+	// Link sends a link to the callback route.
+	Link Mode = "link"
+	// Code sends a short numeric code to be typed into the client that
+	// requested it, for clients that can't open links in the same
+	// context such as mobile apps and TVs.
+	Code Mode = "code"
+)
+
+const purposeCode = "magic_link_code"
+
+// codeConfig configures one time codes.
+type codeConfig struct {
+	length   int
+	expiry   time.Duration
+	attempts int
+	cooldown time.Duration
+}
+
+// WithMode sets the mode used when a request doesn't ask for one with
+// the mode field. Links are the default.
+func WithMode(mode Mode) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.mode = mode
+	}
+}
+
+// WithCode configures one time codes: the number of digits, how long a
+// code can be used, how many guesses are allowed per code and how long
+// a user has to wait before requesting another one. Zero values keep
+// the defaults of 6 digits, 10 minutes, 5 attempts and 1 minute.
+func WithCode(length int, expiry time.Duration, attempts int, cooldown time.Duration) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		if length > 0 {
+			ppc.code.length = length
+		}
+		if expiry > 0 {
+			ppc.code.expiry = expiry
+		}
+		if attempts > 0 {
+			ppc.code.attempts = attempts
+		}
+		if cooldown > 0 {
+			ppc.code.cooldown = cooldown
+		}
+	}
+}
+
+func codeKey(email string) string {
+	return "magic-link:code:" + models.NormalizeEmail(email)
+}
+
+// issueCode stores a new code for email, invalidating the previous one.
+func (c *passwordlessProviderConfig) issueCode(ctx context.Context, store storage.Storage, email string) (string, error) {
+	key := codeKey(email)
+	if _, err := store.Get(ctx, key+":cooldown"); err == nil {
+		return "", errCooldown
+	}
+	code := token.Generate(token.Numeric, c.code.length)
+	hash := linkKey(c.tokens.Hash(purposeCode, models.NormalizeEmail(email)+":"+code))
+	if err := save(ctx, store, hash, link{Email: email}, c.code.expiry); err != nil {
+		return "", err
+	}
+	// the current code is the only one accepted, earlier codes stop
+	// working when a new one is sent
+	if err := store.Set(ctx, key, []byte(hash), c.code.expiry); err != nil {
+		return "", err
+	}
+	_ = store.Del(ctx, key+":attempts")
+	if c.code.cooldown > 0 {
+		_ = store.Set(ctx, key+":cooldown", []byte("1"), c.code.cooldown)
+	}
+	return code, nil
+}
+
+// consumeCode checks code against the current code of email and
+// invalidates it. Every guess counts towards the attempts of the code.
+func (c *passwordlessProviderConfig) consumeCode(ctx context.Context, store storage.Storage, r *http.Request,
+	email, code string) (*link, error) {
+	key := codeKey(email)
+	current, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	attempts, err := store.Incr(ctx, key+":attempts", c.code.expiry)
+	if err != nil {
+		return nil, err
+	}
+	if attempts > int64(c.code.attempts) {
+		return nil, errTooManyAttempts
+	}
+	hash := linkKey(c.tokens.Hash(purposeCode, models.NormalizeEmail(email)+":"+code))
+	if code == "" || subtle.ConstantTimeCompare([]byte(hash), current) != 1 {
+		return nil, errInvalidToken
+	}
+	l, err := c.take(ctx, store, r, hash, c.code.expiry)
+	if err != nil {
+		return nil, err
+	}
+	_ = store.Del(ctx, key)
+	_ = store.Del(ctx, key+":attempts")
+	return l, nil
+}
+
+// retryAfter sets the Retry-After header for errors a client can retry
+// later and returns the status code of err.
+func (c *passwordlessProviderConfig) retryAfter(w http.ResponseWriter, err error) int {
+	switch {
+	case errors.Is(err, errCooldown):
+		w.Header().Set("Retry-After", strconv.Itoa(int(c.code.cooldown.Seconds())))
+		return http.StatusTooManyRequests
+	case errors.Is(err, errTooManyAttempts):
+		return http.StatusTooManyRequests
+	}
+	return linkStatus(err)
+}
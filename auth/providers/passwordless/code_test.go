@@ -0,0 +1,83 @@
+package passwordless
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodes(t *testing.T) {
+	ctx := context.Background()
+	r := httptest.NewRequest(http.MethodPost, "/authorize", nil)
+	newConfig := func(code codeConfig) *passwordlessProviderConfig {
+		return &passwordlessProviderConfig{tokens: token.NewHasher(nil), code: code}
+	}
+
+	t.Run("Single Use", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		cfg := newConfig(codeConfig{length: 6, expiry: time.Minute, attempts: 5})
+		code, err := cfg.issueCode(ctx, store, "jon@doe.com")
+		require.NoError(t, err)
+		assert.Len(t, code, 6)
+
+		l, err := cfg.consumeCode(ctx, store, r, "Jon@Doe.com", code)
+		require.NoError(t, err)
+		assert.Equal(t, "jon@doe.com", l.Email)
+		_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", code)
+		assert.ErrorIs(t, err, errInvalidToken)
+	})
+
+	t.Run("Attempts", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		cfg := newConfig(codeConfig{length: 6, expiry: time.Minute, attempts: 2})
+		code, err := cfg.issueCode(ctx, store, "jon@doe.com")
+		require.NoError(t, err)
+
+		for range 2 {
+			_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", "wrong")
+			assert.ErrorIs(t, err, errInvalidToken)
+		}
+		_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", code)
+		assert.ErrorIs(t, err, errTooManyAttempts)
+
+		// a new code resets the attempts and invalidates the old one
+		next, err := cfg.issueCode(ctx, store, "jon@doe.com")
+		require.NoError(t, err)
+		if next != code {
+			_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", code)
+			assert.ErrorIs(t, err, errInvalidToken)
+		}
+		_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", next)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		cfg := newConfig(codeConfig{length: 6, expiry: 20 * time.Millisecond, attempts: 5})
+		code, err := cfg.issueCode(ctx, store, "jon@doe.com")
+		require.NoError(t, err)
+		time.Sleep(40 * time.Millisecond)
+		_, err = cfg.consumeCode(ctx, store, r, "jon@doe.com", code)
+		assert.ErrorIs(t, err, errInvalidToken)
+	})
+
+	t.Run("Cooldown", func(t *testing.T) {
+		store := storage.NewMemoryStorage()
+		cfg := newConfig(codeConfig{length: 6, expiry: time.Minute, attempts: 5, cooldown: time.Minute})
+		_, err := cfg.issueCode(ctx, store, "jon@doe.com")
+		require.NoError(t, err)
+		_, err = cfg.issueCode(ctx, store, "jon@doe.com")
+		assert.ErrorIs(t, err, errCooldown)
+
+		w := httptest.NewRecorder()
+		assert.Equal(t, http.StatusTooManyRequests, cfg.retryAfter(w, err))
+		assert.Equal(t, "60", w.Header().Get("Retry-After"))
+	})
+}
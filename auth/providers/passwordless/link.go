@@ -0,0 +1,195 @@
+package passwordless
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
+)
+
+var (
+	errRedirectNotAllowed = errors.New("passwordless: redirect url is not allowed")
+	errWrongDevice        = errors.New("passwordless: the link must be opened on the device it was requested from")
+)
+
+// purposes the stored token hashes are bound to
+const (
+	purposeLink   = "magic_link"
+	purposeDevice = "magic_link_device"
+)
+
+const deviceCookie = "magic_link_device"
+
+// link is the state of an issued magic link, stored under the hash of
+// its token until it is used or expires.
+type link struct {
+	Email      string `json:"email"`
+	Device     string `json:"device,omitempty"`
+	RedirectTo string `json:"redirect_to,omitempty"`
+}
+
+func linkKey(hash string) string {
+	return "magic-link:" + hash
+}
+
+// issue stores a new link for email and returns its token. With device
+// binding a cookie identifying the browser is set on w, reusing the one
+// already sent by the browser.
+func (c *passwordlessProviderConfig) issue(ctx context.Context, store storage.Storage, w http.ResponseWriter, r *http.Request,
+	email, redirectTo string) (string, error) {
+	l := link{Email: email, RedirectTo: redirectTo}
+	if c.bind_device {
+		device := ""
+		if cookie, err := r.Cookie(deviceCookie); err == nil && cookie.Value != "" {
+			device = cookie.Value
+		} else {
+			device = token.Generate(token.URL, 0)
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     deviceCookie,
+			Value:    device,
+			Path:     "/",
+			MaxAge:   int(c.link_expiry.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		l.Device = c.tokens.Hash(purposeDevice, device)
+	}
+	tok := token.Generate(token.URL, 0)
+	if err := save(ctx, store, linkKey(c.tokens.Hash(purposeLink, tok)), l, c.link_expiry); err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+func save(ctx context.Context, store storage.Storage, key string, l link, ttl time.Duration) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return store.Set(ctx, key, b, ttl)
+}
+
+// consume returns the link of tok and invalidates it. A link bound to a
+// device is left intact when opened elsewhere, so it can still be used
+// from the right browser.
+func (c *passwordlessProviderConfig) consume(ctx context.Context, store storage.Storage, r *http.Request, tok string) (*link, error) {
+	if tok == "" {
+		return nil, errInvalidToken
+	}
+	return c.take(ctx, store, r, linkKey(c.tokens.Hash(purposeLink, tok)), c.link_expiry)
+}
+
+// take returns the link stored at key and invalidates it.
+func (c *passwordlessProviderConfig) take(ctx context.Context, store storage.Storage, r *http.Request, key string,
+	ttl time.Duration) (*link, error) {
+	b, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var l link
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, errInvalidToken
+	}
+	if l.Device != "" {
+		cookie, err := r.Cookie(deviceCookie)
+		if err != nil || !c.tokens.Equal(purposeDevice, cookie.Value, l.Device) {
+			return nil, errWrongDevice
+		}
+	}
+	// the counter makes concurrent uses of the same link fail, even with
+	// a storage that can't get and delete atomically
+	used, err := store.Incr(ctx, key+":used", ttl)
+	if err != nil {
+		return nil, err
+	}
+	if used > 1 {
+		return nil, errInvalidToken
+	}
+	_ = store.Del(ctx, key)
+	return &l, nil
+}
+
+// redirect returns the url to send the user to after login, raw when it
+// is allowed or the first allowed url when raw is empty. A url is
+// allowed when it has the scheme and host of an allowed url and its
+// path is below the allowed one.
+func (c *passwordlessProviderConfig) redirect(raw string) (string, error) {
+	if raw == "" {
+		if len(c.redirects) > 0 {
+			return c.redirects[0], nil
+		}
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return "", errRedirectNotAllowed
+	}
+	if u.Path != "" {
+		// resolve dot segments so they can't climb out of an allowed path
+		u.Path = path.Clean(u.Path)
+	}
+	for _, allowed := range c.redirects {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, a.Scheme) && strings.EqualFold(u.Host, a.Host) &&
+			(u.Path == a.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(a.Path, "/")+"/")) {
+			return u.String(), nil
+		}
+	}
+	return "", errRedirectNotAllowed
+}
+
+// callbackURL returns the url of the callback route, derived from the
+// request to the authorize route when it isn't configured and its host
+// is allowed.
+func (c *passwordlessProviderConfig) callbackURL(r *http.Request) (string, error) {
+	if c.callback_url != "" {
+		return c.callback_url, nil
+	}
+	if len(c.hosts) == 0 {
+		return "", errNoCallbackURL
+	}
+	if !slices.ContainsFunc(c.hosts, func(h string) bool { return strings.EqualFold(h, r.Host) }) {
+		return "", errHostNotAllowed
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(r.URL.Path, "/authorize") + "/callback", nil
+}
+
+// withToken adds tok to the callback url.
+func withToken(callback, tok string) string {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	q.Set("token", tok)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func withError(redirect, code string) string {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return redirect
+	}
+	q := u.Query()
+	q.Set("error", code)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
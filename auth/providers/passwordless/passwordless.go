@@ -5,12 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/notify"
 	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/utilities"
 )
@@ -20,8 +26,13 @@ var (
 	errInvalidToken       = errors.New("password: the verification token is invalid")
 	errNotVerified        = errors.New("password: user is yet to be verified")
 	errVerified           = errors.New("password: user is verified")
+	errUnknownMode        = errors.New("passwordless: unknown mode")
+	errNoCallbackURL      = errors.New("passwordless: links need a callback url, see WithCallbackURL")
+	errHostNotAllowed     = errors.New("passwordless: links can't be sent for this host")
 )
 
+const name = "magic-link"
+
 type Action string
 
 const (
@@ -32,19 +43,92 @@ const (
 type Option func(*passwordlessProviderConfig)
 
 type passwordlessProviderConfig struct {
-	notify  func(email string, token string) error
-	success func(w http.ResponseWriter, status_code int, data interface{})
-	error   func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int)
+	tokens       *token.Hasher
+	link_expiry  time.Duration
+	callback_url string
+	hosts        []string
+	redirects    []string
+	bind_device  bool
+	mode         Mode
+	code         codeConfig
+	notify       notify.Notifier
+	success      func(w http.ResponseWriter, status_code int, data interface{})
+	error        func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int)
+}
+
+// WithNotifier sets how magic links are sent to users. Messages are
+// printed to stdout by default.
+func WithNotifier(n notify.Notifier) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.notify = n
+	}
+}
+
+// WithTokenSecret sets the key link tokens are hashed with before they
+// are stored. It must be shared by every instance of the provider, a
+// random key is used when it isn't set.
+func WithTokenSecret(secret string) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.tokens = token.NewHasher([]byte(secret))
+	}
 }
 
-func WithNotifier(notifier func(email, token string) error) Option {
+// WithLinkExpiry sets how long a link can be used. Defaults to 10
+// minutes.
+func WithLinkExpiry(d time.Duration) Option {
 	return func(ppc *passwordlessProviderConfig) {
-		ppc.notify = notifier
+		ppc.link_expiry = d
+	}
+}
+
+// WithCallbackURL sets the url of the callback route sent in links, e.g
+// https://example.com/auth/magic-link/callback. Links can't be sent
+// without it, unless WithHosts allows deriving it from requests.
+func WithCallbackURL(u string) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.callback_url = u
+	}
+}
+
+// WithHosts derives the callback url of links from the request for a
+// link when its Host is one of hosts, for providers serving several
+// domains. The Host header is set by clients, any other is refused. The
+// derived url is only correct when the provider isn't behind a proxy
+// rewriting paths.
+func WithHosts(hosts ...string) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.hosts = hosts
+	}
+}
+
+// WithRedirects sets the urls the callback may redirect to after login.
+// A link may ask for any url below one of them with redirect_to, the
+// first one is used when it doesn't. Without redirects the callback
+// responds with the user as the other routes do.
+func WithRedirects(urls ...string) Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.redirects = urls
+	}
+}
+
+// WithDeviceBinding only accepts links on the browser they were
+// requested from, identified by a cookie set when the link is requested.
+func WithDeviceBinding() Option {
+	return func(ppc *passwordlessProviderConfig) {
+		ppc.bind_device = true
 	}
 }
 
 func PasswordlessProvider(opts ...Option) *providers.Provider {
 	cfg := &passwordlessProviderConfig{
+		link_expiry: 10 * time.Minute,
+		mode:        Link,
+		code: codeConfig{
+			length:   6,
+			expiry:   10 * time.Minute,
+			attempts: 5,
+			cooldown: time.Minute,
+		},
 		success: func(w http.ResponseWriter, status_code int, data interface{}) {
 			utilities.JSON(w).SetStatus(utilities.ResponseSuccess).
 				SetStatusCode(status_code).SetData(data).Send()
@@ -53,75 +137,61 @@ func PasswordlessProvider(opts ...Option) *providers.Provider {
 			utilities.JSON(w).SetStatus(status).SetStatusCode(status_code).
 				SetMessage(err.Error()).Send()
 		},
-		notify: func(email, token string) error {
-			fmt.Printf("email: %v, token: %v", email, token)
-			return nil
-		},
+		notify: notify.Stdout,
 	}
 	for _, opt := range opts {
 		opt(cfg)
 	}
+	if cfg.tokens == nil {
+		cfg.tokens = token.NewHasher(nil)
+	}
 	return &providers.Provider{
-		Name: "magic-link",
+		Name: name,
+		AMR:  []string{sessions.AMREmail},
 		Init: func(r chi.Router, ctx *providers.ProviderConfig) {
+			store := ctx.Store
+			if store == nil {
+				store = storage.NewMemoryStorage()
+			}
 			r.Post("/authorize", func(w http.ResponseWriter, r *http.Request) {
 				var body struct {
-					Email string `json:"email"`
-					Token string `json:"token"`
+					Email      string `json:"email"`
+					Token      string `json:"token"`
+					Code       string `json:"code"`
+					Mode       Mode   `json:"mode"`
+					RedirectTo string `json:"redirect_to"`
 				}
 				action := r.URL.Query().Get("action")
 				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
 					return
 				}
+				body.Email = models.NormalizeEmail(body.Email)
 
 				switch Action(action) {
 				case authenticate:
-
-					if body.Token == "" {
-						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
-						return
+					var l *link
+					var err error
+					if body.Code != "" {
+						l, err = cfg.consumeCode(r.Context(), store, r, body.Email, body.Code)
+					} else {
+						l, err = cfg.consume(r.Context(), store, r, body.Token)
 					}
-					//when url contains token
-					//parse token
-					tokenValues, _ := utilities.Decrypt(body.Token)
-					//validate parsed token
-					if tokenValues["email"] != body.Email {
-						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
+					if err != nil {
+						ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, err.Error()))
+						cfg.error(w, utilities.ResponseFail, err, cfg.retryAfter(w, err))
 						return
 					}
-					timestamp, _ := tokenValues["expiry"].(int64)
-					if time.Now().UTC().Unix() > timestamp {
+					if !strings.EqualFold(l.Email, body.Email) {
+						ctx.Events.Publish(r.Context(), failedLogin(r, body.Email, "invalid token"))
 						cfg.error(w, utilities.ResponseFail, errInvalidToken, http.StatusBadRequest)
 						return
 					}
-
-					user, err := ctx.User.WithContext(r.Context()).
-						Query(database.WithFilter("email", body.Email)).First()
-					if err != nil {
-						cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
-						return
-					}
-					user.LastLogin = time.Now().UTC().Unix()
-					if !user.EmailVerified {
-						user.EmailVerified = true
-						user.EmailVerifiedAt = time.Now().UTC()
-					}
-					// create session for user
-					//create session, either JWT or Cookie and send to user
-					err = ctx.Session.Generate(w, user.ID.String(), user.Email)
+					user, status, err := cfg.login(w, r, ctx, l.Email, sessions.AMREmail)
 					if err != nil {
-						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
+						cfg.error(w, utilities.ResponseFail, err, status)
 						return
 					}
-
-					//update user
-					if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", body.Email)).
-						Update(*user); err != nil {
-						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
-						return
-
-					}
 					cfg.success(w, http.StatusOK, user)
 				case resend:
 					if _, err := ctx.User.WithContext(r.Context()).
@@ -129,44 +199,195 @@ func PasswordlessProvider(opts ...Option) *providers.Provider {
 						cfg.error(w, utilities.ResponseFail, errInvalidCredentials, http.StatusBadRequest)
 						return
 					}
-					tokenValues := map[string]any{
-						"email":  body.Email,
-						"expiry": time.Now().Add(time.Minute * 10).UTC().Unix(),
-					}
-					token, _ := utilities.Encrypt(tokenValues)
-					// send to user
-					if err := cfg.notify(body.Email, token); err != nil {
-						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					if err := cfg.send(w, r, store, body.Email, body.RedirectTo, body.Mode); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, cfg.retryAfter(w, err))
 						return
 					}
-					cfg.success(w, http.StatusOK, token)
+					cfg.success(w, http.StatusOK, nil)
 				default:
+					if _, err := cfg.redirect(body.RedirectTo); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
+						return
+					}
 					//get user if it exist and generate session
 					if _, err := ctx.User.WithContext(r.Context()).
 						Query(database.WithFilter("email", body.Email)).First(); err != nil {
 						user := models.User{
-							ID:    uuid.New(),
-							Email: body.Email,
+							ID:        uuid.New(),
+							Email:     body.Email,
+							CreatedAt: time.Now().UTC(),
+						}
+						e := newEvent(r, events.UserRegistered, &user)
+						if err := ctx.Events.Check(r.Context(), e); err != nil {
+							cfg.error(w, utilities.ResponseFail, err, http.StatusForbidden)
+							return
 						}
 						if err := ctx.User.WithContext(r.Context()).Save(user); err != nil {
 							cfg.error(w, utilities.ResponseError, err, http.StatusBadRequest)
 							return
 						}
+						ctx.Events.Publish(r.Context(), e)
 					}
-					tokenValues := map[string]any{
-						"email":  body.Email,
-						"expiry": time.Now().Add(time.Minute * 10).UTC().Unix(),
-					}
-					token, _ := utilities.Encrypt(tokenValues)
-					if err := cfg.notify(body.Email, token); err != nil {
-						cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					if err := cfg.send(w, r, store, body.Email, body.RedirectTo, body.Mode); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, cfg.retryAfter(w, err))
 						return
 					}
+					cfg.success(w, http.StatusOK, nil)
+				}
 
-					cfg.success(w, http.StatusOK, token)
+			})
+			// callback is the route links point to, it logs the user in
+			// and redirects to the url the link was requested with.
+			r.Get("/callback", func(w http.ResponseWriter, r *http.Request) {
+				fallback, _ := cfg.redirect("")
+				fail := func(err error, status int, code string) {
+					if fallback != "" {
+						http.Redirect(w, r, withError(fallback, code), http.StatusSeeOther)
+						return
+					}
+					cfg.error(w, utilities.ResponseFail, err, status)
 				}
 
+				l, err := cfg.consume(r.Context(), store, r, r.URL.Query().Get("token"))
+				if err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, "", err.Error()))
+					code := "invalid_token"
+					if errors.Is(err, errWrongDevice) {
+						code = "wrong_device"
+					}
+					fail(err, linkStatus(err), code)
+					return
+				}
+				user, status, err := cfg.login(w, r, ctx, l.Email, sessions.AMREmail)
+				if err != nil {
+					fail(err, status, "access_denied")
+					return
+				}
+				redirect := l.RedirectTo
+				if redirect == "" {
+					redirect = fallback
+				}
+				if redirect == "" {
+					cfg.success(w, http.StatusOK, user)
+					return
+				}
+				http.Redirect(w, r, redirect, http.StatusSeeOther)
 			})
 		},
 	}
 }
+
+// send issues a link or a code, depending on mode, and notifies the
+// user of it.
+func (c *passwordlessProviderConfig) send(w http.ResponseWriter, r *http.Request, store storage.Storage,
+	email, redirectTo string, mode Mode) error {
+	if mode == "" {
+		mode = c.mode
+	}
+	if mode == Code {
+		code, err := c.issueCode(r.Context(), store, email)
+		if err != nil {
+			return err
+		}
+		return c.notify.Notify(r.Context(), notify.Message{
+			Kind:      notify.LoginCode,
+			To:        email,
+			Locale:    notify.LocaleFromRequest(r),
+			Token:     code,
+			ExpiresAt: time.Now().Add(c.code.expiry).UTC(),
+		})
+	}
+	if mode != Link {
+		return errUnknownMode
+	}
+	callback, err := c.callbackURL(r)
+	if err != nil {
+		return err
+	}
+	// only redirects asked for are stored, so a change of the default
+	// applies to outstanding links
+	var redirect string
+	if redirectTo != "" {
+		var err error
+		if redirect, err = c.redirect(redirectTo); err != nil {
+			return err
+		}
+	}
+	tok, err := c.issue(r.Context(), store, w, r, email, redirect)
+	if err != nil {
+		return err
+	}
+	return c.notify.Notify(r.Context(), notify.Message{
+		Kind:      notify.MagicLink,
+		To:        email,
+		Locale:    notify.LocaleFromRequest(r),
+		Token:     tok,
+		Link:      withToken(callback, tok),
+		ExpiresAt: time.Now().Add(c.link_expiry).UTC(),
+	})
+}
+
+// login creates a session for the user of a used link or code, verifying
+// its email as the link proves ownership of it.
+func (c *passwordlessProviderConfig) login(w http.ResponseWriter, r *http.Request, ctx *providers.ProviderConfig,
+	email, amr string) (*models.User, int, error) {
+	user, err := ctx.User.WithContext(r.Context()).
+		Query(database.WithFilter("email", email)).First()
+	if err != nil {
+		ctx.Events.Publish(r.Context(), failedLogin(r, email, "unknown user"))
+		return nil, http.StatusBadRequest, errInvalidCredentials
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		ctx.Events.Publish(r.Context(), failedLogin(r, email, err.Error()))
+		return nil, http.StatusForbidden, fmt.Errorf("passwordless: %w", err)
+	}
+	e := newEvent(r, events.LoginSucceeded, user)
+	if err := ctx.Events.Check(r.Context(), e); err != nil {
+		ctx.Events.Publish(r.Context(), events.LoginRejected(e, err))
+		return nil, http.StatusForbidden, err
+	}
+	verified := !user.EmailVerified
+	user.LastLogin = time.Now().UTC().Unix()
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		user.EmailVerifiedAt = time.Now().UTC()
+	}
+	//create session, either JWT or Cookie and send to user
+	if err := ctx.NewSession(w, r, user, name, amr); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", email)).
+		Update(*user); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if verified {
+		ctx.Events.Publish(r.Context(), newEvent(r, events.EmailVerified, user))
+	}
+	ctx.Events.Publish(r.Context(), e)
+	return user, http.StatusOK, nil
+}
+
+func linkStatus(err error) int {
+	switch {
+	case errors.Is(err, errWrongDevice):
+		return http.StatusForbidden
+	case errors.Is(err, errInvalidToken), errors.Is(err, errRedirectNotAllowed), errors.Is(err, errUnknownMode),
+		errors.Is(err, errHostNotAllowed):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func newEvent(r *http.Request, t events.Type, user *models.User) events.Event {
+	e := events.FromRequest(r, t, name)
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	return e
+}
+
+func failedLogin(r *http.Request, email, reason string) events.Event {
+	e := events.FromRequest(r, events.LoginFailed, name)
+	e.Email = email
+	e.Reason = reason
+	return e
+}
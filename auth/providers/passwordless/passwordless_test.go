@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/neghi-go/database/mongodb"
+	"github.com/neghi-go/iam/auth/notify"
 	"github.com/neghi-go/iam/auth/providers"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/session"
@@ -54,10 +55,10 @@ func TestPasswordless(t *testing.T) {
 
 	j := session.NewJWTSession()
 
-	PasswordlessProvider(WithNotifier(func(email, token string) error {
-		auth_token = token
+	PasswordlessProvider(WithCallbackURL("http://example.com/callback"), WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+		auth_token = msg.Token
 		return nil
-	})).Init(router, &providers.ProviderConfig{
+	}))).Init(router, &providers.ProviderConfig{
 		Session: j,
 		User:    userModel,
 	})
@@ -113,5 +114,49 @@ func TestPasswordless(t *testing.T) {
 
 			assert.Equal(t, http.StatusOK, res.Code)
 		})
+		t.Run("Test Link Is Single Use", func(t *testing.T) {
+			var buf bytes.Buffer
+			body := map[string]string{
+				"email": "jon@doe.com",
+				"token": auth_token,
+			}
+			require.NoError(t, json.NewEncoder(&buf).Encode(body))
+
+			req := httptest.NewRequest(http.MethodPost, "/authorize?action=authenticate", &buf)
+			res := httptest.NewRecorder()
+
+			router.ServeHTTP(res, req)
+
+			assert.Equal(t, http.StatusBadRequest, res.Code)
+		})
+		t.Run("Test Callback", func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, json.NewEncoder(&buf).Encode(map[string]string{"email": "jon@doe.com"}))
+			req := httptest.NewRequest(http.MethodPost, "/authorize", &buf)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			require.Equal(t, http.StatusOK, res.Code)
+			assert.NotContains(t, res.Body.String(), auth_token)
+
+			req = httptest.NewRequest(http.MethodGet, "/callback?token="+auth_token, nil)
+			res = httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+		})
+		t.Run("Test Code Mode", func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, json.NewEncoder(&buf).Encode(map[string]string{"email": "jon@doe.com", "mode": "code"}))
+			req := httptest.NewRequest(http.MethodPost, "/authorize", &buf)
+			res := httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			require.Equal(t, http.StatusOK, res.Code)
+
+			buf.Reset()
+			require.NoError(t, json.NewEncoder(&buf).Encode(map[string]string{"email": "jon@doe.com", "code": auth_token}))
+			req = httptest.NewRequest(http.MethodPost, "/authorize?action=authenticate", &buf)
+			res = httptest.NewRecorder()
+			router.ServeHTTP(res, req)
+			assert.Equal(t, http.StatusOK, res.Code)
+		})
 	})
 }
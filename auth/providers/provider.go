@@ -1,24 +1,84 @@
 package providers
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
 	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/risk"
+	"github.com/neghi-go/iam/auth/sessions"
 	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/tokens"
 	"github.com/neghi-go/iam/internal/models"
 	"github.com/neghi-go/session"
 )
 
 type ProviderConfig struct {
-	User    database.Model[models.User]
-	Session session.Session
-	Store   storage.Storage
+	User     database.Model[models.User]
+	Session  session.Session
+	Sessions *sessions.Manager
+	// Tokens are the personal access tokens of users, see SignOut.
+	Tokens *tokens.Manager
+	Store  storage.Storage
+	Events *events.Bus
+	// Risk assesses the sign ins of NewSession when it is set.
+	Risk    *risk.Evaluator
 	Success func(w http.ResponseWriter, data interface{})
-	Set     func()
-	Unset   func()
 }
+
+// SignOut revokes every session and personal access token of a user,
+// once their password changes.
+func (p *ProviderConfig) SignOut(ctx context.Context, userID uuid.UUID) error {
+	if _, err := p.Sessions.RevokeAll(ctx, userID); err != nil {
+		return err
+	}
+	_, err := p.Tokens.RevokeAll(ctx, userID)
+	return err
+}
+
+// NewSession issues a session for user, recording it with Sessions when
+// it is set along with amr, the methods the user authenticated with.
+// Sign ins Risk deems risky are reported and, until the user steps up
+// with a second factor, restricted.
+func (p *ProviderConfig) NewSession(w http.ResponseWriter, r *http.Request, user *models.User, provider string, amr ...string) error {
+	if p.Sessions == nil {
+		return p.Session.Generate(w, user.ID.String(), user.Email)
+	}
+	var assessment *risk.Assessment
+	if p.Risk != nil {
+		var err error
+		if assessment, err = p.Risk.Evaluate(r.Context(), r, user.ID, user.Email); err != nil {
+			return err
+		}
+	}
+	rec, err := p.Sessions.Create(w, r, user.ID, user.Email, provider, amr...)
+	if err != nil || assessment == nil {
+		return err
+	}
+	if assessment.RequireMFA && sessions.Level(rec.ACR) < sessions.Level(sessions.AAL2) {
+		if err := p.Sessions.RequireACR(r.Context(), rec, sessions.AAL2); err != nil {
+			return err
+		}
+	}
+	// stepping up completes a sign in already reported
+	if rec.Restricted() || (assessment.Notify && !assessment.RequireMFA) {
+		// the session is issued, failing to notify the user mustn't fail
+		// the sign in: Alert records it in the SuspiciousLogin event
+		_ = p.Risk.Alert(r.Context(), r, user.ID, user.Email, provider, assessment)
+	}
+	if rec.Restricted() {
+		return nil
+	}
+	return p.Risk.Observe(r.Context(), r, user.ID, user.Email, assessment)
+}
+
 type Provider struct {
 	Name string
+	// AMR lists the methods the sessions issued by the provider are
+	// authenticated with, to tell clients which provider to step up with.
+	AMR  []string
 	Init func(r chi.Router, ctx *ProviderConfig)
 }
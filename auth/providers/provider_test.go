@@ -0,0 +1,39 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/tokens"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignOut(t *testing.T) {
+	ctx := context.Background()
+	p := &ProviderConfig{
+		Sessions: sessions.New(testdb.New[sessions.Record](), sessions.NewJWT()),
+		Tokens:   tokens.New(testdb.New[tokens.Token]()),
+	}
+	userID := uuid.New()
+	w := httptest.NewRecorder()
+	_, err := p.Sessions.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), userID, "jon@doe.com", "password")
+	require.NoError(t, err)
+	_, pat, err := p.Tokens.Create(ctx, userID, "ci", nil, time.Time{})
+	require.NoError(t, err)
+
+	require.NoError(t, p.SignOut(ctx, userID))
+	_, err = p.Sessions.Lookup(ctx, w.Header().Get("Auth-Token"))
+	assert.Error(t, err)
+	_, err = p.Tokens.Lookup(ctx, pat)
+	assert.Error(t, err)
+
+	// providers may run without sessions or tokens
+	assert.NoError(t, (&ProviderConfig{}).SignOut(ctx, userID))
+}
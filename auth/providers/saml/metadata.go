@@ -0,0 +1,174 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+const (
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	nameIDEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	nameIDUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+var errInvalidMetadata = errors.New("saml: invalid identity provider metadata")
+
+// IdP is the identity provider of an organization.
+type IdP struct {
+	EntityID string
+	// SSOURL is where AuthnRequests are sent, with the redirect binding.
+	SSOURL string
+	// Certificates are the certificates the IdP signs with, any of them
+	// is accepted.
+	Certificates []*x509.Certificate
+	// Domains are the email domains verified as owned by the
+	// organization. When set, the IdP can only assert addresses in them,
+	// and existing accounts with such an address are linked to the
+	// organization on their first login. Without them, only the accounts
+	// the IdP provisioned can sign in through it.
+	Domains []string
+}
+
+// owns reports whether email is in the verified domains of the IdP.
+func (idp *IdP) owns(email string) bool {
+	_, domain, _ := strings.Cut(email, "@")
+	for _, d := range idp.Domains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMetadata reads the entity id, the single sign-on url of the
+// redirect binding and the signing certificates of an IdP from its
+// metadata.
+func ParseMetadata(metadata []byte) (*IdP, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(metadata); err != nil {
+		return nil, errInvalidMetadata
+	}
+	root := doc.Root()
+	if root == nil {
+		return nil, errInvalidMetadata
+	}
+	// the entity may be wrapped in an EntitiesDescriptor
+	if root.Tag == "EntitiesDescriptor" {
+		root = child(root, "EntityDescriptor")
+	}
+	if root == nil || root.Tag != "EntityDescriptor" {
+		return nil, errInvalidMetadata
+	}
+	idp := &IdP{EntityID: root.SelectAttrValue("entityID", "")}
+	desc := child(root, "IDPSSODescriptor")
+	if idp.EntityID == "" || desc == nil {
+		return nil, errInvalidMetadata
+	}
+	for _, sso := range children(desc, "SingleSignOnService") {
+		if sso.SelectAttrValue("Binding", "") == bindingRedirect {
+			idp.SSOURL = sso.SelectAttrValue("Location", "")
+		}
+	}
+	for _, kd := range children(desc, "KeyDescriptor") {
+		if use := kd.SelectAttrValue("use", "signing"); use != "signing" {
+			continue
+		}
+		for _, el := range kd.FindElements(".//X509Certificate") {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(el.Text()), ""))
+			if err != nil {
+				return nil, errInvalidMetadata
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, errInvalidMetadata
+			}
+			idp.Certificates = append(idp.Certificates, cert)
+		}
+	}
+	if idp.SSOURL == "" || len(idp.Certificates) == 0 {
+		return nil, errInvalidMetadata
+	}
+	return idp, nil
+}
+
+// metadata returns the SP metadata of an organization.
+func (c *samlProviderConfig) metadata(entityID, acs string) []byte {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	ed := doc.CreateElement("md:EntityDescriptor")
+	ed.CreateAttr("xmlns:md", nsMetadata)
+	ed.CreateAttr("entityID", entityID)
+	sp := ed.CreateElement("md:SPSSODescriptor")
+	sp.CreateAttr("AuthnRequestsSigned", boolAttr(c.key != nil))
+	sp.CreateAttr("WantAssertionsSigned", "true")
+	sp.CreateAttr("protocolSupportEnumeration", nsProtocol)
+	if c.cert != nil {
+		kd := sp.CreateElement("md:KeyDescriptor")
+		kd.CreateAttr("use", "signing")
+		ki := kd.CreateElement("ds:KeyInfo")
+		ki.CreateAttr("xmlns:ds", nsDSig)
+		ki.CreateElement("ds:X509Data").CreateElement("ds:X509Certificate").
+			SetText(base64.StdEncoding.EncodeToString(c.cert.Raw))
+	}
+	sp.CreateElement("md:NameIDFormat").SetText(nameIDEmail)
+	acsEl := sp.CreateElement("md:AssertionConsumerService")
+	acsEl.CreateAttr("Binding", bindingPOST)
+	acsEl.CreateAttr("Location", acs)
+	acsEl.CreateAttr("index", "0")
+	acsEl.CreateAttr("isDefault", "true")
+	doc.Indent(2)
+	buf, _ := doc.WriteToBytes()
+	return buf
+}
+
+// ParseCertificate reads a PEM or base64 DER certificate, as pasted
+// from an IdP console.
+func ParseCertificate(raw string) (*x509.Certificate, error) {
+	if block, _ := pem.Decode([]byte(raw)); block != nil {
+		return x509.ParseCertificate(block.Bytes)
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(raw), ""))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func boolAttr(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// child returns the first child element of el named tag. Elements are
+// matched by local name: validated elements are detached copies, whose
+// prefixes may not resolve.
+func child(el *etree.Element, tag string) *etree.Element {
+	if els := children(el, tag); len(els) > 0 {
+		return els[0]
+	}
+	return nil
+}
+
+func children(el *etree.Element, tag string) []*etree.Element {
+	var res []*etree.Element
+	for _, c := range el.ChildElements() {
+		if c.Tag == tag {
+			res = append(res, c)
+		}
+	}
+	return res
+}
@@ -0,0 +1,233 @@
+package saml
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var (
+	errInvalidResponse  = errors.New("saml: the response is invalid")
+	errInvalidSignature = errors.New("saml: the response is not signed by the identity provider")
+	errEncrypted        = errors.New("saml: encrypted assertions are not supported")
+	errWrongIssuer      = errors.New("saml: the response was issued by another identity provider")
+	errWrongDestination = errors.New("saml: the response is meant for another service provider")
+	errWrongAudience    = errors.New("saml: the assertion is meant for another audience")
+	errWrongRequest     = errors.New("saml: the response doesn't answer the request")
+	errExpired          = errors.New("saml: the assertion is expired or not yet valid")
+)
+
+const (
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// assertion holds what the SP uses of a validated assertion.
+type assertion struct {
+	ID           string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	AuthnInstant time.Time
+	// NotOnOrAfter is when the assertion expires, until then its id is
+	// kept to reject replays.
+	NotOnOrAfter time.Time
+	// Attributes are indexed by name and friendly name.
+	Attributes map[string][]string
+}
+
+// validation is what a response must match.
+type validation struct {
+	idp       *IdP
+	entityID  string
+	acs       string
+	requestID string
+	now       time.Time
+	skew      time.Duration
+}
+
+// parseResponse decodes a SAMLResponse of the POST binding and returns
+// its assertion once validated. Either the response or the assertion
+// must be signed, and only the signed elements are read to rule out
+// signature wrapping.
+func parseResponse(raw string, v validation) (*assertion, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(raw), ""))
+	if err != nil {
+		return nil, errInvalidResponse
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, errInvalidResponse
+	}
+	res := doc.Root()
+	if res == nil || res.Tag != "Response" {
+		return nil, errInvalidResponse
+	}
+	if d := res.SelectAttrValue("Destination", ""); d != "" && d != v.acs {
+		return nil, errWrongDestination
+	}
+	if res.SelectAttrValue("InResponseTo", "") != v.requestID {
+		return nil, errWrongRequest
+	}
+	if iss := child(res, "Issuer"); iss != nil && strings.TrimSpace(iss.Text()) != v.idp.EntityID {
+		return nil, errWrongIssuer
+	}
+	if code := res.FindElement("./Status/StatusCode"); code == nil || code.SelectAttrValue("Value", "") != statusSuccess {
+		status := "missing status"
+		if code != nil {
+			status = code.SelectAttrValue("Value", "")
+			if sub := child(code, "StatusCode"); sub != nil {
+				status = sub.SelectAttrValue("Value", "")
+			}
+		}
+		return nil, fmt.Errorf("saml: the identity provider refused the login: %s", status)
+	}
+	if child(res, "EncryptedAssertion") != nil {
+		return nil, errEncrypted
+	}
+	if len(children(res, "Assertion")) != 1 {
+		return nil, errInvalidResponse
+	}
+
+	vctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: v.idp.Certificates})
+	vctx.Clock = dsig.NewFakeClockAt(v.now)
+	var signed *etree.Element
+	if child(res, "Signature") != nil {
+		validated, err := vctx.Validate(res)
+		if err != nil {
+			return nil, errInvalidSignature
+		}
+		signed = child(validated, "Assertion")
+	}
+	a := children(res, "Assertion")[0]
+	if signed != nil {
+		a = signed
+	}
+	if child(a, "Signature") != nil {
+		validated, err := vctx.Validate(a)
+		if err != nil {
+			return nil, errInvalidSignature
+		}
+		signed = validated
+	}
+	if signed == nil {
+		return nil, errInvalidSignature
+	}
+	return readAssertion(signed, v)
+}
+
+// readAssertion checks the issuer, subject confirmation and conditions
+// of a signed assertion and reads it.
+func readAssertion(a *etree.Element, v validation) (*assertion, error) {
+	res := &assertion{ID: a.SelectAttrValue("ID", ""), Attributes: map[string][]string{}}
+	if res.ID == "" {
+		return nil, errInvalidResponse
+	}
+	if iss := child(a, "Issuer"); iss == nil || strings.TrimSpace(iss.Text()) != v.idp.EntityID {
+		return nil, errWrongIssuer
+	}
+	subject := child(a, "Subject")
+	if subject == nil {
+		return nil, errInvalidResponse
+	}
+	if id := child(subject, "NameID"); id != nil {
+		res.NameID = strings.TrimSpace(id.Text())
+		res.NameIDFormat = id.SelectAttrValue("Format", nameIDUnspecified)
+	}
+
+	// a bearer confirmation must be for this SP and request, and current
+	confirmed := false
+	for _, sc := range children(subject, "SubjectConfirmation") {
+		data := child(sc, "SubjectConfirmationData")
+		if sc.SelectAttrValue("Method", "") != methodBearer || data == nil {
+			continue
+		}
+		if data.SelectAttrValue("Recipient", "") != v.acs ||
+			data.SelectAttrValue("InResponseTo", "") != v.requestID {
+			continue
+		}
+		notOnOrAfter, err := parseTime(data.SelectAttrValue("NotOnOrAfter", ""))
+		if err != nil || !v.now.Before(notOnOrAfter.Add(v.skew)) {
+			continue
+		}
+		confirmed = true
+		res.NotOnOrAfter = notOnOrAfter
+	}
+	if !confirmed {
+		return nil, errWrongRequest
+	}
+
+	conditions := child(a, "Conditions")
+	if conditions == nil {
+		return nil, errWrongAudience
+	}
+	if nb := conditions.SelectAttrValue("NotBefore", ""); nb != "" {
+		t, err := parseTime(nb)
+		if err != nil || v.now.Add(v.skew).Before(t) {
+			return nil, errExpired
+		}
+	}
+	if na := conditions.SelectAttrValue("NotOnOrAfter", ""); na != "" {
+		t, err := parseTime(na)
+		if err != nil || !v.now.Before(t.Add(v.skew)) {
+			return nil, errExpired
+		}
+		if t.Before(res.NotOnOrAfter) {
+			res.NotOnOrAfter = t
+		}
+	}
+	restrictions := children(conditions, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return nil, errWrongAudience
+	}
+	// every restriction must be met
+	for _, ar := range restrictions {
+		if !slices.ContainsFunc(children(ar, "Audience"), func(el *etree.Element) bool {
+			return strings.TrimSpace(el.Text()) == v.entityID
+		}) {
+			return nil, errWrongAudience
+		}
+	}
+
+	if as := child(a, "AuthnStatement"); as != nil {
+		res.AuthnInstant, _ = parseTime(as.SelectAttrValue("AuthnInstant", ""))
+		res.SessionIndex = as.SelectAttrValue("SessionIndex", "")
+	}
+	for _, st := range children(a, "AttributeStatement") {
+		for _, attr := range children(st, "Attribute") {
+			var values []string
+			for _, val := range children(attr, "AttributeValue") {
+				values = append(values, strings.TrimSpace(val.Text()))
+			}
+			for _, key := range []string{attr.SelectAttrValue("Name", ""), attr.SelectAttrValue("FriendlyName", "")} {
+				if key != "" {
+					res.Attributes[key] = append(res.Attributes[key], values...)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// attribute returns the first value of the first of names the assertion
+// has.
+func (a *assertion) attribute(names ...string) string {
+	for _, n := range names {
+		for _, v := range a.Attributes[n] {
+			if v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
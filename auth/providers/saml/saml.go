@@ -0,0 +1,651 @@
+// Package saml is a SAML 2.0 service provider: users of an organization
+// sign in with its identity provider, which posts a signed assertion
+// back after the provider redirected them to it.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/utilities"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var (
+	errUnknownOrganization = errors.New("saml: unknown organization")
+	errUnknownRequest      = errors.New("saml: the login request is unknown or expired")
+	errWrongBrowser        = errors.New("saml: the login was started from another browser")
+	errReplayed            = errors.New("saml: the assertion was already used")
+	errNoEmail             = errors.New("saml: the assertion has no email address")
+	errNotProvisioned      = errors.New("saml: the user doesn't exist")
+	errNotLinked           = errors.New("saml: the account isn't linked to this organization")
+	errDomain              = errors.New("saml: the email domain isn't verified for this organization")
+	errRedirectNotAllowed  = errors.New("saml: redirect url is not allowed")
+)
+
+const name = "saml"
+
+// requestCookie binds AuthnRequests to the browser that started them.
+const requestCookie = "saml_request"
+
+type Option func(*samlProviderConfig)
+
+// Attributes names the assertion attributes user fields are read from,
+// the first one present is used. The email falls back to the NameID.
+type Attributes struct {
+	Email       []string
+	GivenName   []string
+	FamilyName  []string
+	DisplayName []string
+}
+
+type samlProviderConfig struct {
+	base_url       string
+	entity_id      string
+	idps           map[string]*IdP
+	resolve        func(ctx context.Context, org string) (*IdP, error)
+	cert           *x509.Certificate
+	key            crypto.Signer
+	attributes     Attributes
+	provision      bool
+	idp_initiated  bool
+	redirects      []string
+	skew           time.Duration
+	request_expiry time.Duration
+	now            func() time.Time
+	success        func(w http.ResponseWriter, status_code int, data interface{})
+	error          func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int)
+}
+
+// WithBaseURL sets the url the provider is mounted at, e.g.
+// https://example.com/auth/saml. It is derived from requests by default,
+// which is only correct when the provider isn't behind a proxy rewriting
+// paths.
+func WithBaseURL(u string) Option {
+	return func(c *samlProviderConfig) {
+		c.base_url = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithEntityID sets the entity id of the SP for every organization. By
+// default each organization gets the url of its metadata.
+func WithEntityID(id string) Option {
+	return func(c *samlProviderConfig) {
+		c.entity_id = id
+	}
+}
+
+// WithIdP sets the identity provider of an organization, see
+// ParseMetadata.
+func WithIdP(org string, idp *IdP) Option {
+	return func(c *samlProviderConfig) {
+		c.idps[org] = idp
+	}
+}
+
+// WithIdPResolver looks up the identity provider of organizations not
+// set with WithIdP, e.g. from metadata stored per tenant.
+func WithIdPResolver(fn func(ctx context.Context, org string) (*IdP, error)) Option {
+	return func(c *samlProviderConfig) {
+		c.resolve = fn
+	}
+}
+
+// WithSigningKey signs AuthnRequests with key, its certificate being
+// published in the SP metadata.
+func WithSigningKey(cert *x509.Certificate, key crypto.Signer) Option {
+	return func(c *samlProviderConfig) {
+		c.cert = cert
+		c.key = key
+	}
+}
+
+// WithAttributes sets the attributes user fields are read from. The
+// defaults cover Okta, Entra ID, ADFS and Google Workspace.
+func WithAttributes(a Attributes) Option {
+	return func(c *samlProviderConfig) {
+		c.attributes = a
+	}
+}
+
+// WithoutProvisioning rejects users that don't exist yet, instead of
+// creating them on their first login.
+func WithoutProvisioning() Option {
+	return func(c *samlProviderConfig) {
+		c.provision = false
+	}
+}
+
+// WithIdPInitiated accepts responses the SP didn't request, sent when
+// users start from the IdP dashboard. They can't be bound to a browser
+// and are refused by default.
+func WithIdPInitiated() Option {
+	return func(c *samlProviderConfig) {
+		c.idp_initiated = true
+	}
+}
+
+// WithRedirects sets the urls the ACS may redirect to after login. A
+// login may ask for any url below one of them with redirect_to, the
+// first one is used when it doesn't. Without redirects the ACS responds
+// with the user.
+func WithRedirects(urls ...string) Option {
+	return func(c *samlProviderConfig) {
+		c.redirects = urls
+	}
+}
+
+// WithClockSkew sets the difference tolerated between the clocks of the
+// SP and the IdP, 3 minutes by default.
+func WithClockSkew(d time.Duration) Option {
+	return func(c *samlProviderConfig) {
+		c.skew = d
+	}
+}
+
+func SAMLProvider(opts ...Option) *providers.Provider {
+	cfg := &samlProviderConfig{
+		idps: map[string]*IdP{},
+		attributes: Attributes{
+			Email: []string{
+				"email", "mail", "Email", "emailAddress",
+				"urn:oid:0.9.2342.19200300.100.1.3",
+				"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+			},
+			GivenName: []string{
+				"givenName", "firstName", "first_name", "urn:oid:2.5.4.42",
+				"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname",
+			},
+			FamilyName: []string{
+				"sn", "surname", "lastName", "last_name", "urn:oid:2.5.4.4",
+				"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname",
+			},
+			DisplayName: []string{
+				"displayName", "name", "urn:oid:2.16.840.1.113730.3.1.241",
+				"http://schemas.microsoft.com/identity/claims/displayname",
+			},
+		},
+		provision:      true,
+		skew:           3 * time.Minute,
+		request_expiry: 10 * time.Minute,
+		now:            time.Now,
+		success: func(w http.ResponseWriter, status_code int, data interface{}) {
+			utilities.JSON(w).SetStatus(utilities.ResponseSuccess).
+				SetStatusCode(status_code).SetData(data).Send()
+		},
+		error: func(w http.ResponseWriter, status utilities.ResponseStatus, err error, status_code int) {
+			utilities.JSON(w).SetStatus(status).SetStatusCode(status_code).
+				SetMessage(err.Error()).Send()
+		},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &providers.Provider{
+		Name: name,
+		AMR:  []string{sessions.AMRFederated},
+		Init: func(r chi.Router, ctx *providers.ProviderConfig) {
+			store := ctx.Store
+			if store == nil {
+				store = storage.NewMemoryStorage()
+			}
+			r.Get("/metadata/{org}", func(w http.ResponseWriter, r *http.Request) {
+				org := chi.URLParam(r, "org")
+				if _, err := cfg.idp(r.Context(), org); err != nil {
+					cfg.error(w, utilities.ResponseFail, err, http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", "application/samlmetadata+xml")
+				_, _ = w.Write(cfg.metadata(cfg.entityID(r, org), cfg.acsURL(r, org)))
+			})
+			// authorize redirects to the IdP of the organization with an
+			// AuthnRequest, remembering it until the response comes back.
+			r.Get("/authorize", func(w http.ResponseWriter, r *http.Request) {
+				org := r.URL.Query().Get("org")
+				idp, err := cfg.idp(r.Context(), org)
+				if err != nil {
+					cfg.error(w, utilities.ResponseFail, err, http.StatusNotFound)
+					return
+				}
+				redirect := r.URL.Query().Get("redirect_to")
+				if redirect != "" {
+					if redirect, err = cfg.redirect(redirect); err != nil {
+						cfg.error(w, utilities.ResponseFail, err, http.StatusBadRequest)
+						return
+					}
+				}
+				u, err := cfg.authnRequest(w, r, store, org, idp, redirect)
+				if err != nil {
+					cfg.error(w, utilities.ResponseError, err, http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, u, http.StatusFound)
+			})
+			// acs consumes the response the IdP posts back.
+			r.Post("/acs/{org}", func(w http.ResponseWriter, r *http.Request) {
+				fallback, _ := cfg.redirect("")
+				fail := func(err error, status int, code string) {
+					if fallback != "" {
+						http.Redirect(w, r, withError(fallback, code), http.StatusSeeOther)
+						return
+					}
+					cfg.error(w, utilities.ResponseFail, err, status)
+				}
+				org := chi.URLParam(r, "org")
+				idp, err := cfg.idp(r.Context(), org)
+				if err != nil {
+					fail(err, http.StatusNotFound, "unknown_organization")
+					return
+				}
+				req, err := cfg.pending(r, store, org)
+				if err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, org, "", err.Error()))
+					fail(err, http.StatusBadRequest, "invalid_request")
+					return
+				}
+				a, err := parseResponse(r.PostFormValue("SAMLResponse"), validation{
+					idp:       idp,
+					entityID:  cfg.entityID(r, org),
+					acs:       cfg.acsURL(r, org),
+					requestID: req.ID,
+					now:       cfg.now(),
+					skew:      cfg.skew,
+				})
+				if err != nil {
+					ctx.Events.Publish(r.Context(), failedLogin(r, org, "", err.Error()))
+					fail(err, http.StatusBadRequest, "invalid_response")
+					return
+				}
+				// an assertion is accepted once, its id is remembered until
+				// it expires
+				n, err := store.Incr(r.Context(), "saml:assertion:"+idp.EntityID+":"+a.ID,
+					time.Until(a.NotOnOrAfter.Add(cfg.skew)))
+				if err != nil {
+					fail(err, http.StatusInternalServerError, "server_error")
+					return
+				}
+				if n > 1 {
+					ctx.Events.Publish(r.Context(), failedLogin(r, org, a.NameID, errReplayed.Error()))
+					fail(errReplayed, http.StatusBadRequest, "invalid_response")
+					return
+				}
+				user, status, err := cfg.login(w, r, ctx, org, idp, a)
+				if err != nil {
+					fail(err, status, "access_denied")
+					return
+				}
+				redirect := req.RedirectTo
+				if redirect == "" {
+					redirect = fallback
+				}
+				if redirect == "" {
+					cfg.success(w, http.StatusOK, user)
+					return
+				}
+				http.Redirect(w, r, redirect, http.StatusSeeOther)
+			})
+		},
+	}
+}
+
+// request is an AuthnRequest awaiting its response, stored under the
+// RelayState sent with it. Browser is the hash of the requestCookie of
+// the browser that sent it, so a response can't be posted to another
+// browser to sign it in to the attacker's account.
+type request struct {
+	ID         string `json:"id"`
+	Org        string `json:"org"`
+	RedirectTo string `json:"redirect_to,omitempty"`
+	Browser    string `json:"browser"`
+}
+
+func requestKey(relayState string) string {
+	return "saml:request:" + relayState
+}
+
+func (c *samlProviderConfig) idp(ctx context.Context, org string) (*IdP, error) {
+	if idp, ok := c.idps[org]; ok && org != "" {
+		return idp, nil
+	}
+	if c.resolve == nil || org == "" {
+		return nil, errUnknownOrganization
+	}
+	idp, err := c.resolve(ctx, org)
+	if err != nil || idp == nil {
+		return nil, errUnknownOrganization
+	}
+	return idp, nil
+}
+
+// baseURL returns the url the provider is mounted at.
+func (c *samlProviderConfig) baseURL(r *http.Request) string {
+	if c.base_url != "" {
+		return c.base_url
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	p := r.URL.Path
+	for _, route := range []string{"/metadata/", "/acs/", "/authorize"} {
+		if i := strings.LastIndex(p, route); i >= 0 {
+			p = p[:i]
+			break
+		}
+	}
+	return scheme + "://" + r.Host + p
+}
+
+func (c *samlProviderConfig) entityID(r *http.Request, org string) string {
+	if c.entity_id != "" {
+		return c.entity_id
+	}
+	return c.baseURL(r) + "/metadata/" + url.PathEscape(org)
+}
+
+func (c *samlProviderConfig) acsURL(r *http.Request, org string) string {
+	return c.baseURL(r) + "/acs/" + url.PathEscape(org)
+}
+
+// authnRequest stores a new AuthnRequest and returns the url sending it
+// to the IdP with the redirect binding. The requestCookie of the browser
+// is set on w, reusing the one it already sent.
+func (c *samlProviderConfig) authnRequest(w http.ResponseWriter, r *http.Request, store storage.Storage, org string,
+	idp *IdP, redirect string) (string, error) {
+	browser := ""
+	if cookie, err := r.Cookie(requestCookie); err == nil && cookie.Value != "" {
+		browser = cookie.Value
+	} else {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		browser = base64.RawURLEncoding.EncodeToString(b)
+	}
+	// the IdP posts the response cross site, the cookie is only sent
+	// along with SameSite=None
+	http.SetCookie(w, &http.Cookie{
+		Name:     requestCookie,
+		Value:    browser,
+		Path:     "/",
+		MaxAge:   int(c.request_expiry.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteNoneMode,
+	})
+	req := request{ID: "_" + uuid.NewString(), Org: org, RedirectTo: redirect, Browser: browserHash(browser)}
+	doc := etree.NewDocument()
+	el := doc.CreateElement("samlp:AuthnRequest")
+	el.CreateAttr("xmlns:samlp", nsProtocol)
+	el.CreateAttr("xmlns:saml", nsAssertion)
+	el.CreateAttr("ID", req.ID)
+	el.CreateAttr("Version", "2.0")
+	el.CreateAttr("IssueInstant", c.now().UTC().Format(time.RFC3339))
+	el.CreateAttr("Destination", idp.SSOURL)
+	el.CreateAttr("AssertionConsumerServiceURL", c.acsURL(r, org))
+	el.CreateAttr("ProtocolBinding", bindingPOST)
+	el.CreateElement("saml:Issuer").SetText(c.entityID(r, org))
+	policy := el.CreateElement("samlp:NameIDPolicy")
+	policy.CreateAttr("Format", nameIDUnspecified)
+	policy.CreateAttr("AllowCreate", "true")
+	raw, err := doc.WriteToBytes()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fw.Write(raw); err != nil {
+		return "", err
+	}
+	if err := fw.Close(); err != nil {
+		return "", err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	relayState := hex.EncodeToString(b)
+	state, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	if err := store.Set(r.Context(), requestKey(relayState), state, c.request_expiry); err != nil {
+		return "", err
+	}
+
+	// the signature covers the parameters in this order, as encoded
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(buf.Bytes())) +
+		"&RelayState=" + url.QueryEscape(relayState)
+	if c.key != nil {
+		sctx, err := dsig.NewSigningContext(c.key, [][]byte{c.cert.Raw})
+		if err != nil {
+			return "", err
+		}
+		query += "&SigAlg=" + url.QueryEscape(sctx.GetSignatureMethodIdentifier())
+		sig, err := sctx.SignString(query)
+		if err != nil {
+			return "", err
+		}
+		query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+	}
+	sep := "?"
+	if strings.Contains(idp.SSOURL, "?") {
+		sep = "&"
+	}
+	return idp.SSOURL + sep + query, nil
+}
+
+// pending returns the request a response answers, consuming it, once
+// checked it was sent by the browser posting the response. IdP initiated
+// responses have no request, when they are accepted.
+func (c *samlProviderConfig) pending(r *http.Request, store storage.Storage, org string) (*request, error) {
+	relayState := r.PostFormValue("RelayState")
+	if relayState != "" {
+		state, err := store.Get(r.Context(), requestKey(relayState))
+		if err == nil {
+			_ = store.Del(r.Context(), requestKey(relayState))
+			var req request
+			if err := json.Unmarshal(state, &req); err != nil || req.Org != org {
+				return nil, errUnknownRequest
+			}
+			cookie, err := r.Cookie(requestCookie)
+			if err != nil || subtle.ConstantTimeCompare([]byte(browserHash(cookie.Value)), []byte(req.Browser)) != 1 {
+				return nil, errWrongBrowser
+			}
+			return &req, nil
+		}
+	}
+	if !c.idp_initiated {
+		return nil, errUnknownRequest
+	}
+	// the RelayState of an IdP initiated login is not trusted as a
+	// redirect
+	return &request{Org: org}, nil
+}
+
+// login signs in the user of an assertion, creating it when it doesn't
+// exist yet and updating its name from the assertion. Users are linked
+// to the organization that provisioned them, or that owns the domain of
+// their address, and can't be signed in by the IdP of another one.
+func (c *samlProviderConfig) login(w http.ResponseWriter, r *http.Request, ctx *providers.ProviderConfig,
+	org string, idp *IdP, a *assertion) (*models.User, int, error) {
+	email := a.attribute(c.attributes.Email...)
+	if email == "" && (a.NameIDFormat == nameIDEmail || strings.Contains(a.NameID, "@")) {
+		email = a.NameID
+	}
+	email = models.NormalizeEmail(email)
+	if email == "" {
+		ctx.Events.Publish(r.Context(), failedLogin(r, org, a.NameID, errNoEmail.Error()))
+		return nil, http.StatusBadRequest, errNoEmail
+	}
+	if len(idp.Domains) > 0 && !idp.owns(email) {
+		ctx.Events.Publish(r.Context(), failedLogin(r, org, email, errDomain.Error()))
+		return nil, http.StatusForbidden, errDomain
+	}
+	now := time.Now().UTC()
+	user, err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("saml_organization", org),
+		database.WithFilter("saml_name_id", a.NameID)).First()
+	if err != nil {
+		user, err = ctx.User.WithContext(r.Context()).Query(database.WithFilter("email", email)).First()
+		if err == nil {
+			// the organization already owns the account when the NameID
+			// changed, otherwise only through its verified domains
+			if user.SAMLOrganization != org && (user.SAMLOrganization != "" || !idp.owns(email)) {
+				ctx.Events.Publish(r.Context(), failedLogin(r, org, email, errNotLinked.Error()))
+				return nil, http.StatusForbidden, errNotLinked
+			}
+			user.SAMLOrganization = org
+			user.SAMLNameID = a.NameID
+		}
+	}
+	if err != nil {
+		if !c.provision {
+			ctx.Events.Publish(r.Context(), failedLogin(r, org, email, "unknown user"))
+			return nil, http.StatusForbidden, errNotProvisioned
+		}
+		// the IdP vouches for the address of its users
+		user = &models.User{
+			ID:               uuid.New(),
+			Email:            email,
+			EmailVerified:    true,
+			EmailVerifiedAt:  now,
+			SAMLOrganization: org,
+			SAMLNameID:       a.NameID,
+			CreatedAt:        now,
+		}
+		c.profile(user, a)
+		e := newEvent(r, events.UserRegistered, org, user)
+		if err := ctx.Events.Check(r.Context(), e); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+		if err := ctx.User.WithContext(r.Context()).Save(*user); err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		ctx.Events.Publish(r.Context(), e)
+	}
+	if err := user.CheckStatus(time.Now()); err != nil {
+		ctx.Events.Publish(r.Context(), failedLogin(r, org, email, err.Error()))
+		return nil, http.StatusForbidden, fmt.Errorf("saml: %w", err)
+	}
+	e := newEvent(r, events.LoginSucceeded, org, user)
+	if err := ctx.Events.Check(r.Context(), e); err != nil {
+		ctx.Events.Publish(r.Context(), events.LoginRejected(e, err))
+		return nil, http.StatusForbidden, err
+	}
+	c.profile(user, a)
+	user.LastLogin = now.Unix()
+	if err := ctx.NewSession(w, r, user, name, sessions.AMRFederated); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if err := ctx.User.WithContext(r.Context()).Query(database.WithFilter("id", user.ID)).
+		Update(*user); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	ctx.Events.Publish(r.Context(), e)
+	return user, http.StatusOK, nil
+}
+
+// profile sets the name fields of user from the assertion attributes
+// it has.
+func (c *samlProviderConfig) profile(user *models.User, a *assertion) {
+	if v := a.attribute(c.attributes.GivenName...); v != "" {
+		user.GivenName = v
+	}
+	if v := a.attribute(c.attributes.FamilyName...); v != "" {
+		user.FamilyName = v
+	}
+	if v := a.attribute(c.attributes.DisplayName...); v != "" {
+		user.DisplayName = v
+	}
+}
+
+// redirect returns the url to redirect to after login, raw when it is
+// below one of the allowed redirects and the first one when raw is
+// empty.
+func (c *samlProviderConfig) redirect(raw string) (string, error) {
+	if raw == "" {
+		if len(c.redirects) > 0 {
+			return c.redirects[0], nil
+		}
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.User != nil {
+		return "", errRedirectNotAllowed
+	}
+	if u.Path != "" {
+		u.Path = path.Clean(u.Path)
+	}
+	for _, allowed := range c.redirects {
+		a, err := url.Parse(allowed)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, a.Scheme) && strings.EqualFold(u.Host, a.Host) &&
+			(u.Path == a.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(a.Path, "/")+"/")) {
+			return u.String(), nil
+		}
+	}
+	return "", errRedirectNotAllowed
+}
+
+func browserHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+func withError(redirect, code string) string {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return redirect
+	}
+	q := u.Query()
+	q.Set("error", code)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func newEvent(r *http.Request, t events.Type, org string, user *models.User) events.Event {
+	e := events.FromRequest(r, t, name)
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	e.Data = map[string]any{"organization": org}
+	return e
+}
+
+func failedLogin(r *http.Request, org, email, reason string) events.Event {
+	e := events.FromRequest(r, events.LoginFailed, name)
+	e.Email = email
+	e.Reason = reason
+	e.Data = map[string]any{"organization": org}
+	return e
+}
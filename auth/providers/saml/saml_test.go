@@ -0,0 +1,413 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	idpEntityID = "http://www.okta.com/exk1a2b3c4"
+	ssoURL      = "https://acme.okta.com/app/exk1a2b3c4/sso/saml"
+	spEntityID  = "http://example.com/saml/metadata/acme"
+	acsURL      = "http://example.com/saml/acs/acme"
+)
+
+// idpFixture signs responses as the IdP of the acme organization.
+type idpFixture struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newIdP(t *testing.T) *idpFixture {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "acme.okta.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &idpFixture{key: key, cert: cert}
+}
+
+func (f *idpFixture) metadata() []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+  <md:IDPSSODescriptor WantAuthnRequestsSigned="false" protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</md:NameIDFormat>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="%s"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="%s"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, idpEntityID, base64.StdEncoding.EncodeToString(f.cert.Raw), ssoURL, ssoURL))
+}
+
+// claims are what a response asserts, zero values get valid defaults.
+type claims struct {
+	requestID     string
+	email         string
+	audience      string
+	recipient     string
+	issuer        string
+	notOnOrAfter  time.Time
+	signResponse  bool
+	keepAssertion bool // leave the assertion unsigned
+}
+
+func (f *idpFixture) response(t *testing.T, c claims) *etree.Document {
+	now := time.Now().UTC()
+	if c.email == "" {
+		c.email = "jon@acme.com"
+	}
+	if c.audience == "" {
+		c.audience = spEntityID
+	}
+	if c.recipient == "" {
+		c.recipient = acsURL
+	}
+	if c.issuer == "" {
+		c.issuer = idpEntityID
+	}
+	if c.notOnOrAfter.IsZero() {
+		c.notOnOrAfter = now.Add(5 * time.Minute)
+	}
+	inResponseTo := ""
+	if c.requestID != "" {
+		inResponseTo = fmt.Sprintf(` InResponseTo="%s"`, c.requestID)
+	}
+	ts := func(t time.Time) string { return t.Format(time.RFC3339) }
+	raw := fmt.Sprintf(`<saml2p:Response xmlns:saml2p="urn:oasis:names:tc:SAML:2.0:protocol" Destination="%[1]s" ID="_%[2]s"%[3]s IssueInstant="%[4]s" Version="2.0">
+<saml2:Issuer xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion">%[5]s</saml2:Issuer>
+<saml2p:Status><saml2p:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></saml2p:Status>
+<saml2:Assertion xmlns:saml2="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%[6]s" IssueInstant="%[4]s" Version="2.0">
+<saml2:Issuer>%[5]s</saml2:Issuer>
+<saml2:Subject>
+<saml2:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%[7]s</saml2:NameID>
+<saml2:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+<saml2:SubjectConfirmationData%[3]s NotOnOrAfter="%[8]s" Recipient="%[9]s"/>
+</saml2:SubjectConfirmation>
+</saml2:Subject>
+<saml2:Conditions NotBefore="%[10]s" NotOnOrAfter="%[8]s">
+<saml2:AudienceRestriction><saml2:Audience>%[11]s</saml2:Audience></saml2:AudienceRestriction>
+</saml2:Conditions>
+<saml2:AuthnStatement AuthnInstant="%[4]s" SessionIndex="_%[6]s">
+<saml2:AuthnContext><saml2:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml2:AuthnContextClassRef></saml2:AuthnContext>
+</saml2:AuthnStatement>
+<saml2:AttributeStatement>
+<saml2:Attribute Name="firstName" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"><saml2:AttributeValue>Jon</saml2:AttributeValue></saml2:Attribute>
+<saml2:Attribute Name="lastName" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"><saml2:AttributeValue>Snow</saml2:AttributeValue></saml2:Attribute>
+</saml2:AttributeStatement>
+</saml2:Assertion>
+</saml2p:Response>`, acsURL, uuid.NewString(), inResponseTo, ts(now), c.issuer, uuid.NewString(),
+		c.email, ts(c.notOnOrAfter), c.recipient, ts(now.Add(-time.Minute)), c.audience)
+	doc := etree.NewDocument()
+	require.NoError(t, doc.ReadFromString(raw))
+
+	sctx, err := dsig.NewSigningContext(f.key, [][]byte{f.cert.Raw})
+	require.NoError(t, err)
+	sctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	res := doc.Root()
+	if !c.keepAssertion {
+		a := res.SelectElement("Assertion")
+		signed, err := sctx.SignEnveloped(a)
+		require.NoError(t, err)
+		res.RemoveChild(a)
+		res.AddChild(signed)
+	}
+	if c.signResponse {
+		signed, err := sctx.SignEnveloped(res)
+		require.NoError(t, err)
+		doc.SetRoot(signed)
+	}
+	return doc
+}
+
+func encode(t *testing.T, doc *etree.Document) string {
+	buf, err := doc.WriteToBytes()
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+func TestParseMetadata(t *testing.T) {
+	f := newIdP(t)
+	idp, err := ParseMetadata(f.metadata())
+	require.NoError(t, err)
+	assert.Equal(t, idpEntityID, idp.EntityID)
+	assert.Equal(t, ssoURL, idp.SSOURL)
+	require.Len(t, idp.Certificates, 1)
+	assert.True(t, idp.Certificates[0].Equal(f.cert))
+
+	_, err = ParseMetadata([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="x"/>`))
+	assert.ErrorIs(t, err, errInvalidMetadata)
+	_, err = ParseMetadata([]byte("not xml"))
+	assert.ErrorIs(t, err, errInvalidMetadata)
+}
+
+func TestParseResponse(t *testing.T) {
+	f := newIdP(t)
+	idp, err := ParseMetadata(f.metadata())
+	require.NoError(t, err)
+	v := validation{idp: idp, entityID: spEntityID, acs: acsURL, requestID: "_req", now: time.Now(), skew: time.Minute}
+
+	a, err := parseResponse(encode(t, f.response(t, claims{requestID: "_req"})), v)
+	require.NoError(t, err)
+	assert.Equal(t, "jon@acme.com", a.NameID)
+	assert.Equal(t, "Jon", a.attribute("firstName"))
+	assert.False(t, a.NotOnOrAfter.IsZero())
+
+	// a signed response covers its assertion
+	_, err = parseResponse(encode(t, f.response(t, claims{requestID: "_req", signResponse: true, keepAssertion: true})), v)
+	assert.NoError(t, err)
+	_, err = parseResponse(encode(t, f.response(t, claims{requestID: "_req", signResponse: true})), v)
+	assert.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		claims claims
+		err    error
+	}{
+		"Unsigned":      {claims{requestID: "_req", keepAssertion: true}, errInvalidSignature},
+		"Other Request": {claims{requestID: "_other"}, errWrongRequest},
+		"Unsolicited":   {claims{}, errWrongRequest},
+		"Audience":      {claims{requestID: "_req", audience: "https://evil.com"}, errWrongAudience},
+		"Recipient":     {claims{requestID: "_req", recipient: "https://evil.com/acs"}, errWrongRequest},
+		"Expired":       {claims{requestID: "_req", notOnOrAfter: time.Now().Add(-5 * time.Minute)}, errWrongRequest},
+		"Issuer":        {claims{requestID: "_req", issuer: "https://evil.com"}, errWrongIssuer},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := parseResponse(encode(t, f.response(t, tc.claims)), v)
+			assert.ErrorIs(t, err, tc.err)
+		})
+	}
+
+	t.Run("Tampered", func(t *testing.T) {
+		doc := f.response(t, claims{requestID: "_req"})
+		doc.FindElement("//NameID").SetText("admin@acme.com")
+		_, err := parseResponse(encode(t, doc), v)
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+
+	t.Run("Other Key", func(t *testing.T) {
+		_, err := parseResponse(encode(t, newIdP(t).response(t, claims{requestID: "_req"})), v)
+		assert.ErrorIs(t, err, errInvalidSignature)
+	})
+
+	t.Run("Wrapping", func(t *testing.T) {
+		// a forged assertion next to the signed one
+		doc := f.response(t, claims{requestID: "_req"})
+		forged := doc.Root().SelectElement("Assertion").Copy()
+		forged.RemoveChild(forged.SelectElement("Signature"))
+		forged.CreateAttr("ID", "_forged")
+		forged.FindElement(".//NameID").SetText("admin@acme.com")
+		doc.Root().InsertChildAt(0, forged)
+		_, err := parseResponse(encode(t, doc), v)
+		assert.ErrorIs(t, err, errInvalidResponse)
+	})
+}
+
+func TestProvider(t *testing.T) {
+	f := newIdP(t)
+	idp, err := ParseMetadata(f.metadata())
+	require.NoError(t, err)
+	users := testdb.New[models.User]()
+	store := storage.NewMemoryStorage()
+	router := func(opts ...Option) http.Handler {
+		p := SAMLProvider(append([]Option{WithIdP("acme", idp)}, opts...)...)
+		sub := chi.NewRouter()
+		p.Init(sub, &providers.ProviderConfig{
+			User:    users,
+			Session: session.NewJWTSession(),
+			Events:  events.New(),
+			Store:   store,
+		})
+		r := chi.NewRouter()
+		r.Mount("/saml", sub)
+		return r
+	}
+	h := router()
+	do := func(h http.Handler, r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	post := func(h http.Handler, samlResponse, relayState string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		form := url.Values{"SAMLResponse": {samlResponse}, "RelayState": {relayState}}
+		r := httptest.NewRequest(http.MethodPost, "/saml/acs/acme", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		return do(h, r)
+	}
+
+	t.Run("Metadata", func(t *testing.T) {
+		w := do(h, httptest.NewRequest(http.MethodGet, "/saml/metadata/acme", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `entityID="`+spEntityID+`"`)
+		assert.Contains(t, w.Body.String(), `Location="`+acsURL+`"`)
+		assert.Equal(t, http.StatusNotFound, do(h, httptest.NewRequest(http.MethodGet, "/saml/metadata/globex", nil)).Code)
+	})
+
+	var requestID, relayState string
+	var browser []*http.Cookie
+	t.Run("Authorize", func(t *testing.T) {
+		w := do(h, httptest.NewRequest(http.MethodGet, "/saml/authorize?org=acme", nil))
+		require.Equal(t, http.StatusFound, w.Code)
+		browser = w.Result().Cookies()
+		require.Len(t, browser, 1)
+		assert.Equal(t, http.SameSiteNoneMode, browser[0].SameSite)
+		loc, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		assert.Equal(t, ssoURL, loc.Scheme+"://"+loc.Host+loc.Path)
+		relayState = loc.Query().Get("RelayState")
+		require.NotEmpty(t, relayState)
+
+		deflated, err := base64.StdEncoding.DecodeString(loc.Query().Get("SAMLRequest"))
+		require.NoError(t, err)
+		raw, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		require.NoError(t, err)
+		doc := etree.NewDocument()
+		require.NoError(t, doc.ReadFromBytes(raw))
+		req := doc.Root()
+		assert.Equal(t, "AuthnRequest", req.Tag)
+		assert.Equal(t, acsURL, req.SelectAttrValue("AssertionConsumerServiceURL", ""))
+		assert.Equal(t, spEntityID, req.SelectElement("Issuer").Text())
+		requestID = req.SelectAttrValue("ID", "")
+
+		assert.Equal(t, http.StatusNotFound, do(h, httptest.NewRequest(http.MethodGet, "/saml/authorize?org=globex", nil)).Code)
+	})
+
+	t.Run("ACS", func(t *testing.T) {
+		samlResponse := encode(t, f.response(t, claims{requestID: requestID}))
+		w := post(h, samlResponse, relayState, browser...)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NotEmpty(t, w.Header().Get("Auth-Token"))
+		user, err := users.Query(database.WithFilter("email", "jon@acme.com")).First()
+		require.NoError(t, err)
+		assert.True(t, user.EmailVerified)
+		assert.Equal(t, "Jon", user.GivenName)
+		assert.Equal(t, "Snow", user.FamilyName)
+
+		// the request is answered once
+		assert.Equal(t, http.StatusBadRequest, post(h, samlResponse, relayState, browser...).Code)
+		// unsolicited responses are refused by default
+		assert.Equal(t, http.StatusBadRequest, post(h, encode(t, f.response(t, claims{})), "").Code)
+	})
+
+	t.Run("Other Browser", func(t *testing.T) {
+		// a response to a request started in the attacker's browser
+		w := do(h, httptest.NewRequest(http.MethodGet, "/saml/authorize?org=acme", nil))
+		loc, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		deflated, _ := base64.StdEncoding.DecodeString(loc.Query().Get("SAMLRequest"))
+		raw, _ := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		doc := etree.NewDocument()
+		require.NoError(t, doc.ReadFromBytes(raw))
+		samlResponse := encode(t, f.response(t, claims{requestID: doc.Root().SelectAttrValue("ID", ""), email: "arya@acme.com"}))
+
+		// can't be posted by the victim's
+		other := &http.Cookie{Name: requestCookie, Value: "victim"}
+		assert.Equal(t, http.StatusBadRequest, post(h, samlResponse, loc.Query().Get("RelayState"), other).Code)
+	})
+
+	t.Run("IdP Initiated", func(t *testing.T) {
+		h := router(WithIdPInitiated())
+		samlResponse := encode(t, f.response(t, claims{email: "arya@acme.com"}))
+		require.Equal(t, http.StatusOK, post(h, samlResponse, "").Code)
+		// replayed assertions are refused
+		assert.Equal(t, http.StatusBadRequest, post(h, samlResponse, "").Code)
+	})
+
+	t.Run("Provisioning", func(t *testing.T) {
+		h := router(WithIdPInitiated(), WithoutProvisioning())
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "sansa@acme.com"})), "").Code)
+		assert.Equal(t, http.StatusOK, post(h, encode(t, f.response(t, claims{email: "jon@acme.com"})), "").Code)
+
+		user, err := users.Query(database.WithFilter("email", "jon@acme.com")).First()
+		require.NoError(t, err)
+		user.Status = models.StatusDisabled
+		require.NoError(t, users.Query(database.WithFilter("id", user.ID)).Update(*user))
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "jon@acme.com"})), "").Code)
+	})
+
+	t.Run("Accounts", func(t *testing.T) {
+		h := router(WithIdPInitiated())
+		// accounts the organization didn't provision can't be taken over
+		ceo := models.User{ID: uuid.New(), Email: "ceo@globex.com", EmailVerified: true}
+		robb := models.User{ID: uuid.New(), Email: "robb@acme.com", EmailVerified: true}
+		require.NoError(t, users.Save(ceo, robb))
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "ceo@globex.com"})), "").Code)
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "robb@acme.com"})), "").Code)
+
+		// unless they are in a domain verified for it
+		verified := *idp
+		verified.Domains = []string{"acme.com"}
+		h = router(WithIdPInitiated(), WithIdP("acme", &verified))
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "ceo@globex.com"})), "").Code)
+		assert.Equal(t, http.StatusOK, post(h, encode(t, f.response(t, claims{email: "robb@acme.com"})), "").Code)
+		user, err := users.Query(database.WithFilter("id", robb.ID)).First()
+		require.NoError(t, err)
+		assert.Equal(t, "acme", user.SAMLOrganization)
+		assert.Equal(t, "robb@acme.com", user.SAMLNameID)
+
+		// accounts linked to another organization can't be signed in
+		// even in a verified domain
+		user.SAMLOrganization, user.SAMLNameID = "globex", "robb"
+		require.NoError(t, users.Query(database.WithFilter("id", robb.ID)).Update(*user))
+		assert.Equal(t, http.StatusForbidden, post(h, encode(t, f.response(t, claims{email: "robb@acme.com"})), "").Code)
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		h := router(WithRedirects("https://app.example.com/"))
+		assert.Equal(t, http.StatusBadRequest, do(h, httptest.NewRequest(http.MethodGet, "/saml/authorize?org=acme&redirect_to=https://evil.com", nil)).Code)
+		w := do(h, httptest.NewRequest(http.MethodGet, "/saml/authorize?org=acme&redirect_to=https://app.example.com/home", nil))
+		browser := w.Result().Cookies()
+		loc, err := url.Parse(w.Header().Get("Location"))
+		require.NoError(t, err)
+		deflated, _ := base64.StdEncoding.DecodeString(loc.Query().Get("SAMLRequest"))
+		raw, _ := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+		doc := etree.NewDocument()
+		require.NoError(t, doc.ReadFromBytes(raw))
+
+		w = post(h, encode(t, f.response(t, claims{requestID: doc.Root().SelectAttrValue("ID", ""), email: "bran@acme.com"})), loc.Query().Get("RelayState"), browser...)
+		require.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Equal(t, "https://app.example.com/home", w.Header().Get("Location"))
+		w = post(h, encode(t, f.response(t, claims{})), "")
+		assert.Equal(t, "https://app.example.com/?error=invalid_request", w.Header().Get("Location"))
+	})
+}
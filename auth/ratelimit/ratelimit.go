@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/utilities"
+)
+
+var errTooManyRequests = errors.New("ratelimit: too many requests, try again later")
+
+// maxBodySize bounds how much of a request body is read to find the
+// email address it targets.
+const maxBodySize = 1 << 20
+
+// Rule allows Limit requests within a sliding Window. A zero Rule
+// disables the limit.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+func (r Rule) enabled() bool {
+	return r.Limit > 0 && r.Window > 0
+}
+
+type Options func(*Limiter)
+
+// PerIP limits the requests a client ip can make to a single route.
+func PerIP(limit int, window time.Duration) Options {
+	return func(l *Limiter) {
+		l.ip = Rule{Limit: limit, Window: window}
+	}
+}
+
+// PerEmail limits the requests targeting the email address found in
+// the JSON body of a request to a single route.
+func PerEmail(limit int, window time.Duration) Options {
+	return func(l *Limiter) {
+		l.email = Rule{Limit: limit, Window: window}
+	}
+}
+
+// Route overrides the ip and email rules for a route, given as the
+// method and full path e.g "POST /magic-link/authorize".
+func Route(route string, ip, email Rule) Options {
+	return func(l *Limiter) {
+		l.routes[route] = [2]Rule{ip, email}
+	}
+}
+
+// Limiter counts requests in storage using a sliding window counter,
+// the count of the previous window is weighted by how much of it still
+// overlaps the sliding window.
+type Limiter struct {
+	store  storage.Storage
+	ip     Rule
+	email  Rule
+	routes map[string][2]Rule
+}
+
+func New(store storage.Storage, opts ...Options) *Limiter {
+	cfg := &Limiter{
+		store:  store,
+		ip:     Rule{Limit: 60, Window: time.Minute},
+		email:  Rule{Limit: 10, Window: 10 * time.Minute},
+		routes: make(map[string][2]Rule),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// Handler rejects requests over the limit with 429 Too Many Requests
+// and a Retry-After header.
+func (l *Limiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.Method + " " + r.URL.Path
+		ip, email := l.ip, l.email
+		if rules, ok := l.routes[route]; ok {
+			ip, email = rules[0], rules[1]
+		}
+
+		if ip.enabled() {
+			if wait, err := l.Allow(r.Context(), "ip:"+route+":"+events.ClientIP(r), ip); err == nil && wait > 0 {
+				reject(w, wait)
+				return
+			}
+		}
+		if email.enabled() {
+			if addr := readEmail(r); addr != "" {
+				if wait, err := l.Allow(r.Context(), "email:"+route+":"+addr, email); err == nil && wait > 0 {
+					reject(w, wait)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Allow counts a request against key and returns how long the caller
+// has to wait when the rule's limit is exceeded.
+func (l *Limiter) Allow(ctx context.Context, key string, rule Rule) (time.Duration, error) {
+	now := time.Now()
+	window := now.UnixNano() / int64(rule.Window)
+	elapsed := time.Duration(now.UnixNano() % int64(rule.Window))
+	key = "ratelimit:" + key + ":"
+
+	current, err := l.store.Incr(ctx, key+strconv.FormatInt(window, 10), 2*rule.Window)
+	if err != nil {
+		return 0, err
+	}
+	var previous int64
+	if b, err := l.store.Get(ctx, key+strconv.FormatInt(window-1, 10)); err == nil {
+		previous, _ = strconv.ParseInt(string(b), 10, 64)
+	}
+
+	weight := 1 - float64(elapsed)/float64(rule.Window)
+	if float64(previous)*weight+float64(current) <= float64(rule.Limit) {
+		return 0, nil
+	}
+	return rule.Window - elapsed, nil
+}
+
+func reject(w http.ResponseWriter, wait time.Duration) {
+	if wait <= 0 {
+		wait = time.Second
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	utilities.JSON(w).SetStatus(utilities.ResponseFail).SetStatusCode(http.StatusTooManyRequests).
+		SetMessage(errTooManyRequests.Error()).Send()
+}
+
+// readEmail peeks at the JSON body for an email field and restores the
+// body for the next handler.
+func readEmail(r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, "application/json") {
+		return ""
+	}
+	b, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return ""
+	}
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return ""
+	}
+	return models.NormalizeEmail(body.Email)
+}
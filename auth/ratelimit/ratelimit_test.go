@@ -0,0 +1,60 @@
+package ratelimit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter(t *testing.T) {
+	limiter := New(storage.NewMemoryStorage(), PerIP(3, time.Minute), PerEmail(2, time.Minute),
+		Route("POST /open", Rule{}, Rule{}))
+
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the body must still be readable after the limiter peeked at it
+		b, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.NotEmpty(t, b)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(path, email, ip string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		err := json.NewEncoder(&buf).Encode(map[string]string{"email": email})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, path, &buf)
+		req.RemoteAddr = ip + ":1234"
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+
+	t.Run("Limit By Email", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("/authorize", "jon@doe.com", "10.0.0.1").Code)
+		assert.Equal(t, http.StatusOK, send("/authorize", "jon@doe.com", "10.0.0.2").Code)
+		res := send("/authorize", "jon@doe.com", "10.0.0.3")
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.NotEmpty(t, res.Header().Get("Retry-After"))
+	})
+
+	t.Run("Limit By IP", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, send("/resend", "a@doe.com", "10.0.0.9").Code)
+		assert.Equal(t, http.StatusOK, send("/resend", "b@doe.com", "10.0.0.9").Code)
+		assert.Equal(t, http.StatusOK, send("/resend", "c@doe.com", "10.0.0.9").Code)
+		assert.Equal(t, http.StatusTooManyRequests, send("/resend", "d@doe.com", "10.0.0.9").Code)
+	})
+
+	t.Run("Route Override", func(t *testing.T) {
+		for range 5 {
+			assert.Equal(t, http.StatusOK, send("/open", "jon@doe.com", "10.0.0.1").Code)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package risk
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var errGeoColumns = errors.New("risk: the geoip csv needs network, latitude and longitude columns")
+
+// Location is where an ip is located.
+type Location struct {
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoIP locates ip addresses.
+type GeoIP interface {
+	Locate(ip netip.Addr) (Location, bool)
+}
+
+// GeoDB is an in-memory GeoIP database of networks, looked up by
+// longest prefix.
+type GeoDB struct {
+	// networks by prefix length, bits lists the lengths longest first
+	networks map[int]map[netip.Prefix]Location
+	bits     []int
+}
+
+// OpenGeoCSV loads the GeoIP database of the csv file at path, see
+// LoadGeoCSV.
+func OpenGeoCSV(path string) (*GeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadGeoCSV(f)
+}
+
+// LoadGeoCSV reads a GeoIP database from csv with a header naming its
+// network, latitude and longitude columns, and optionally a country or
+// country_iso_code column. The blocks files of GeoLite2 City have this
+// layout. Rows without coordinates are skipped.
+func LoadGeoCSV(r io.Reader) (*GeoDB, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		col[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	network, ok1 := col["network"]
+	lat, ok2 := col["latitude"]
+	lon, ok3 := col["longitude"]
+	if !ok1 || !ok2 || !ok3 {
+		return nil, errGeoColumns
+	}
+	country, ok := col["country_iso_code"]
+	if !ok {
+		country, ok = col["country"]
+	}
+	if !ok {
+		country = -1
+	}
+	db := &GeoDB{networks: map[int]map[netip.Prefix]Location{}}
+	for {
+		row, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(row) <= max(network, lat, lon) {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(row[network]))
+		if err != nil {
+			return nil, err
+		}
+		var loc Location
+		if loc.Latitude, err = strconv.ParseFloat(strings.TrimSpace(row[lat]), 64); err != nil {
+			continue
+		}
+		if loc.Longitude, err = strconv.ParseFloat(strings.TrimSpace(row[lon]), 64); err != nil {
+			continue
+		}
+		if country >= 0 && country < len(row) {
+			loc.Country = strings.TrimSpace(row[country])
+		}
+		db.Add(prefix, loc)
+	}
+	return db, nil
+}
+
+// Add locates the ips of prefix at loc.
+func (db *GeoDB) Add(prefix netip.Prefix, loc Location) {
+	if db.networks == nil {
+		db.networks = map[int]map[netip.Prefix]Location{}
+	}
+	prefix = unmap(prefix).Masked()
+	bits := prefix.Bits()
+	if db.networks[bits] == nil {
+		db.networks[bits] = map[netip.Prefix]Location{}
+		db.bits = append(db.bits, bits)
+		slices.Sort(db.bits)
+		slices.Reverse(db.bits)
+	}
+	db.networks[bits][prefix] = loc
+}
+
+// Locate implements GeoIP.
+func (db *GeoDB) Locate(ip netip.Addr) (Location, bool) {
+	ip = ip.Unmap()
+	for _, bits := range db.bits {
+		if bits > ip.BitLen() {
+			continue
+		}
+		prefix, err := ip.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		if loc, ok := db.networks[bits][prefix]; ok {
+			return loc, true
+		}
+	}
+	return Location{}, false
+}
+
+// unmap turns IPv4-mapped IPv6 prefixes into IPv4 ones.
+func unmap(p netip.Prefix) netip.Prefix {
+	if !p.Addr().Is4In6() {
+		return p
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), max(p.Bits()-96, 0))
+}
+
+// Distance returns the great-circle distance between a and b in
+// kilometres.
+func Distance(a, b Location) float64 {
+	const earthRadius = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dlat := rad(b.Latitude - a.Latitude)
+	dlon := rad(b.Longitude - a.Longitude)
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(rad(a.Latitude))*math.Cos(rad(b.Latitude))*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
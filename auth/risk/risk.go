@@ -0,0 +1,403 @@
+// Package risk evaluates how suspicious a sign in is from the devices
+// and networks a user signed in from before, recent failed logins and
+// how far the user would have travelled since their last sign in. Risky
+// sign ins can require a second factor, see sessions.Record.RequiredACR,
+// and notify the user.
+package risk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/notify"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+type Signal string
+
+const (
+	// NewDevice is a device the user never signed in from.
+	NewDevice Signal = "new_device"
+	// NewNetwork is an ip range the user never signed in from, a /24
+	// for IPv4 and a /48 for IPv6.
+	NewNetwork Signal = "new_network"
+	// FailureVelocity is a burst of failed logins for the user.
+	FailureVelocity Signal = "failure_velocity"
+	// ImpossibleTravel is a location too far from the last sign in of
+	// the user to have travelled since.
+	ImpossibleTravel Signal = "impossible_travel"
+)
+
+// maxNetworks is how many networks are remembered per device.
+const maxNetworks = 10
+
+// Device is a device a user signed in from.
+type Device struct {
+	ID          uuid.UUID `json:"id" db:"id,index,required,unique"`
+	UserID      uuid.UUID `json:"user_id" db:"user_id,index,required"`
+	Fingerprint string    `json:"-" db:"fingerprint,index"`
+	Name        string    `json:"name" db:"name"`
+	// Networks is the space separated list of networks the device
+	// signed in from, the most recent last.
+	Networks   string    `json:"-" db:"networks"`
+	IP         string    `json:"ip" db:"ip"`
+	Located    bool      `json:"-" db:"located"`
+	Country    string    `json:"country,omitempty" db:"country"`
+	Latitude   float64   `json:"-" db:"latitude"`
+	Longitude  float64   `json:"-" db:"longitude"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+}
+
+// Assessment is the risk of a sign in.
+type Assessment struct {
+	Score       int       `json:"score"`
+	Signals     []Signal  `json:"signals"`
+	Fingerprint string    `json:"-"`
+	Network     string    `json:"network,omitempty"`
+	Location    *Location `json:"location,omitempty"`
+	// RequireMFA and Notify report whether the score reached the
+	// thresholds of the evaluator.
+	RequireMFA bool `json:"require_mfa"`
+	Notify     bool `json:"notify"`
+}
+
+type Options func(*Evaluator)
+
+// Evaluator assesses sign ins, see Evaluate.
+type Evaluator struct {
+	model  database.Model[Device]
+	store  storage.Storage
+	events *events.Bus
+	notify notify.Notifier
+	geoip  GeoIP
+
+	weights        map[Signal]int
+	notify_at      int
+	mfa_at         int
+	failures       int64
+	failure_window time.Duration
+	max_speed      float64
+}
+
+// WithGeoIP locates sign ins with db to detect impossible travel, e.g
+// with a database loaded by OpenGeoCSV.
+func WithGeoIP(db GeoIP) Options {
+	return func(e *Evaluator) {
+		e.geoip = db
+	}
+}
+
+// WithWeight sets the score a signal adds. Defaults to 30 for NewDevice,
+// 20 for NewNetwork, 40 for FailureVelocity and 60 for ImpossibleTravel.
+func WithWeight(s Signal, weight int) Options {
+	return func(e *Evaluator) {
+		e.weights[s] = weight
+	}
+}
+
+// WithThresholds sets the scores from which the user is notified of the
+// sign in and has to authenticate with a second factor, 30 and 60 by
+// default. A threshold of 0 disables the action.
+func WithThresholds(notify, mfa int) Options {
+	return func(e *Evaluator) {
+		e.notify_at = notify
+		e.mfa_at = mfa
+	}
+}
+
+// WithFailureVelocity raises FailureVelocity once a user failed to log in
+// failures times within window, 5 times within 15 minutes by default.
+func WithFailureVelocity(failures int, window time.Duration) Options {
+	return func(e *Evaluator) {
+		e.failures = int64(failures)
+		e.failure_window = window
+	}
+}
+
+// WithMaxSpeed sets the speed, in km/h, above which travelling between
+// sign ins is deemed impossible. Defaults to 1000.
+func WithMaxSpeed(kmh float64) Options {
+	return func(e *Evaluator) {
+		e.max_speed = kmh
+	}
+}
+
+// WithNotifier notifies users of risky sign ins with a notify.NewLogin
+// message. Users aren't notified by default.
+func WithNotifier(n notify.Notifier) Options {
+	return func(e *Evaluator) {
+		e.notify = n
+	}
+}
+
+// WithStorage sets the storage failed logins are counted in. An
+// in-memory storage is used by default.
+func WithStorage(s storage.Storage) Options {
+	return func(e *Evaluator) {
+		e.store = s
+	}
+}
+
+// WithEvents counts the events.LoginFailed events of bus and publishes
+// an events.SuspiciousLogin event for risky sign ins.
+func WithEvents(bus *events.Bus) Options {
+	return func(e *Evaluator) {
+		e.events = bus
+	}
+}
+
+// New returns an evaluator remembering devices in model, registered by
+// the caller e.g mongodb.RegisterModel(db, "auth_devices", risk.Device{}).
+func New(model database.Model[Device], opts ...Options) *Evaluator {
+	e := &Evaluator{
+		model: model,
+		store: storage.NewMemoryStorage(),
+		weights: map[Signal]int{
+			NewDevice:        30,
+			NewNetwork:       20,
+			FailureVelocity:  40,
+			ImpossibleTravel: 60,
+		},
+		notify_at:      30,
+		mfa_at:         60,
+		failures:       5,
+		failure_window: 15 * time.Minute,
+		max_speed:      1000,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.events != nil {
+		e.events.After(events.LoginFailed, e.failed)
+	}
+	return e
+}
+
+// failed counts a failed login of the user of ev.
+func (e *Evaluator) failed(ctx context.Context, ev events.Event) error {
+	for _, key := range failureKeys(ev.UserID, ev.Email) {
+		if _, err := e.store.Incr(ctx, key, e.failure_window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func failureKeys(userID, email string) []string {
+	var keys []string
+	if userID != "" {
+		keys = append(keys, "risk:failures:"+userID)
+	}
+	if email != "" {
+		keys = append(keys, "risk:failures:"+models.NormalizeEmail(email))
+	}
+	return keys
+}
+
+// Evaluate assesses the sign in of the user with the request. The first
+// sign in of a user is trusted, there is nothing to compare it with.
+func (e *Evaluator) Evaluate(ctx context.Context, r *http.Request, userID uuid.UUID, email string) (*Assessment, error) {
+	a := &Assessment{Fingerprint: Fingerprint(r)}
+	ip, err := netip.ParseAddr(events.ClientIP(r))
+	if err == nil {
+		a.Network = Network(ip)
+		if e.geoip != nil {
+			if loc, ok := e.geoip.Locate(ip); ok {
+				a.Location = &loc
+			}
+		}
+	}
+	devices, err := e.Devices(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(devices) > 0 {
+		if !slices.ContainsFunc(devices, func(d *Device) bool { return d.Fingerprint == a.Fingerprint }) {
+			a.Signals = append(a.Signals, NewDevice)
+		}
+		if a.Network != "" && !slices.ContainsFunc(devices, func(d *Device) bool {
+			return slices.Contains(strings.Fields(d.Networks), a.Network)
+		}) {
+			a.Signals = append(a.Signals, NewNetwork)
+		}
+		if e.travelled(devices, a.Location) {
+			a.Signals = append(a.Signals, ImpossibleTravel)
+		}
+	}
+	if e.failures > 0 {
+		for _, key := range failureKeys(userID.String(), email) {
+			v, err := e.store.Get(ctx, key)
+			if err != nil {
+				continue
+			}
+			if n, _ := strconv.ParseInt(string(v), 10, 64); n >= e.failures {
+				a.Signals = append(a.Signals, FailureVelocity)
+				break
+			}
+		}
+	}
+	for _, s := range a.Signals {
+		a.Score += e.weights[s]
+	}
+	a.Notify = e.notify_at > 0 && a.Score >= e.notify_at
+	a.RequireMFA = e.mfa_at > 0 && a.Score >= e.mfa_at
+	return a, nil
+}
+
+// travelled reports whether reaching loc from the last located sign in
+// of devices was too fast. Distances under 100km are ignored, as GeoIP
+// isn't more precise.
+func (e *Evaluator) travelled(devices []*Device, loc *Location) bool {
+	if loc == nil || e.max_speed <= 0 {
+		return false
+	}
+	var last *Device
+	for _, d := range devices {
+		if d.Located && (last == nil || d.LastSeenAt.After(last.LastSeenAt)) {
+			last = d
+		}
+	}
+	if last == nil {
+		return false
+	}
+	km := Distance(Location{Latitude: last.Latitude, Longitude: last.Longitude}, *loc)
+	if km < 100 {
+		return false
+	}
+	hours := time.Since(last.LastSeenAt).Hours()
+	return hours <= 0 || km/hours > e.max_speed
+}
+
+// Observe remembers the device and network of a sign in assessed as a,
+// once it is trusted, and resets the failed logins of the user.
+func (e *Evaluator) Observe(ctx context.Context, r *http.Request, userID uuid.UUID, email string, a *Assessment) error {
+	now := time.Now().UTC()
+	d, err := e.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithFilter("fingerprint", a.Fingerprint),
+	).First()
+	found := err == nil
+	if !found {
+		d = &Device{
+			ID:          uuid.New(),
+			UserID:      userID,
+			Fingerprint: a.Fingerprint,
+			CreatedAt:   now,
+		}
+	}
+	d.Name = sessions.Device(r)
+	d.IP = events.ClientIP(r)
+	d.LastSeenAt = now
+	if a.Network != "" {
+		networks := slices.DeleteFunc(strings.Fields(d.Networks), func(n string) bool { return n == a.Network })
+		networks = append(networks, a.Network)
+		d.Networks = strings.Join(networks[max(len(networks)-maxNetworks, 0):], " ")
+	}
+	if a.Location != nil {
+		d.Located = true
+		d.Country = a.Location.Country
+		d.Latitude, d.Longitude = a.Location.Latitude, a.Location.Longitude
+	}
+	if found {
+		err = e.model.WithContext(ctx).Query(database.WithFilter("id", d.ID)).Update(*d)
+	} else {
+		err = e.model.WithContext(ctx).Save(*d)
+	}
+	if err != nil {
+		return err
+	}
+	for _, key := range failureKeys(userID.String(), email) {
+		_ = e.store.Del(ctx, key)
+	}
+	return nil
+}
+
+// Alert notifies the user of the sign in assessed as a and publishes an
+// events.SuspiciousLogin event for it. The error of the notifier is
+// returned and recorded in the event Data as notify_error.
+func (e *Evaluator) Alert(ctx context.Context, r *http.Request, userID uuid.UUID, email, provider string, a *Assessment) error {
+	ev := events.FromRequest(r, events.SuspiciousLogin, provider)
+	ev.UserID = userID.String()
+	ev.Email = email
+	ev.Data = map[string]any{
+		"score":       a.Score,
+		"signals":     a.Signals,
+		"require_mfa": a.RequireMFA,
+	}
+	data := map[string]any{
+		"device": sessions.Device(r),
+		"ip":     ev.IP,
+		"time":   ev.CreatedAt,
+	}
+	if a.Location != nil {
+		ev.Data["country"] = a.Location.Country
+		data["country"] = a.Location.Country
+	}
+	var err error
+	if e.notify != nil {
+		err = e.notify.Notify(ctx, notify.Message{
+			Kind:   notify.NewLogin,
+			To:     email,
+			Locale: notify.LocaleFromRequest(r),
+			Data:   data,
+		})
+		if err != nil {
+			ev.Data["notify_error"] = err.Error()
+		}
+	}
+	e.events.Publish(ctx, ev)
+	return err
+}
+
+// Devices returns the devices a user signed in from, the most recently
+// used first.
+func (e *Evaluator) Devices(ctx context.Context, userID uuid.UUID) ([]*Device, error) {
+	return e.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithOrder("last_seen_at", database.DESC),
+	).All()
+}
+
+// Forget removes the devices of a user, so their next sign ins are
+// assessed as the first one.
+func (e *Evaluator) Forget(ctx context.Context, userID uuid.UUID) error {
+	return e.model.WithContext(ctx).Query(database.WithFilter("user_id", userID)).DeleteMany()
+}
+
+// Fingerprint identifies the device of the request, by the X-Device-ID
+// header when the client sends one or its user agent and languages.
+func Fingerprint(r *http.Request) string {
+	id := r.Header.Get("X-Device-ID")
+	if id == "" {
+		id = r.UserAgent() + "\n" + r.Header.Get("Accept-Language")
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// Network returns the /24 of an IPv4 address or the /48 of an IPv6 one.
+func Network(ip netip.Addr) string {
+	ip = ip.Unmap()
+	bits := 48
+	if ip.Is4() {
+		bits = 24
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return p.String()
+}
@@ -0,0 +1,191 @@
+package risk
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/notify"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const geoCSV = `network,geoname_id,latitude,longitude,country_iso_code
+192.0.2.0/24,1,51.5072,-0.1276,GB
+198.51.100.0/24,2,40.7128,-74.0060,US
+203.0.113.0/24,3,35.6762,139.6503,JP
+203.0.113.128/25,4,34.6937,135.5023,JP
+2001:db8::/32,5,48.8566,2.3522,FR
+10.0.0.0/8,6,,,
+`
+
+func TestGeoDB(t *testing.T) {
+	db, err := LoadGeoCSV(strings.NewReader(geoCSV))
+	require.NoError(t, err)
+	locate := func(ip string) (Location, bool) {
+		return db.Locate(netip.MustParseAddr(ip))
+	}
+	loc, ok := locate("192.0.2.10")
+	require.True(t, ok)
+	assert.Equal(t, "GB", loc.Country)
+	loc, ok = locate("::ffff:198.51.100.1")
+	require.True(t, ok)
+	assert.Equal(t, "US", loc.Country)
+	// the longest prefix wins
+	loc, _ = locate("203.0.113.200")
+	assert.Equal(t, 34.6937, loc.Latitude)
+	loc, _ = locate("203.0.113.20")
+	assert.Equal(t, 35.6762, loc.Latitude)
+	_, ok = locate("2001:db8:1::1")
+	assert.True(t, ok)
+	_, ok = locate("10.1.2.3")
+	assert.False(t, ok)
+
+	london, newYork := Location{Latitude: 51.5072, Longitude: -0.1276}, Location{Latitude: 40.7128, Longitude: -74.0060}
+	assert.InDelta(t, 5570, Distance(london, newYork), 10)
+
+	_, err = LoadGeoCSV(strings.NewReader("ip,lat,lon\n"))
+	assert.Error(t, err)
+}
+
+func TestEvaluator(t *testing.T) {
+	ctx := context.Background()
+	geo, err := LoadGeoCSV(strings.NewReader(geoCSV))
+	require.NoError(t, err)
+	bus := events.New()
+	var mu sync.Mutex
+	var sent []notify.Message
+	var alerts []events.Event
+	bus.After(events.SuspiciousLogin, func(ctx context.Context, e events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		alerts = append(alerts, e)
+		return nil
+	})
+	e := New(testdb.New[Device](),
+		WithGeoIP(geo),
+		WithEvents(bus),
+		WithFailureVelocity(3, time.Minute),
+		WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = append(sent, msg)
+			return nil
+		})),
+	)
+	user := uuid.New()
+	request := func(ip, ua string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/password/authorize", nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("User-Agent", ua)
+		return r
+	}
+	const firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	const safari = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Version/17.0 Mobile/15E148 Safari/604.1"
+	signIn := func(r *http.Request) *Assessment {
+		a, err := e.Evaluate(ctx, r, user, "jon@doe.com")
+		require.NoError(t, err)
+		return a
+	}
+
+	t.Run("First Sign In", func(t *testing.T) {
+		r := request("192.0.2.10", firefox)
+		a := signIn(r)
+		assert.Empty(t, a.Signals)
+		assert.False(t, a.Notify)
+		assert.Equal(t, "192.0.2.0/24", a.Network)
+		require.NotNil(t, a.Location)
+		require.NoError(t, e.Observe(ctx, r, user, "jon@doe.com", a))
+
+		// the same device from the same network
+		a = signIn(request("192.0.2.99", firefox))
+		assert.Empty(t, a.Signals)
+		assert.Equal(t, 0, a.Score)
+	})
+
+	t.Run("New Device", func(t *testing.T) {
+		r := request("192.0.2.11", safari)
+		a := signIn(r)
+		assert.Equal(t, []Signal{NewDevice}, a.Signals)
+		assert.True(t, a.Notify)
+		assert.False(t, a.RequireMFA)
+		require.NoError(t, e.Alert(ctx, r, user, "jon@doe.com", "password", a))
+		require.NoError(t, e.Observe(ctx, r, user, "jon@doe.com", a))
+
+		devices, err := e.Devices(ctx, user)
+		require.NoError(t, err)
+		require.Len(t, devices, 2)
+		assert.Equal(t, "Safari on iOS", devices[0].Name)
+		assert.Equal(t, "GB", devices[0].Country)
+
+		bus.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, sent, 1)
+		assert.Equal(t, notify.NewLogin, sent[0].Kind)
+		assert.Equal(t, "jon@doe.com", sent[0].To)
+		assert.Equal(t, "Safari on iOS", sent[0].Data["device"])
+		require.Len(t, alerts, 1)
+		assert.Equal(t, user.String(), alerts[0].UserID)
+		assert.Equal(t, []Signal{NewDevice}, alerts[0].Data["signals"])
+	})
+
+	t.Run("Impossible Travel", func(t *testing.T) {
+		// new york minutes after london
+		a := signIn(request("198.51.100.7", firefox))
+		assert.Equal(t, []Signal{NewNetwork, ImpossibleTravel}, a.Signals)
+		assert.Equal(t, 80, a.Score)
+		assert.True(t, a.RequireMFA)
+
+		// a network that can't be located is only a new network
+		a = signIn(request("2001:db9::1", firefox))
+		assert.Equal(t, []Signal{NewNetwork}, a.Signals)
+		assert.False(t, a.Notify)
+	})
+
+	t.Run("Failure Velocity", func(t *testing.T) {
+		failed := events.FromRequest(request("192.0.2.10", firefox), events.LoginFailed, "password")
+		failed.Email = "Jon@Doe.com"
+		for range 3 {
+			bus.Publish(ctx, failed)
+		}
+		bus.Wait()
+		r := request("192.0.2.10", firefox)
+		a := signIn(r)
+		assert.Equal(t, []Signal{FailureVelocity}, a.Signals)
+		assert.True(t, a.Notify)
+
+		// a trusted sign in resets the failures
+		require.NoError(t, e.Observe(ctx, r, user, "jon@doe.com", a))
+		assert.Empty(t, signIn(r).Signals)
+	})
+
+	t.Run("Notification Failure", func(t *testing.T) {
+		failing := New(testdb.New[Device](), WithEvents(bus),
+			WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+				return errors.New("smtp: connection refused")
+			})))
+		r := request("192.0.2.11", safari)
+		assert.Error(t, failing.Alert(ctx, r, user, "jon@doe.com", "password", &Assessment{Notify: true}))
+
+		bus.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.NotEmpty(t, alerts)
+		assert.Equal(t, "smtp: connection refused", alerts[len(alerts)-1].Data["notify_error"])
+	})
+
+	t.Run("Forget", func(t *testing.T) {
+		require.NoError(t, e.Forget(ctx, user))
+		assert.Empty(t, signIn(request("198.51.100.7", safari)).Signals)
+	})
+}
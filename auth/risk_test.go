@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/notify"
+	"github.com/neghi-go/iam/auth/providers"
+	"github.com/neghi-go/iam/auth/risk"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/tokens"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRiskySignIn(t *testing.T) {
+	ctx := context.Background()
+	geo, err := risk.LoadGeoCSV(strings.NewReader("network,latitude,longitude\n192.0.2.0/24,51.5072,-0.1276\n198.51.100.0/24,40.7128,-74.0060\n"))
+	require.NoError(t, err)
+	a := New()
+	a.user = testdb.New[models.User]()
+	a.sessions = sessions.New(testdb.New[sessions.Record](), a.session)
+	a.tokens = tokens.New(testdb.New[tokens.Token]())
+	// alerts fail to be sent, which mustn't fail the sign ins
+	a.risk_evaluator = risk.New(testdb.New[risk.Device](), risk.WithGeoIP(geo), risk.WithEvents(a.events),
+		risk.WithNotifier(notify.NotifierFunc(func(ctx context.Context, msg notify.Message) error {
+			return errors.New("smtp: connection refused")
+		})))
+	a.providers = []*providers.Provider{
+		{Name: "password", AMR: []string{sessions.AMRPassword}},
+		{Name: "passwordless", AMR: []string{sessions.AMROTP}},
+	}
+	cfg := &providers.ProviderConfig{User: a.user, Session: a.session, Sessions: a.sessions, Events: a.events, Risk: a.risk_evaluator}
+
+	user := models.User{ID: uuid.New(), Email: "jon@doe.com", EmailVerified: true}
+	require.NoError(t, a.user.Save(user))
+	signIn := func(ip, tok, provider string, amr string) string {
+		r := httptest.NewRequest(http.MethodPost, "/"+provider+"/authorize", nil)
+		r.RemoteAddr = ip + ":1234"
+		r.Header.Set("User-Agent", "curl/8.0")
+		if tok != "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		w := httptest.NewRecorder()
+		require.NoError(t, cfg.NewSession(w, r, &user, provider, amr))
+		return w.Header().Get("Auth-Token")
+	}
+	call := func(tok string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		a.Middleware()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+		return w
+	}
+
+	trusted := signIn("192.0.2.10", "", "password", sessions.AMRPassword)
+	assert.Equal(t, http.StatusOK, call(trusted).Code)
+
+	// new york right after london
+	time.Sleep(time.Second) // so the new JWT differs from the old one
+	risky := signIn("198.51.100.7", "", "password", sessions.AMRPassword)
+	w := call(risky)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), `acr_values="aal2"`)
+	assert.Contains(t, w.Body.String(), `"passwordless"`)
+	assert.Equal(t, http.StatusOK, call(trusted).Code)
+
+	// the restricted session can't create tokens
+	r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{"name":"ci"}`)))
+	r.Header.Set("Authorization", "Bearer "+risky)
+	w = httptest.NewRecorder()
+	a.tokens.Handler(a.sessions).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// nor be stepped up with the same factor
+	time.Sleep(time.Second)
+	again := signIn("198.51.100.7", risky, "password", sessions.AMRPassword)
+	assert.Equal(t, http.StatusUnauthorized, call(again).Code)
+	devices, err := a.risk_evaluator.Devices(ctx, user.ID)
+	require.NoError(t, err)
+	assert.Len(t, devices, 1)
+
+	time.Sleep(time.Second)
+	stepped := signIn("198.51.100.7", again, "passwordless", sessions.AMROTP)
+	assert.Equal(t, http.StatusOK, call(stepped).Code)
+	// the network is now known
+	devices, err = a.risk_evaluator.Devices(ctx, user.ID)
+	require.NoError(t, err)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "198.51.100.7", devices[0].IP)
+	a.events.Wait()
+}
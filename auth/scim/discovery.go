@@ -0,0 +1,140 @@
+package scim
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type attribute struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type"`
+	MultiValued   bool        `json:"multiValued"`
+	Required      bool        `json:"required"`
+	CaseExact     bool        `json:"caseExact"`
+	Mutability    string      `json:"mutability"`
+	Returned      string      `json:"returned"`
+	Uniqueness    string      `json:"uniqueness"`
+	SubAttributes []attribute `json:"subAttributes,omitempty"`
+}
+
+func attr(name, kind string) attribute {
+	return attribute{Name: name, Type: kind, Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+}
+
+func multi(name string, mutability string, sub ...attribute) attribute {
+	a := attr(name, "complex")
+	a.MultiValued = true
+	a.Mutability = mutability
+	a.SubAttributes = sub
+	return a
+}
+
+var schemas = []map[string]any{
+	{
+		"id":          UserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes": []attribute{
+			{Name: "userName", Type: "string", Required: true, Mutability: "readWrite", Returned: "default", Uniqueness: "server"},
+			attr("externalId", "string"),
+			{Name: "name", Type: "complex", Mutability: "readWrite", Returned: "default", Uniqueness: "none", SubAttributes: []attribute{
+				attr("givenName", "string"),
+				attr("familyName", "string"),
+				attr("formatted", "string"),
+			}},
+			attr("displayName", "string"),
+			multi("emails", "readWrite", attr("value", "string"), attr("type", "string"), attr("primary", "boolean")),
+			attr("active", "boolean"),
+			multi("groups", "readOnly", attr("value", "string"), attr("display", "string"), attr("$ref", "reference")),
+		},
+		"meta": map[string]any{"resourceType": "Schema", "location": "/Schemas/" + UserSchema},
+	},
+	{
+		"id":          GroupSchema,
+		"name":        "Group",
+		"description": "Group",
+		"attributes": []attribute{
+			{Name: "displayName", Type: "string", Required: true, Mutability: "readWrite", Returned: "default", Uniqueness: "server"},
+			attr("externalId", "string"),
+			multi("members", "readWrite", attr("value", "string"), attr("display", "string"), attr("$ref", "reference")),
+		},
+		"meta": map[string]any{"resourceType": "Schema", "location": "/Schemas/" + GroupSchema},
+	},
+}
+
+func (s *Server) serviceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	writeResource(w, http.StatusOK, map[string]any{
+		"schemas":          []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+		"documentationUri": "https://datatracker.ietf.org/doc/html/rfc7644",
+		"patch":            map[string]any{"supported": true},
+		"bulk":             map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]any{"supported": true, "maxResults": s.max_results},
+		"changePassword":   map[string]any{"supported": false},
+		"sort":             map[string]any{"supported": false},
+		"etag":             map[string]any{"supported": true},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "OAuth Bearer Token",
+			"description": "A personal access token or a service account access token",
+			"primary":     true,
+		}},
+		"meta": map[string]any{"resourceType": "ServiceProviderConfig", "location": s.baseURL(r) + "/ServiceProviderConfig"},
+	})
+}
+
+func (s *Server) schemas(w http.ResponseWriter, r *http.Request) {
+	if id := chi.URLParam(r, "id"); id != "" {
+		for _, schema := range schemas {
+			if schema["id"] == id {
+				writeResource(w, http.StatusOK, schema)
+				return
+			}
+		}
+		writeError(w, errNotFound)
+		return
+	}
+	writeResource(w, http.StatusOK, listOf(schemas))
+}
+
+func (s *Server) resourceTypes(w http.ResponseWriter, r *http.Request) {
+	types := []map[string]any{{
+		"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+		"id":       "User",
+		"name":     "User",
+		"endpoint": "/Users",
+		"schema":   UserSchema,
+		"meta":     map[string]any{"resourceType": "ResourceType", "location": s.baseURL(r) + "/ResourceTypes/User"},
+	}}
+	if s.acl != nil {
+		types = append(types, map[string]any{
+			"schemas":  []string{"urn:ietf:params:scim:schemas:core:2.0:ResourceType"},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   GroupSchema,
+			"meta":     map[string]any{"resourceType": "ResourceType", "location": s.baseURL(r) + "/ResourceTypes/Group"},
+		})
+	}
+	if id := chi.URLParam(r, "id"); id != "" {
+		for _, t := range types {
+			if t["id"] == id {
+				writeResource(w, http.StatusOK, t)
+				return
+			}
+		}
+		writeError(w, errNotFound)
+		return
+	}
+	writeResource(w, http.StatusOK, listOf(types))
+}
+
+func listOf(resources []map[string]any) map[string]any {
+	return map[string]any{
+		"schemas":      []string{ListSchema},
+		"totalResults": len(resources),
+		"startIndex":   1,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	}
+}
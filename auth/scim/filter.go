@@ -0,0 +1,366 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// filter is a parsed SCIM filter, RFC 7644 section 3.4.2.2, evaluated
+// against the JSON representation of a resource.
+type filter interface {
+	match(v map[string]any) bool
+}
+
+type logical struct {
+	and         bool
+	left, right filter
+}
+
+func (l logical) match(v map[string]any) bool {
+	if l.and {
+		return l.left.match(v) && l.right.match(v)
+	}
+	return l.left.match(v) || l.right.match(v)
+}
+
+type negation struct {
+	f filter
+}
+
+func (n negation) match(v map[string]any) bool {
+	return !n.f.match(v)
+}
+
+// comparison compares the values at path with value.
+type comparison struct {
+	path  []string
+	op    string
+	value any
+}
+
+func (c comparison) match(v map[string]any) bool {
+	values := resolve(v, c.path)
+	if c.op == "pr" {
+		for _, x := range values {
+			if x != nil && x != "" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, x := range values {
+		if compare(x, c.op, c.value, caseExact(c.path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// valueFilter matches when an element of the multi-valued attribute
+// attr matches f, as in emails[type eq "work"].
+type valueFilter struct {
+	attr string
+	f    filter
+}
+
+func (vf valueFilter) match(v map[string]any) bool {
+	for _, el := range elements(v, vf.attr) {
+		if m, ok := el.(map[string]any); ok && vf.f.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// mentions reports whether f compares the attribute attr.
+func mentions(f filter, attr string) bool {
+	switch f := f.(type) {
+	case logical:
+		return mentions(f.left, attr) || mentions(f.right, attr)
+	case negation:
+		return mentions(f.f, attr)
+	case comparison:
+		return strings.EqualFold(f.path[0], attr)
+	case valueFilter:
+		return strings.EqualFold(f.attr, attr)
+	}
+	return false
+}
+
+// caseExact reports whether the attribute at path is compared case
+// sensitively, every other string attribute is case insensitive.
+func caseExact(path []string) bool {
+	return len(path) == 1 && (strings.EqualFold(path[0], "id") || strings.EqualFold(path[0], "externalId"))
+}
+
+func compare(x any, op string, value any, exact bool) bool {
+	switch xv := x.(type) {
+	case string:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		if !exact {
+			xv, s = strings.ToLower(xv), strings.ToLower(s)
+		}
+		switch op {
+		case "eq":
+			return xv == s
+		case "ne":
+			return xv != s
+		case "co":
+			return strings.Contains(xv, s)
+		case "sw":
+			return strings.HasPrefix(xv, s)
+		case "ew":
+			return strings.HasSuffix(xv, s)
+		case "gt":
+			return xv > s
+		case "ge":
+			return xv >= s
+		case "lt":
+			return xv < s
+		case "le":
+			return xv <= s
+		}
+	case bool:
+		b, ok := value.(bool)
+		switch op {
+		case "eq":
+			return ok && xv == b
+		case "ne":
+			return !ok || xv != b
+		}
+	case float64:
+		n, ok := value.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return xv == n
+		case "ne":
+			return xv != n
+		case "gt":
+			return xv > n
+		case "ge":
+			return xv >= n
+		case "lt":
+			return xv < n
+		case "le":
+			return xv <= n
+		}
+	case nil:
+		return op == "eq" && value == nil
+	}
+	return false
+}
+
+// lookup returns the value of key in m, attribute names are case
+// insensitive.
+func lookup(m map[string]any, key string) (string, any, bool) {
+	if v, ok := m[key]; ok {
+		return key, v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return k, v, true
+		}
+	}
+	return key, nil, false
+}
+
+// elements returns the values of attr, a single value as one element.
+func elements(v map[string]any, attr string) []any {
+	_, x, ok := lookup(v, attr)
+	if !ok || x == nil {
+		return nil
+	}
+	if list, ok := x.([]any); ok {
+		return list
+	}
+	return []any{x}
+}
+
+// resolve returns the values at path, flattening multi-valued
+// attributes.
+func resolve(v map[string]any, path []string) []any {
+	values := elements(v, path[0])
+	if len(path) == 1 {
+		return values
+	}
+	var res []any
+	for _, el := range values {
+		if m, ok := el.(map[string]any); ok {
+			res = append(res, resolve(m, path[1:])...)
+		}
+	}
+	return res
+}
+
+// splitPath splits an attribute path into its attribute and sub
+// attributes, dropping the schema URN prefix of core attributes.
+func splitPath(p string) []string {
+	for _, urn := range []string{UserSchema + ":", GroupSchema + ":"} {
+		if len(p) > len(urn) && strings.EqualFold(p[:len(urn)], urn) {
+			p = p[len(urn):]
+		}
+	}
+	return strings.Split(p, ".")
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func parseFilter(s string) (filter, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) or() (filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (filter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) factor() (filter, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case strings.EqualFold(t, "not"):
+		if p.next() != "(" {
+			return nil, fmt.Errorf("expected ( after not")
+		}
+		f, err := p.group()
+		return negation{f: f}, err
+	case t == "(":
+		return p.group()
+	}
+	if p.peek() == "[" {
+		p.next()
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != "]" {
+			return nil, fmt.Errorf("expected ]")
+		}
+		return valueFilter{attr: t, f: f}, nil
+	}
+	op := strings.ToLower(p.next())
+	switch op {
+	case "pr":
+		return comparison{path: splitPath(t), op: op}, nil
+	case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+	default:
+		return nil, fmt.Errorf("unknown operator %q", op)
+	}
+	raw := p.next()
+	if raw == "" {
+		return nil, fmt.Errorf("missing value for %s", t)
+	}
+	var value any
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		return nil, fmt.Errorf("invalid value %s", raw)
+	}
+	return comparison{path: splitPath(t), op: op, value: value}, nil
+}
+
+func (p *parser) group() (filter, error) {
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.next() != ")" {
+		return nil, fmt.Errorf("expected )")
+	}
+	return f, nil
+}
+
+// tokenize splits a filter into words, JSON strings and brackets.
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, s[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()[]\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,295 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/acl"
+)
+
+type group struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []multiValue `json:"members"`
+}
+
+// groupsOf returns the groups of a subject, none without an acl.
+func (s *Server) groupsOf(r *http.Request, sub acl.Subject) ([]*acl.Group, error) {
+	if s.acl == nil {
+		return nil, nil
+	}
+	return s.acl.GroupsOf(r.Context(), sub)
+}
+
+func (s *Server) toGroup(r *http.Request, g *acl.Group) (map[string]any, error) {
+	members, err := s.acl.Members(r.Context(), g.ID)
+	if err != nil {
+		return nil, err
+	}
+	res := group{
+		Schemas:     []string{GroupSchema},
+		ID:          g.ID.String(),
+		ExternalID:  g.ExternalID,
+		DisplayName: g.Name,
+		Members:     []multiValue{},
+	}
+	for _, m := range members {
+		if m.Kind != acl.User {
+			continue
+		}
+		mv := multiValue{Value: m.ID, Type: "User", Ref: s.baseURL(r) + "/Users/" + m.ID}
+		if u, err := s.findUser(r, m.ID); err == nil {
+			mv.Display = u.Email
+		}
+		res.Members = append(res.Members, mv)
+	}
+	return resource(res, meta{
+		ResourceType: "Group",
+		Created:      g.CreatedAt,
+		LastModified: g.UpdatedAt,
+		Location:     s.baseURL(r) + "/Groups/" + res.ID,
+	})
+}
+
+// members returns the users listed in the members attribute of v.
+func (s *Server) members(r *http.Request, v map[string]any) ([]acl.Subject, error) {
+	var res []acl.Subject
+	for _, el := range elements(v, "members") {
+		m, ok := el.(map[string]any)
+		if !ok {
+			return nil, invalid("invalidValue", errors.New("members must be objects"))
+		}
+		id, _ := str(m, "value")
+		if _, err := s.findUser(r, id); err != nil {
+			return nil, invalid("invalidValue", fmt.Errorf("unknown member %q", id))
+		}
+		res = append(res, acl.Subject{Kind: acl.User, ID: id})
+	}
+	return res, nil
+}
+
+func (s *Server) findGroup(r *http.Request, id string) (*acl.Group, error) {
+	gid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, errNotFound
+	}
+	g, err := s.acl.Group(r.Context(), gid)
+	if errors.Is(err, acl.ErrGroupNotFound) {
+		return nil, errNotFound
+	}
+	return g, err
+}
+
+func (s *Server) groupResource(r *http.Request, id string) (map[string]any, error) {
+	g, err := s.findGroup(r, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.toGroup(r, g)
+}
+
+// groupResources lists groups, matching eq comparisons of displayName
+// and externalId before looking up the members of the groups.
+func (s *Server) groupResources(r *http.Request, f filter, offset, limit int) ([]map[string]any, int, error) {
+	groups, err := s.acl.Groups(r.Context())
+	if err != nil {
+		return nil, 0, err
+	}
+	eq := equalities(f)
+	if f != nil && (eq == nil || !groupFilterable(eq)) {
+		return pageOf(r, groups, s.toGroup, f, offset, limit)
+	}
+	matched := groups[:0]
+	for _, g := range groups {
+		if groupMatches(g, eq) {
+			matched = append(matched, g)
+		}
+	}
+	page := matched[min(offset, len(matched)):]
+	page = page[:min(limit, len(page))]
+	res, _, err := pageOf(r, page, s.toGroup, nil, 0, limit)
+	return res, len(matched), err
+}
+
+// groupFilterable reports whether groupMatches applies every comparison
+// of eq.
+func groupFilterable(eq map[string]any) bool {
+	for attr, v := range eq {
+		if _, ok := v.(string); !ok ||
+			(!strings.EqualFold(attr, "displayName") && !strings.EqualFold(attr, "externalId")) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupMatches reports whether g has the displayName and externalId in
+// eq.
+func groupMatches(g *acl.Group, eq map[string]any) bool {
+	for attr, v := range eq {
+		value, _ := v.(string)
+		switch {
+		case strings.EqualFold(attr, "displayName") && !strings.EqualFold(g.Name, value):
+			return false
+		case strings.EqualFold(attr, "externalId") && g.ExternalID != value:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	v, err := decode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	name, _ := str(v, "displayName")
+	if name == "" {
+		writeError(w, invalid("invalidValue", errors.New("displayName is required")))
+		return
+	}
+	members, err := s.members(r, v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	externalID, _ := str(v, "externalId")
+	g, err := s.acl.CreateGroup(r.Context(), name, externalID)
+	if errors.Is(err, acl.ErrGroupExists) {
+		writeError(w, errUniqueness)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, m := range members {
+		if err := s.acl.AddMember(r.Context(), g.ID, m); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	res, err := s.toGroup(r, g)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResource(w, http.StatusCreated, res)
+}
+
+// updateGroup saves the representation v of g, adding and removing
+// members to match it.
+func (s *Server) updateGroup(w http.ResponseWriter, r *http.Request, g *acl.Group, v map[string]any) {
+	name, _ := str(v, "displayName")
+	if name == "" {
+		writeError(w, invalid("invalidValue", errors.New("displayName is required")))
+		return
+	}
+	members, err := s.members(r, v)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	g.Name = name
+	g.ExternalID, _ = str(v, "externalId")
+	if err := s.acl.UpdateGroup(r.Context(), g); err != nil {
+		if errors.Is(err, acl.ErrGroupExists) {
+			err = errUniqueness
+		}
+		writeError(w, err)
+		return
+	}
+	current, err := s.acl.Members(r.Context(), g.ID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	want := map[string]bool{}
+	for _, m := range members {
+		want[m.String()] = true
+		if err := s.acl.AddMember(r.Context(), g.ID, m); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	for _, m := range current {
+		if m.Kind != acl.User || want[m.String()] {
+			continue
+		}
+		if err := s.acl.RemoveMember(r.Context(), g.ID, m); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	res, err := s.toGroup(r, g)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResource(w, http.StatusOK, res)
+}
+
+func (s *Server) replaceGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := s.findGroup(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	current, err := s.toGroup(r, g)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkVersion(r, current); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := decode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.updateGroup(w, r, g, v)
+}
+
+func (s *Server) patchGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := s.findGroup(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := s.toGroup(r, g)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkVersion(r, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := patch(r, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.updateGroup(w, r, g, v)
+}
+
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	g, err := s.findGroup(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.acl.DeleteGroup(r.Context(), g.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
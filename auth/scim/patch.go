@@ -0,0 +1,234 @@
+package scim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// patchOp is an operation of a PATCH request, RFC 7644 section 3.5.2.
+type patchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value"`
+}
+
+// patchPath is the target of an operation: attr, attr.sub, attr[filter]
+// or attr[filter].sub.
+type patchPath struct {
+	attr   string
+	filter filter
+	sub    string
+	// eq holds the attribute values a filter of equality comparisons
+	// requires, to create the element an add targets when there is none.
+	eq map[string]any
+}
+
+func parsePath(p string) (*patchPath, error) {
+	parts := splitPath(p)
+	pp := &patchPath{}
+	if i := strings.Index(p, "["); i >= 0 {
+		j := strings.LastIndex(p, "]")
+		if j < i {
+			return nil, fmt.Errorf("invalid path %q", p)
+		}
+		f, err := parseFilter(p[i+1 : j])
+		if err != nil {
+			return nil, err
+		}
+		pp.attr = splitPath(p[:i])[0]
+		pp.filter = f
+		pp.eq = equalities(f)
+		pp.sub = strings.TrimPrefix(p[j+1:], ".")
+		return pp, nil
+	}
+	switch len(parts) {
+	case 1:
+		pp.attr = parts[0]
+	case 2:
+		pp.attr, pp.sub = parts[0], parts[1]
+	default:
+		return nil, fmt.Errorf("invalid path %q", p)
+	}
+	return pp, nil
+}
+
+// equalities returns the attribute values of a filter made of eq
+// comparisons joined by and, nil for any other filter.
+func equalities(f filter) map[string]any {
+	switch f := f.(type) {
+	case comparison:
+		if f.op == "eq" && len(f.path) == 1 {
+			return map[string]any{f.path[0]: f.value}
+		}
+	case logical:
+		if f.and {
+			l, r := equalities(f.left), equalities(f.right)
+			if l == nil || r == nil {
+				return nil
+			}
+			for k, v := range r {
+				l[k] = v
+			}
+			return l
+		}
+	}
+	return nil
+}
+
+// apply applies an operation to the JSON representation of a resource.
+func apply(v map[string]any, op patchOp) error {
+	kind := strings.ToLower(op.Op)
+	if kind != "add" && kind != "replace" && kind != "remove" {
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	if op.Path == "" {
+		if kind == "remove" {
+			return fmt.Errorf("remove requires a path")
+		}
+		values, ok := op.Value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("the value of an operation without path must be an object")
+		}
+		for k, x := range values {
+			// a path may be used as key, e.g. name.givenName
+			if err := apply(v, patchOp{Op: op.Op, Path: k, Value: x}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	p, err := parsePath(op.Path)
+	if err != nil {
+		return err
+	}
+	key, current, _ := lookup(v, p.attr)
+
+	if p.filter == nil {
+		if p.sub != "" {
+			m, ok := current.(map[string]any)
+			if !ok {
+				if kind == "remove" {
+					return nil
+				}
+				m = map[string]any{}
+			}
+			if kind == "remove" {
+				subKey, _, _ := lookup(m, p.sub)
+				delete(m, subKey)
+			} else {
+				subKey, _, _ := lookup(m, p.sub)
+				m[subKey] = op.Value
+			}
+			v[key] = m
+			return nil
+		}
+		list, multi := current.([]any)
+		switch kind {
+		case "remove":
+			values, ok := op.Value.([]any)
+			if !multi || !ok {
+				delete(v, key)
+				return nil
+			}
+			// remove the elements listed in value, as sent for members
+			v[key] = without(list, values)
+		case "add":
+			if values, ok := op.Value.([]any); ok {
+				v[key] = merge(list, values)
+				return nil
+			}
+			v[key] = op.Value
+		case "replace":
+			v[key] = op.Value
+		}
+		return nil
+	}
+
+	list, _ := current.([]any)
+	matched := false
+	res := make([]any, 0, len(list))
+	for _, el := range list {
+		m, ok := el.(map[string]any)
+		if !ok || !p.filter.match(m) {
+			res = append(res, el)
+			continue
+		}
+		matched = true
+		switch {
+		case kind == "remove" && p.sub == "":
+			continue
+		case kind == "remove":
+			subKey, _, _ := lookup(m, p.sub)
+			delete(m, subKey)
+		case p.sub != "":
+			subKey, _, _ := lookup(m, p.sub)
+			m[subKey] = op.Value
+		default:
+			values, ok := op.Value.(map[string]any)
+			if !ok {
+				return fmt.Errorf("the value of %s must be an object", op.Path)
+			}
+			for k, x := range values {
+				subKey, _, _ := lookup(m, k)
+				m[subKey] = x
+			}
+		}
+		res = append(res, m)
+	}
+	if !matched && kind != "remove" {
+		if p.eq == nil || p.sub == "" {
+			return errNoTarget
+		}
+		el := map[string]any{p.sub: op.Value}
+		for k, x := range p.eq {
+			el[k] = x
+		}
+		res = append(res, el)
+	}
+	v[key] = res
+	return nil
+}
+
+// merge appends the values not in list already.
+func merge(list, values []any) []any {
+	for _, x := range values {
+		if !contains(list, x) {
+			list = append(list, x)
+		}
+	}
+	return list
+}
+
+// without returns list without the elements whose value is in values.
+func without(list, values []any) []any {
+	res := make([]any, 0, len(list))
+	for _, x := range list {
+		if !contains(values, x) {
+			res = append(res, x)
+		}
+	}
+	return res
+}
+
+// contains reports whether list holds x, elements with a value
+// attribute are compared by it.
+func contains(list []any, x any) bool {
+	for _, el := range list {
+		if sameValue(el, x) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameValue(a, b any) bool {
+	am, aok := a.(map[string]any)
+	bm, bok := b.(map[string]any)
+	if aok && bok {
+		_, av, _ := lookup(am, "value")
+		_, bv, _ := lookup(bm, "value")
+		return av != nil && reflect.DeepEqual(av, bv)
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,400 @@
+// Package scim is a SCIM 2.0 server, RFC 7643 and RFC 7644, letting
+// identity providers such as Okta and Entra ID provision users, mapped
+// onto models.User, and groups, mapped onto acl groups.
+package scim
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+const (
+	UserSchema  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ListSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	// Permission is the acl permission clients need to use the server.
+	Permission = "scim:provision"
+
+	contentType = "application/scim+json"
+)
+
+// Error is a SCIM error response, RFC 7644 section 3.12.
+type Error struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e *Error) Error() string {
+	return "scim: " + e.Detail
+}
+
+var (
+	errNotFound           = &Error{Status: http.StatusNotFound, Detail: "resource not found"}
+	errUniqueness         = &Error{Status: http.StatusConflict, ScimType: "uniqueness", Detail: "a resource with this name already exists"}
+	errPreconditionFailed = &Error{Status: http.StatusPreconditionFailed, Detail: "the resource has been modified"}
+	errNoTarget           = &Error{Status: http.StatusBadRequest, ScimType: "noTarget", Detail: "the path matched no value"}
+)
+
+func invalid(scimType string, err error) *Error {
+	return &Error{Status: http.StatusBadRequest, ScimType: scimType, Detail: err.Error()}
+}
+
+type Options func(*Server)
+
+type Server struct {
+	users       database.Model[models.User]
+	acl         *acl.ACL
+	events      *events.Bus
+	base_url    string
+	max_results int
+	delete      func(ctx context.Context, id uuid.UUID) error
+	deactivate  func(ctx context.Context, id uuid.UUID) error
+}
+
+// WithBaseURL sets the URL the server is mounted at, used in the
+// location of resources. It is derived from requests by default.
+func WithBaseURL(url string) Options {
+	return func(s *Server) {
+		s.base_url = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithMaxResults sets the maximum number of resources in a page, 100 by
+// default.
+func WithMaxResults(n int) Options {
+	return func(s *Server) {
+		s.max_results = n
+	}
+}
+
+// WithEvents publishes an events.UserRegistered event, with the scim
+// provider, when a user is provisioned.
+func WithEvents(bus *events.Bus) Options {
+	return func(s *Server) {
+		s.events = bus
+	}
+}
+
+// WithDeleteUser sets how users are deleted, they are removed from the
+// users model by default.
+func WithDeleteUser(fn func(ctx context.Context, id uuid.UUID) error) Options {
+	return func(s *Server) {
+		s.delete = fn
+	}
+}
+
+// WithDeactivateUser sets a function called when a user is deactivated,
+// to end its sessions.
+func WithDeactivateUser(fn func(ctx context.Context, id uuid.UUID) error) Options {
+	return func(s *Server) {
+		s.deactivate = fn
+	}
+}
+
+// New returns a server provisioning users and, when groups is not nil,
+// the groups of an acl created with acl.WithGroups.
+func New(users database.Model[models.User], groups *acl.ACL, opts ...Options) *Server {
+	s := &Server{
+		users:       users,
+		acl:         groups,
+		max_results: 100,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.delete == nil {
+		s.delete = func(ctx context.Context, id uuid.UUID) error {
+			return s.users.WithContext(ctx).Query(database.WithFilter("id", id)).Delete()
+		}
+	}
+	return s
+}
+
+// Handler serves the SCIM endpoints. Clients must be authenticated and
+// authorized before, see Permission.
+func (s *Server) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/ServiceProviderConfig", s.serviceProviderConfig)
+	r.Get("/Schemas", s.schemas)
+	r.Get("/Schemas/{id}", s.schemas)
+	r.Get("/ResourceTypes", s.resourceTypes)
+	r.Get("/ResourceTypes/{id}", s.resourceTypes)
+
+	r.Get("/Users", s.list(s.userResources))
+	r.Post("/Users", s.createUser)
+	r.Get("/Users/{id}", s.get(s.userResource))
+	r.Put("/Users/{id}", s.replaceUser)
+	r.Patch("/Users/{id}", s.patchUser)
+	r.Delete("/Users/{id}", s.deleteUser)
+
+	if s.acl != nil {
+		r.Get("/Groups", s.list(s.groupResources))
+		r.Post("/Groups", s.createGroup)
+		r.Get("/Groups/{id}", s.get(s.groupResource))
+		r.Put("/Groups/{id}", s.replaceGroup)
+		r.Patch("/Groups/{id}", s.patchGroup)
+		r.Delete("/Groups/{id}", s.deleteGroup)
+	}
+	return r
+}
+
+type meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+	Version      string    `json:"version,omitempty"`
+}
+
+// resource converts a resource to its JSON representation and sets its
+// meta attribute, the version being a hash of the representation.
+func resource(v any, m meta) (map[string]any, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	m.Version = `W/"` + hex.EncodeToString(sum[:8]) + `"`
+	var res map[string]any
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, err
+	}
+	buf, err = json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var mm map[string]any
+	if err := json.Unmarshal(buf, &mm); err != nil {
+		return nil, err
+	}
+	res["meta"] = mm
+	return res, nil
+}
+
+func version(res map[string]any) string {
+	m, _ := res["meta"].(map[string]any)
+	v, _ := m["version"].(string)
+	return v
+}
+
+// fetch returns the resource of the request, in JSON representation.
+type fetch func(r *http.Request, id string) (map[string]any, error)
+
+// fetchAll returns the resources of a type matching f, nil matching
+// any, in JSON representation: at most limit of them from the offset-th
+// and the number of matches.
+type fetchAll func(r *http.Request, f filter, offset, limit int) ([]map[string]any, int, error)
+
+func (s *Server) get(fn fetch) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res, err := fn(r, chi.URLParam(r, "id"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if match := r.Header.Get("If-None-Match"); match != "" && match == version(res) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeResource(w, http.StatusOK, project(r, res))
+	}
+}
+
+// list serves a filtered page of resources, RFC 7644 section 3.4.2.
+func (s *Server) list(fn fetchAll) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var f filter
+		if raw := q.Get("filter"); raw != "" {
+			var err error
+			if f, err = parseFilter(raw); err != nil {
+				writeError(w, invalid("invalidFilter", err))
+				return
+			}
+		}
+		start, _ := strconv.Atoi(q.Get("startIndex"))
+		start = max(start, 1)
+		count := s.max_results
+		if c, err := strconv.Atoi(q.Get("count")); err == nil {
+			count = min(max(c, 0), s.max_results)
+		}
+		page, total, err := fn(r, f, start-1, count)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		resources := make([]map[string]any, 0, len(page))
+		for _, res := range page {
+			resources = append(resources, project(r, res))
+		}
+		writeResource(w, http.StatusOK, map[string]any{
+			"schemas":      []string{ListSchema},
+			"totalResults": total,
+			"startIndex":   start,
+			"itemsPerPage": len(resources),
+			"Resources":    resources,
+		})
+	}
+}
+
+// pageOf returns the items from the offset-th matching f once converted
+// by convert, at most limit of them, and the number of matches. Filters
+// apply to the JSON representation so every item is converted, the
+// fetchers only use it for filters they can't apply to the database.
+func pageOf[T any](r *http.Request, items []T, convert func(*http.Request, T) (map[string]any, error),
+	f filter, offset, limit int) ([]map[string]any, int, error) {
+	var page []map[string]any
+	total := 0
+	for _, item := range items {
+		res, err := convert(r, item)
+		if err != nil {
+			return nil, 0, err
+		}
+		if f != nil && !f.match(res) {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, res)
+		}
+		total++
+	}
+	return page, total, nil
+}
+
+// project applies the attributes and excludedAttributes parameters of
+// the request to a resource.
+func project(r *http.Request, res map[string]any) map[string]any {
+	always := func(k string) bool {
+		return k == "id" || k == "schemas" || k == "meta"
+	}
+	if attrs := r.URL.Query().Get("attributes"); attrs != "" {
+		keep := map[string]any{}
+		for k, v := range res {
+			if always(k) {
+				keep[k] = v
+			}
+		}
+		for _, a := range strings.Split(attrs, ",") {
+			if k, v, ok := lookup(res, splitPath(strings.TrimSpace(a))[0]); ok {
+				keep[k] = v
+			}
+		}
+		return keep
+	}
+	if attrs := r.URL.Query().Get("excludedAttributes"); attrs != "" {
+		for _, a := range strings.Split(attrs, ",") {
+			if k, _, ok := lookup(res, splitPath(strings.TrimSpace(a))[0]); ok && !always(k) {
+				delete(res, k)
+			}
+		}
+	}
+	return res
+}
+
+// checkVersion enforces the If-Match header of a request modifying res.
+func checkVersion(r *http.Request, res map[string]any) error {
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != version(res) {
+		return errPreconditionFailed
+	}
+	return nil
+}
+
+// decode reads the JSON representation of a resource from the request.
+func decode(r *http.Request) (map[string]any, error) {
+	var v map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return nil, invalid("invalidSyntax", err)
+	}
+	return v, nil
+}
+
+// patch applies the operations of a PATCH request to res.
+func patch(r *http.Request, res map[string]any) error {
+	var body struct {
+		Operations []patchOp `json:"Operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return invalid("invalidSyntax", err)
+	}
+	for _, op := range body.Operations {
+		if err := apply(res, op); err != nil {
+			var e *Error
+			if errors.As(err, &e) {
+				return e
+			}
+			return invalid("invalidPath", err)
+		}
+	}
+	return nil
+}
+
+// baseURL returns the URL the server is mounted at.
+func (s *Server) baseURL(r *http.Request) string {
+	if s.base_url != "" {
+		return s.base_url
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	p := r.URL.Path
+	for _, suffix := range []string{"/Users", "/Groups"} {
+		if i := strings.LastIndex(p, suffix); i >= 0 {
+			p = p[:i]
+			break
+		}
+	}
+	return scheme + "://" + r.Host + p
+}
+
+func writeResource(w http.ResponseWriter, status int, v any) {
+	if res, ok := v.(map[string]any); ok {
+		if ver := version(res); ver != "" {
+			w.Header().Set("ETag", ver)
+		}
+		if m, ok := res["meta"].(map[string]any); ok && status == http.StatusCreated {
+			if loc, ok := m["location"].(string); ok {
+				w.Header().Set("Location", loc)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Status: http.StatusInternalServerError, Detail: err.Error()}
+	}
+	body := map[string]any{
+		"schemas": []string{ErrorSchema},
+		"status":  strconv.Itoa(e.Status),
+		"detail":  e.Detail,
+	}
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(e.Status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,277 @@
+package scim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T, opts ...Options) http.Handler {
+	a, err := acl.New(
+		acl.WithBindings(testdb.New[acl.Binding]()),
+		acl.WithGroups(testdb.New[acl.Group](), testdb.New[acl.Member]()),
+	)
+	require.NoError(t, err)
+	return New(testdb.New[models.User](), a, opts...).Handler()
+}
+
+func do(h http.Handler, method, path string, body any, header ...string) *httptest.ResponseRecorder {
+	var buf bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&buf).Encode(body)
+	}
+	r := httptest.NewRequest(method, path, &buf)
+	r.Header.Set("Content-Type", contentType)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// step is a request recorded from an identity provider and what the
+// response must contain. {{name}} in the path and body is replaced by
+// the id saved by an earlier step as name.
+type step struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Body     json.RawMessage `json:"body"`
+	Status   int             `json:"status"`
+	Save     string          `json:"save"`
+	Response json.RawMessage `json:"response"`
+}
+
+// TestProviders replays the requests Okta and Entra ID send while
+// provisioning.
+func TestProviders(t *testing.T) {
+	for _, provider := range []string{"okta", "entra"} {
+		t.Run(provider, func(t *testing.T) {
+			raw, err := os.ReadFile("testdata/" + provider + ".json")
+			require.NoError(t, err)
+			var steps []step
+			require.NoError(t, json.Unmarshal(raw, &steps))
+
+			h := newServer(t)
+			ids := map[string]string{}
+			expand := func(s string) string {
+				for k, v := range ids {
+					s = strings.ReplaceAll(s, "{{"+k+"}}", v)
+				}
+				return s
+			}
+			for i, st := range steps {
+				var body any
+				if st.Body != nil {
+					require.NoError(t, json.Unmarshal([]byte(expand(string(st.Body))), &body))
+				}
+				w := do(h, st.Method, expand(st.Path), body)
+				require.Equal(t, st.Status, w.Code, "step %d: %s %s: %s", i, st.Method, st.Path, w.Body.String())
+				if st.Status == http.StatusNoContent {
+					continue
+				}
+				assert.Equal(t, contentType, w.Header().Get("Content-Type"))
+				var res map[string]any
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+				if st.Save != "" {
+					ids[st.Save] = res["id"].(string)
+				}
+				if st.Response != nil {
+					var want any
+					require.NoError(t, json.Unmarshal([]byte(expand(string(st.Response))), &want))
+					assert.True(t, subset(want, res), "step %d: %s %s: got %s", i, st.Method, st.Path, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// subset reports whether got holds every value of want, lists must have
+// the same length.
+func subset(want, got any) bool {
+	switch w := want.(type) {
+	case map[string]any:
+		g, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !subset(v, g[k]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !subset(w[i], g[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return want == got
+}
+
+func TestServer(t *testing.T) {
+	var deactivated uuid.UUID
+	h := newServer(t, WithMaxResults(2), WithDeactivateUser(func(ctx context.Context, id uuid.UUID) error {
+		deactivated = id
+		return nil
+	}))
+	var ids []string
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		w := do(h, http.MethodPost, "/Users", map[string]any{"userName": email})
+		require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+		var res map[string]any
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		ids = append(ids, res["id"].(string))
+		assert.Equal(t, "/Users/"+res["id"].(string), strings.TrimPrefix(w.Header().Get("Location"), "http://example.com"))
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		var res map[string]any
+		w := do(h, http.MethodGet, "/Users?startIndex=2&count=10", nil)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.EqualValues(t, 3, res["totalResults"])
+		assert.EqualValues(t, 2, res["itemsPerPage"])
+		assert.EqualValues(t, 2, res["startIndex"])
+		assert.Equal(t, ids[1], res["Resources"].([]any)[0].(map[string]any)["id"])
+	})
+
+	t.Run("Filter", func(t *testing.T) {
+		list := func(filter string) map[string]any {
+			var res map[string]any
+			w := do(h, http.MethodGet, "/Users?filter="+url.QueryEscape(filter), nil)
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			return res
+		}
+		// looked up in the database
+		res := list(`userName eq "B@Example.com"`)
+		assert.EqualValues(t, 1, res["totalResults"])
+		assert.Equal(t, ids[1], res["Resources"].([]any)[0].(map[string]any)["id"])
+		assert.EqualValues(t, 0, list(`userName eq "b@example.com" and externalId eq "b"`)["totalResults"])
+		// matched against the representations
+		res = list(`userName ne "b@example.com"`)
+		assert.EqualValues(t, 2, res["totalResults"])
+		assert.Equal(t, ids[2], res["Resources"].([]any)[1].(map[string]any)["id"])
+		// read in batches
+		defer func(batch int64) { userBatch = batch }(userBatch)
+		userBatch = 1
+		res = list(`userName ne "b@example.com"`)
+		assert.EqualValues(t, 2, res["totalResults"])
+		assert.Len(t, res["Resources"], 2)
+		assert.Equal(t, ids[2], res["Resources"].([]any)[1].(map[string]any)["id"])
+	})
+
+	t.Run("Attributes", func(t *testing.T) {
+		var res map[string]any
+		w := do(h, http.MethodGet, "/Users/"+ids[0]+"?attributes=userName", nil)
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Contains(t, res, "userName")
+		assert.Contains(t, res, "id")
+		assert.NotContains(t, res, "emails")
+
+		w = do(h, http.MethodGet, "/Users/"+ids[0]+"?excludedAttributes=emails,id", nil)
+		res = nil
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Contains(t, res, "id")
+		assert.NotContains(t, res, "emails")
+	})
+
+	t.Run("ETag", func(t *testing.T) {
+		w := do(h, http.MethodGet, "/Users/"+ids[0], nil)
+		etag := w.Header().Get("ETag")
+		require.True(t, strings.HasPrefix(etag, `W/"`))
+		assert.Equal(t, http.StatusNotModified, do(h, http.MethodGet, "/Users/"+ids[0], nil, "If-None-Match", etag).Code)
+
+		body := map[string]any{"Operations": []any{map[string]any{"op": "replace", "path": "active", "value": false}}}
+		w = do(h, http.MethodPatch, "/Users/"+ids[0], body, "If-Match", etag)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+		assert.Equal(t, ids[0], deactivated.String())
+		assert.Equal(t, http.StatusPreconditionFailed, do(h, http.MethodPatch, "/Users/"+ids[0], body, "If-Match", etag).Code)
+
+		w = do(h, http.MethodPatch, "/Users/"+ids[0], map[string]any{"Operations": []any{map[string]any{"op": "replace", "path": "active", "value": true}}})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Contains(t, w.Body.String(), `"active":true`)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		w := do(h, http.MethodGet, "/Users?filter=userName+xx+%22a%22", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalidFilter")
+		assert.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/Users/"+uuid.NewString(), nil).Code)
+		assert.Equal(t, http.StatusBadRequest, do(h, http.MethodPost, "/Users", map[string]any{"displayName": "x"}).Code)
+		w = do(h, http.MethodPost, "/Groups", map[string]any{"displayName": "x", "members": []any{map[string]any{"value": "nobody"}}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		w = do(h, http.MethodPatch, "/Users/"+ids[1], map[string]any{"Operations": []any{map[string]any{"op": "replace", "path": "emails[type eq \"home\"]", "value": map[string]any{"value": "x"}}}})
+		assert.Contains(t, w.Body.String(), "noTarget")
+	})
+
+	t.Run("Discovery", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/ServiceProviderConfig", nil).Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/Schemas/"+UserSchema, nil).Code)
+		assert.Equal(t, http.StatusOK, do(h, http.MethodGet, "/ResourceTypes/Group", nil).Code)
+		assert.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/Schemas/unknown", nil).Code)
+	})
+}
+
+func TestFilter(t *testing.T) {
+	user := map[string]any{
+		"id":       "2819c223",
+		"userName": "Bjensen",
+		"active":   true,
+		"name":     map[string]any{"familyName": "Jensen"},
+		"emails": []any{
+			map[string]any{"value": "bjensen@example.com", "type": "work"},
+			map[string]any{"value": "babs@jensen.org", "type": "home"},
+		},
+	}
+	for filter, want := range map[string]bool{
+		`userName eq "bjensen"`:    true,
+		`id eq "2819C223"`:         false,
+		`name.familyName co "ens"`: true,
+		`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "B"`: true,
+		`emails[type eq "work" and value ew "example.com"]`:          true,
+		`emails[type eq "other"]`:                                    false,
+		`emails.value eq "babs@jensen.org"`:                          true,
+		`active eq true and not (userName eq "x")`:                   true,
+		`userName eq "x" or (title pr)`:                              false,
+		`name pr`:                                                    true,
+	} {
+		f, err := parseFilter(filter)
+		require.NoError(t, err, filter)
+		assert.Equal(t, want, f.match(user), filter)
+	}
+	for _, filter := range []string{`userName eq`, `userName zz "x"`, `(userName eq "x"`, `userName eq "x`} {
+		_, err := parseFilter(filter)
+		assert.Error(t, err, filter)
+	}
+	for filter, want := range map[string]bool{
+		`userName sw "b" or not (groups[display eq "admins"])`: true,
+		`groups.value eq "1234"`:                               true,
+		`emails[value co "groups"]`:                            false,
+	} {
+		f, err := parseFilter(filter)
+		require.NoError(t, err, filter)
+		assert.Equal(t, want, mentions(f, "groups"), filter)
+	}
+}
@@ -0,0 +1,400 @@
+package scim
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+// userBatch is how many users are read at a time for filters the
+// database can't apply.
+var userBatch int64 = 500
+
+type name struct {
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+type multiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+type user struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []multiValue `json:"emails"`
+	Active      bool         `json:"active"`
+	Groups      []multiValue `json:"groups,omitempty"`
+}
+
+func (s *Server) toUser(r *http.Request, u *models.User) (map[string]any, error) {
+	return s.userOf(r, u, true)
+}
+
+// userOf returns the JSON representation of u, with its groups when
+// groups is true.
+func (s *Server) userOf(r *http.Request, u *models.User, groups bool) (map[string]any, error) {
+	res := user{
+		Schemas:     []string{UserSchema},
+		ID:          u.ID.String(),
+		ExternalID:  u.ExternalID,
+		UserName:    u.Email,
+		DisplayName: u.DisplayName,
+		Emails:      []multiValue{{Value: u.Email, Type: "work", Primary: true}},
+		Active:      u.CheckStatus(time.Now()) == nil,
+	}
+	if u.GivenName != "" || u.FamilyName != "" {
+		res.Name = &name{
+			GivenName:  u.GivenName,
+			FamilyName: u.FamilyName,
+			Formatted:  strings.TrimSpace(u.GivenName + " " + u.FamilyName),
+		}
+	}
+	if !groups {
+		return s.userMeta(r, u, res)
+	}
+	if groups, err := s.groupsOf(r, acl.Subject{Kind: acl.User, ID: res.ID}); err == nil {
+		for _, g := range groups {
+			res.Groups = append(res.Groups, multiValue{
+				Value:   g.ID.String(),
+				Display: g.Name,
+				Ref:     s.baseURL(r) + "/Groups/" + g.ID.String(),
+			})
+		}
+	}
+	return s.userMeta(r, u, res)
+}
+
+func (s *Server) userMeta(r *http.Request, u *models.User, res user) (map[string]any, error) {
+	return resource(res, meta{
+		ResourceType: "User",
+		Created:      u.CreatedAt,
+		LastModified: u.UpdatedAt,
+		Location:     s.baseURL(r) + "/Users/" + res.ID,
+	})
+}
+
+// fromUser sets the attributes of u from the JSON representation of a
+// user, read case insensitively as clients differ in how they spell
+// attribute names.
+func fromUser(v map[string]any, u *models.User) error {
+	userName, _ := str(v, "userName")
+	if userName == "" {
+		return invalid("invalidValue", errors.New("userName is required"))
+	}
+	u.Email = models.NormalizeEmail(userName)
+	u.ExternalID, _ = str(v, "externalId")
+	u.DisplayName, _ = str(v, "displayName")
+	u.GivenName, u.FamilyName = "", ""
+	if _, n, ok := lookup(v, "name"); ok {
+		if m, ok := n.(map[string]any); ok {
+			u.GivenName, _ = str(m, "givenName")
+			u.FamilyName, _ = str(m, "familyName")
+		}
+	}
+	active := true
+	if _, value, ok := lookup(v, "active"); ok {
+		switch a := value.(type) {
+		case bool:
+			active = a
+		case string:
+			// sent as a string by some versions of Entra ID
+			active = !strings.EqualFold(a, "false")
+		case nil:
+		default:
+			return invalid("invalidValue", fmt.Errorf("active must be a boolean"))
+		}
+	}
+	setActive(u, active, time.Now().UTC())
+	return nil
+}
+
+// setActive disables or reactivates u. Identity providers only manage
+// disabled accounts, the other statuses are left to administrators.
+func setActive(u *models.User, active bool, now time.Time) {
+	switch s := u.AccountStatus(now); {
+	case !active && s == models.StatusActive:
+		_ = u.SetStatus(models.StatusDisabled, "deactivated by the identity provider", time.Time{}, now)
+	case active && s == models.StatusDisabled:
+		_ = u.SetStatus(models.StatusActive, "", time.Time{}, now)
+	}
+}
+
+func str(m map[string]any, key string) (string, bool) {
+	_, v, _ := lookup(m, key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+func (s *Server) findUser(r *http.Request, id string) (*models.User, error) {
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return nil, errNotFound
+	}
+	u, err := s.users.WithContext(r.Context()).Query(database.WithFilter("id", uid)).First()
+	if err != nil {
+		return nil, errNotFound
+	}
+	return u, nil
+}
+
+func (s *Server) userResource(r *http.Request, id string) (map[string]any, error) {
+	u, err := s.findUser(r, id)
+	if err != nil {
+		return nil, err
+	}
+	return s.toUser(r, u)
+}
+
+// userResources lists users, looking them up by userName or externalId
+// in the database for filters made of eq comparisons of these.
+func (s *Server) userResources(r *http.Request, f filter, offset, limit int) ([]map[string]any, int, error) {
+	params, ok := userFilters(f)
+	if !ok {
+		return s.scanUsers(r, f, offset, limit)
+	}
+	total, err := s.users.WithContext(r.Context()).Query(params...).Count()
+	if err != nil || total == 0 || limit == 0 {
+		return nil, int(total), err
+	}
+	users, err := s.users.WithContext(r.Context()).Query(append(params,
+		database.WithOrder("created_at", database.ASC),
+		database.WithOffset(int64(offset)),
+		database.WithLimit(int64(limit)),
+	)...).All()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, _, err := pageOf(r, users, s.toUser, nil, 0, limit)
+	return page, int(total), err
+}
+
+// scanUsers lists the users matching f, a filter the database can't
+// apply, reading them userBatch at a time. Their groups are only looked
+// up for the page returned, unless f compares them.
+func (s *Server) scanUsers(r *http.Request, f filter, offset, limit int) ([]map[string]any, int, error) {
+	groups := mentions(f, "groups")
+	var page []*models.User
+	total := 0
+	for skip := int64(0); ; skip += userBatch {
+		users, err := s.users.WithContext(r.Context()).Query(
+			database.WithOrder("created_at", database.ASC),
+			database.WithOffset(skip),
+			database.WithLimit(userBatch),
+		).All()
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, u := range users {
+			res, err := s.userOf(r, u, groups)
+			if err != nil {
+				return nil, 0, err
+			}
+			if !f.match(res) {
+				continue
+			}
+			if total >= offset && len(page) < limit {
+				page = append(page, u)
+			}
+			total++
+		}
+		if int64(len(users)) < userBatch {
+			break
+		}
+	}
+	res, _, err := pageOf(r, page, s.toUser, nil, 0, limit)
+	return res, total, err
+}
+
+// userFilters returns the database filters equivalent to f, false when
+// it has none.
+func userFilters(f filter) ([]database.Params, bool) {
+	if f == nil {
+		return nil, true
+	}
+	eq := equalities(f)
+	if eq == nil {
+		return nil, false
+	}
+	var params []database.Params
+	for attr, v := range eq {
+		value, ok := v.(string)
+		switch {
+		case !ok:
+			return nil, false
+		case strings.EqualFold(attr, "userName"):
+			params = append(params, database.WithFilter("email", models.NormalizeEmail(value)))
+		case strings.EqualFold(attr, "externalId"):
+			params = append(params, database.WithFilter("external_id", value))
+		default:
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// emailTaken reports whether a user other than id has email.
+func (s *Server) emailTaken(r *http.Request, email string, id uuid.UUID) bool {
+	other, err := s.users.WithContext(r.Context()).Query(database.WithFilter("email", email)).First()
+	return err == nil && other.ID != id
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	v, err := decode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	now := time.Now().UTC()
+	u := models.User{ID: uuid.New(), CreatedAt: now, UpdatedAt: now}
+	if err := fromUser(v, &u); err != nil {
+		writeError(w, err)
+		return
+	}
+	// the identity provider is trusted to have verified the address
+	u.EmailVerified = true
+	u.EmailVerifiedAt = now
+	if s.emailTaken(r, u.Email, u.ID) {
+		writeError(w, errUniqueness)
+		return
+	}
+	e := events.FromRequest(r, events.UserRegistered, "scim")
+	e.UserID = u.ID.String()
+	e.Email = u.Email
+	if err := s.events.Check(r.Context(), e); err != nil {
+		writeError(w, &Error{Status: http.StatusForbidden, Detail: err.Error()})
+		return
+	}
+	if err := s.users.WithContext(r.Context()).Save(u); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.events.Publish(r.Context(), e)
+	res, err := s.toUser(r, &u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResource(w, http.StatusCreated, res)
+}
+
+// updateUser saves the representation v of u, ending its sessions when
+// it is deactivated.
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, u *models.User, v map[string]any) {
+	was := u.AccountStatus(time.Now())
+	if err := fromUser(v, u); err != nil {
+		writeError(w, err)
+		return
+	}
+	if s.emailTaken(r, u.Email, u.ID) {
+		writeError(w, errUniqueness)
+		return
+	}
+	u.UpdatedAt = time.Now().UTC()
+	if err := s.users.WithContext(r.Context()).Query(database.WithFilter("id", u.ID)).Update(*u); err != nil {
+		writeError(w, err)
+		return
+	}
+	if status := u.AccountStatus(time.Now()); status != was {
+		if status != models.StatusActive && s.deactivate != nil {
+			if err := s.deactivate(r.Context(), u.ID); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+		e := events.FromRequest(r, events.StatusChanged, "scim")
+		e.UserID = u.ID.String()
+		e.Email = u.Email
+		e.Reason = u.StatusReason
+		e.Data = map[string]any{"from": was, "to": status}
+		s.events.Publish(r.Context(), e)
+	}
+	res, err := s.toUser(r, u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResource(w, http.StatusOK, res)
+}
+
+func (s *Server) replaceUser(w http.ResponseWriter, r *http.Request) {
+	u, err := s.findUser(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	current, err := s.toUser(r, u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkVersion(r, current); err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := decode(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.updateUser(w, r, u, v)
+}
+
+func (s *Server) patchUser(w http.ResponseWriter, r *http.Request) {
+	u, err := s.findUser(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	v, err := s.toUser(r, u)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkVersion(r, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := patch(r, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	s.updateUser(w, r, u, v)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	u, err := s.findUser(r, chi.URLParam(r, "id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.delete(r.Context(), u.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	if s.acl != nil {
+		if err := s.acl.Forget(r.Context(), acl.Subject{Kind: acl.User, ID: u.ID.String()}); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
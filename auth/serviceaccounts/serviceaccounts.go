@@ -0,0 +1,321 @@
+// Package serviceaccounts gives services their own identities, separate
+// from users. Service accounts authenticate with a client secret or a
+// key pair and exchange them for short lived JWT access tokens at an
+// OAuth 2.0 client credentials token endpoint.
+package serviceaccounts
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
+)
+
+var (
+	ErrNotFound     = errors.New("serviceaccounts: not found")
+	ErrInvalidKey   = errors.New("serviceaccounts: the key must be an RSA, EC or Ed25519 public key, as PEM or JWK")
+	ErrUnknownScope = errors.New("serviceaccounts: unknown scope")
+	errNoName       = errors.New("serviceaccounts: a name is required")
+	errNoTokenURL   = errors.New("serviceaccounts: client assertions require a token URL")
+)
+
+// ServiceAccount is the identity of a service. Its ID is the OAuth 2.0
+// client_id.
+type ServiceAccount struct {
+	ID          uuid.UUID `json:"id" db:"id,index,required,unique"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	// Scopes, space separated, are the scopes the account may request.
+	// Tokens of accounts without scopes aren't restricted to scopes.
+	Scopes    string    `json:"scopes" db:"scopes"`
+	Disabled  bool      `json:"disabled" db:"disabled"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+}
+
+// ScopeList returns the space separated scopes of the account.
+func (sa *ServiceAccount) ScopeList() []string {
+	return strings.Fields(sa.Scopes)
+}
+
+type CredentialKind string
+
+const (
+	Secret CredentialKind = "secret"
+	Key    CredentialKind = "key"
+)
+
+// Credential is a client secret, of which only a hash is stored, or the
+// public key of a key pair the account signs client assertions with.
+type Credential struct {
+	ID        uuid.UUID      `json:"id" db:"id,index,required,unique"`
+	AccountID uuid.UUID      `json:"account_id" db:"account_id,index,required"`
+	Kind      CredentialKind `json:"kind" db:"kind"`
+	Hint      string         `json:"hint,omitempty" db:"hint"`
+	Hash      string         `json:"-" db:"hash,index"`
+	KeyID     string         `json:"kid,omitempty" db:"kid"`
+	PublicKey string         `json:"public_key,omitempty" db:"public_key"`
+	CreatedAt time.Time      `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time      `json:"expires_at,omitempty" db:"expires_at"`
+	Revoked   bool           `json:"-" db:"revoked,index"`
+	RevokedAt time.Time      `json:"-" db:"revoked_at"`
+}
+
+func (c *Credential) active(now time.Time) bool {
+	return !c.Revoked && (c.ExpiresAt.IsZero() || now.Before(c.ExpiresAt))
+}
+
+type Options func(*Manager)
+
+type Manager struct {
+	accounts      database.Model[ServiceAccount]
+	credentials   database.Model[Credential]
+	store         storage.Storage
+	key           jwk.Key
+	issuer        string
+	audience      string
+	token_url     string
+	ttl           time.Duration
+	assertion_ttl time.Duration
+}
+
+// WithSigningKey sets the key access tokens are signed with, an RSA, a
+// P-256 ECDSA or an Ed25519 private key. A P-256 key is generated by
+// default, which invalidates issued tokens on restart and doesn't work
+// across multiple instances.
+func WithSigningKey(key crypto.Signer) Options {
+	return func(m *Manager) {
+		k, err := jwk.FromRaw(key)
+		if err != nil {
+			panic(err)
+		}
+		m.key = k
+	}
+}
+
+// WithIssuer sets the iss claim of access tokens, iam by default.
+func WithIssuer(iss string) Options {
+	return func(m *Manager) {
+		m.issuer = iss
+	}
+}
+
+// WithAudience sets the aud claim of access tokens.
+func WithAudience(aud string) Options {
+	return func(m *Manager) {
+		m.audience = aud
+	}
+}
+
+// WithTokenURL sets the public URL of the token endpoint, the audience
+// client assertions must be issued for. Client assertions are refused
+// without it.
+func WithTokenURL(url string) Options {
+	return func(m *Manager) {
+		m.token_url = url
+	}
+}
+
+// WithTokenTTL sets how long access tokens are valid, 10 minutes by
+// default.
+func WithTokenTTL(d time.Duration) Options {
+	return func(m *Manager) {
+		m.ttl = d
+	}
+}
+
+// WithStorage sets the storage the ids of client assertions are kept in,
+// to reject replays. An in-memory storage is used by default.
+func WithStorage(s storage.Storage) Options {
+	return func(m *Manager) {
+		m.store = s
+	}
+}
+
+func New(accounts database.Model[ServiceAccount], credentials database.Model[Credential], opts ...Options) *Manager {
+	m := &Manager{
+		accounts:      accounts,
+		credentials:   credentials,
+		issuer:        "iam",
+		ttl:           10 * time.Minute,
+		assertion_ttl: 5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.key == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		WithSigningKey(key)(m)
+	}
+	if m.store == nil {
+		m.store = storage.NewMemoryStorage()
+	}
+	_ = jwk.AssignKeyID(m.key)
+	return m
+}
+
+// Create adds a service account allowed to request scopes.
+func (m *Manager) Create(ctx context.Context, name, description string, scopes []string) (*ServiceAccount, error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil, errNoName
+	}
+	for _, s := range scopes {
+		if s == "" || strings.ContainsAny(s, " \t\n") {
+			return nil, ErrUnknownScope
+		}
+	}
+	sa := ServiceAccount{
+		ID:          uuid.New(),
+		Name:        name,
+		Description: description,
+		Scopes:      strings.Join(scopes, " "),
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := m.accounts.WithContext(ctx).Save(sa); err != nil {
+		return nil, err
+	}
+	return &sa, nil
+}
+
+// Get returns a service account.
+func (m *Manager) Get(ctx context.Context, id uuid.UUID) (*ServiceAccount, error) {
+	sa, err := m.accounts.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	return sa, nil
+}
+
+// List returns every service account.
+func (m *Manager) List(ctx context.Context) ([]*ServiceAccount, error) {
+	return m.accounts.WithContext(ctx).Query().All()
+}
+
+// SetDisabled disables or enables a service account. Disabled accounts
+// can't get tokens, and the tokens they got are rejected.
+func (m *Manager) SetDisabled(ctx context.Context, id uuid.UUID, disabled bool) error {
+	sa, err := m.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	sa.Disabled = disabled
+	return m.accounts.WithContext(ctx).Query(database.WithFilter("id", id)).Update(*sa)
+}
+
+// AddSecret issues a client secret for a service account and returns it
+// along with the secret, which can't be retrieved later.
+func (m *Manager) AddSecret(ctx context.Context, id uuid.UUID, expiresAt time.Time) (*Credential, string, error) {
+	if _, err := m.Get(ctx, id); err != nil {
+		return nil, "", err
+	}
+	secret := "iam_sa_" + token.Generate(token.URL, 0)
+	c := Credential{
+		ID:        uuid.New(),
+		AccountID: id,
+		Kind:      Secret,
+		Hint:      secret[:11],
+		Hash:      hash(secret),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt.UTC(),
+	}
+	if err := m.credentials.WithContext(ctx).Save(c); err != nil {
+		return nil, "", err
+	}
+	return &c, secret, nil
+}
+
+// AddKey registers a public key, PEM encoded or a JWK, a service
+// account signs client assertions with. Its key ID is the kid of the JWK
+// or its thumbprint.
+func (m *Manager) AddKey(ctx context.Context, id uuid.UUID, key []byte) (*Credential, error) {
+	if _, err := m.Get(ctx, id); err != nil {
+		return nil, err
+	}
+	k, err := jwk.ParseKey(key, jwk.WithPEM(!json.Valid(key)))
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	if !slices.Contains([]jwa.KeyType{jwa.RSA, jwa.EC, jwa.OKP}, k.KeyType()) {
+		return nil, ErrInvalidKey
+	}
+	if k, err = k.PublicKey(); err != nil {
+		return nil, ErrInvalidKey
+	}
+	if k.KeyID() == "" {
+		if err := jwk.AssignKeyID(k); err != nil {
+			return nil, ErrInvalidKey
+		}
+	}
+	buf, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	c := Credential{
+		ID:        uuid.New(),
+		AccountID: id,
+		Kind:      Key,
+		KeyID:     k.KeyID(),
+		PublicKey: string(buf),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := m.credentials.WithContext(ctx).Save(c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Credentials returns the active credentials of a service account.
+func (m *Manager) Credentials(ctx context.Context, id uuid.UUID) ([]*Credential, error) {
+	all, err := m.credentials.WithContext(ctx).Query(
+		database.WithFilter("account_id", id),
+		database.WithFilter("revoked", false),
+	).All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	res := make([]*Credential, 0, len(all))
+	for _, c := range all {
+		if c.active(now) {
+			res = append(res, c)
+		}
+	}
+	return res, nil
+}
+
+// RevokeCredential revokes a credential of a service account, tokens
+// already issued with it stay valid until they expire.
+func (m *Manager) RevokeCredential(ctx context.Context, id, credentialID uuid.UUID) error {
+	c, err := m.credentials.WithContext(ctx).Query(
+		database.WithFilter("id", credentialID),
+		database.WithFilter("account_id", id),
+	).First()
+	if err != nil || c.Revoked {
+		return ErrNotFound
+	}
+	c.Revoked = true
+	c.RevokedAt = time.Now().UTC()
+	return m.credentials.WithContext(ctx).Query(database.WithFilter("id", c.ID)).Update(*c)
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,152 @@
+package serviceaccounts
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tokenURL = "https://iam.example.com/oauth/token"
+
+func TestTokenEndpoint(t *testing.T) {
+	m := New(testdb.New[ServiceAccount](), testdb.New[Credential](), WithTokenURL(tokenURL))
+	ctx := context.Background()
+	sa, err := m.Create(ctx, "billing", "charges customers", []string{"invoices:read", "invoices:write"})
+	require.NoError(t, err)
+	_, secret, err := m.AddSecret(ctx, sa.ID, time.Time{})
+	require.NoError(t, err)
+
+	post := func(form url.Values, basic ...string) (int, map[string]any) {
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(basic) == 2 {
+			r.SetBasicAuth(basic[0], basic[1])
+		}
+		w := httptest.NewRecorder()
+		m.Handler().ServeHTTP(w, r)
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&body))
+		return w.Code, body
+	}
+
+	t.Run("Client Secret", func(t *testing.T) {
+		code, body := post(url.Values{"grant_type": {"client_credentials"}}, sa.ID.String(), secret)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "Bearer", body["token_type"])
+		assert.Equal(t, "invoices:read invoices:write", body["scope"])
+		tok := body["access_token"].(string)
+		assert.True(t, m.Is(tok))
+		access, err := m.Verify(ctx, tok)
+		require.NoError(t, err)
+		assert.Equal(t, sa.ID, access.Account.ID)
+
+		code, body = post(url.Values{"grant_type": {"client_credentials"}, "client_id": {sa.ID.String()},
+			"client_secret": {secret}, "scope": {"invoices:read"}})
+		require.Equal(t, http.StatusOK, code)
+		access, err = m.Verify(ctx, body["access_token"].(string))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"invoices:read"}, access.Scopes)
+
+		code, body = post(url.Values{"grant_type": {"client_credentials"}, "scope": {"users:delete"}}, sa.ID.String(), secret)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, "invalid_scope", body["error"])
+		code, body = post(url.Values{"grant_type": {"client_credentials"}}, sa.ID.String(), secret+"x")
+		assert.Equal(t, http.StatusUnauthorized, code)
+		assert.Equal(t, "invalid_client", body["error"])
+		code, body = post(url.Values{"grant_type": {"password"}}, sa.ID.String(), secret)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, "unsupported_grant_type", body["error"])
+	})
+
+	t.Run("Private Key JWT", func(t *testing.T) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		require.NoError(t, err)
+		c, err := m.AddKey(ctx, sa.ID, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		require.NoError(t, err)
+		_, err = m.AddKey(ctx, sa.ID, []byte("not a key"))
+		assert.ErrorIs(t, err, ErrInvalidKey)
+
+		key, err := jwk.FromRaw(priv)
+		require.NoError(t, err)
+		require.NoError(t, key.Set(jwk.KeyIDKey, c.KeyID))
+		assertion := func(aud string, exp time.Duration) string {
+			tok, err := jwt.NewBuilder().Issuer(sa.ID.String()).Subject(sa.ID.String()).Audience([]string{aud}).
+				JwtID(uuid.NewString()).Expiration(time.Now().Add(exp)).Build()
+			require.NoError(t, err)
+			signed, err := jwt.Sign(tok, jwt.WithKey(jwa.ES256, key))
+			require.NoError(t, err)
+			return string(signed)
+		}
+		form := func(assertion string) url.Values {
+			return url.Values{"grant_type": {"client_credentials"},
+				"client_assertion_type": {AssertionType}, "client_assertion": {assertion}}
+		}
+
+		a := assertion(tokenURL, time.Minute)
+		code, _ := post(form(a))
+		require.Equal(t, http.StatusOK, code)
+		code, _ = post(form(a))
+		assert.Equal(t, http.StatusUnauthorized, code, "replayed assertion")
+		code, _ = post(form(assertion("https://evil.example.com/token", time.Minute)))
+		assert.Equal(t, http.StatusUnauthorized, code, "wrong audience")
+		code, _ = post(form(assertion(tokenURL, time.Hour)))
+		assert.Equal(t, http.StatusUnauthorized, code, "long lived assertion")
+
+		// without a token URL the audience would come from the request
+		r := httptest.NewRequest(http.MethodPost, "/token", strings.NewReader(form(assertion("http://example.com/token", time.Minute)).Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		New(m.accounts, m.credentials).Handler().ServeHTTP(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "no token URL")
+
+		other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		key, err = jwk.FromRaw(other)
+		require.NoError(t, err)
+		code, _ = post(form(assertion(tokenURL, time.Minute)))
+		assert.Equal(t, http.StatusUnauthorized, code, "unknown key")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		code, body := post(url.Values{"grant_type": {"client_credentials"}}, sa.ID.String(), secret)
+		require.Equal(t, http.StatusOK, code)
+		require.NoError(t, m.SetDisabled(ctx, sa.ID, true))
+		_, err := m.Verify(ctx, body["access_token"].(string))
+		assert.ErrorIs(t, err, ErrInvalidToken)
+		code, _ = post(url.Values{"grant_type": {"client_credentials"}}, sa.ID.String(), secret)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("JWKS", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jwks", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		set, err := jwk.Parse(w.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, 1, set.Len())
+		k, _ := set.Key(0)
+		_, private := k.(jwk.ECDSAPrivateKey)
+		assert.False(t, private)
+		assert.False(t, m.Is("iam_pat_abc"))
+	})
+}
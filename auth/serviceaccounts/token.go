@@ -0,0 +1,318 @@
+package serviceaccounts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neghi-go/database"
+)
+
+// AssertionType is the client_assertion_type of private_key_jwt client
+// authentication, RFC 7523.
+const AssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+const accessTokenType = "at+jwt"
+
+var (
+	ErrInvalidClient = errors.New("serviceaccounts: client authentication failed")
+	ErrInvalidToken  = errors.New("serviceaccounts: the access token is invalid or expired")
+)
+
+// Access is the service account an access token was issued to, and the
+// scopes it was issued with, nil when the account isn't restricted to
+// scopes.
+type Access struct {
+	Account  *ServiceAccount
+	Scopes   []string
+	IssuedAt time.Time
+}
+
+// tokenError is an OAuth 2.0 error response, RFC 6749 section 5.2.
+type tokenError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// Handler serves the OAuth 2.0 routes of service accounts:
+//
+//	POST /token   issues access tokens for the client credentials grant
+//	GET  /jwks    publishes the keys access tokens can be verified with
+func (m *Manager) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/token", m.Token)
+	r.Get("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub, err := m.key.PublicKey()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_ = pub.Set(jwk.KeyUsageKey, jwk.ForSignature)
+		set := jwk.NewSet()
+		_ = set.AddKey(pub)
+		w.Header().Set("Content-Type", "application/jwk-set+json")
+		_ = json.NewEncoder(w).Encode(set)
+	})
+	return r
+}
+
+// Token is the token endpoint. Clients authenticate with a client secret,
+// using HTTP Basic authentication or the client_id and client_secret
+// form fields, or with a client assertion signed with one of their keys.
+// Responses follow RFC 6749 rather than the JSON envelope of other
+// routes, as OAuth clients expect.
+func (m *Manager) Token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenError{Code: "invalid_request"})
+		return
+	}
+	if gt := r.PostForm.Get("grant_type"); gt != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, tokenError{Code: "unsupported_grant_type"})
+		return
+	}
+	sa, err := m.authenticateClient(r)
+	if err != nil {
+		if _, _, basic := r.BasicAuth(); basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+		}
+		writeJSON(w, http.StatusUnauthorized, tokenError{Code: "invalid_client", Description: err.Error()})
+		return
+	}
+	scopes, err := grant(sa, strings.Fields(r.PostForm.Get("scope")))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, tokenError{Code: "invalid_scope"})
+		return
+	}
+	tok, err := m.issue(sa, scopes)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, tokenError{Code: "server_error"})
+		return
+	}
+	res := map[string]any{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   int(m.ttl.Seconds()),
+	}
+	if scopes != nil {
+		res["scope"] = strings.Join(scopes, " ")
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// grant returns the scopes of a token requested with scopes, every scope
+// of the account when none are requested.
+func grant(sa *ServiceAccount, requested []string) ([]string, error) {
+	allowed := sa.ScopeList()
+	if len(allowed) == 0 {
+		if len(requested) == 0 {
+			return nil, nil
+		}
+		return requested, nil
+	}
+	if len(requested) == 0 {
+		return allowed, nil
+	}
+	for _, s := range requested {
+		if !slices.Contains(allowed, s) {
+			return nil, ErrUnknownScope
+		}
+	}
+	return requested, nil
+}
+
+func (m *Manager) authenticateClient(r *http.Request) (*ServiceAccount, error) {
+	ctx := r.Context()
+	if r.PostForm.Get("client_assertion_type") == AssertionType {
+		return m.verifyAssertion(r, r.PostForm.Get("client_assertion"))
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	sa, err := m.account(ctx, clientID)
+	if err != nil || secret == "" {
+		return nil, ErrInvalidClient
+	}
+	c, err := m.credentials.WithContext(ctx).Query(
+		database.WithFilter("hash", hash(secret)),
+		database.WithFilter("account_id", sa.ID),
+	).First()
+	if err != nil || c.Kind != Secret || !c.active(time.Now().UTC()) {
+		return nil, ErrInvalidClient
+	}
+	return sa, nil
+}
+
+// verifyAssertion verifies a private_key_jwt client assertion: it must
+// be signed with a key of the account, have the account as issuer and
+// subject, be issued for the token endpoint and not have been used.
+// Assertions are refused without WithTokenURL: the URL of the request
+// is up to the client and can't tell which endpoint they were issued for.
+func (m *Manager) verifyAssertion(r *http.Request, assertion string) (*ServiceAccount, error) {
+	ctx := r.Context()
+	if m.token_url == "" {
+		return nil, errNoTokenURL
+	}
+	unverified, err := jwt.ParseInsecure([]byte(assertion))
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	sa, err := m.account(ctx, unverified.Subject())
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	keys, err := m.Credentials(ctx, sa.ID)
+	if err != nil {
+		return nil, err
+	}
+	set := jwk.NewSet()
+	for _, c := range keys {
+		if c.Kind != Key {
+			continue
+		}
+		k, err := jwk.ParseKey([]byte(c.PublicKey))
+		if err == nil {
+			_ = set.AddKey(k)
+		}
+	}
+	if set.Len() == 0 {
+		return nil, ErrInvalidClient
+	}
+	tok, err := jwt.Parse([]byte(assertion),
+		jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true), jws.WithUseDefault(true)),
+		jwt.WithIssuer(sa.ID.String()),
+		jwt.WithSubject(sa.ID.String()),
+		jwt.WithAudience(m.token_url),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+		jwt.WithRequiredClaim(jwt.JwtIDKey),
+		jwt.WithAcceptableSkew(30*time.Second),
+	)
+	if err != nil {
+		return nil, ErrInvalidClient
+	}
+	if time.Until(tok.Expiration()) > m.assertion_ttl {
+		return nil, ErrInvalidClient
+	}
+	// the assertion can't be replayed before it expires
+	n, err := m.store.Incr(ctx, "client-assertion:"+sa.ID.String()+":"+tok.JwtID(), time.Until(tok.Expiration())+time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1 {
+		return nil, ErrInvalidClient
+	}
+	return sa, nil
+}
+
+// account returns the enabled service account of a client_id.
+func (m *Manager) account(ctx context.Context, clientID string) (*ServiceAccount, error) {
+	id, err := uuid.Parse(clientID)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	sa, err := m.Get(ctx, id)
+	if err != nil || sa.Disabled {
+		return nil, ErrNotFound
+	}
+	return sa, nil
+}
+
+// issue signs an access token for sa, RFC 9068.
+func (m *Manager) issue(sa *ServiceAccount, scopes []string) (string, error) {
+	now := time.Now().UTC()
+	b := jwt.NewBuilder().
+		Issuer(m.issuer).
+		Subject(sa.ID.String()).
+		IssuedAt(now).
+		Expiration(now.Add(m.ttl)).
+		JwtID(uuid.NewString()).
+		Claim("client_id", sa.ID.String())
+	if m.audience != "" {
+		b = b.Audience([]string{m.audience})
+	}
+	if scopes != nil {
+		b = b.Claim("scope", strings.Join(scopes, " "))
+	}
+	tok, err := b.Build()
+	if err != nil {
+		return "", err
+	}
+	headers := jws.NewHeaders()
+	_ = headers.Set(jws.TypeKey, accessTokenType)
+	signed, err := jwt.Sign(tok, jwt.WithKey(m.algorithm(), m.key, jws.WithProtectedHeaders(headers)))
+	if err != nil {
+		return "", err
+	}
+	return string(signed), nil
+}
+
+func (m *Manager) algorithm() jwa.SignatureAlgorithm {
+	switch m.key.KeyType() {
+	case jwa.RSA:
+		return jwa.RS256
+	case jwa.OKP:
+		return jwa.EdDSA
+	}
+	return jwa.ES256
+}
+
+// Is reports whether credential is an access token signed by m, without
+// validating it.
+func (m *Manager) Is(credential string) bool {
+	if m == nil || strings.Count(credential, ".") != 2 {
+		return false
+	}
+	msg, err := jws.Parse([]byte(credential))
+	if err != nil || len(msg.Signatures()) != 1 {
+		return false
+	}
+	h := msg.Signatures()[0].ProtectedHeaders()
+	return h.Type() == accessTokenType && h.KeyID() == m.key.KeyID()
+}
+
+// Verify validates an access token issued by m and returns the access
+// it grants. Tokens of disabled accounts are rejected.
+func (m *Manager) Verify(ctx context.Context, credential string) (*Access, error) {
+	pub, err := m.key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	opts := []jwt.ParseOption{
+		jwt.WithKey(m.algorithm(), pub),
+		jwt.WithIssuer(m.issuer),
+	}
+	if m.audience != "" {
+		opts = append(opts, jwt.WithAudience(m.audience))
+	}
+	tok, err := jwt.Parse([]byte(credential), opts...)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	sa, err := m.account(ctx, tok.Subject())
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	a := &Access{Account: sa, IssuedAt: tok.IssuedAt()}
+	if scope, ok := tok.Get("scope"); ok {
+		s, _ := scope.(string)
+		a.Scopes = strings.Fields(s)
+	}
+	return a, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,113 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/neghi-go/database"
+)
+
+// ErrStepUpRequired is returned for actions sessions can't take until
+// they are stepped up, see RequireACR.
+var ErrStepUpRequired = errors.New("sessions: the session has to be stepped up first")
+
+// Authentication methods a session is recorded with, the amr values of
+// RFC 8176.
+const (
+	AMRPassword  = "pwd"
+	AMROTP       = "otp"
+	AMRFederated = "fed"
+	AMRHardware  = "hwk"
+	AMRMFA       = "mfa"
+	// AMREmail is a link or code sent to the user's email address,
+	// which has no RFC 8176 value.
+	AMREmail = "email"
+)
+
+// Authentication assurance levels, the acr of a session.
+const (
+	AAL1 = "aal1"
+	AAL2 = "aal2"
+)
+
+// factors maps authentication methods to the kind of factor they prove,
+// something known, something held or something the user is. AMREmail
+// isn't a factor: whoever can reset the password by email can also open
+// the links and codes sent there, so it never adds to a password.
+var factors = map[string]string{
+	AMRPassword: "knowledge",
+	"pin":       "knowledge",
+	AMROTP:      "possession",
+	AMRHardware: "possession",
+	"swk":       "possession",
+	"sms":       "possession",
+	"bio":       "inherence",
+	"fpt":       "inherence",
+	"face":      "inherence",
+}
+
+// ACR returns the assurance level reached by authenticating with amr,
+// AAL2 when two kinds of factor were used.
+func ACR(amr []string) string {
+	kinds := map[string]bool{}
+	for _, m := range amr {
+		if m == AMRMFA {
+			return AAL2
+		}
+		if k, ok := factors[m]; ok {
+			kinds[k] = true
+		}
+	}
+	switch {
+	case len(kinds) >= 2:
+		return AAL2
+	case len(amr) > 0:
+		return AAL1
+	}
+	return ""
+}
+
+// Level orders assurance levels, unknown levels are 0.
+func Level(acr string) int {
+	switch acr {
+	case AAL1:
+		return 1
+	case AAL2:
+		return 2
+	}
+	return 0
+}
+
+// Methods returns the authentication methods of the session.
+func (rec *Record) Methods() []string {
+	return strings.Fields(rec.AMR)
+}
+
+// authenticated records that the user authenticated with amr, on top of
+// the methods in prev when the session is stepped up.
+func (rec *Record) authenticated(prev []string, amr []string) {
+	methods := slices.Clone(prev)
+	for _, m := range amr {
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	rec.AMR = strings.Join(methods, " ")
+	rec.ACR = ACR(methods)
+}
+
+// Restricted reports whether the session has yet to be stepped up to
+// RequiredACR.
+func (rec *Record) Restricted() bool {
+	return Level(rec.ACR) < Level(rec.RequiredACR)
+}
+
+// RequireACR restricts the session until the user steps it up to the
+// assurance level acr, e.g after a risky sign in. Stepping up keeps the
+// requirement, so it is met once the methods of the session reach acr.
+func (m *Manager) RequireACR(ctx context.Context, rec *Record, acr string) error {
+	rec.RequiredACR = acr
+	return m.model.WithContext(ctx).Query(database.WithFilter("id", rec.ID)).Update(*rec)
+}
@@ -0,0 +1,105 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/utilities"
+)
+
+// Handler serves the session management routes of the signed in user:
+//
+//	GET    /       lists the active sessions
+//	DELETE /{id}   revokes a session
+//	DELETE /       revokes every other session, or all of them with ?all=true
+//
+// Impersonation sessions and sessions yet to be stepped up, see
+// RequireACR, can't revoke sessions.
+func (m *Manager) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := m.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		list, err := m.List(r.Context(), current.UserID)
+		if err != nil {
+			fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		for _, rec := range list {
+			rec.Current = rec.ID == current.ID
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(list).Send()
+	})
+	r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		current, err := m.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		// revoking would sign the user out of their own sessions
+		if current.Impersonated() {
+			fail(w, ErrImpersonating, http.StatusForbidden)
+			return
+		}
+		if current.Restricted() {
+			fail(w, ErrStepUpRequired, http.StatusForbidden)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			fail(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+		if err := m.Revoke(r.Context(), current.UserID, id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			fail(w, err, status)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).Send()
+	})
+	r.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := m.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		// revoking would sign the user out of their own sessions
+		if current.Impersonated() {
+			fail(w, ErrImpersonating, http.StatusForbidden)
+			return
+		}
+		if current.Restricted() {
+			fail(w, ErrStepUpRequired, http.StatusForbidden)
+			return
+		}
+		var keep []uuid.UUID
+		if r.URL.Query().Get("all") != "true" {
+			keep = append(keep, current.ID)
+		}
+		n, err := m.RevokeAll(r.Context(), current.UserID, keep...)
+		if err != nil {
+			fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(map[string]int{"revoked": n}).Send()
+	})
+	return r
+}
+
+func fail(w http.ResponseWriter, err error, status int) {
+	res := utilities.ResponseFail
+	if status >= http.StatusInternalServerError {
+		res = utilities.ResponseError
+	}
+	utilities.JSON(w).SetStatus(res).SetStatusCode(status).SetMessage(err.Error()).Send()
+}
@@ -0,0 +1,84 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+)
+
+// ProviderImpersonation is the provider of impersonation sessions.
+const ProviderImpersonation = "impersonation"
+
+var (
+	// ErrImpersonating is returned for actions impersonation sessions
+	// can't take.
+	ErrImpersonating   = errors.New("sessions: not allowed while impersonating a user")
+	errCredentialInUse = errors.New("sessions: the credential is held by another session")
+)
+
+// generateUnique issues a credential no active session holds. Only the
+// JWTs of session.JWT can collide, see JWT.
+func (m *Manager) generateUnique(ctx context.Context, w http.ResponseWriter, userID uuid.UUID, email string) (string, error) {
+	credential, err := m.generate(w, userID, email)
+	if err != nil {
+		return "", err
+	}
+	if _, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("token_hash", hash(credential)),
+		database.WithFilter("revoked", false),
+	).First(); err == nil {
+		return "", errCredentialInUse
+	}
+	return credential, nil
+}
+
+// Impersonated reports whether the session was opened by an
+// administrator as the user.
+func (rec *Record) Impersonated() bool {
+	return rec.ImpersonatorID != uuid.Nil
+}
+
+// Impersonate issues a session of the user for impersonator, valid for
+// ttl. The session records who opened it and why, has no authentication
+// methods, so routes requiring a level of assurance challenge it, and
+// gets no refresh token: it ends when it expires.
+func (m *Manager) Impersonate(w http.ResponseWriter, r *http.Request, impersonator *Record,
+	userID uuid.UUID, email, reason string, ttl time.Duration) (*Record, error) {
+	if impersonator.Impersonated() {
+		return nil, ErrImpersonating
+	}
+	credential, err := m.generateUnique(r.Context(), w, userID, email)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	if m.ttl > 0 && m.ttl < ttl {
+		ttl = m.ttl
+	}
+	rec := Record{
+		ID:                  uuid.New(),
+		UserID:              userID,
+		Email:               email,
+		TokenHash:           hash(credential),
+		Provider:            ProviderImpersonation,
+		Device:              Device(r),
+		IP:                  events.ClientIP(r),
+		UserAgent:           r.UserAgent(),
+		CreatedAt:           now,
+		LastSeenAt:          now,
+		AuthTime:            now,
+		ExpiresAt:           now.Add(ttl),
+		ImpersonatorID:      impersonator.UserID,
+		ImpersonatorEmail:   impersonator.Email,
+		ImpersonationReason: reason,
+	}
+	if err := m.model.WithContext(r.Context()).Save(rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
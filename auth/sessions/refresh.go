@@ -0,0 +1,256 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/auth/token"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/session/store"
+	"github.com/neghi-go/utilities"
+)
+
+var (
+	ErrRefreshInvalid = errors.New("sessions: the refresh token is invalid or expired")
+	// ErrRefreshReused is returned when a refresh token is used twice,
+	// which means it leaked. The session it belongs to is revoked.
+	ErrRefreshReused = errors.New("sessions: the refresh token was already used, the session has been revoked")
+)
+
+// RefreshToken is a single use token exchanged for a new session
+// credential. Every token issued for a session shares the session's ID,
+// so reuse of any of them revokes the whole session.
+type RefreshToken struct {
+	ID        uuid.UUID `json:"id" db:"id,index,required,unique"`
+	SessionID uuid.UUID `json:"session_id" db:"session_id,index,required"`
+	UserID    uuid.UUID `json:"user_id" db:"user_id,index"`
+	Hash      string    `json:"-" db:"hash,index,unique"`
+	Used      bool      `json:"used" db:"used"`
+	UsedAt    time.Time `json:"used_at" db:"used_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// WithRefreshTokens issues a refresh token, in the Refresh-Token header,
+// along with every session. Refresh tokens are valid for ttl, 30 days
+// when ttl is zero.
+func WithRefreshTokens(model database.Model[RefreshToken], ttl time.Duration) Options {
+	return func(m *Manager) {
+		m.refresh = model
+		if ttl > 0 {
+			m.refresh_ttl = ttl
+		}
+	}
+}
+
+// WithSessionStore sets the store of a server session backend, so that
+// logging out deletes the session from it.
+func WithSessionStore(s store.Store) Options {
+	return func(m *Manager) {
+		m.backend = s
+	}
+}
+
+// WithStorage sets the storage refresh tokens are consumed in, so that
+// only one of concurrent rotations of a token succeeds. It must be shared
+// by every instance, an in-memory storage is used by default.
+func WithStorage(s storage.Storage) Options {
+	return func(m *Manager) {
+		m.store = s
+	}
+}
+
+// WithUsers sets the users returned by WhoAmI.
+func WithUsers(model database.Model[models.User]) Options {
+	return func(m *Manager) {
+		m.users = model
+	}
+}
+
+func (m *Manager) issueRefresh(w http.ResponseWriter, r *http.Request, rec *Record) error {
+	if m.refresh == nil {
+		return nil
+	}
+	tok := token.Generate(token.URL, 0)
+	now := time.Now().UTC()
+	if err := m.refresh.WithContext(r.Context()).Save(RefreshToken{
+		ID:        uuid.New(),
+		SessionID: rec.ID,
+		UserID:    rec.UserID,
+		Hash:      hash(tok),
+		CreatedAt: now,
+		ExpiresAt: now.Add(m.refresh_ttl),
+	}); err != nil {
+		return err
+	}
+	w.Header().Set("Refresh-Token", tok)
+	return nil
+}
+
+// Rotate exchanges a refresh token for a new session credential and
+// refresh token, written to w as by Create.
+func (m *Manager) Rotate(w http.ResponseWriter, r *http.Request, refreshToken string) (*Record, error) {
+	if m.refresh == nil || refreshToken == "" {
+		return nil, ErrRefreshInvalid
+	}
+	ctx := r.Context()
+	rt, err := m.refresh.WithContext(ctx).Query(database.WithFilter("hash", hash(refreshToken))).First()
+	if err != nil {
+		return nil, ErrRefreshInvalid
+	}
+	if rt.Used {
+		return nil, m.reused(ctx, rt)
+	}
+	now := time.Now().UTC()
+	if now.After(rt.ExpiresAt) {
+		return nil, ErrRefreshInvalid
+	}
+	rec, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("id", rt.SessionID),
+		database.WithFilter("revoked", false),
+	).First()
+	if err != nil || (!rec.ExpiresAt.IsZero() && now.After(rec.ExpiresAt)) {
+		return nil, ErrRefreshInvalid
+	}
+	if m.users != nil {
+		user, err := m.users.WithContext(ctx).Query(database.WithFilter("id", rec.UserID)).First()
+		if err != nil || user.CheckStatus(now) != nil {
+			return nil, ErrRefreshInvalid
+		}
+	}
+
+	// the first rotation to consume the token wins, any other is a reuse
+	used, err := m.store.Incr(ctx, "refresh-token:"+rt.ID.String()+":used", time.Until(rt.ExpiresAt)+time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if used > 1 {
+		return nil, m.reused(ctx, rt)
+	}
+	rt.Used = true
+	rt.UsedAt = now
+	if err := m.refresh.WithContext(ctx).Query(database.WithFilter("id", rt.ID)).Update(*rt); err != nil {
+		return nil, err
+	}
+	credential, err := m.generate(w, rec.UserID, rec.Email)
+	if err != nil {
+		return nil, err
+	}
+	rec.TokenHash = hash(credential)
+	rec.LastSeenAt = now
+	rec.IP = events.ClientIP(r)
+	rec.UserAgent = r.UserAgent()
+	if err := m.model.WithContext(ctx).Query(database.WithFilter("id", rec.ID)).Update(*rec); err != nil {
+		return nil, err
+	}
+	return rec, m.issueRefresh(w, r, rec)
+}
+
+// reused revokes the session of rt, a refresh token used twice, and
+// returns ErrRefreshReused.
+func (m *Manager) reused(ctx context.Context, rt *RefreshToken) error {
+	rec, err := m.model.WithContext(ctx).Query(database.WithFilter("id", rt.SessionID)).First()
+	if err == nil && !rec.Revoked {
+		if err := m.revoke(ctx, rec); err != nil {
+			return err
+		}
+	}
+	return ErrRefreshReused
+}
+
+// revokeRefresh marks every refresh token of a session as used.
+func (m *Manager) revokeRefresh(ctx context.Context, sessionID uuid.UUID) error {
+	if m.refresh == nil {
+		return nil
+	}
+	tokens, err := m.refresh.WithContext(ctx).Query(
+		database.WithFilter("session_id", sessionID),
+		database.WithFilter("used", false),
+	).All()
+	if err != nil {
+		return err
+	}
+	for _, rt := range tokens {
+		rt.Used = true
+		rt.UsedAt = time.Now().UTC()
+		if err := m.refresh.WithContext(ctx).Query(database.WithFilter("id", rt.ID)).Update(*rt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Logout revokes the session of the request, deletes it from the
+// session backend when its store is known and expires the session
+// cookie.
+func (m *Manager) Logout(w http.ResponseWriter, r *http.Request) {
+	credential := m.Credential(r)
+	rec, err := m.Lookup(r.Context(), credential)
+	if err != nil {
+		fail(w, errNotAuthorized, http.StatusUnauthorized)
+		return
+	}
+	if err := m.revoke(r.Context(), rec); err != nil {
+		fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if m.backend != nil {
+		_ = m.backend.Del(r.Context(), credential)
+	}
+	if _, err := r.Cookie(m.cookie_name); err == nil {
+		http.SetCookie(w, &http.Cookie{Name: m.cookie_name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).Send()
+}
+
+// Refresh rotates the refresh token of the request, read from the
+// refresh_token field of a JSON body or the Refresh-Token header.
+func (m *Manager) Refresh(w http.ResponseWriter, r *http.Request) {
+	tok := r.Header.Get("Refresh-Token")
+	if tok == "" {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		tok = body.RefreshToken
+	}
+	rec, err := m.Rotate(w, r, tok)
+	if err != nil {
+		status := http.StatusUnauthorized
+		if !errors.Is(err, ErrRefreshInvalid) && !errors.Is(err, ErrRefreshReused) {
+			status = http.StatusInternalServerError
+		}
+		fail(w, err, status)
+		return
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+		SetData(rec).Send()
+}
+
+// WhoAmI responds with the session of the request and its user.
+func (m *Manager) WhoAmI(w http.ResponseWriter, r *http.Request) {
+	rec, err := m.Authenticate(r)
+	if err != nil {
+		fail(w, errNotAuthorized, http.StatusUnauthorized)
+		return
+	}
+	rec.Current = true
+	data := map[string]any{"session": rec}
+	if m.users != nil {
+		user, err := m.users.WithContext(r.Context()).Query(database.WithFilter("id", rec.UserID)).First()
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		data["user"] = user
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+		SetData(data).Send()
+}
@@ -0,0 +1,113 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/neghi-go/session/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefresh(t *testing.T) {
+	users := testdb.New[models.User]()
+	user := models.User{ID: uuid.New(), Email: "jon@doe.com"}
+	require.NoError(t, users.Save(user))
+	m := New(testdb.New[Record](), session.NewJWTSession(),
+		WithRefreshTokens(testdb.New[RefreshToken](), time.Hour), WithUsers(users))
+
+	w := httptest.NewRecorder()
+	_, err := m.Create(w, httptest.NewRequest(http.MethodPost, "/password/authorize", nil), user.ID, user.Email, "password")
+	require.NoError(t, err)
+	access, refresh := w.Header().Get("Auth-Token"), w.Header().Get("Refresh-Token")
+	require.NotEmpty(t, refresh)
+
+	call := func(h http.HandlerFunc, header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		if value != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	t.Run("Who Am I", func(t *testing.T) {
+		res := call(m.WhoAmI, "Authorization", "Bearer "+access)
+		require.Equal(t, http.StatusOK, res.Code)
+		assert.Contains(t, res.Body.String(), `"email":"jon@doe.com"`)
+		assert.Equal(t, http.StatusUnauthorized, call(m.WhoAmI, "Authorization", "").Code)
+	})
+
+	var rotated string
+	t.Run("Rotate", func(t *testing.T) {
+		time.Sleep(time.Second) // so the new JWT differs from the old one
+		res := call(m.Refresh, "Refresh-Token", refresh)
+		require.Equal(t, http.StatusOK, res.Code)
+		rotated = res.Header().Get("Refresh-Token")
+		assert.NotEqual(t, refresh, rotated)
+		assert.Equal(t, http.StatusUnauthorized, call(m.WhoAmI, "Authorization", "Bearer "+access).Code)
+		access = res.Header().Get("Auth-Token")
+		assert.Equal(t, http.StatusOK, call(m.WhoAmI, "Authorization", "Bearer "+access).Code)
+
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"refresh_token":"unknown"}`))
+		w := httptest.NewRecorder()
+		m.Refresh(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("Reuse Revokes The Session", func(t *testing.T) {
+		res := call(m.Refresh, "Refresh-Token", refresh)
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Contains(t, res.Body.String(), ErrRefreshReused.Error())
+		assert.Equal(t, http.StatusUnauthorized, call(m.WhoAmI, "Authorization", "Bearer "+access).Code)
+		assert.Equal(t, http.StatusUnauthorized, call(m.Refresh, "Refresh-Token", rotated).Code)
+	})
+
+	t.Run("Concurrent Rotations", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		_, err := m.Create(w, httptest.NewRequest(http.MethodPost, "/password/authorize", nil), user.ID, user.Email, "password")
+		require.NoError(t, err)
+		refresh := w.Header().Get("Refresh-Token")
+		rt, err := m.refresh.Query(database.WithFilter("hash", hash(refresh))).First()
+		require.NoError(t, err)
+		// another rotation consumed the token but hasn't marked it used yet
+		_, err = m.store.Incr(context.Background(), "refresh-token:"+rt.ID.String()+":used", time.Minute)
+		require.NoError(t, err)
+		res := call(m.Refresh, "Refresh-Token", refresh)
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+		assert.Contains(t, res.Body.String(), ErrRefreshReused.Error())
+	})
+}
+
+func TestLogout(t *testing.T) {
+	backend := store.NewMemoryStore()
+	m := New(testdb.New[Record](), session.NewServerSession(session.WithStore(backend)),
+		WithSessionStore(backend))
+
+	w := httptest.NewRecorder()
+	_, err := m.Create(w, httptest.NewRequest(http.MethodPost, "/password/authorize", nil), uuid.New(), "jon@doe.com", "password")
+	require.NoError(t, err)
+	cookie := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	m.Logout(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+	_, err = backend.Get(r.Context(), cookie.Value)
+	assert.Error(t, err)
+	_, err = m.Authenticate(r)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
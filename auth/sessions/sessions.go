@@ -0,0 +1,374 @@
+// Package sessions records the sessions issued by providers, so users
+// can see where they are signed in and sessions can be revoked before
+// they expire in the session backend.
+package sessions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/storage"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/session"
+	"github.com/neghi-go/session/store"
+)
+
+var (
+	ErrNotFound      = errors.New("sessions: session not found")
+	ErrNoCredential  = errors.New("sessions: the session backend did not issue a credential")
+	errNotAuthorized = errors.New("sessions: no valid session")
+)
+
+// Record is an issued session. Only a hash of the credential (the JWT
+// or the session cookie) is stored.
+type Record struct {
+	ID         uuid.UUID `json:"id" db:"id,index,required,unique"`
+	UserID     uuid.UUID `json:"user_id" db:"user_id,index,required"`
+	Email      string    `json:"email" db:"email"`
+	TokenHash  string    `json:"-" db:"token_hash,index"`
+	Provider   string    `json:"provider" db:"provider"`
+	Device     string    `json:"device" db:"device"`
+	IP         string    `json:"ip" db:"ip"`
+	UserAgent  string    `json:"user_agent" db:"user_agent"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at" db:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	// AMR is the space separated list of methods the user authenticated
+	// with, ACR the assurance level they reach and AuthTime when the
+	// user last authenticated.
+	AMR      string    `json:"amr" db:"amr"`
+	ACR      string    `json:"acr" db:"acr"`
+	AuthTime time.Time `json:"auth_time" db:"auth_time"`
+	// RequiredACR is the level the session has to be stepped up to
+	// before it can be used, see RequireACR.
+	RequiredACR string    `json:"required_acr,omitempty" db:"required_acr"`
+	Revoked     bool      `json:"-" db:"revoked,index"`
+	RevokedAt   time.Time `json:"-" db:"revoked_at"`
+	// ImpersonatorID is set on sessions an administrator opened as the
+	// user, see Impersonate.
+	ImpersonatorID      uuid.UUID `json:"impersonator_id,omitempty" db:"impersonator_id,index"`
+	ImpersonatorEmail   string    `json:"impersonator_email,omitempty" db:"impersonator_email"`
+	ImpersonationReason string    `json:"impersonation_reason,omitempty" db:"impersonation_reason"`
+
+	// Current marks the session of the request in listings.
+	Current bool `json:"current" db:"-"`
+}
+
+type Options func(*Manager)
+
+// Manager issues sessions through the session backend and keeps a
+// record of each of them.
+type Manager struct {
+	model       database.Model[Record]
+	session     session.Session
+	ttl         time.Duration
+	cookie_name string
+	touch_every time.Duration
+
+	refresh     database.Model[RefreshToken]
+	refresh_ttl time.Duration
+	backend     store.Store
+	users       database.Model[models.User]
+	store       storage.Storage
+}
+
+// WithTTL sets how long a session is valid after it is created, even
+// when its credential is refreshed. Zero, the default, leaves expiry to
+// the session backend: the exp claim of JWTs, the lifetime of server
+// sessions in their store.
+func WithTTL(d time.Duration) Options {
+	return func(m *Manager) {
+		m.ttl = d
+	}
+}
+
+// WithCookieName sets the cookie the session backend stores sessions in.
+// Defaults to sessions-key, the name used by session.NewServerSession.
+func WithCookieName(name string) Options {
+	return func(m *Manager) {
+		m.cookie_name = name
+	}
+}
+
+func New(model database.Model[Record], s session.Session, opts ...Options) *Manager {
+	m := &Manager{
+		model:       model,
+		session:     s,
+		cookie_name: "sessions-key",
+		touch_every: time.Minute,
+		refresh_ttl: 30 * 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.store == nil {
+		m.store = storage.NewMemoryStorage()
+	}
+	return m
+}
+
+// Create issues a session for the user through the session backend and
+// records it along with the device it was issued to and amr, the methods
+// the user authenticated with. When the request carries a session of the
+// same user, the user is stepping up: the new session replaces it and
+// keeps its methods.
+func (m *Manager) Create(w http.ResponseWriter, r *http.Request, userID uuid.UUID, email, provider string, amr ...string) (*Record, error) {
+	var prev *Record
+	if rec, err := m.Authenticate(r); err == nil && rec.UserID == userID && !rec.Impersonated() {
+		prev = rec
+	}
+	credential, err := m.generateUnique(r.Context(), w, userID, email)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	rec := Record{
+		ID:         uuid.New(),
+		UserID:     userID,
+		Email:      email,
+		TokenHash:  hash(credential),
+		Provider:   provider,
+		Device:     Device(r),
+		IP:         events.ClientIP(r),
+		UserAgent:  r.UserAgent(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		AuthTime:   now,
+	}
+	var methods []string
+	if prev != nil {
+		methods = prev.Methods()
+		rec.RequiredACR = prev.RequiredACR
+	}
+	rec.authenticated(methods, amr)
+	if m.ttl > 0 {
+		rec.ExpiresAt = now.Add(m.ttl)
+	}
+	if err := m.model.WithContext(r.Context()).Save(rec); err != nil {
+		return nil, err
+	}
+	if prev != nil {
+		if err := m.revoke(r.Context(), prev); err != nil {
+			return nil, err
+		}
+	}
+	return &rec, m.issueRefresh(w, r, &rec)
+}
+
+// generate issues a credential through the session backend.
+func (m *Manager) generate(w http.ResponseWriter, userID uuid.UUID, email string) (string, error) {
+	cookies := len(w.Header().Values("Set-Cookie"))
+	if err := m.session.Generate(w, userID.String(), email); err != nil {
+		return "", err
+	}
+	credential := issued(w.Header(), cookies, m.cookie_name)
+	if credential == "" {
+		return "", ErrNoCredential
+	}
+	return credential, nil
+}
+
+// issued returns the credential the session backend wrote to header,
+// the Auth-Token header of JWT sessions or the cookie of server
+// sessions set after the first n cookies.
+func issued(header http.Header, n int, cookie string) string {
+	if tok := header.Get("Auth-Token"); tok != "" {
+		return tok
+	}
+	set := header.Values("Set-Cookie")
+	for i := len(set) - 1; i >= n; i-- {
+		c, err := http.ParseSetCookie(set[i])
+		if err == nil && c.Name == cookie {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// Credential returns the session credential of the request, a bearer
+// token, the Auth-Token header or the session cookie.
+func (m *Manager) Credential(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if tok := r.Header.Get("Auth-Token"); tok != "" {
+		return tok
+	}
+	if c, err := r.Cookie(m.cookie_name); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+// Lookup returns the active session of credential and records that it
+// was seen.
+func (m *Manager) Lookup(ctx context.Context, credential string) (*Record, error) {
+	if credential == "" || m.validate(credential) != nil {
+		return nil, ErrNotFound
+	}
+	rec, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("token_hash", hash(credential)),
+		database.WithFilter("revoked", false),
+	).First()
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	now := time.Now().UTC()
+	if !rec.ExpiresAt.IsZero() && now.After(rec.ExpiresAt) {
+		return nil, ErrNotFound
+	}
+	if now.Sub(rec.LastSeenAt) >= m.touch_every {
+		rec.LastSeenAt = now
+		_ = m.model.WithContext(ctx).Query(database.WithFilter("id", rec.ID)).Update(*rec)
+	}
+	return rec, nil
+}
+
+// validate checks credential with the session backend, which expires
+// it.
+func (m *Manager) validate(credential string) error {
+	if _, ok := m.session.(*session.JWT); ok {
+		// JWT.Verify rejects every token, as it hands jwx its own
+		// algorithm type. The signature needn't be checked anyway: only
+		// credentials whose hash was recorded when they were issued are
+		// accepted, leaving the expiry to validate.
+		tok, err := jwt.ParseInsecure([]byte(credential))
+		if err != nil {
+			return err
+		}
+		return jwt.Validate(tok)
+	}
+	return m.session.Validate(credential)
+}
+
+// Authenticate returns the active session of the request.
+func (m *Manager) Authenticate(r *http.Request) (*Record, error) {
+	return m.Lookup(r.Context(), m.Credential(r))
+}
+
+// List returns the active sessions of a user.
+func (m *Manager) List(ctx context.Context, userID uuid.UUID) ([]*Record, error) {
+	all, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithFilter("revoked", false),
+	).All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	res := make([]*Record, 0, len(all))
+	for _, rec := range all {
+		if rec.ExpiresAt.IsZero() || now.Before(rec.ExpiresAt) {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// Revoke ends a session of a user.
+func (m *Manager) Revoke(ctx context.Context, userID, id uuid.UUID) error {
+	rec, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("id", id),
+		database.WithFilter("user_id", userID),
+	).First()
+	if err != nil || rec.Revoked {
+		return ErrNotFound
+	}
+	return m.revoke(ctx, rec)
+}
+
+// RevokeAll ends every session of a user except the sessions in keep,
+// and returns the number of sessions revoked.
+func (m *Manager) RevokeAll(ctx context.Context, userID uuid.UUID, keep ...uuid.UUID) (int, error) {
+	if m == nil {
+		return 0, nil
+	}
+	active, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithFilter("revoked", false),
+	).All()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, rec := range active {
+		if slices.Contains(keep, rec.ID) {
+			continue
+		}
+		if err := m.revoke(ctx, rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (m *Manager) revoke(ctx context.Context, rec *Record) error {
+	rec.Revoked = true
+	rec.RevokedAt = time.Now().UTC()
+	if err := m.model.WithContext(ctx).Query(database.WithFilter("id", rec.ID)).Update(*rec); err != nil {
+		return err
+	}
+	return m.revokeRefresh(ctx, rec.ID)
+}
+
+func hash(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// Device returns a short description of the client of the request, the
+// X-Device-Name header when the client sends one or the browser and
+// operating system of its user agent.
+func Device(r *http.Request) string {
+	if name := r.Header.Get("X-Device-Name"); name != "" {
+		return name
+	}
+	ua := r.UserAgent()
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	os := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Mac OS X", "macOS"},
+		{"Windows", "Windows"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			os = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	}
+	return "Unknown device"
+}
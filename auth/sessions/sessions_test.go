@@ -0,0 +1,156 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	m := New(testdb.New[Record](), NewJWT())
+	userID := uuid.New()
+
+	login := func(ua string) (*Record, string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/password/authorize", nil)
+		r.Header.Set("User-Agent", ua)
+		rec, err := m.Create(w, r, userID, "jon@doe.com", "password")
+		require.NoError(t, err)
+		return rec, w.Header().Get("Auth-Token")
+	}
+	request := func(method, target, tok string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		if tok != "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		w := httptest.NewRecorder()
+		m.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	laptop, laptopTok := login("Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Version/17.0 Safari/605.1.15")
+	_, phoneTok := login("Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 Chrome/120.0 Mobile Safari/537.36")
+	_, tabletTok := login("Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) Version/17.0 Safari/605.1.15")
+	assert.Equal(t, "Safari on macOS", laptop.Device)
+
+	t.Run("List", func(t *testing.T) {
+		res := request(http.MethodGet, "/", laptopTok)
+		require.Equal(t, http.StatusOK, res.Code)
+		var body struct {
+			Data []Record `json:"data"`
+		}
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&body))
+		require.Len(t, body.Data, 3)
+		for _, rec := range body.Data {
+			assert.Equal(t, rec.ID == laptop.ID, rec.Current)
+		}
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", "").Code)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		phone, err := m.Lookup(context.Background(), phoneTok)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, request(http.MethodDelete, "/"+phone.ID.String(), laptopTok).Code)
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", phoneTok).Code)
+		assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/"+phone.ID.String(), laptopTok).Code)
+		// sessions of other users can't be revoked
+		other := New(testdb.New[Record](), session.NewJWTSession())
+		assert.ErrorIs(t, other.Revoke(context.Background(), uuid.New(), laptop.ID), ErrNotFound)
+	})
+
+	t.Run("Revoke All", func(t *testing.T) {
+		res := request(http.MethodDelete, "/", laptopTok)
+		require.Equal(t, http.StatusOK, res.Code)
+		assert.Contains(t, res.Body.String(), `"revoked":1`)
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", tabletTok).Code)
+		assert.Equal(t, http.StatusOK, request(http.MethodGet, "/", laptopTok).Code)
+
+		n, err := m.RevokeAll(context.Background(), userID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", laptopTok).Code)
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	// the session backend expires the credential without a TTL
+	m := New(testdb.New[Record](), session.NewJWTSession(session.SetExpiration(1)))
+	w := httptest.NewRecorder()
+	_, err := m.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), uuid.New(), "jon@doe.com", "password")
+	require.NoError(t, err)
+	tok := w.Header().Get("Auth-Token")
+	_, err = m.Lookup(context.Background(), tok)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Second)
+	_, err = m.Lookup(context.Background(), tok)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestJWT(t *testing.T) {
+	userID := uuid.New()
+	create := func(m *Manager) (*Record, string, error) {
+		w := httptest.NewRecorder()
+		rec, err := m.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), userID, "jon@doe.com", "password")
+		return rec, w.Header().Get("Auth-Token"), err
+	}
+
+	t.Run("Unique Credentials", func(t *testing.T) {
+		m := New(testdb.New[Record](), NewJWT())
+		first, firstTok, err := create(m)
+		require.NoError(t, err)
+		second, secondTok, err := create(m)
+		require.NoError(t, err)
+		assert.NotEqual(t, firstTok, secondTok)
+		assert.NotEqual(t, first.ID, second.ID)
+	})
+
+	t.Run("Same Second", func(t *testing.T) {
+		m := New(testdb.New[Record](), session.NewJWTSession())
+		// start on a second boundary, so both tokens have the same iat
+		time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+		_, _, err := create(m)
+		require.NoError(t, err)
+		_, _, err = create(m)
+		assert.ErrorIs(t, err, errCredentialInUse)
+	})
+
+	t.Run("Validate", func(t *testing.T) {
+		j := NewJWT(WithJWTSecret([]byte("secret")), WithJWTIssuer("iam"))
+		w := httptest.NewRecorder()
+		require.NoError(t, j.Generate(w, userID.String()))
+		tok := w.Header().Get("Auth-Token")
+		assert.NoError(t, j.Validate(tok))
+		assert.Error(t, NewJWT(WithJWTSecret([]byte("other")), WithJWTIssuer("iam")).Validate(tok))
+		assert.Error(t, NewJWT(WithJWTSecret([]byte("secret"))).Validate(tok))
+	})
+}
+
+func TestIssued(t *testing.T) {
+	w := httptest.NewRecorder()
+	http.SetCookie(w, &http.Cookie{Name: "sessions-key", Value: "old"})
+	n := len(w.Header().Values("Set-Cookie"))
+	http.SetCookie(w, &http.Cookie{Name: "other", Value: "x"})
+	http.SetCookie(w, &http.Cookie{Name: "sessions-key", Value: "new"})
+	assert.Equal(t, "new", issued(w.Header(), n, "sessions-key"))
+	assert.Equal(t, "", issued(w.Header(), 3, "sessions-key"))
+}
+
+func TestACR(t *testing.T) {
+	assert.Equal(t, "", ACR(nil))
+	assert.Equal(t, AAL1, ACR([]string{AMRPassword}))
+	assert.Equal(t, AAL1, ACR([]string{AMROTP, AMREmail}))
+	// emails don't add a factor to passwords
+	assert.Equal(t, AAL1, ACR([]string{AMRPassword, AMREmail}))
+	assert.Equal(t, AAL1, ACR([]string{AMRFederated}))
+	assert.Equal(t, AAL2, ACR([]string{AMRPassword, AMROTP}))
+	assert.Equal(t, AAL2, ACR([]string{AMRMFA}))
+}
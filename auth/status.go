@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/profile"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/utilities"
+)
+
+// PermissionManageStatus is the permission to change the status of
+// accounts through the /users routes.
+const PermissionManageStatus = "users:status"
+
+// Status is the status of an account, only active accounts can sign in.
+type Status = models.Status
+
+// Account statuses and the transitions between them:
+//
+//	active            -> disabled, locked, pending_deletion, banned
+//	disabled          -> active, locked, pending_deletion, banned
+//	locked            -> active, disabled, pending_deletion, banned
+//	pending_deletion  -> active, banned
+//	banned            -> active, pending_deletion
+const (
+	StatusActive          = models.StatusActive
+	StatusDisabled        = models.StatusDisabled
+	StatusLocked          = models.StatusLocked
+	StatusPendingDeletion = models.StatusPendingDeletion
+	StatusBanned          = models.StatusBanned
+)
+
+var (
+	errNoStatusReason = errors.New("auth: a reason is required to deactivate an account")
+	errOwnStatus      = errors.New("auth: you can't change the status of your own account")
+)
+
+// AccountDeletionGrace sets how long accounts stay pending deletion, and
+// can be restored, before PurgeDeletedUsers deletes them. Defaults to 30
+// days.
+func AccountDeletionGrace(d time.Duration) Options {
+	return func(a *Auth) {
+		a.deletion_grace = d
+	}
+}
+
+// SetUserStatus changes the status of a user for reason, on behalf of
+// the user actorID when it is set. until is when a lock ends, or when an
+// account pending deletion is deleted. The sessions and personal access
+// tokens of users who are no longer active are revoked. Pre-hooks of
+// events.StatusChanged can veto the change. It can only be called after
+// Build.
+func (a *Auth) SetUserStatus(ctx context.Context, id uuid.UUID, status Status, reason string, until time.Time, actorID string) error {
+	e := events.Event{
+		ID:        uuid.NewString(),
+		Type:      events.StatusChanged,
+		ActorID:   actorID,
+		CreatedAt: time.Now().UTC(),
+	}
+	_, err := a.setStatus(ctx, e, id, status, reason, until)
+	return err
+}
+
+func (a *Auth) setStatus(ctx context.Context, e events.Event, id uuid.UUID, status Status, reason string, until time.Time) (*models.User, error) {
+	if !status.Valid() {
+		return nil, models.ErrUnknownStatus
+	}
+	if status != StatusActive && reason == "" {
+		return nil, errNoStatusReason
+	}
+	user, err := a.user.WithContext(ctx).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		return nil, errUserNotFound
+	}
+	now := time.Now().UTC()
+	if status == StatusPendingDeletion && until.IsZero() {
+		until = now.Add(a.deletion_grace)
+	}
+	from := user.AccountStatus(now)
+	if err := user.SetStatus(status, reason, until, now); err != nil {
+		return nil, err
+	}
+	e.UserID = user.ID.String()
+	e.Email = user.Email
+	e.Reason = reason
+	e.Data = map[string]any{"from": from, "to": status}
+	if !until.IsZero() {
+		e.Data["until"] = until
+	}
+	if err := a.events.Check(ctx, e); err != nil {
+		return nil, err
+	}
+	user.UpdatedAt = now
+	if err := a.user.WithContext(ctx).Query(database.WithFilter("id", id)).Update(*user); err != nil {
+		return nil, err
+	}
+	if status != StatusActive {
+		if err := a.endSessions(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	a.events.Publish(ctx, e)
+	return user, nil
+}
+
+// PurgeDeletedUsers deletes the users whose pending deletion is due, see
+// DeleteUser, and returns how many were deleted. It can only be called
+// after Build.
+func (a *Auth) PurgeDeletedUsers(ctx context.Context) (int, error) {
+	pending, err := a.user.WithContext(ctx).Query(database.WithFilter("status", StatusPendingDeletion)).All()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	now := time.Now()
+	for _, u := range pending {
+		if now.Before(u.StatusUntil) {
+			continue
+		}
+		if err := a.DeleteUser(ctx, u.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+type accountStatus struct {
+	Status    Status    `json:"status"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+}
+
+func statusOf(u *models.User) accountStatus {
+	s := accountStatus{Status: u.AccountStatus(time.Now()), ChangedAt: u.StatusChangedAt}
+	if s.Status != StatusActive {
+		s.Reason = u.StatusReason
+		s.Until = u.StatusUntil
+	}
+	return s
+}
+
+// usersHandler serves the account status of users to principals granted
+// PermissionManageStatus, and their profile to principals granted
+// profile.Permission:
+//
+//	GET   /{id}/status    the status of the user, its reason and until when
+//	PUT   /{id}/status    changes it to {"status", "reason", "until"}
+//	GET   /{id}/profile   the profile of the user, see profile.Manager.AdminHandler
+//	PATCH /{id}/profile   updates it
+func (a *Auth) usersHandler() http.Handler {
+	r := chi.NewRouter()
+	r.With(a.Middleware(RequirePermission(profile.Permission))).
+		Mount("/{id}/profile", a.profiles.AdminHandler(func(r *http.Request) string {
+			p, _ := PrincipalFrom(r.Context())
+			return p.Subject().ID
+		}))
+	r.Group(func(r chi.Router) {
+		r.Use(a.Middleware(RequirePermission(PermissionManageStatus)))
+		r.Get("/{id}/status", a.getStatus)
+		r.Put("/{id}/status", a.putStatus)
+	})
+	return r
+}
+
+func (a *Auth) getStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		deny(w, errUserNotFound, http.StatusNotFound, nil)
+		return
+	}
+	user, err := a.user.WithContext(r.Context()).Query(database.WithFilter("id", id)).First()
+	if err != nil {
+		deny(w, errUserNotFound, http.StatusNotFound, nil)
+		return
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+		SetData(statusOf(user)).Send()
+}
+
+func (a *Auth) putStatus(w http.ResponseWriter, r *http.Request) {
+	p, _ := PrincipalFrom(r.Context())
+	id, err := uuid.Parse(chi.URLParam(r, "id"))
+	if err != nil {
+		deny(w, errUserNotFound, http.StatusNotFound, nil)
+		return
+	}
+	if id == p.UserID {
+		deny(w, errOwnStatus, http.StatusBadRequest, nil)
+		return
+	}
+	var body struct {
+		Status Status    `json:"status"`
+		Reason string    `json:"reason"`
+		Until  time.Time `json:"until"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		deny(w, err, http.StatusBadRequest, nil)
+		return
+	}
+	e := events.FromRequest(r, events.StatusChanged, "")
+	e.ActorID = p.Subject().ID
+	user, err := a.setStatus(r.Context(), e, id, body.Status, body.Reason, body.Until)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, errUserNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errNoStatusReason), errors.Is(err, models.ErrUnknownStatus):
+			status = http.StatusBadRequest
+		case errors.Is(err, models.ErrTransition):
+			status = http.StatusConflict
+		case errors.Is(err, events.ErrVetoed):
+			status = http.StatusForbidden
+		}
+		deny(w, err, status, nil)
+		return
+	}
+	utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+		SetData(statusOf(user)).Send()
+}
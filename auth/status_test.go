@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/events"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/auth/tokens"
+	"github.com/neghi-go/iam/internal/models"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserStatus(t *testing.T) {
+	ctx := context.Background()
+	bindings, err := acl.New(
+		acl.WithBindings(testdb.New[acl.Binding]()),
+		acl.WithRole("admin", PermissionManageStatus),
+	)
+	require.NoError(t, err)
+	a := New(RegisterACL(bindings))
+	a.user = testdb.New[models.User]()
+	a.sessions = sessions.New(testdb.New[sessions.Record](), a.session)
+	a.tokens = tokens.New(testdb.New[tokens.Token]())
+
+	var mu sync.Mutex
+	var changes []events.Event
+	a.events.After(events.StatusChanged, func(ctx context.Context, e events.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, e)
+		return nil
+	})
+
+	admin := models.User{ID: uuid.New(), Email: "admin@example.com", EmailVerified: true}
+	user := models.User{ID: uuid.New(), Email: "jon@doe.com", EmailVerified: true}
+	require.NoError(t, a.user.Save(admin, user))
+	require.NoError(t, bindings.Bind(ctx, acl.Subject{Kind: acl.User, ID: admin.ID.String()}, "admin"))
+	login := func(u models.User) string {
+		w := httptest.NewRecorder()
+		_, err := a.sessions.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), u.ID, u.Email, "password", sessions.AMRPassword)
+		require.NoError(t, err)
+		return w.Header().Get("Auth-Token")
+	}
+	adminTok, userTok := login(admin), login(user)
+	_, pat, err := a.tokens.Create(ctx, user.ID, "ci", nil, time.Time{})
+	require.NoError(t, err)
+
+	h := a.usersHandler()
+	do := func(method, tok string, id uuid.UUID, body any) (int, accountStatus) {
+		var buf bytes.Buffer
+		if body != nil {
+			require.NoError(t, json.NewEncoder(&buf).Encode(body))
+		}
+		r := httptest.NewRequest(method, "/"+id.String()+"/status", &buf)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		var res struct {
+			Data accountStatus `json:"data"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&res)
+		return w.Code, res.Data
+	}
+	set := func(status Status, reason string, until time.Time) (int, accountStatus) {
+		return do(http.MethodPut, adminTok, user.ID, map[string]any{"status": status, "reason": reason, "until": until})
+	}
+	authenticated := func(tok string) bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		_, err := a.Principal(r)
+		return err == nil
+	}
+
+	t.Run("Get", func(t *testing.T) {
+		code, s := do(http.MethodGet, adminTok, user.ID, nil)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, StatusActive, s.Status)
+		code, _ = do(http.MethodGet, userTok, admin.ID, nil)
+		assert.Equal(t, http.StatusForbidden, code)
+		code, _ = do(http.MethodGet, adminTok, uuid.New(), nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		code, _ := set("frozen", "why not", time.Time{})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = set(StatusBanned, "", time.Time{})
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = set(StatusActive, "", time.Time{})
+		assert.Equal(t, http.StatusConflict, code)
+		code, _ = do(http.MethodPut, adminTok, admin.ID, map[string]any{"status": StatusDisabled, "reason": "oops"})
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.True(t, authenticated(userTok))
+	})
+
+	t.Run("Banned", func(t *testing.T) {
+		code, s := set(StatusBanned, "fraud", time.Time{})
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, StatusBanned, s.Status)
+		assert.Equal(t, "fraud", s.Reason)
+		// sessions and tokens end right away
+		assert.False(t, authenticated(userTok))
+		assert.False(t, authenticated(pat))
+		_, err := a.sessions.Lookup(ctx, userTok)
+		assert.ErrorIs(t, err, sessions.ErrNotFound)
+		// and new ones are rejected
+		assert.False(t, authenticated(login(user)))
+
+		code, _ = set(StatusLocked, "investigating", time.Time{})
+		assert.Equal(t, http.StatusConflict, code)
+		code, s = set(StatusActive, "", time.Time{})
+		require.Equal(t, http.StatusOK, code)
+		assert.Empty(t, s.Reason)
+		time.Sleep(time.Second) // so the new JWT differs from the revoked one
+		userTok = login(user)
+		assert.True(t, authenticated(userTok))
+
+		a.events.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, changes, 2)
+		for _, e := range changes {
+			assert.Equal(t, admin.ID.String(), e.ActorID)
+			assert.Equal(t, user.ID.String(), e.UserID)
+		}
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		until := time.Now().Add(time.Second).Truncate(time.Second)
+		code, s := set(StatusLocked, "suspected compromise", until)
+		require.Equal(t, http.StatusOK, code)
+		assert.True(t, until.Equal(s.Until))
+		stored, err := a.user.Query(database.WithFilter("id", user.ID)).First()
+		require.NoError(t, err)
+		var serr *models.StatusError
+		require.ErrorAs(t, stored.CheckStatus(time.Now()), &serr)
+		assert.Contains(t, serr.Error(), "the account is locked until")
+		// the lock ends by itself
+		assert.NoError(t, stored.CheckStatus(until))
+	})
+
+	t.Run("Pending Deletion", func(t *testing.T) {
+		code, s := set(StatusPendingDeletion, "requested by the user", time.Time{})
+		require.Equal(t, http.StatusOK, code)
+		assert.WithinDuration(t, time.Now().Add(30*24*time.Hour), s.Until, time.Minute)
+		n, err := a.PurgeDeletedUsers(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		require.NoError(t, a.SetUserStatus(ctx, user.ID, StatusActive, "", time.Time{}, admin.ID.String()))
+		require.NoError(t, a.SetUserStatus(ctx, user.ID, StatusPendingDeletion, "requested by the user", time.Now(), ""))
+		n, err = a.PurgeDeletedUsers(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		_, err = a.user.Query(database.WithFilter("id", user.ID)).First()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type item struct {
+	value   []byte
+	expires time.Time
+}
+
+func (i item) expired(now time.Time) bool {
+	return !i.expires.IsZero() && now.After(i.expires)
+}
+
+type Memory struct {
+	mu    *sync.Mutex
+	items map[string]item
+}
+
+func NewMemoryStorage() *Memory {
+	return &Memory{
+		mu:    &sync.Mutex{},
+		items: make(map[string]item),
+	}
+}
+
+// Get implements Storage.
+func (m *Memory) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, ok := m.items[key]
+	if !ok || i.expired(time.Now()) {
+		delete(m.items, key)
+		return nil, ErrNotFound
+	}
+	return i.value, nil
+}
+
+// Set implements Storage.
+func (m *Memory) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[key] = item{value: value, expires: expiry(ttl)}
+	return nil
+}
+
+// Del implements Storage.
+func (m *Memory) Del(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.items, key)
+	return nil
+}
+
+// Incr implements Storage.
+func (m *Memory) Incr(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i, ok := m.items[key]
+	if !ok || i.expired(time.Now()) {
+		i = item{value: []byte("0"), expires: expiry(ttl)}
+	}
+	count, err := strconv.ParseInt(string(i.value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	count++
+	i.value = []byte(strconv.FormatInt(count, 10))
+	m.items[key] = i
+	return count, nil
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+var _ Storage = (*Memory)(nil)
@@ -1,11 +1,20 @@
 package storage
 
-type Storage interface{}
+import (
+	"context"
+	"errors"
+	"time"
+)
 
-type Store struct{}
+var ErrNotFound = errors.New("storage: item not found")
 
-func (s *Store) Get(st Storage) {}
-
-func (s *Store) Set(st Storage) {}
-
-func (s *Store) Del(st Storage) {}
+// Storage is a key-value store with expiring entries used by providers
+// for short lived state such as attempt counters and single use tokens.
+type Storage interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Del(ctx context.Context, key string) error
+	// Incr increments the counter stored at key and returns its new
+	// value. The ttl is only applied when the counter is created.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+}
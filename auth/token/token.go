@@ -0,0 +1,79 @@
+// Package token generates one time tokens and the keyed hashes they are
+// stored as, so that a database dump doesn't leak usable tokens.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+	"strings"
+)
+
+type Format string
+
+const (
+	// Numeric tokens are short codes meant to be typed by the user.
+	Numeric Format = "numeric"
+	// URL tokens are long random strings meant to be embedded in links.
+	URL Format = "url"
+)
+
+// Generate returns a token of the given format, length is the number of
+// digits of a numeric code and ignored for url tokens.
+func Generate(format Format, length int) string {
+	if format == URL {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(buf)
+	}
+	var b strings.Builder
+	for range length {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			panic(err)
+		}
+		b.WriteByte(byte('0' + n.Int64()))
+	}
+	return b.String()
+}
+
+// Hasher computes HMAC-SHA256 hashes of tokens. The purpose is mixed
+// into the hash so a token issued for one flow can't be used in another.
+type Hasher struct {
+	key []byte
+}
+
+// NewHasher returns a hasher using key, a random key is generated when
+// key is empty, which invalidates outstanding tokens on restart and
+// doesn't work across multiple instances.
+func NewHasher(key []byte) *Hasher {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(err)
+		}
+	}
+	return &Hasher{key: key}
+}
+
+func (h *Hasher) Hash(purpose, token string) string {
+	m := hmac.New(sha256.New, h.key)
+	m.Write([]byte(purpose))
+	m.Write([]byte{0})
+	m.Write([]byte(token))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// Equal reports in constant time whether token hashes to stored. An
+// empty stored hash never matches.
+func (h *Hasher) Equal(purpose, token, stored string) bool {
+	if stored == "" || token == "" {
+		return false
+	}
+	return hmac.Equal([]byte(h.Hash(purpose, token)), []byte(stored))
+}
@@ -0,0 +1,29 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	code := Generate(Numeric, 6)
+	assert.Len(t, code, 6)
+	assert.Regexp(t, "^[0-9]{6}$", code)
+
+	link := Generate(URL, 6)
+	assert.Len(t, link, 43)
+	assert.NotEqual(t, link, Generate(URL, 6))
+}
+
+func TestHasher(t *testing.T) {
+	h := NewHasher([]byte("secret"))
+	stored := h.Hash("email_verify", "123456")
+
+	assert.NotContains(t, stored, "123456")
+	assert.True(t, h.Equal("email_verify", "123456", stored))
+	assert.False(t, h.Equal("email_verify", "654321", stored))
+	assert.False(t, h.Equal("password_reset", "123456", stored))
+	assert.False(t, NewHasher([]byte("other")).Equal("email_verify", "123456", stored))
+	assert.False(t, h.Equal("email_verify", "", ""))
+}
@@ -0,0 +1,111 @@
+package tokens
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/utilities"
+)
+
+var errNotAuthorized = errors.New("tokens: no valid session")
+
+// Handler serves the token management routes of the user signed in with
+// a session of s, tokens can't be used to manage tokens:
+//
+//	GET    /       lists the active tokens
+//	POST   /       creates a token, the response is the only time its secret is shown
+//	DELETE /{id}   revokes a token
+//
+// Impersonation sessions and sessions yet to be stepped up, see
+// sessions.Manager.RequireACR, can't create tokens.
+func (m *Manager) Handler(s *sessions.Manager) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := s.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		list, err := m.List(r.Context(), current.UserID)
+		if err != nil {
+			fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).
+			SetData(list).Send()
+	})
+	r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+		current, err := s.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		// a token would outlive the impersonation
+		if current.Impersonated() {
+			fail(w, sessions.ErrImpersonating, http.StatusForbidden)
+			return
+		}
+		if current.Restricted() {
+			fail(w, sessions.ErrStepUpRequired, http.StatusForbidden)
+			return
+		}
+		var body struct {
+			Name      string    `json:"name"`
+			Scopes    []string  `json:"scopes"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fail(w, err, http.StatusBadRequest)
+			return
+		}
+		t, secret, err := m.Create(r.Context(), current.UserID, body.Name, body.Scopes, body.ExpiresAt)
+		if err != nil {
+			status := http.StatusBadRequest
+			if !errors.Is(err, ErrUnknownScope) && !errors.Is(err, ErrExpiry) && !errors.Is(err, errNoName) {
+				status = http.StatusInternalServerError
+			}
+			fail(w, err, status)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusCreated).
+			SetData(struct {
+				*Token
+				Secret string `json:"token"`
+			}{t, secret}).Send()
+	})
+	r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+		current, err := s.Authenticate(r)
+		if err != nil {
+			fail(w, errNotAuthorized, http.StatusUnauthorized)
+			return
+		}
+		id, err := uuid.Parse(chi.URLParam(r, "id"))
+		if err != nil {
+			fail(w, ErrNotFound, http.StatusNotFound)
+			return
+		}
+		if err := m.Revoke(r.Context(), current.UserID, id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			fail(w, err, status)
+			return
+		}
+		utilities.JSON(w).SetStatus(utilities.ResponseSuccess).SetStatusCode(http.StatusOK).Send()
+	})
+	return r
+}
+
+func fail(w http.ResponseWriter, err error, status int) {
+	res := utilities.ResponseFail
+	if status >= http.StatusInternalServerError {
+		res = utilities.ResponseError
+	}
+	utilities.JSON(w).SetStatus(res).SetStatusCode(status).SetMessage(err.Error()).Send()
+}
@@ -0,0 +1,234 @@
+// Package tokens issues personal access tokens, long lived credentials
+// tied to a user for non-interactive clients such as CLIs and CI jobs.
+// Tokens start with a recognizable prefix, so they can be told apart
+// from session credentials and picked up by secret scanners, and only a
+// hash of them is stored.
+package tokens
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/database"
+	"github.com/neghi-go/iam/acl"
+	"github.com/neghi-go/iam/auth/token"
+)
+
+var (
+	ErrNotFound     = errors.New("tokens: token not found")
+	ErrInvalid      = errors.New("tokens: the token is invalid, expired or revoked")
+	ErrUnknownScope = errors.New("tokens: unknown scope")
+	ErrExpiry       = errors.New("tokens: the expiry is in the past or beyond the maximum lifetime")
+	errNoName       = errors.New("tokens: a name is required")
+)
+
+// Token is a personal access token, without its secret.
+type Token struct {
+	ID     uuid.UUID `json:"id" db:"id,index,required,unique"`
+	UserID uuid.UUID `json:"user_id" db:"user_id,index,required"`
+	Name   string    `json:"name" db:"name"`
+	// Hint is the start of the token, to recognize it in listings.
+	Hint       string    `json:"hint" db:"hint"`
+	Hash       string    `json:"-" db:"hash,index,unique"`
+	Scopes     string    `json:"scopes" db:"scopes"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitempty" db:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	Revoked    bool      `json:"-" db:"revoked,index"`
+	RevokedAt  time.Time `json:"-" db:"revoked_at"`
+}
+
+// ScopeList returns the space separated scopes of the token.
+func (t *Token) ScopeList() []string {
+	return strings.Fields(t.Scopes)
+}
+
+// Allows reports whether the scopes of t grant permission.
+func (t *Token) Allows(permission string) bool {
+	for _, s := range t.ScopeList() {
+		if acl.Match(s, permission) {
+			return true
+		}
+	}
+	return false
+}
+
+type Options func(*Manager)
+
+type Manager struct {
+	model       database.Model[Token]
+	prefix      string
+	scopes      []string
+	max_ttl     time.Duration
+	touch_every time.Duration
+}
+
+// WithPrefix sets the prefix of issued tokens, iam_pat_ by default.
+func WithPrefix(prefix string) Options {
+	return func(m *Manager) {
+		m.prefix = prefix
+	}
+}
+
+// WithScopes restricts the scopes tokens can be created with. Scopes
+// have the syntax of acl permissions. Any scope is accepted by default.
+func WithScopes(scopes ...string) Options {
+	return func(m *Manager) {
+		m.scopes = append(m.scopes, scopes...)
+	}
+}
+
+// WithMaxTTL sets the maximum lifetime of tokens, and the lifetime of
+// tokens created without an expiry. Tokens don't expire by default.
+func WithMaxTTL(d time.Duration) Options {
+	return func(m *Manager) {
+		m.max_ttl = d
+	}
+}
+
+func New(model database.Model[Token], opts ...Options) *Manager {
+	m := &Manager{
+		model:       model,
+		prefix:      "iam_pat_",
+		touch_every: time.Minute,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Is reports whether credential looks like a token of m, without
+// checking that it is valid.
+func (m *Manager) Is(credential string) bool {
+	return m != nil && strings.HasPrefix(credential, m.prefix)
+}
+
+// Create issues a token for a user and returns it along with its secret,
+// which can't be retrieved later. A zero expiresAt is replaced by the
+// maximum lifetime when there is one.
+func (m *Manager) Create(ctx context.Context, userID uuid.UUID, name string, scopes []string, expiresAt time.Time) (*Token, string, error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return nil, "", errNoName
+	}
+	for _, s := range scopes {
+		if strings.ContainsAny(s, " \t\n") || (len(m.scopes) > 0 && !slices.Contains(m.scopes, s)) {
+			return nil, "", ErrUnknownScope
+		}
+	}
+	now := time.Now().UTC()
+	if m.max_ttl > 0 && expiresAt.IsZero() {
+		expiresAt = now.Add(m.max_ttl)
+	}
+	if !expiresAt.IsZero() && (expiresAt.Before(now) || (m.max_ttl > 0 && expiresAt.After(now.Add(m.max_ttl)))) {
+		return nil, "", ErrExpiry
+	}
+	secret := m.prefix + token.Generate(token.URL, 0)
+	t := Token{
+		ID:        uuid.New(),
+		UserID:    userID,
+		Name:      name,
+		Hint:      secret[:len(m.prefix)+4],
+		Hash:      hash(secret),
+		Scopes:    strings.Join(scopes, " "),
+		CreatedAt: now,
+		ExpiresAt: expiresAt.UTC(),
+	}
+	if err := m.model.WithContext(ctx).Save(t); err != nil {
+		return nil, "", err
+	}
+	return &t, secret, nil
+}
+
+// Lookup returns the active token of secret and records that it was
+// used.
+func (m *Manager) Lookup(ctx context.Context, secret string) (*Token, error) {
+	if !m.Is(secret) {
+		return nil, ErrInvalid
+	}
+	t, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("hash", hash(secret)),
+		database.WithFilter("revoked", false),
+	).First()
+	if err != nil {
+		return nil, ErrInvalid
+	}
+	now := time.Now().UTC()
+	if !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt) {
+		return nil, ErrInvalid
+	}
+	if now.Sub(t.LastUsedAt) >= m.touch_every {
+		t.LastUsedAt = now
+		_ = m.model.WithContext(ctx).Query(database.WithFilter("id", t.ID)).Update(*t)
+	}
+	return t, nil
+}
+
+// List returns the active tokens of a user.
+func (m *Manager) List(ctx context.Context, userID uuid.UUID) ([]*Token, error) {
+	all, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithFilter("revoked", false),
+	).All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	res := make([]*Token, 0, len(all))
+	for _, t := range all {
+		if t.ExpiresAt.IsZero() || now.Before(t.ExpiresAt) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// Revoke revokes a token of a user.
+func (m *Manager) Revoke(ctx context.Context, userID, id uuid.UUID) error {
+	t, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("id", id),
+		database.WithFilter("user_id", userID),
+	).First()
+	if err != nil || t.Revoked {
+		return ErrNotFound
+	}
+	return m.revoke(ctx, t)
+}
+
+// RevokeAll revokes every token of a user and returns how many were
+// revoked.
+func (m *Manager) RevokeAll(ctx context.Context, userID uuid.UUID) (int, error) {
+	if m == nil {
+		return 0, nil
+	}
+	active, err := m.model.WithContext(ctx).Query(
+		database.WithFilter("user_id", userID),
+		database.WithFilter("revoked", false),
+	).All()
+	if err != nil {
+		return 0, err
+	}
+	for i, t := range active {
+		if err := m.revoke(ctx, t); err != nil {
+			return i, err
+		}
+	}
+	return len(active), nil
+}
+
+func (m *Manager) revoke(ctx context.Context, t *Token) error {
+	t.Revoked = true
+	t.RevokedAt = time.Now().UTC()
+	return m.model.WithContext(ctx).Query(database.WithFilter("id", t.ID)).Update(*t)
+}
+
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
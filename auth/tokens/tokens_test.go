@@ -0,0 +1,105 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/neghi-go/iam/auth/sessions"
+	"github.com/neghi-go/iam/internal/testdb"
+	"github.com/neghi-go/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	m := New(testdb.New[Token](), WithScopes("repo:read", "repo:write"), WithMaxTTL(24*time.Hour))
+	ctx := context.Background()
+	userID := uuid.New()
+
+	tok, secret, err := m.Create(ctx, userID, "ci", []string{"repo:read"}, time.Time{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(secret, "iam_pat_"))
+	assert.True(t, strings.HasPrefix(secret, tok.Hint))
+	assert.NotContains(t, tok.Hash, secret)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), tok.ExpiresAt, time.Minute)
+	assert.True(t, m.Is(secret))
+	assert.False(t, m.Is("eyJhbGciOi"))
+
+	t.Run("Create", func(t *testing.T) {
+		_, _, err := m.Create(ctx, userID, "ci", []string{"admin"}, time.Time{})
+		assert.ErrorIs(t, err, ErrUnknownScope)
+		_, _, err = m.Create(ctx, userID, "ci", nil, time.Now().Add(48*time.Hour))
+		assert.ErrorIs(t, err, ErrExpiry)
+		_, _, err = m.Create(ctx, userID, "ci", nil, time.Now().Add(-time.Hour))
+		assert.ErrorIs(t, err, ErrExpiry)
+		_, _, err = m.Create(ctx, userID, " ", nil, time.Time{})
+		assert.Error(t, err)
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		got, err := m.Lookup(ctx, secret)
+		require.NoError(t, err)
+		assert.Equal(t, tok.ID, got.ID)
+		assert.True(t, got.Allows("repo:read"))
+		assert.False(t, got.Allows("repo:write"))
+		_, err = m.Lookup(ctx, secret+"x")
+		assert.ErrorIs(t, err, ErrInvalid)
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		assert.ErrorIs(t, m.Revoke(ctx, uuid.New(), tok.ID), ErrNotFound)
+		require.NoError(t, m.Revoke(ctx, userID, tok.ID))
+		_, err := m.Lookup(ctx, secret)
+		assert.ErrorIs(t, err, ErrInvalid)
+		list, err := m.List(ctx, userID)
+		require.NoError(t, err)
+		assert.Empty(t, list)
+	})
+}
+
+func TestHandler(t *testing.T) {
+	m := New(testdb.New[Token]())
+	s := sessions.New(testdb.New[sessions.Record](), session.NewJWTSession())
+	w := httptest.NewRecorder()
+	_, err := s.Create(w, httptest.NewRequest(http.MethodPost, "/", nil), uuid.New(), "jon@doe.com", "password")
+	require.NoError(t, err)
+	access := w.Header().Get("Auth-Token")
+
+	request := func(method, target, tok, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if tok != "" {
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		w := httptest.NewRecorder()
+		m.Handler(s).ServeHTTP(w, r)
+		return w
+	}
+
+	res := request(http.MethodPost, "/", access, `{"name":"laptop","scopes":["repo:read"]}`)
+	require.Equal(t, http.StatusCreated, res.Code)
+	var created struct {
+		Data struct {
+			ID     uuid.UUID `json:"id"`
+			Secret string    `json:"token"`
+			Scopes string    `json:"scopes"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&created))
+	assert.Equal(t, "repo:read", created.Data.Scopes)
+
+	// tokens can't manage tokens
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/", created.Data.Secret, "").Code)
+	res = request(http.MethodGet, "/", access, "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"name":"laptop"`)
+	assert.NotContains(t, res.Body.String(), created.Data.Secret)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodDelete, "/"+created.Data.ID.String(), access, "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/"+created.Data.ID.String(), access, "").Code)
+}
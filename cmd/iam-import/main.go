@@ -0,0 +1,67 @@
+// Command iam-import bulk imports users exported from another system
+// into the user store, keeping their password hashes.
+//
+//	iam-import -url mongodb://localhost:27017 -database app -format csv -file users.csv
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/neghi-go/database/mongodb"
+	"github.com/neghi-go/iam/auth/providers/password"
+	"github.com/neghi-go/iam/internal/models"
+)
+
+func main() {
+	url := flag.String("url", "mongodb://localhost:27017", "database connection url")
+	db := flag.String("database", "", "database name")
+	file := flag.String("file", "", "export file to import")
+	format := flag.String("format", "", "export format, csv or json (defaults to the file extension)")
+	flag.Parse()
+
+	if err := run(*url, *db, *file, *format); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(url, db, file, format string) error {
+	if db == "" || file == "" {
+		return fmt.Errorf("iam-import: -database and -file are required")
+	}
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(file), ".")
+		if format == "ndjson" || format == "jsonl" {
+			format = string(password.JSON)
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mgd, err := mongodb.New(url, db)
+	if err != nil {
+		return err
+	}
+	userModel, err := mongodb.RegisterModel(mgd, "auth_users", models.User{})
+	if err != nil {
+		return err
+	}
+
+	res, err := password.Import(context.Background(), userModel, f, password.Format(format))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(res)
+}
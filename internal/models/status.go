@@ -0,0 +1,107 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Status is the status of an account, only active accounts can sign in.
+type Status string
+
+const (
+	StatusActive Status = "active"
+	// StatusDisabled is an account deactivated by an administrator or
+	// the identity provider that provisions it.
+	StatusDisabled Status = "disabled"
+	// StatusLocked is an account locked, e.g while a compromise is
+	// investigated, until StatusUntil when it is set.
+	StatusLocked Status = "locked"
+	// StatusPendingDeletion is an account due for deletion at
+	// StatusUntil, it can be restored until then.
+	StatusPendingDeletion Status = "pending_deletion"
+	// StatusBanned is an account banned from the service, unlike
+	// disabled accounts it can't be reactivated by an identity provider.
+	StatusBanned Status = "banned"
+)
+
+var (
+	ErrUnknownStatus = errors.New("models: unknown account status")
+	ErrTransition    = errors.New("models: the account can't change to this status")
+)
+
+// transitions lists the statuses each status can change to.
+var transitions = map[Status][]Status{
+	StatusActive:          {StatusDisabled, StatusLocked, StatusPendingDeletion, StatusBanned},
+	StatusDisabled:        {StatusActive, StatusLocked, StatusPendingDeletion, StatusBanned},
+	StatusLocked:          {StatusActive, StatusDisabled, StatusPendingDeletion, StatusBanned},
+	StatusPendingDeletion: {StatusActive, StatusBanned},
+	StatusBanned:          {StatusActive, StatusPendingDeletion},
+}
+
+// Valid reports whether s is a known status.
+func (s Status) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// StatusError is returned for accounts that can't sign in, it doesn't
+// carry the reason of the status which may be meant for administrators
+// only.
+type StatusError struct {
+	Status Status
+	Until  time.Time
+}
+
+func (e *StatusError) Error() string {
+	msg := "the account is " + strings.ReplaceAll(string(e.Status), "_", " ")
+	if e.Status == StatusLocked && !e.Until.IsZero() {
+		msg += " until " + e.Until.UTC().Format(time.RFC3339)
+	}
+	return msg
+}
+
+// AccountStatus returns the status of the account at now. Accounts
+// without a status are active, as are accounts whose lock has ended.
+func (u *User) AccountStatus(now time.Time) Status {
+	switch {
+	case u.Status == "":
+		return StatusActive
+	case u.Status == StatusLocked && !u.StatusUntil.IsZero() && !now.Before(u.StatusUntil):
+		return StatusActive
+	}
+	return u.Status
+}
+
+// CheckStatus returns a *StatusError unless the account is active at now.
+func (u *User) CheckStatus(now time.Time) error {
+	if s := u.AccountStatus(now); s != StatusActive {
+		return &StatusError{Status: s, Until: u.StatusUntil}
+	}
+	return nil
+}
+
+// SetStatus changes the status of the account for reason. until is when
+// a lock ends or a pending deletion is due. Changing to the current
+// status isn't a transition and fails, as does any transition the
+// status machine doesn't allow.
+func (u *User) SetStatus(status Status, reason string, until, now time.Time) error {
+	if !status.Valid() {
+		return ErrUnknownStatus
+	}
+	from := u.AccountStatus(now)
+	if !slices.Contains(transitions[from], status) {
+		return fmt.Errorf("%w: %s to %s", ErrTransition, from, status)
+	}
+	u.Status = status
+	u.StatusReason = reason
+	u.StatusUntil = until
+	u.StatusChangedAt = now
+	if status == StatusActive {
+		u.StatusReason = ""
+		u.StatusUntil = time.Time{}
+	}
+	return nil
+}
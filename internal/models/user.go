@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -24,7 +25,50 @@ type User struct {
 	PasswordResetTokenCreatedAt time.Time `json:"-" db:"password_reset_token_created_at"`
 	PasswordResetTokenExpiresAt time.Time `json:"-" db:"password_reset_token_expires"`
 	PasswordUpdatedOn           time.Time `json:"-" db:"password_updated_on"`
+	PasswordHistory             string    `json:"-" db:"password_history"`
+
+	FailedLoginAttempt   int       `json:"-" db:"failed_login_attempt"`
+	LastFailedLogin      time.Time `json:"-" db:"last_failed_login"`
+	LockedUntil          time.Time `json:"-" db:"locked_until"`
+	UnlockToken          string    `json:"-" db:"unlock_token"`
+	UnlockAttempt        int       `json:"-" db:"unlock_attempt"`
+	UnlockTokenExpiresAt time.Time `json:"-" db:"unlock_token_expires_at"`
 
 	MFAStrategy string `json:"-" db:"mfa_strategy"`
 	LastLogin   int64  `json:"last_login" db:"last_login,required"`
+
+	// ExternalID is the id of the user in the identity provider that
+	// provisions it, see the scim package.
+	ExternalID string `json:"external_id,omitempty" db:"external_id,index"`
+	// SAMLOrganization and SAMLNameID link the user to the organization
+	// whose identity provider signs them in, see the saml package.
+	SAMLOrganization string `json:"-" db:"saml_organization,index"`
+	SAMLNameID       string `json:"-" db:"saml_name_id,index"`
+	GivenName        string `json:"given_name,omitempty" db:"given_name"`
+	FamilyName       string `json:"family_name,omitempty" db:"family_name"`
+	DisplayName      string `json:"display_name,omitempty" db:"display_name"`
+	Picture          string `json:"picture,omitempty" db:"picture"`
+	Locale           string `json:"locale,omitempty" db:"locale"`
+	Timezone         string `json:"timezone,omitempty" db:"timezone"`
+	Phone            string `json:"phone_number,omitempty" db:"phone_number"`
+	// Metadata and AppMetadata are JSON objects of application data,
+	// the first editable by the user and the second by administrators
+	// only, see the profile package.
+	Metadata    string `json:"-" db:"metadata"`
+	AppMetadata string `json:"-" db:"app_metadata"`
+	// Status is the status of the account, active when empty, see
+	// SetStatus. Only active accounts can sign in.
+	Status          Status    `json:"status,omitempty" db:"status,index"`
+	StatusReason    string    `json:"status_reason,omitempty" db:"status_reason"`
+	StatusChangedAt time.Time `json:"status_changed_at,omitempty" db:"status_changed_at"`
+	StatusUntil     time.Time `json:"status_until,omitempty" db:"status_until"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// NormalizeEmail returns email in the form it is stored and looked up in,
+// trimmed and lowercased, so that addresses differing only in case
+// belong to the same user.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
@@ -0,0 +1,210 @@
+// Package testdb is an in-memory database.Model for unit tests that
+// don't need a database container. Filters match fields by the name in
+// their db tag, with the equality semantics of the mongodb driver.
+package testdb
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/neghi-go/database"
+)
+
+var ErrNotFound = errors.New("testdb: no documents in result")
+
+type Model[T any] struct {
+	mu   *sync.Mutex
+	docs *[]T
+}
+
+func New[T any]() database.Model[T] {
+	return &Model[T]{mu: &sync.Mutex{}, docs: &[]T{}}
+}
+
+func (m *Model[T]) WithContext(ctx context.Context) database.Model[T] {
+	return m
+}
+
+func (m *Model[T]) ExecRaw() error {
+	return nil
+}
+
+func (m *Model[T]) Save(docs ...T) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*m.docs = append(*m.docs, docs...)
+	return nil
+}
+
+func (m *Model[T]) Query(params ...database.Params) database.Query[T] {
+	q := &query[T]{model: m}
+	for _, p := range params {
+		qs := p()
+		switch qs.Key() {
+		case database.QueryFilter:
+			q.filters = append(q.filters, qs.Value().(database.FilterStruct))
+		case database.QuerySort:
+			q.order = append(q.order, qs.Value().(database.OrderStruct))
+		case database.QueryLimit:
+			q.limit = qs.Value().(int64)
+		case database.QueryOffset:
+			q.offset = qs.Value().(int64)
+		}
+	}
+	return q
+}
+
+type query[T any] struct {
+	model         *Model[T]
+	filters       []database.FilterStruct
+	order         []database.OrderStruct
+	limit, offset int64
+}
+
+// match returns the indexes of the documents matching the filters.
+func (q *query[T]) match() []int {
+	var res []int
+	for i, doc := range *q.model.docs {
+		ok := true
+		for _, f := range q.filters {
+			v, found := field(doc, f.Key())
+			if !found || !equal(v, f.Value()) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			res = append(res, i)
+		}
+	}
+	docs := *q.model.docs
+	for i := len(q.order) - 1; i >= 0; i-- {
+		o := q.order[i]
+		slices.SortStableFunc(res, func(a, b int) int {
+			va, _ := field(docs[a], o.Key())
+			vb, _ := field(docs[b], o.Key())
+			c := compare(va, vb)
+			if o.Value() == database.DESC {
+				return -c
+			}
+			return c
+		})
+	}
+	if q.offset > 0 {
+		res = res[min(int(q.offset), len(res)):]
+	}
+	if q.limit > 0 && int(q.limit) < len(res) {
+		res = res[:q.limit]
+	}
+	return res
+}
+
+func (q *query[T]) Count() (int64, error) {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	return int64(len(q.match())), nil
+}
+
+func (q *query[T]) First() (*T, error) {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	idx := q.match()
+	if len(idx) == 0 {
+		return nil, ErrNotFound
+	}
+	doc := (*q.model.docs)[idx[0]]
+	return &doc, nil
+}
+
+func (q *query[T]) All() ([]*T, error) {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	var res []*T
+	for _, i := range q.match() {
+		doc := (*q.model.docs)[i]
+		res = append(res, &doc)
+	}
+	return res, nil
+}
+
+func (q *query[T]) Update(doc T) error {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	idx := q.match()
+	if len(idx) == 0 {
+		return ErrNotFound
+	}
+	(*q.model.docs)[idx[0]] = doc
+	return nil
+}
+
+func (q *query[T]) UpdateMany(doc T) error {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	for _, i := range q.match() {
+		(*q.model.docs)[i] = doc
+	}
+	return nil
+}
+
+func (q *query[T]) Delete() error {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	idx := q.match()
+	if len(idx) == 0 {
+		return ErrNotFound
+	}
+	*q.model.docs = slices.Delete(*q.model.docs, idx[0], idx[0]+1)
+	return nil
+}
+
+func (q *query[T]) DeleteMany() error {
+	q.model.mu.Lock()
+	defer q.model.mu.Unlock()
+	idx := q.match()
+	for i := len(idx) - 1; i >= 0; i-- {
+		*q.model.docs = slices.Delete(*q.model.docs, idx[i], idx[i]+1)
+	}
+	return nil
+}
+
+// field returns the value of the field whose db tag names key.
+func field(doc any, key string) (any, bool) {
+	v := reflect.ValueOf(doc)
+	t := v.Type()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("db"), ",")
+		if name == key {
+			return v.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+func equal(a, b any) bool {
+	if ta, ok := a.(time.Time); ok {
+		tb, ok := b.(time.Time)
+		return ok && ta.Equal(tb)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func compare(a, b any) int {
+	switch va := a.(type) {
+	case time.Time:
+		return va.Compare(b.(time.Time))
+	case string:
+		return strings.Compare(va, b.(string))
+	case int:
+		return cmp.Compare(va, b.(int))
+	case int64:
+		return cmp.Compare(va, b.(int64))
+	}
+	return 0
+}
@@ -0,0 +1,75 @@
+package iam
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/neghi-go/iam/auth"
+)
+
+// Principal is the authenticated user of a request.
+type Principal = auth.Principal
+
+// Middleware authenticates requests to the consumer's own routes with
+// the sessions issued by a, putting the Principal into the request
+// context:
+//
+//	r.With(iam.Middleware(a, iam.RequireVerifiedEmail())).Get("/me", handler)
+func Middleware(a *auth.Auth, opts ...auth.MiddlewareOptions) func(http.Handler) http.Handler {
+	return a.Middleware(opts...)
+}
+
+// RequireVerifiedEmail rejects users whose email address isn't verified.
+func RequireVerifiedEmail() auth.MiddlewareOptions {
+	return auth.RequireVerifiedEmail()
+}
+
+// RequireScope rejects personal access tokens lacking one of scopes.
+func RequireScope(scopes ...string) auth.MiddlewareOptions {
+	return auth.RequireScope(scopes...)
+}
+
+// RequirePermission rejects principals the ACL doesn't grant permission
+// to.
+func RequirePermission(permission string) auth.MiddlewareOptions {
+	return auth.RequirePermission(permission)
+}
+
+// RequireMFA challenges sessions created without a second factor.
+func RequireMFA() auth.MiddlewareOptions {
+	return auth.RequireMFA()
+}
+
+// RequireACR challenges sessions below the assurance level acr.
+func RequireACR(acr string) auth.MiddlewareOptions {
+	return auth.RequireACR(acr)
+}
+
+// MaxAuthAge challenges sessions whose user authenticated more than d
+// ago.
+func MaxAuthAge(d time.Duration) auth.MiddlewareOptions {
+	return auth.MaxAuthAge(d)
+}
+
+// Optional lets requests without a valid session through.
+func Optional() auth.MiddlewareOptions {
+	return auth.Optional()
+}
+
+// PrincipalFrom returns the principal of the request, it is false for
+// requests that didn't go through Middleware or, with Optional, had no
+// session.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	return auth.PrincipalFrom(ctx)
+}
+
+// MustPrincipal returns the principal of the request and panics when
+// there is none, for handlers only reachable through Middleware.
+func MustPrincipal(ctx context.Context) *Principal {
+	p, ok := auth.PrincipalFrom(ctx)
+	if !ok {
+		panic("iam: no principal in context, is the route behind iam.Middleware?")
+	}
+	return p
+}